@@ -1,5 +1,43 @@
 package api
 
+import (
+	"errors"
+	"time"
+)
+
+// ErrIdempotencyKeyReused is returned when an idempotency key is reused for a different request.
+var ErrIdempotencyKeyReused = errors.New("idempotency key has already been used for a different request")
+
+// ErrPrivacyGroupNotFound is returned when a privacy group does not exist.
+var ErrPrivacyGroupNotFound = errors.New("privacy group not found")
+
+// ErrorResponse is returned by the HTTP API for all requests which fail, with a Code clients can
+// handle programmatically.
+type ErrorResponse struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// Field is the request field which was missing or invalid, if the error relates to one.
+	Field string `json:"field,omitempty"`
+}
+
+// Codes returned in an ErrorResponse.
+const (
+	CodeBadRequest         = "bad_request"
+	CodeInvalidBody        = "invalid_body"     // The request body could not be parsed
+	CodeMissingField       = "missing_field"    // A required field was not provided
+	CodeInvalidEncoding    = "invalid_encoding" // A field was not valid base64
+	CodeInvalidKey         = "invalid_key"      // A public key was not 32 bytes
+	CodeUnprocessable      = "unprocessable"
+	CodeKeyMismatch        = "key_mismatch" // A pushed payload did not match its key
+	CodeRequestTooLarge    = "request_too_large"
+	CodeUnknownEncoding    = "unknown_encoding" // The request's Content-Encoding is not supported
+	CodeNotFound           = "not_found"
+	CodeForbidden          = "forbidden"
+	CodeTooManyRequests    = "too_many_requests"
+	CodeInternalError      = "internal_error"
+	CodeServiceUnavailable = "service_unavailable" // The request may be retried
+)
+
 // SendRequest sends a new transaction to the enclave for storage and propagation to the provided
 // recipients.
 type SendRequest struct {
@@ -9,6 +47,13 @@ type SendRequest struct {
 	From string `json:"from"`
 	// To is a list of the recipient nodes that should be privy to this transaction payload.
 	To []string `json:"to"`
+	// IdempotencyKey optionally identifies the request, so that if it is retried the original
+	// transaction key is returned, rather than the payload being stored again. It is equivalent
+	// to the Idempotency-Key header.
+	IdempotencyKey string `json:"idempotencyKey,omitempty"`
+	// PrivacyGroupId optionally identifies a privacy group to send the payload to, in place of
+	// To, in which case all members of the group other than the sender are recipients.
+	PrivacyGroupId string `json:"privacyGroupId,omitempty"`
 }
 
 // SendResponse is the response to the SendRequest
@@ -17,6 +62,120 @@ type SendResponse struct {
 	Key string `json:"key"`
 }
 
+// States of an asynchronous send, and of its delivery to each recipient.
+const (
+	SendPending   = "pending"
+	SendComplete  = "complete"
+	SendDelivered = "delivered"
+	SendFailed    = "failed"
+)
+
+// SendAsyncResponse is the response to a SendRequest made asynchronously.
+type SendAsyncResponse struct {
+	// Id identifies the send, so its progress can be requested from /sendstatus.
+	Id string `json:"id"`
+}
+
+// SendStatus reports the progress of an asynchronous send. State is pending until the payload
+// has been stored and published to its recipients, then complete, or failed if it could not be
+// stored, in which case Error describes why.
+type SendStatus struct {
+	Id    string `json:"id"`
+	State string `json:"state"`
+	// Key is the key that can be used to retrieve the transaction, once it is complete.
+	Key        string            `json:"key,omitempty"`
+	Error      string            `json:"error,omitempty"`
+	Recipients []RecipientStatus `json:"recipients"`
+}
+
+// RecipientStatus reports the delivery of an asynchronous send to one of its recipients. State
+// is pending, delivered, or failed, in which case Error describes why.
+type RecipientStatus struct {
+	PublicKey string `json:"publicKey"`
+	State     string `json:"state"`
+	Error     string `json:"error,omitempty"`
+}
+
+// UpCheckResponse is the detailed status of a node, returned by /upcheck when JSON is requested.
+type UpCheckResponse struct {
+	Status  string `json:"status"`
+	Version string `json:"version"`
+	// Peers is the number of other nodes this node is aware of.
+	Peers   int    `json:"peers"`
+	Storage string `json:"storage"`
+	// Subsystems are the background loops monitored by the node's watchdog.
+	Subsystems []SubsystemStatus `json:"subsystems,omitempty"`
+}
+
+// ProbeResponse is returned by the /healthz and /readyz probes, with the checks they made.
+type ProbeResponse struct {
+	Status string       `json:"status"` // "ok" or "unavailable"
+	Checks []ProbeCheck `json:"checks,omitempty"`
+}
+
+// ProbeCheck is the outcome of a single check made by a probe.
+type ProbeCheck struct {
+	Name   string `json:"name"`
+	Ok     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// SubsystemStatus is the state of a background loop monitored by a node's watchdog.
+type SubsystemStatus struct {
+	Name          string     `json:"name"`
+	Healthy       bool       `json:"healthy"` // Whether a heartbeat was received within the timeout
+	LastHeartbeat time.Time  `json:"lastHeartbeat"`
+	Restarts      int        `json:"restarts"`
+	LastRestart   *time.Time `json:"lastRestart,omitempty"`
+}
+
+// Actions recorded in a payload's provenance.
+const (
+	ProvenanceSend    = "send"    // The payload was created by this node
+	ProvenancePush    = "push"    // The payload was pushed to a remote node
+	ProvenanceReceive = "receive" // The payload was pushed to this node by a remote node
+	ProvenanceResend  = "resend"  // The payload was recovered from a remote node
+)
+
+// ProvenanceHop records a single step in how a payload reached, or left, a node.
+// The sender key is authenticated by the payload's encryption, a recipient can only open the
+// payload if it was sealed by the holder of the sender's private key.
+type ProvenanceHop struct {
+	Action string `json:"action"`
+	// From and To are the URLs or addresses of the nodes involved.
+	From string `json:"from,omitempty"`
+	To   string `json:"to,omitempty"`
+	// Sender and Recipient are base64 encoded public keys.
+	Sender    string    `json:"sender,omitempty"`
+	Recipient string    `json:"recipient,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+// Operations recorded in the audit log.
+const (
+	AuditSend    = "send"    // A payload was sent via the private API
+	AuditReceive = "receive" // A payload was retrieved via the private API
+	AuditDelete  = "delete"  // A payload was deleted via the private API
+	AuditPush    = "push"    // A payload was pushed to this node by a remote node
+	AuditResend  = "resend"  // Payloads were resent to a remote node at its request
+)
+
+// AuditEntry records a privacy-relevant operation performed by a node. Payload contents are
+// never recorded.
+type AuditEntry struct {
+	Time      time.Time `json:"time"`
+	Operation string    `json:"operation"`
+	// PublicKey is the base64 encoded key the operation was requested for, the sender of a send
+	// or push, and the recipient of a receive or resend. It is absent if the request did not
+	// provide one, in which case the node's default key was used for sends and all of its keys
+	// for receives.
+	PublicKey string `json:"publicKey,omitempty"`
+	// Key is the base64 encoded digest of the payload, absent for resends of all payloads.
+	Key       string `json:"key,omitempty"`
+	Remote    string `json:"remote,omitempty"`    // Address of the client which made the request
+	RequestId string `json:"requestId,omitempty"` // ID of the request, as logged by the node
+}
+
 // ReceiveRequest
 type ReceiveRequest struct {
 	Key string `json:"key"`
@@ -26,6 +185,68 @@ type ReceiveRequest struct {
 // ReceiveResponse returns the raw payload associated with the ReceiveRequest.
 type ReceiveResponse struct {
 	Payload string `json:"payload"`
+	// PrivacyGroupId is the privacy group the payload was sent to, if it was sent to one by this
+	// node.
+	PrivacyGroupId string `json:"privacyGroupId,omitempty"`
+}
+
+// PayloadNotification is sent to subscribers when a payload pushed by another node is stored.
+// Key is the payload's base64 encoded transaction key, which can be provided to /receive, and
+// Sender the base64 encoded public key it was sent from.
+type PayloadNotification struct {
+	Key    string `json:"key"`
+	Sender string `json:"sender"`
+}
+
+// Roles of the public keys payloads can be listed by.
+const (
+	PartySender    = "sender"
+	PartyRecipient = "recipient"
+)
+
+// PayloadList lists the keys of the payloads stored for a public key, in order. Next is provided
+// if there are further keys to list, which follow it.
+type PayloadList struct {
+	Keys []string `json:"keys"`
+	Next string   `json:"next,omitempty"`
+}
+
+// PrivacyGroup is a named group of public keys, which payloads can be sent to as a whole.
+type PrivacyGroup struct {
+	PrivacyGroupId string   `json:"privacyGroupId"`
+	Name           string   `json:"name"`
+	Description    string   `json:"description"`
+	Members        []string `json:"members"`
+}
+
+// CreatePrivacyGroupRequest creates a privacy group of the public keys in Addresses, which must
+// include From, one of the node's own keys.
+type CreatePrivacyGroupRequest struct {
+	Addresses   []string `json:"addresses"`
+	From        string   `json:"from"`
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+}
+
+// FindPrivacyGroupRequest finds the privacy groups whose members are exactly Addresses.
+type FindPrivacyGroupRequest struct {
+	Addresses []string `json:"addresses"`
+}
+
+// DeletePrivacyGroupRequest deletes a privacy group, on behalf of From, one of its members.
+type DeletePrivacyGroupRequest struct {
+	PrivacyGroupId string `json:"privacyGroupId"`
+	From           string `json:"from"`
+}
+
+// RepushRequest pushes an existing transaction to one of its recipients again.
+type RepushRequest struct {
+	// Key is the key of the transaction to push.
+	Key string `json:"key"`
+	// To is the public key of the recipient to push the transaction to.
+	To string `json:"to"`
+	// Url optionally overrides the URL of the node the transaction is pushed to.
+	Url string `json:"url,omitempty"`
 }
 
 // DeleteRequest deletes the entry matching the given key from the enclave.
@@ -51,6 +272,74 @@ type UpdatePartyInfo struct {
 	Parties    map[string]bool   `json:"parties"`
 }
 
+// PartyInfoChallenge asks a node to prove it holds the private key for PublicKey. The node must
+// open Box, which was sealed to PublicKey using EphemeralKey with its nonce prepended, and return
+// its contents following ChallengeTag. Boxes which do not begin with ChallengeTag are refused, so
+// that challenges cannot be used to open boxes sealed for other purposes, such as recipient boxes.
+type PartyInfoChallenge struct {
+	PublicKey    []byte `json:"publicKey"`
+	EphemeralKey []byte `json:"ephemeralKey"`
+	Box          []byte `json:"box"`
+}
+
+// Peer is a node known to the admin API, along with the public keys it hosts.
+type Peer struct {
+	Url        string   `json:"url"`
+	PublicKeys []string `json:"publicKeys"`
+}
+
+// KeyUsage summarises the payloads sent with a public key since a node was started. Latencies
+// cover encrypting, storing and distributing a payload.
+type KeyUsage struct {
+	PublicKey        string  `json:"publicKey"`
+	Payloads         int64   `json:"payloads"`
+	Failures         int64   `json:"failures"`
+	Bytes            int64   `json:"bytes"`
+	AverageLatencyMs float64 `json:"averageLatencyMs"`
+	MaxLatencyMs     float64 `json:"maxLatencyMs"`
+}
+
+// RotateKeyRequest requests that stored payloads are re-encrypted from one of a node's public
+// keys to another, retiring the former.
+type RotateKeyRequest struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// RotateKeyResponse is the outcome of a key rotation.
+type RotateKeyResponse struct {
+	Reencrypted int `json:"reencrypted"`
+	Unchanged   int `json:"unchanged"`
+	Failed      int `json:"failed"`
+}
+
+// PairInfo describes a node to another when pairing them.
+type PairInfo struct {
+	Url        string   `json:"url"`
+	PublicKeys []string `json:"publicKeys"`
+	// Certificate is the PEM encoded TLS certificate of the node, if it uses TLS.
+	Certificate string `json:"certificate,omitempty"`
+}
+
+// StorageStats summarises the contents of a node's payload storage.
+type StorageStats struct {
+	Entries int   `json:"entries"`
+	Bytes   int64 `json:"bytes"`
+}
+
+// PurgeResponse is the outcome of purging old payloads.
+type PurgeResponse struct {
+	Purged int `json:"purged"`
+	// UnknownAge is the number of payloads retained as they have no recorded provenance.
+	UnknownAge int `json:"unknownAge"`
+}
+
+// ImportResponse is the outcome of importing an export of a node's storage, with the number of
+// entries imported into each of its stores.
+type ImportResponse struct {
+	Entries map[string]int `json:"entries"`
+}
+
 type PartyInfoResponse struct {
 	Payload []byte `json:"payload"`
 }
@@ -1,11 +1,22 @@
 package api
 
 import (
+	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"github.com/blk-io/crux/utils"
 	"github.com/kevinburke/nacl"
+	"sort"
 )
 
+// EncodePayload encodes the provided EncryptedPayload using the same binary format as
+// Constellation. Each field is length prefixed, with the recipient boxes prefixed by their count:
+//   - the sender's public key
+//   - the cipher text
+//   - the nonce of the cipher text
+//   - the recipient boxes
+//   - the nonce of the recipient boxes
 func EncodePayload(ep EncryptedPayload) []byte {
 	// constant fields are 216 bytes
 	encoded := make([]byte, 512)
@@ -20,24 +31,20 @@ func EncodePayload(ep EncryptedPayload) []byte {
 	return encoded[:offset]
 }
 
-func DecodePayload(encoded []byte) EncryptedPayload {
-
-	ep := EncryptedPayload{
-		Sender:         new([nacl.KeySize]byte),
-		Nonce:          new([nacl.NonceSize]byte),
-		RecipientNonce: new([nacl.NonceSize]byte),
+// DecodePayload decodes an EncryptedPayload in the format written by EncodePayload. An error is
+// returned if the input is truncated or malformed, or a key or nonce has the wrong length.
+func DecodePayload(encoded []byte) (EncryptedPayload, error) {
+	d := decoder{src: encoded}
+	ep := d.readPayload()
+	if d.err != nil {
+		return EncryptedPayload{}, fmt.Errorf("unable to decode payload: %v", d.err)
 	}
-
-	offset := 0
-	offset = readSliceToArray(encoded, offset, (*ep.Sender)[:])
-	ep.CipherText, offset = readSlice(encoded, offset)
-	offset = readSliceToArray(encoded, offset, (*ep.Nonce)[:])
-	ep.RecipientBoxes, offset = readSliceOfSlice(encoded, offset)
-	offset = readSliceToArray(encoded, offset, (*ep.RecipientNonce)[:])
-
-	return ep
+	return ep, nil
 }
 
+// EncodePayloadWithRecipients encodes the provided EncryptedPayload along with its recipients'
+// public keys, as held in storage. The encoded payload and the list of recipients are written as
+// a list of two length prefixed fields.
 func EncodePayloadWithRecipients(ep EncryptedPayload, recipients [][]byte) []byte {
 	encoded := make([][]byte, 2)
 
@@ -51,17 +58,47 @@ func EncodePayloadWithRecipients(ep EncryptedPayload, recipients [][]byte) []byt
 	return encoded2[:length]
 }
 
-func DecodePayloadWithRecipients(encoded []byte) (EncryptedPayload, [][]byte) {
+// DecodePayloadWithRecipients decodes an EncryptedPayload and its recipients in the format
+// written by EncodePayloadWithRecipients.
+func DecodePayloadWithRecipients(encoded []byte) (EncryptedPayload, [][]byte, error) {
+	d := decoder{src: encoded}
+	fields := d.readSliceOfSlice()
+	if d.err == nil && len(fields) != 2 {
+		d.err = fmt.Errorf("expected 2 fields, found %d", len(fields))
+	}
+	if d.err != nil {
+		return EncryptedPayload{}, nil, fmt.Errorf("unable to decode payload: %v", d.err)
+	}
 
-	decoded, _ := readSliceOfSlice(encoded, 0)
+	ep, err := DecodePayload(fields[0])
+	if err != nil {
+		return EncryptedPayload{}, nil, err
+	}
 
-	ep := DecodePayload(decoded[0])
-	recipients, _ := readSliceOfSlice(decoded[1], 0)
+	d = decoder{src: fields[1]}
+	recipients := d.readSliceOfSlice()
+	for _, recipient := range recipients {
+		if d.err == nil && len(recipient) != nacl.KeySize {
+			d.err = fmt.Errorf("invalid recipient key length: %d", len(recipient))
+		}
+	}
+	if d.err != nil {
+		return EncryptedPayload{}, nil, fmt.Errorf("unable to decode recipients: %v", d.err)
+	}
 
-	return ep, recipients
+	return ep, recipients, nil
 }
 
+// EncodePartyInfo encodes the provided PartyInfo using the same binary format as Constellation,
+// which consists of:
+//   - the URL of the node
+//   - the number of recipients, followed by a (public key, URL) tuple for each
+//   - the list of party URLs
+//
+// Recipients and parties are written in sorted order so the encoding is deterministic.
 func EncodePartyInfo(pi PartyInfo) []byte {
+	pi.mu.RLock()
+	defer pi.mu.RUnlock()
 
 	encoded := make([]byte, 256)
 
@@ -70,56 +107,189 @@ func EncodePartyInfo(pi PartyInfo) []byte {
 	encoded, offset = writeSlice([]byte(pi.url), encoded, offset)
 	encoded, offset = writeInt(len(pi.recipients), encoded, offset)
 
-	for recipient, url := range pi.recipients {
+	recipients := make([][nacl.KeySize]byte, 0, len(pi.recipients))
+	for recipient := range pi.recipients {
+		recipients = append(recipients, recipient)
+	}
+	sort.Slice(recipients, func(i, j int) bool {
+		return bytes.Compare(recipients[i][:], recipients[j][:]) < 0
+	})
+
+	for _, recipient := range recipients {
 		tuple := [][]byte{
 			recipient[:],
-			[]byte(url),
+			[]byte(pi.recipients[recipient]),
 		}
 		encoded, offset = writeSliceOfSlice(tuple, encoded, offset)
 	}
 
-	parties := make([][]byte, len(pi.parties))
-	i := 0
+	parties := make([]string, 0, len(pi.parties))
 	for party := range pi.parties {
-		parties[i] = []byte(party)
-		i += 1
+		parties = append(parties, party)
+	}
+	sort.Strings(parties)
+
+	encodedParties := make([][]byte, len(parties))
+	for i, party := range parties {
+		encodedParties[i] = []byte(party)
 	}
-	encoded, offset = writeSliceOfSlice(parties, encoded, offset)
+	encoded, offset = writeSliceOfSlice(encodedParties, encoded, offset)
 
-	return encoded
+	return encoded[:offset]
 }
 
+// DecodePartyInfo decodes PartyInfo in the format written by EncodePartyInfo. An error is
+// returned if the input is truncated, or contains invalid keys or URLs.
+// Trailing data is ignored, as earlier versions padded the encoded output.
 func DecodePartyInfo(encoded []byte) (PartyInfo, error) {
 	pi := PartyInfo{
 		recipients: make(map[[nacl.KeySize]byte]string),
 		parties:    make(map[string]bool),
 	}
 
-	url, offset := readSlice(encoded, 0)
-	pi.url = string(url)
+	d := decoder{src: encoded}
 
-	var size int
-	size, offset = readInt(encoded, offset)
+	pi.url = string(d.readSlice())
+	if d.err != nil {
+		return PartyInfo{}, d.err
+	}
+	err := validatePartyUrl(pi.url)
+	if err != nil {
+		return PartyInfo{}, err
+	}
+
+	size := d.readInt()
+	if d.err == nil && size > d.remaining()/minTupleSize {
+		d.err = fmt.Errorf("invalid recipient count: %d", size)
+	}
 
-	for i := 0; i < size; i++ {
-		var kv [][]byte
-		kv, offset = readSliceOfSlice(encoded, offset)
+	for i := 0; i < size && d.err == nil; i++ {
+		kv := d.readSliceOfSlice()
+		if d.err != nil {
+			break
+		}
+		if len(kv) != 2 {
+			return PartyInfo{}, fmt.Errorf("invalid recipient entry with %d fields", len(kv))
+		}
 		key, err := utils.ToKey(kv[0])
 		if err != nil {
 			return PartyInfo{}, err
 		}
-		pi.recipients[*key] = string(kv[1])
+		url := string(kv[1])
+		err = validatePartyUrl(url)
+		if err != nil {
+			return PartyInfo{}, err
+		}
+		pi.recipients[*key] = url
 	}
 
-	var parties [][]byte
-	parties, offset = readSliceOfSlice(encoded, offset)
+	parties := d.readSliceOfSlice()
+	if d.err != nil {
+		return PartyInfo{}, fmt.Errorf("unable to decode party info: %v", d.err)
+	}
 	for _, party := range parties {
-		pi.parties[string(party)] = true
+		url := string(party)
+		err = validatePartyUrl(url)
+		if err != nil {
+			return PartyInfo{}, err
+		}
+		pi.parties[url] = true
 	}
 
 	return pi, nil
 }
 
+// minTupleSize is the smallest possible encoding of a recipient tuple, which contains two
+// length prefixed fields.
+const minTupleSize = 3 * 8
+
+// decoder reads values written by the write functions, recording an error rather than
+// panicking if the input is malformed. Once an error occurs, subsequent reads return zero values.
+type decoder struct {
+	src    []byte
+	offset int
+	err    error
+}
+
+func (d *decoder) remaining() int {
+	return len(d.src) - d.offset
+}
+
+func (d *decoder) readInt() int {
+	if d.err != nil {
+		return 0
+	}
+	if d.remaining() < 8 {
+		d.err = errors.New("unexpected end of input")
+		return 0
+	}
+	v := binary.BigEndian.Uint64(d.src[d.offset:])
+	d.offset += 8
+	if v > uint64(len(d.src)) {
+		// No length or count can exceed the size of the input
+		d.err = fmt.Errorf("invalid length: %d", v)
+		return 0
+	}
+	return int(v)
+}
+
+func (d *decoder) readSlice() []byte {
+	length := d.readInt()
+	if d.err != nil {
+		return nil
+	}
+	if length > d.remaining() {
+		d.err = fmt.Errorf("invalid length: %d, %d bytes remaining", length, d.remaining())
+		return nil
+	}
+	result := d.src[d.offset : d.offset+length]
+	d.offset += length
+	return result
+}
+
+// readFixed reads a slice into dest, which must be the same length.
+func (d *decoder) readFixed(dest []byte) {
+	value := d.readSlice()
+	if d.err == nil && len(value) != len(dest) {
+		d.err = fmt.Errorf("invalid length: %d, expected %d", len(value), len(dest))
+	}
+	copy(dest, value)
+}
+
+func (d *decoder) readPayload() EncryptedPayload {
+	ep := EncryptedPayload{
+		Sender:         new([nacl.KeySize]byte),
+		Nonce:          new([nacl.NonceSize]byte),
+		RecipientNonce: new([nacl.NonceSize]byte),
+	}
+
+	d.readFixed((*ep.Sender)[:])
+	ep.CipherText = append([]byte{}, d.readSlice()...)
+	d.readFixed((*ep.Nonce)[:])
+	ep.RecipientBoxes = d.readSliceOfSlice()
+	d.readFixed((*ep.RecipientNonce)[:])
+
+	return ep
+}
+
+func (d *decoder) readSliceOfSlice() [][]byte {
+	size := d.readInt()
+	if d.err != nil {
+		return nil
+	}
+	// Each entry requires at least a length prefix
+	if size > d.remaining()/8 {
+		d.err = fmt.Errorf("invalid size: %d", size)
+		return nil
+	}
+
+	result := make([][]byte, size)
+	for i := 0; i < size && d.err == nil; i++ {
+		result[i] = append(result[i], d.readSlice()...)
+	}
+	return result
+}
+
 func writeInt(v int, dest []byte, offset int) ([]byte, int) {
 	dest = confirmCapacity(dest, offset, 8)
 	binary.BigEndian.PutUint64(dest[offset:], uint64(v))
@@ -141,10 +311,6 @@ func confirmCapacity(dest []byte, offset, required int) []byte {
 	}
 }
 
-func readInt(src []byte, offset int) (int, int) {
-	return int(binary.BigEndian.Uint64(src[offset:])), offset + 8
-}
-
 func writeSlice(src []byte, dest []byte, offset int) ([]byte, int) {
 	length := len(src)
 	dest, offset = writeInt(length, dest, offset)
@@ -154,19 +320,6 @@ func writeSlice(src []byte, dest []byte, offset int) ([]byte, int) {
 	return dest, offset + length
 }
 
-func readSliceToArray(src []byte, offset int, dest []byte) int {
-	var length int
-	length, offset = readInt(src, offset)
-	offset += copy(dest, src[offset:offset+length])
-	return offset
-}
-
-func readSlice(src []byte, offset int) ([]byte, int) {
-	var length int
-	length, offset = readInt(src, offset)
-	return src[offset : offset+length], offset + length
-}
-
 func writeSliceOfSlice(src [][]byte, dest []byte, offset int) ([]byte, int) {
 	length := len(src)
 	dest, offset = writeInt(length, dest, offset)
@@ -177,17 +330,3 @@ func writeSliceOfSlice(src [][]byte, dest []byte, offset int) ([]byte, int) {
 
 	return dest, offset
 }
-
-func readSliceOfSlice(src []byte, offset int) ([][]byte, int) {
-	arraySize, offset := readInt(src, offset)
-
-	result := make([][]byte, arraySize)
-	for i := 0; i < arraySize; i++ {
-		var length int
-		length, offset = readInt(src, offset)
-		result[i] = append(
-			result[i], src[offset:offset+length]...)
-		offset += length
-	}
-	return result, offset
-}
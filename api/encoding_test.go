@@ -1,8 +1,11 @@
 package api
 
 import (
+	"bytes"
+	"encoding/binary"
 	"github.com/blk-io/crux/utils"
 	"github.com/kevinburke/nacl"
+	"math/rand"
 	"reflect"
 	"testing"
 )
@@ -18,7 +21,10 @@ func TestEncodePayload(t *testing.T) {
 	}
 
 	encoded := EncodePayload(epl)
-	decoded := DecodePayload(encoded)
+	decoded, err := DecodePayload(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	if !reflect.DeepEqual(epl, decoded) {
 		t.Errorf("Decoded payload: %v does not match input %v", decoded, epl)
@@ -55,7 +61,10 @@ func TestEncodePayloadWithRecipients(t *testing.T) {
 
 	for i, epl := range epls {
 		encoded := EncodePayloadWithRecipients(epl, recipients[i])
-		decodedEpl, decodedRecipients := DecodePayloadWithRecipients(encoded)
+		decodedEpl, decodedRecipients, err := DecodePayloadWithRecipients(encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
 
 		if !reflect.DeepEqual(epl, decodedEpl) {
 			t.Errorf("Decoded partyInfo: %v does not match input %v", decodedEpl, epl)
@@ -95,6 +104,89 @@ func TestEncodePartyInfo(t *testing.T) {
 	runEncodePartyInfoTest(t, pi)
 }
 
+func TestEncodePartyInfoDeterministic(t *testing.T) {
+	pi := testPartyInfo()
+	encoded := EncodePartyInfo(pi)
+
+	for i := 0; i < 10; i++ {
+		if !bytes.Equal(encoded, EncodePartyInfo(pi)) {
+			t.Fatal("Encoding the same partyInfo produced different results")
+		}
+	}
+}
+
+func TestDecodePartyInfoPadded(t *testing.T) {
+	pi := testPartyInfo()
+	encoded := append(EncodePartyInfo(pi), make([]byte, 64)...)
+
+	decoded, err := DecodePartyInfo(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(pi, decoded) {
+		t.Errorf("Decoded partyInfo: %v does not match input %v", decoded, pi)
+	}
+}
+
+func TestDecodePartyInfoTruncated(t *testing.T) {
+	encoded := EncodePartyInfo(testPartyInfo())
+
+	for i := 0; i < len(encoded); i++ {
+		_, err := DecodePartyInfo(encoded[:i])
+		if err == nil {
+			t.Errorf("No error returned decoding partyInfo truncated to %d bytes", i)
+		}
+	}
+}
+
+func TestDecodePartyInfoInvalid(t *testing.T) {
+	invalid := []PartyInfo{
+		{url: "not a url", recipients: map[[nacl.KeySize]byte]string{}, parties: map[string]bool{}},
+		{
+			url:        "http://localhost:9000",
+			recipients: map[[nacl.KeySize]byte]string{{1}: "ftp://localhost:9001"},
+			parties:    map[string]bool{},
+		},
+		{
+			url:        "http://localhost:9000",
+			recipients: map[[nacl.KeySize]byte]string{},
+			parties:    map[string]bool{"localhost:9001": true},
+		},
+	}
+
+	for _, pi := range invalid {
+		_, err := DecodePartyInfo(EncodePartyInfo(pi))
+		if err == nil {
+			t.Errorf("No error returned decoding invalid partyInfo %v", pi)
+		}
+	}
+
+	// A huge recipient count must not cause a large allocation or panic
+	encoded := EncodePartyInfo(testPartyInfo())
+	urlLength := 8 + len(testPartyInfo().url)
+	binary.BigEndian.PutUint64(encoded[urlLength:], 1<<62)
+	_, err := DecodePartyInfo(encoded)
+	if err == nil {
+		t.Error("No error returned decoding partyInfo with an invalid recipient count")
+	}
+}
+
+func testPartyInfo() PartyInfo {
+	return PartyInfo{
+		url: "https://127.0.0.1:9001/",
+		recipients: map[[nacl.KeySize]byte]string{
+			toKey("BULeR8JyUWhiuuCMU/HLA0Q5pzkYT+cHII3ZKBey3Bo="): "https://127.0.0.1:9001/",
+			toKey("QfeDAys9MPDs2XHExtc84jKGHxZg/aj52DTh0vtA3Xc="): "https://127.0.0.2:9002/",
+			toKey("1iTZde/ndBHvzhcl7V68x44Vx7pl8nwx9LqnM/AfJUg="): "https://127.0.0.3:9003/",
+		},
+		parties: map[string]bool{
+			"https://127.0.0.1:9001/": true,
+			"https://127.0.0.2:9002/": true,
+			"https://127.0.0.3:9003/": true,
+		},
+	}
+}
+
 func runEncodePartyInfoTest(t *testing.T, pi PartyInfo) {
 	encoded := EncodePartyInfo(pi)
 	decoded, err := DecodePartyInfo(encoded)
@@ -112,3 +204,87 @@ func toKey(encodedKey string) [nacl.KeySize]byte {
 	key, _ := utils.LoadBase64Key(encodedKey)
 	return *key
 }
+
+func testPayload() EncryptedPayload {
+	return EncryptedPayload{
+		Sender:         nacl.NewKey(),
+		CipherText:     []byte("C1ph3r T3xt"),
+		Nonce:          nacl.NewNonce(),
+		RecipientBoxes: [][]byte{[]byte("B0x1"), []byte("B0x2")},
+		RecipientNonce: nacl.NewNonce(),
+	}
+}
+
+func TestDecodeTruncatedPayload(t *testing.T) {
+	recipients := [][]byte{(*nacl.NewKey())[:], (*nacl.NewKey())[:]}
+	encoded := EncodePayloadWithRecipients(testPayload(), recipients)
+
+	for i := 0; i < len(encoded); i++ {
+		_, _, err := DecodePayloadWithRecipients(encoded[:i])
+		if err == nil {
+			t.Errorf("Payload truncated to %d bytes should not decode", i)
+		}
+	}
+
+	encodedEpl := EncodePayload(testPayload())
+	for i := 0; i < len(encodedEpl); i++ {
+		_, err := DecodePayload(encodedEpl[:i])
+		if err == nil {
+			t.Errorf("Payload truncated to %d bytes should not decode", i)
+		}
+	}
+}
+
+func TestDecodeInvalidPayload(t *testing.T) {
+	epl := testPayload()
+	shortKey := EncodePayload(epl)
+	// Shorten the sender key length prefix
+	binary.BigEndian.PutUint64(shortKey, nacl.KeySize-1)
+
+	invalidRecipient := EncodePayloadWithRecipients(epl, [][]byte{[]byte("short")})
+
+	hugeCount := EncodePayload(epl)
+	// The recipient box count follows the sender, cipher text and nonce
+	offset := 8 + nacl.KeySize + 8 + len(epl.CipherText) + 8 + nacl.NonceSize
+	binary.BigEndian.PutUint64(hugeCount[offset:], 1<<62)
+
+	for name, encoded := range map[string][]byte{
+		"short key":         shortKey,
+		"huge box count":    hugeCount,
+		"invalid recipient": invalidRecipient,
+	} {
+		var err error
+		if name == "invalid recipient" {
+			_, _, err = DecodePayloadWithRecipients(encoded)
+		} else {
+			_, err = DecodePayload(encoded)
+		}
+		if err == nil {
+			t.Errorf("Payload with %s should not decode", name)
+		}
+	}
+}
+
+// TestDecodeRandomPayload mutates valid encodings, checking decoding never panics, and any
+// payload which does decode re-encodes to the same bytes.
+func TestDecodeRandomPayload(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	encoded := EncodePayloadWithRecipients(testPayload(), [][]byte{(*nacl.NewKey())[:]})
+
+	for i := 0; i < 10000; i++ {
+		mutated := append([]byte{}, encoded...)
+		for j := rng.Intn(4); j >= 0; j-- {
+			mutated[rng.Intn(len(mutated))] = byte(rng.Intn(256))
+		}
+		mutated = mutated[:rng.Intn(len(mutated)+1)]
+
+		epl, recipients, err := DecodePayloadWithRecipients(mutated)
+		if err != nil {
+			continue
+		}
+		reencoded := EncodePayloadWithRecipients(epl, recipients)
+		if !bytes.Equal(reencoded, mutated[:len(reencoded)]) {
+			t.Fatalf("Decoded payload does not re-encode to its input: %x", mutated)
+		}
+	}
+}
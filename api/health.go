@@ -0,0 +1,195 @@
+package api
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// UnhealthyFailures is the number of consecutive failed requests after which a peer is
+// considered unhealthy. Requests to an unhealthy peer are skipped, other than a single request
+// made periodically to probe whether it has recovered.
+const UnhealthyFailures = 5
+
+// The time an unhealthy peer is skipped for before it is probed starts at minProbeBackoff, and
+// doubles with each failed probe up to maxProbeBackoff.
+const (
+	minProbeBackoff = 5 * time.Second
+	maxProbeBackoff = 5 * time.Minute
+)
+
+// ErrPeerUnavailable is returned instead of making a request to an unhealthy peer.
+var ErrPeerUnavailable = errors.New("peer is unhealthy, skipping request until it is next probed")
+
+// PeerHealth summarises the observed health of a remote node.
+type PeerHealth struct {
+	Url      string        `json:"url"`
+	Healthy  bool          `json:"healthy"`
+	Latency  time.Duration `json:"latency"`  // Round trip time of the last successful request
+	Failures int           `json:"failures"` // Number of consecutive failed requests
+	LastSeen time.Time     `json:"lastSeen"` // Time of the last successful request
+	Requests int           `json:"requests"` // Total number of requests made
+	Failed   int           `json:"failed"`   // Total number of failed requests
+	// NextProbe is when an unhealthy peer will next be sent a request.
+	NextProbe *time.Time `json:"nextProbe,omitempty"`
+}
+
+// PeerStatus is the liveness of a node we know of, as determined by upchecking it.
+type PeerStatus struct {
+	Url        string        `json:"url"`
+	PublicKeys []string      `json:"publicKeys"` // Keys hosted by the node
+	Up         bool          `json:"up"`         // Whether the last request to the node succeeded
+	LastSeen   *time.Time    `json:"lastSeen,omitempty"`
+	Latency    time.Duration `json:"latency"` // Round trip time of the last successful request
+}
+
+type healthTracker struct {
+	mu    sync.Mutex
+	peers map[string]*peerState
+}
+
+// peerState is the health of a peer, along with the state of its probing if it is unhealthy.
+type peerState struct {
+	health  PeerHealth
+	backoff time.Duration // Time until the next probe after the last failure
+	probing bool          // Whether a probe is in progress
+	added   time.Time     // Time of the first request made
+}
+
+func newHealthTracker() *healthTracker {
+	return &healthTracker{peers: make(map[string]*peerState)}
+}
+
+func (h *healthTracker) record(url string, latency time.Duration, err error) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	peer, ok := h.peers[url]
+	if !ok {
+		peer = &peerState{health: PeerHealth{Url: url, Healthy: true}, added: time.Now()}
+		h.peers[url] = peer
+	}
+	health := &peer.health
+	health.Requests++
+	peer.probing = false
+
+	if err != nil {
+		health.Failed++
+		health.Failures++
+		if health.Failures < UnhealthyFailures {
+			return
+		}
+		if health.Healthy {
+			peer.backoff = minProbeBackoff
+		} else if peer.backoff *= 2; peer.backoff > maxProbeBackoff {
+			peer.backoff = maxProbeBackoff
+		}
+		next := time.Now().Add(peer.backoff)
+		health.Healthy, health.NextProbe = false, &next
+	} else {
+		health.Healthy, health.NextProbe = true, nil
+		health.Failures = 0
+		health.Latency = latency
+		health.LastSeen = time.Now()
+	}
+}
+
+// allow returns ErrPeerUnavailable if requests to url should be skipped as it is unhealthy. Once
+// it is due to be probed, a single request is allowed until its outcome is recorded.
+func (h *healthTracker) allow(url string) error {
+	if h == nil {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	peer, ok := h.peers[url]
+	if !ok || peer.health.Healthy {
+		return nil
+	}
+	if peer.probing || time.Now().Before(*peer.health.NextProbe) {
+		return ErrPeerUnavailable
+	}
+	peer.probing = true
+	return nil
+}
+
+func (h *healthTracker) get(url string) (PeerHealth, bool) {
+	if h == nil {
+		return PeerHealth{Url: url, Healthy: true}, false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	peer, ok := h.peers[url]
+	if !ok {
+		return PeerHealth{Url: url, Healthy: true}, false
+	}
+	return peer.health, true
+}
+
+// dead reports whether requests to url have failed continuously for longer than after, either
+// since it was last seen, or since the first request to it if it never has been.
+func (h *healthTracker) dead(url string, after time.Duration) bool {
+	if h == nil {
+		return false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	peer, ok := h.peers[url]
+	if !ok || peer.health.Failures == 0 {
+		return false
+	}
+	since := peer.health.LastSeen
+	if since.IsZero() {
+		since = peer.added
+	}
+	return time.Since(since) > after
+}
+
+func (h *healthTracker) all() []PeerHealth {
+	if h == nil {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	peers := make([]PeerHealth, 0, len(h.peers))
+	for _, peer := range h.peers {
+		peers = append(peers, peer.health)
+	}
+	return peers
+}
+
+// rank orders the provided urls healthiest first. Peers with fewer consecutive failures come
+// first, followed by those with the lowest latency. Peers we have not heard from yet are ranked
+// after healthy peers with the same failure count.
+func (h *healthTracker) rank(urls []string) []string {
+	peers := make([]PeerHealth, len(urls))
+	seen := make(map[string]bool)
+	for i, url := range urls {
+		peers[i], seen[url] = h.get(url)
+	}
+
+	sort.SliceStable(peers, func(i, j int) bool {
+		a, b := peers[i], peers[j]
+		if a.Failures != b.Failures {
+			return a.Failures < b.Failures
+		}
+		if seen[a.Url] != seen[b.Url] {
+			return seen[a.Url]
+		}
+		return a.Latency < b.Latency
+	})
+
+	ranked := make([]string, len(peers))
+	for i, peer := range peers {
+		ranked[i] = peer.Url
+	}
+	return ranked
+}
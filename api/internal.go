@@ -2,8 +2,10 @@ package api
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/blk-io/chimera-api/chimera"
 	"github.com/blk-io/crux/utils"
@@ -16,6 +18,8 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"sort"
+	"sync"
 	"time"
 )
 
@@ -34,33 +38,138 @@ type PartyInfo struct {
 	url        string                        // URL identifying this node
 	recipients map[[nacl.KeySize]byte]string // public key -> URL
 	parties    map[string]bool               // Node (or party) URLs
+	static     map[string]bool               // Node URLs we were configured with, which are never pruned
 	client     utils.HttpClient
 	grpc       bool
+	health     *healthTracker // Shared between copies of this PartyInfo
+	validate   bool           // Validate announced recipients before accepting them
+	pruneAfter time.Duration  // Time after which unresponsive nodes are pruned, if greater than 0
+	mu         *partyLock     // Guards recipients and parties, shared between copies of this PartyInfo
+	listener   *partyListener // Notified of changes, shared between copies of this PartyInfo
+}
+
+// partyListener is notified when the recipients or parties of a PartyInfo change as a result of
+// the party info of another node being merged. A nil partyListener is never notified.
+type partyListener struct {
+	mu sync.Mutex
+	f  func()
+}
+
+func (l *partyListener) set(f func()) {
+	if l != nil {
+		l.mu.Lock()
+		l.f = f
+		l.mu.Unlock()
+	}
+}
+
+func (l *partyListener) notify() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	f := l.f
+	l.mu.Unlock()
+	if f != nil {
+		f()
+	}
+}
+
+// partyLock guards the maps of a PartyInfo, which are updated by request handlers and by polling
+// other nodes concurrently. A nil partyLock does nothing, for PartyInfos which are not shared,
+// such as those decoded from other nodes.
+type partyLock struct {
+	mu sync.RWMutex
+}
+
+func (l *partyLock) Lock() {
+	if l != nil {
+		l.mu.Lock()
+	}
+}
+
+func (l *partyLock) Unlock() {
+	if l != nil {
+		l.mu.Unlock()
+	}
+}
+
+func (l *partyLock) RLock() {
+	if l != nil {
+		l.mu.RLock()
+	}
+}
+
+func (l *partyLock) RUnlock() {
+	if l != nil {
+		l.mu.RUnlock()
+	}
 }
 
 // GetRecipient retrieves the URL associated with the provided recipient.
 func (s *PartyInfo) GetRecipient(key nacl.Key) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	value, ok := s.recipients[*key]
 	return value, ok
 }
 
+// GetAllValues returns this node's URL, along with copies of the recipients and parties it
+// knows of.
 func (s *PartyInfo) GetAllValues() (string, map[[nacl.KeySize]byte]string, map[string]bool) {
-	return s.url, s.recipients, s.parties
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.url, s.copyRecipients(), s.copyParties()
+}
+
+// copyRecipients and copyParties must be called with the lock held.
+func (s *PartyInfo) copyRecipients() map[[nacl.KeySize]byte]string {
+	recipients := make(map[[nacl.KeySize]byte]string, len(s.recipients))
+	for key, url := range s.recipients {
+		recipients[key] = url
+	}
+	return recipients
+}
+
+func (s *PartyInfo) copyParties() map[string]bool {
+	parties := make(map[string]bool, len(s.parties))
+	for url, v := range s.parties {
+		parties[url] = v
+	}
+	return parties
+}
+
+// grpcRecipients returns the URL of each recipient keyed by URL, as they are sent via gRPC.
+func (s *PartyInfo) grpcRecipients() map[string][]byte {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	recipients := make(map[string][]byte)
+	for key, url := range s.recipients {
+		key := key
+		recipients[url] = key[:]
+	}
+	return recipients
 }
 
 // InitPartyInfo initializes a new PartyInfo store.
 func InitPartyInfo(rawUrl string, otherNodes []string, client utils.HttpClient, grpc bool) PartyInfo {
 	parties := make(map[string]bool)
+	static := make(map[string]bool)
 	for _, node := range otherNodes {
 		parties[node] = true
+		static[node] = true
 	}
 
 	return PartyInfo{
 		url:        rawUrl,
 		recipients: make(map[[nacl.KeySize]byte]string),
 		parties:    parties,
+		static:     static,
 		client:     client,
 		grpc:       grpc,
+		health:     newHealthTracker(),
+		mu:         &partyLock{},
+		listener:   &partyListener{},
 	}
 }
 
@@ -73,8 +182,10 @@ func CreatePartyInfo(
 
 	recipients := make(map[[nacl.KeySize]byte]string)
 	parties := make(map[string]bool)
+	static := make(map[string]bool)
 	for i, node := range otherNodes {
 		parties[node] = true
+		static[node] = true
 		recipients[*otherKeys[i]] = node
 	}
 
@@ -82,26 +193,98 @@ func CreatePartyInfo(
 		url:        url,
 		recipients: recipients,
 		parties:    parties,
+		static:     static,
 		client:     client,
+		health:     newHealthTracker(),
+		mu:         &partyLock{},
+		listener:   &partyListener{},
+	}
+}
+
+// OnUpdate registers f to be called whenever the recipients or parties known to the PartyInfo
+// change, as the party info of another node is merged. Only a single function is registered,
+// replacing any previous one, and it is called after the change has been applied.
+func (s *PartyInfo) OnUpdate(f func()) {
+	s.listener.set(f)
+}
+
+// RecordRequest records the outcome of a request made to the node at url, which is used to
+// determine which peers are the most reliable.
+func (s *PartyInfo) RecordRequest(url string, latency time.Duration, err error) {
+	s.health.record(url, latency, err)
+}
+
+// AllowRequest returns ErrPeerUnavailable if requests to the node at url should be skipped, as
+// recent requests to it have failed and it is not yet due to be probed.
+func (s *PartyInfo) AllowRequest(url string) error {
+	return s.health.allow(url)
+}
+
+// GetPeerHealth returns the observed health of all remote nodes we have made requests to.
+func (s *PartyInfo) GetPeerHealth() []PeerHealth {
+	return s.health.all()
+}
+
+// RankPeers returns the URLs of all other nodes on the network, healthiest first.
+func (s *PartyInfo) RankPeers() []string {
+	var urls []string
+	s.mu.RLock()
+	for url := range s.parties {
+		if url != s.url {
+			urls = append(urls, url)
+		}
 	}
+	s.mu.RUnlock()
+	sort.Strings(urls)
+	return s.health.rank(urls)
 }
 
 // RegisterPublicKeys associates the provided public keys with this node.
 func (s *PartyInfo) RegisterPublicKeys(pubKeys []nacl.Key) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	for _, pubKey := range pubKeys {
 		s.recipients[*pubKey] = s.url
 	}
 }
 
-func (s *PartyInfo) GetPartyInfoGrpc() {
-	recipients := make(map[string][]byte)
-	for key, url := range s.recipients {
-		recipients[url] = key[:]
+// UnregisterPublicKeys stops associating the provided public keys with this node, so they are no
+// longer announced to other nodes. Announcements by other nodes mapping them to this node are
+// ignored, as for all mappings to this node.
+func (s *PartyInfo) UnregisterPublicKeys(pubKeys []nacl.Key) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, pubKey := range pubKeys {
+		if s.recipients[*pubKey] == s.url {
+			delete(s.recipients, *pubKey)
+		}
 	}
-	urls := make(map[string]bool)
-	for k, v := range s.parties {
-		urls[k] = v
+}
+
+// AddParties adds the provided node URLs to those we request party info from, returning the URLs
+// which were not already known. Like the nodes provided to InitPartyInfo, they are never pruned.
+func (s *PartyInfo) AddParties(urls []string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var added []string
+	for _, url := range urls {
+		if url == "" {
+			continue
+		}
+		s.static[url] = true
+		if !s.parties[url] {
+			s.parties[url] = true
+			added = append(added, url)
+		}
 	}
+	return added
+}
+
+func (s *PartyInfo) GetPartyInfoGrpc() {
+	recipients := s.grpcRecipients()
+	s.mu.RLock()
+	urls := s.copyParties()
+	s.mu.RUnlock()
 
 	for rawUrl := range urls {
 		if rawUrl == s.url {
@@ -120,19 +303,21 @@ func (s *PartyInfo) GetPartyInfoGrpc() {
 			log.Errorf("Client is not intialised")
 			continue
 		}
-		party := chimera.PartyInfo{Url: rawUrl, Recipients: recipients, Parties: s.parties}
+		party := chimera.PartyInfo{Url: rawUrl, Recipients: recipients, Parties: urls}
 
+		start := time.Now()
 		partyInfoResp, err := cli.UpdatePartyInfo(context.Background(), &party)
+		s.RecordRequest(rawUrl, time.Since(start), err)
 		if err != nil {
 			log.Errorf("Error in updating party info %s", err)
 			continue
 		} else {
 			log.Printf("Connected to the other node %s", rawUrl)
 		}
-		err = s.updatePartyInfoGrpc(*partyInfoResp, s.url)
+		err = s.updatePartyInfoGrpc(*partyInfoResp, rawUrl)
 		if err != nil {
 			log.Errorf("Error: %s", err)
-			break
+			continue
 		}
 	}
 }
@@ -147,10 +332,9 @@ func (s *PartyInfo) GetPartyInfo() {
 	encodedPartyInfo := EncodePartyInfo(*s)
 
 	// First copy our endpoints as we update this map in place
-	urls := make(map[string]bool)
-	for k, v := range s.parties {
-		urls[k] = v
-	}
+	s.mu.RLock()
+	urls := s.copyParties()
+	s.mu.RUnlock()
 
 	for rawUrl := range urls {
 		if rawUrl == s.url {
@@ -176,23 +360,29 @@ func (s *PartyInfo) GetPartyInfo() {
 		req.Header.Set("Content-Type", "application/octet-stream")
 
 		logRequest(req)
+		start := time.Now()
 		resp, err := s.client.Do(req)
 		if err != nil {
+			s.RecordRequest(rawUrl, time.Since(start), err)
 			log.WithField("url", rawUrl).Errorf(
 				"Error sending /partyinfo request, %v", err)
 			continue
 		}
 
 		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			s.RecordRequest(rawUrl, time.Since(start),
+				fmt.Errorf("non-200 status code: %d", resp.StatusCode))
 			log.WithField("url", rawUrl).Errorf(
 				"Error sending /partyinfo request, non-200 status code: %v", resp)
 			continue
 		}
+		s.RecordRequest(rawUrl, time.Since(start), nil)
 
 		err = s.updatePartyInfo(resp, rawUrl)
 
 		if err != nil {
-			break
+			continue
 		}
 	}
 }
@@ -217,17 +407,16 @@ func (s *PartyInfo) updatePartyInfo(resp *http.Response, rawUrl string) error {
 			"Unable to read partyInfo response from host, %v", err)
 		return err
 	}
-	s.UpdatePartyInfo(encoded)
-	return nil
+	return s.UpdatePartyInfo(encoded)
 }
 
 func (s *PartyInfo) getEncoded(encodedPartyInfo []byte) []byte {
 	if s.grpc {
-		recipients := make(map[string][]byte)
-		for key, url := range s.recipients {
-			recipients[url] = key[:]
-		}
-		e, err := json.Marshal(UpdatePartyInfo{s.url, recipients, s.parties})
+		recipients := s.grpcRecipients()
+		s.mu.RLock()
+		parties := s.copyParties()
+		s.mu.RUnlock()
+		e, err := json.Marshal(UpdatePartyInfo{s.url, recipients, parties})
 		if err != nil {
 			log.Errorf("Marshalling failed %v", err)
 			return nil
@@ -237,72 +426,184 @@ func (s *PartyInfo) getEncoded(encodedPartyInfo []byte) []byte {
 	return encodedPartyInfo[:]
 }
 
-func (s *PartyInfo) PollPartyInfo() {
-	time.Sleep(time.Duration(rand.Intn(16)) * time.Second)
-	s.GetPartyInfo()
-
-	ticker := time.NewTicker(2 * time.Minute)
-	quit := make(chan struct{})
-	go func() {
-		for {
-			select {
-			case <-ticker.C:
-				s.GetPartyInfo()
-			case <-quit:
-				ticker.Stop()
-				return
-			}
+// PollInterval is how often PollPartyInfo requests party info from other nodes.
+const PollInterval = 2 * time.Minute
+
+// PollPartyInfo requests party info from all other nodes every PollInterval, until stop is
+// closed. Each round first upchecks the other nodes, other than with gRPC, and prunes those which
+// have been unresponsive for too long. heartbeat is called before and after each round of
+// requests, so a watchdog can detect if a round never completes.
+func (s *PartyInfo) PollPartyInfo(stop <-chan struct{}, heartbeat func()) {
+	select {
+	case <-time.After(time.Duration(rand.Intn(16)) * time.Second):
+	case <-stop:
+		return
+	}
+
+	ticker := time.NewTicker(PollInterval)
+	defer ticker.Stop()
+	for {
+		heartbeat()
+		if !s.grpc {
+			s.UpcheckPeers()
+		}
+		s.PrunePeers()
+		s.GetPartyInfo()
+		heartbeat()
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
 		}
-	}()
+	}
 }
 
 // UpdatePartyInfo updates the PartyInfo datastore with the provided encoded data.
 // This can happen from the /partyinfo server endpoint being hit, or by a response from us hitting
 // another nodes /partyinfo endpoint.
-// TODO: Control access via a channel for updates.
-func (s *PartyInfo) UpdatePartyInfo(encoded []byte) {
+// An error is returned if the encoded data is invalid, in which case no changes are made.
+func (s *PartyInfo) UpdatePartyInfo(encoded []byte) error {
 	log.Debugf("Updating party info payload: %s", hex.EncodeToString(encoded))
 	pi, err := DecodePartyInfo(encoded)
 
 	if err != nil {
-		log.WithField("encoded", encoded).Errorf(
+		log.WithField("encoded", hex.EncodeToString(encoded)).Errorf(
 			"Unable to decode party info, error: %v", err)
+		return err
 	}
 
-	for publicKey, url := range pi.recipients {
-		// we should ignore messages about ourselves
-		// in order to stop people masquerading as you, there
-		// should be a digital signature associated with each
-		// url -> node broadcast
-		if url != s.url {
-			s.recipients[publicKey] = url
-		}
-	}
-
-	for url := range pi.parties {
-		// we don't want to broadcast party info to ourselves
-		s.parties[url] = true
-	}
+	s.merge(pi.url, pi.recipients, pi.parties)
+	return nil
 }
 
+// UpdatePartyInfoGrpc applies party details received via gRPC, using the same rules as
+// UpdatePartyInfo.
 func (s *PartyInfo) UpdatePartyInfoGrpc(url string, recipients map[[nacl.KeySize]byte]string, parties map[string]bool) {
+	s.merge(url, recipients, parties)
+}
+
+// merge applies the party details announced by the node at senderUrl. The following rules are
+// applied so that nodes converge on the same view of the network:
+//   - Mappings for our own public keys are never replaced, and no other keys may be mapped to us.
+//   - A public key we don't know about is accepted from any node.
+//   - A public key we already know about is only moved to a different URL if the node at that
+//     URL announced it itself.
+//   - Parties are only ever added, although unresponsive nodes may be removed by PrunePeers.
+//
+// Entries with invalid URLs are ignored. If validation is enabled, new or changed recipients are
+// only accepted once the node at their URL proves that it holds the recipient's private key.
+// Validation requires a request to each node, so is performed without holding the lock, and the
+// rules are applied again once it completes, in case another update was merged in the meantime.
+func (s *PartyInfo) merge(senderUrl string, recipients map[[nacl.KeySize]byte]string, parties map[string]bool) {
+	accepted := make(map[[nacl.KeySize]byte]string)
+	var unvalidated [][nacl.KeySize]byte
+	s.mu.RLock()
 	for publicKey, url := range recipients {
-		// we should ignore messages about ourselves
-		// in order to stop people masquerading as you, there
-		// should be a digital signature associated with each
-		// url -> node broadcast
-		if url != s.url {
-			s.recipients[publicKey] = url
+		validate, err := s.acceptRecipient(senderUrl, publicKey, url)
+		if err == errOwnRecipient {
+			continue
+		} else if err != nil {
+			log.WithFields(log.Fields{"url": url, "sender": senderUrl}).Warnf(
+				"Ignoring recipient, %v", err)
+			continue
+		}
+		if validate {
+			unvalidated = append(unvalidated, publicKey)
+		}
+		accepted[publicKey] = url
+	}
+	s.mu.RUnlock()
+
+	validated := make(map[[nacl.KeySize]byte]bool)
+	for _, publicKey := range unvalidated {
+		url := accepted[publicKey]
+		if err := s.validateRecipient(url, publicKey); err != nil {
+			log.WithFields(log.Fields{"url": url, "sender": senderUrl}).Warnf(
+				"Ignoring recipient which could not be validated, %v", err)
+			delete(accepted, publicKey)
+			continue
+		}
+		validated[publicKey] = true
+	}
+
+	changed := false
+	s.mu.Lock()
+	for publicKey, url := range accepted {
+		validate, err := s.acceptRecipient(senderUrl, publicKey, url)
+		if err != nil || (validate && !validated[publicKey]) {
+			continue
 		}
+		changed = changed || s.recipients[publicKey] != url
+		s.recipients[publicKey] = url
 	}
 
 	for url := range parties {
-		// we don't want to broadcast party info to ourselves
+		if err := validatePartyUrl(url); err != nil {
+			log.WithField("sender", senderUrl).Warnf("Ignoring party, %v", err)
+			continue
+		}
+		// we don't broadcast party info to ourselves, see GetPartyInfo
+		changed = changed || !s.parties[url]
 		s.parties[url] = true
 	}
+
+	if senderUrl != s.url && validatePartyUrl(senderUrl) == nil {
+		changed = changed || !s.parties[senderUrl]
+		s.parties[senderUrl] = true
+	}
+	s.mu.Unlock()
+
+	if changed {
+		s.listener.notify()
+	}
+}
+
+// errOwnRecipient is returned by acceptRecipient for mappings involving this node, which are
+// silently ignored, as other nodes announce our recipients back to us.
+var errOwnRecipient = errors.New("recipient belongs to this node")
+
+// acceptRecipient applies the rules of merge to a single recipient announced by senderUrl,
+// returning an error if it must be ignored, or whether it must first be validated. It must be
+// called with the lock held.
+func (s *PartyInfo) acceptRecipient(
+	senderUrl string, publicKey [nacl.KeySize]byte, url string) (bool, error) {
+
+	// in order to stop people masquerading as you, there
+	// should be a digital signature associated with each
+	// url -> node broadcast
+	current, known := s.recipients[publicKey]
+	if url == s.url || (known && current == s.url) {
+		return false, errOwnRecipient
+	}
+	if known && current != url && url != senderUrl {
+		return false, fmt.Errorf(
+			"second hand announcement moving a known recipient from %s", current)
+	}
+	if err := validatePartyUrl(url); err != nil {
+		return false, err
+	}
+	return s.validate && (!known || current != url), nil
+}
+
+// validatePartyUrl ensures that rawUrl is an absolute HTTP(S) URL.
+func validatePartyUrl(rawUrl string) error {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return fmt.Errorf("invalid url %q: %v", rawUrl, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid url %q: an absolute http(s) url is required", rawUrl)
+	}
+	return nil
 }
 
 func PushGrpc(encoded []byte, path string, epl EncryptedPayload) error {
+	return PushGrpcContext(context.Background(), encoded, path, epl)
+}
+
+// PushGrpcContext is equivalent to PushGrpc, abandoning the push if ctx is done.
+func PushGrpcContext(ctx context.Context, encoded []byte, path string, epl EncryptedPayload) error {
 	var completeUrl url.URL
 	url, err := completeUrl.Parse(path)
 	conn, err := grpc.Dial(url.Host, grpc.WithInsecure())
@@ -330,7 +631,7 @@ func PushGrpc(encoded []byte, path string, epl EncryptedPayload) error {
 		ReciepientBoxes: epl.RecipientBoxes,
 	}
 	pushPayload := chimera.PushPayload{Ep: &encrypt, Encoded: encoded}
-	_, err = cli.Push(context.Background(), &pushPayload)
+	_, err = cli.Push(ctx, &pushPayload)
 	if err != nil {
 		log.Errorf("Push failed with %s", err)
 		return err
@@ -338,39 +639,163 @@ func PushGrpc(encoded []byte, path string, epl EncryptedPayload) error {
 	return nil
 }
 
+// PushKeyHeader is the header of a push providing the base64 encoded key of the pushed payload.
+const PushKeyHeader = "c11n-key"
+
 // Push is responsible for propagating the encoded payload to the given remote node.
+// The payload's key, the digest of its cipher text, is provided in the PushKeyHeader, so the
+// remote node can verify the payload was not altered in transit.
 func Push(encoded []byte, url string, client utils.HttpClient) (string, error) {
+	return PushWithCompression(encoded, url, client, utils.CompressionNone)
+}
+
+// PushWithCompression is equivalent to Push, compressing the request body with the provided
+// algorithm, which is indicated by its Content-Encoding. Nodes which do not support compressed
+// pushes respond with a 400 or 415, in which case the payload is pushed again uncompressed.
+func PushWithCompression(
+	encoded []byte, url string, client utils.HttpClient, compression string) (string, error) {
+	return PushContext(context.Background(), encoded, url, client, compression)
+}
+
+// PushContext is equivalent to PushWithCompression, abandoning the push if ctx is done. Any
+// request ID in ctx is sent in the RequestIdHeader, to correlate the push with its origin.
+func PushContext(
+	ctx context.Context,
+	encoded []byte, url string, client utils.HttpClient, compression string) (string, error) {
 
 	endPoint, err := utils.BuildUrl(url, "/push")
 	if err != nil {
 		return "", err
 	}
 
-	var req *http.Request
-	req, err = http.NewRequest("POST", endPoint, bytes.NewReader(encoded))
+	epl, _, err := DecodePayloadWithRecipients(encoded)
 	if err != nil {
 		return "", err
 	}
-	req.Header.Set("Content-Type", "application/octet-stream")
+	key := base64.StdEncoding.EncodeToString(utils.Digest(epl.CipherText))
 
-	logRequest(req)
-	resp, err := client.Do(req)
+	body, encoding := encoded, ""
+	if compression == utils.CompressionGzip {
+		if body, err = utils.Gzip(encoded); err != nil {
+			return "", err
+		}
+		encoding = utils.CompressionGzip
+	}
+
+	resp, err := push(ctx, endPoint, key, body, encoding, client)
 	if err != nil {
 		return "", err
 	}
+	if encoding != "" &&
+		(resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusUnsupportedMediaType) {
+		resp.Body.Close()
+		log.WithField("url", url).Debug("Compressed push was rejected, pushing uncompressed")
+		if resp, err = push(ctx, endPoint, key, encoded, "", client); err != nil {
+			return "", err
+		}
+	}
 
 	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
 		return "", fmt.Errorf("non-200 status code received: %v", resp)
 	}
 
-	body, err := ioutil.ReadAll(resp.Body)
+	respBody, err := ioutil.ReadAll(resp.Body)
 	resp.Body.Close()
 
 	if err != nil {
 		return "", err
 	}
 
-	return string(body), nil
+	return string(respBody), nil
+}
+
+func push(
+	ctx context.Context,
+	endPoint, key string, body []byte, encoding string, client utils.HttpClient) (*http.Response, error) {
+
+	req, err := http.NewRequest("POST", endPoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set(PushKeyHeader, key)
+	if requestId := RequestIdFromContext(ctx); requestId != "" {
+		req.Header.Set(RequestIdHeader, requestId)
+	}
+	if encoding != "" {
+		req.Header.Set("Content-Encoding", encoding)
+	}
+
+	logRequest(req)
+	return client.Do(req)
+}
+
+// Resend requests that the remote node at url resends transactions as per the provided
+// ResendRequest. For individual requests the encoded payload is returned.
+func Resend(resendReq ResendRequest, url string, client utils.HttpClient) ([]byte, error) {
+
+	endPoint, err := utils.BuildUrl(url, "/resend")
+	if err != nil {
+		return nil, err
+	}
+
+	encoded, err := json.Marshal(resendReq)
+	if err != nil {
+		return nil, err
+	}
+
+	var req *http.Request
+	req, err = http.NewRequest("POST", endPoint, bytes.NewReader(encoded))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	logRequest(req)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("non-200 status code received: %v", resp)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return body, nil
+}
+
+// ResendGrpc is the gRPC equivalent of Resend.
+func ResendGrpc(resendType string, publicKey, key []byte, path string) ([]byte, error) {
+	var completeUrl url.URL
+	url, err := completeUrl.Parse(path)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := grpc.Dial(url.Host, grpc.WithInsecure())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	cli := chimera.NewClientClient(conn)
+
+	resendResp, err := cli.Resend(context.Background(), &chimera.ResendRequest{
+		Type:      resendType,
+		PublicKey: publicKey,
+		Key:       key,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resendResp.Encoded, nil
 }
 
 func logRequest(r *http.Request) {
@@ -1,9 +1,13 @@
 package api
 
 import (
+	"fmt"
 	"github.com/kevinburke/nacl"
 	"net/http"
+	"net/http/httptest"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestRegisterPublicKeys(t *testing.T) {
@@ -26,3 +30,264 @@ func TestRegisterPublicKeys(t *testing.T) {
 	}
 
 }
+
+func TestUpdatePartyInfoMerge(t *testing.T) {
+	ownKey, knownKey, newKey := nacl.NewKey(), nacl.NewKey(), nacl.NewKey()
+
+	pi := CreatePartyInfo(
+		"http://localhost:9000",
+		[]string{"http://localhost:9001"},
+		[]nacl.Key{knownKey},
+		http.DefaultClient)
+	pi.RegisterPublicKeys([]nacl.Key{ownKey})
+
+	// A third party attempting to redirect existing keys
+	update := PartyInfo{
+		url: "http://localhost:9002",
+		recipients: map[[nacl.KeySize]byte]string{
+			*ownKey:   "http://localhost:9002",
+			*knownKey: "http://localhost:9003",
+			*newKey:   "http://localhost:9003",
+		},
+		parties: map[string]bool{"http://localhost:9003": true},
+	}
+
+	err := pi.UpdatePartyInfo(EncodePartyInfo(update))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[nacl.Key]string{
+		ownKey:   "http://localhost:9000",
+		knownKey: "http://localhost:9001",
+		newKey:   "http://localhost:9003",
+	}
+	for key, expUrl := range expected {
+		if url, _ := pi.GetRecipient(key); url != expUrl {
+			t.Errorf("Url is %s whereas %s is expected", url, expUrl)
+		}
+	}
+
+	for _, party := range []string{"http://localhost:9002", "http://localhost:9003"} {
+		if !pi.parties[party] {
+			t.Errorf("Party %s was not added", party)
+		}
+	}
+
+	// The node now hosting a known key may announce it itself
+	update = PartyInfo{
+		url:        "http://localhost:9003",
+		recipients: map[[nacl.KeySize]byte]string{*knownKey: "http://localhost:9003"},
+		parties:    map[string]bool{},
+	}
+
+	err = pi.UpdatePartyInfo(EncodePartyInfo(update))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if url, _ := pi.GetRecipient(knownKey); url != "http://localhost:9003" {
+		t.Errorf("Url is %s whereas %s is expected", url, "http://localhost:9003")
+	}
+
+	err = pi.UpdatePartyInfo([]byte("invalid"))
+	if err == nil {
+		t.Error("No error returned updating with invalid partyInfo")
+	}
+}
+
+func TestConcurrentPartyInfo(t *testing.T) {
+	pi := InitPartyInfo("http://localhost:9000", []string{"http://localhost:9001"},
+		http.DefaultClient, false)
+	copied := pi
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			url := fmt.Sprintf("http://localhost:%d", 9100+i)
+			for j := 0; j < 50; j++ {
+				key := nacl.NewKey()
+				update := CreatePartyInfo(url, []string{url}, []nacl.Key{key}, http.DefaultClient)
+				if err := pi.UpdatePartyInfo(EncodePartyInfo(update)); err != nil {
+					t.Error(err)
+					return
+				}
+				copied.RegisterPublicKeys([]nacl.Key{nacl.NewKey()})
+				copied.AddParties([]string{url})
+				if got, _ := copied.GetRecipient(key); got != url {
+					t.Errorf("Url is %s whereas %s is expected", got, url)
+				}
+				_, recipients, parties := copied.GetAllValues()
+				for range recipients {
+				}
+				for range parties {
+				}
+				pi.RankPeers()
+				EncodePartyInfo(copied)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	_, recipients, parties := pi.GetAllValues()
+	if len(recipients) != 8*50*2 || len(parties) != 9 {
+		t.Errorf("Unexpected party info with %d recipients and %d parties",
+			len(recipients), len(parties))
+	}
+
+	// The values returned are copies, which may be modified without affecting the PartyInfo
+	parties["http://localhost:9999"] = true
+	if _, _, parties = pi.GetAllValues(); parties["http://localhost:9999"] {
+		t.Error("Modifying the returned parties modified the PartyInfo")
+	}
+}
+
+func TestPollPartyInfoStop(t *testing.T) {
+	pi := InitPartyInfo("http://localhost:9000", nil, http.DefaultClient, false)
+	stop := make(chan struct{})
+	close(stop)
+
+	done := make(chan struct{})
+	go func() {
+		pi.PollPartyInfo(stop, func() {})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("PollPartyInfo did not return once stopped")
+	}
+}
+
+func TestPeerCircuitBreaker(t *testing.T) {
+	pi := InitPartyInfo("http://localhost:9000", []string{"http://localhost:9001"},
+		http.DefaultClient, false)
+	url := "http://localhost:9001"
+	failure := fmt.Errorf("connection refused")
+
+	for i := 0; i < UnhealthyFailures; i++ {
+		if err := pi.AllowRequest(url); err != nil {
+			t.Fatalf("Request %d should be allowed, error: %v", i, err)
+		}
+		pi.RecordRequest(url, time.Millisecond, failure)
+	}
+	if err := pi.AllowRequest(url); err != ErrPeerUnavailable {
+		t.Fatalf("Requests to an unhealthy peer should be skipped, got: %v", err)
+	}
+	health := pi.GetPeerHealth()[0]
+	if health.Healthy || health.NextProbe == nil || health.Requests != UnhealthyFailures {
+		t.Errorf("Unexpected health %+v", health)
+	}
+
+	// Once the peer is due to be probed, a single request is allowed
+	probe := func() {
+		peer := pi.health.peers[url]
+		past := time.Now().Add(-time.Second)
+		peer.health.NextProbe = &past
+		if err := pi.AllowRequest(url); err != nil {
+			t.Fatalf("Probe should be allowed, error: %v", err)
+		}
+		if err := pi.AllowRequest(url); err != ErrPeerUnavailable {
+			t.Fatalf("Only a single probe should be allowed, got: %v", err)
+		}
+	}
+	probe()
+	pi.RecordRequest(url, time.Millisecond, failure)
+	if backoff := pi.health.peers[url].backoff; backoff != 2*minProbeBackoff {
+		t.Errorf("Failed probe should double the backoff, got %v", backoff)
+	}
+
+	probe()
+	pi.RecordRequest(url, time.Millisecond, nil)
+	if err := pi.AllowRequest(url); err != nil {
+		t.Errorf("Requests to a recovered peer should be allowed, error: %v", err)
+	}
+	health = pi.GetPeerHealth()[0]
+	if !health.Healthy || health.NextProbe != nil || health.Failures != 0 ||
+		health.Requests != UnhealthyFailures+2 || health.Failed != UnhealthyFailures+1 {
+		t.Errorf("Unexpected health %+v", health)
+	}
+}
+
+func TestOnUpdate(t *testing.T) {
+	pi := InitPartyInfo("http://localhost:9000", []string{}, http.DefaultClient, false)
+	copied := pi
+	updates := 0
+	copied.OnUpdate(func() { updates++ })
+
+	remote := CreatePartyInfo("http://localhost:9001", []string{"http://localhost:9001"},
+		[]nacl.Key{nacl.NewKey()}, http.DefaultClient)
+	for i := 0; i < 2; i++ {
+		if err := pi.UpdatePartyInfo(EncodePartyInfo(remote)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if updates != 1 {
+		t.Errorf("Expected a single update, as the second merge changed nothing, got %d", updates)
+	}
+}
+
+func TestUpcheckAndPrunePeers(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != upcheckPath {
+			http.NotFound(w, r)
+		}
+	}))
+	defer up.Close()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer down.Close()
+	gone := httptest.NewServer(down.Config.Handler)
+	defer gone.Close()
+
+	pi := InitPartyInfo("http://localhost:9000", []string{down.URL}, http.DefaultClient, false)
+	pi.EnablePruning(time.Hour)
+	upKey, goneKey := nacl.NewKey(), nacl.NewKey()
+	pi.UpdatePartyInfoGrpc(up.URL,
+		map[[nacl.KeySize]byte]string{*upKey: up.URL, *goneKey: gone.URL},
+		map[string]bool{gone.URL: true})
+
+	pi.UpcheckPeers()
+	status := make(map[string]PeerStatus)
+	for _, peer := range pi.GetPeerStatus() {
+		status[peer.Url] = peer
+	}
+	if peer := status[up.URL]; !peer.Up || peer.LastSeen == nil || len(peer.PublicKeys) != 1 {
+		t.Errorf("Expected %s to be up, status: %+v", up.URL, peer)
+	}
+	for _, url := range []string{down.URL, gone.URL} {
+		if peer, ok := status[url]; !ok || peer.Up || peer.LastSeen != nil {
+			t.Errorf("Expected %s to be down, status: %+v", url, peer)
+		}
+	}
+
+	if pruned := pi.PrunePeers(); len(pruned) != 0 {
+		t.Errorf("Nodes should not be pruned until they have been down for an hour, pruned %v", pruned)
+	}
+
+	// Nodes we were configured with are never pruned
+	for _, url := range []string{down.URL, gone.URL} {
+		pi.health.peers[url].added = time.Now().Add(-2 * time.Hour)
+	}
+	if pruned := pi.PrunePeers(); len(pruned) != 1 || pruned[0] != gone.URL {
+		t.Errorf("Expected only %s to be pruned, pruned %v", gone.URL, pruned)
+	}
+	_, recipients, parties := pi.GetAllValues()
+	if parties[gone.URL] || !parties[down.URL] || !parties[up.URL] {
+		t.Errorf("Unexpected parties after pruning %v", parties)
+	}
+	if _, ok := recipients[*goneKey]; ok || recipients[*upKey] != up.URL {
+		t.Errorf("Unexpected recipients after pruning %v", recipients)
+	}
+
+	// Nodes added to our configuration later are never pruned either
+	pi.AddParties([]string{gone.URL, up.URL})
+	pi.health.peers[up.URL].health.Failures = UnhealthyFailures
+	pi.health.peers[up.URL].health.LastSeen = time.Now().Add(-2 * time.Hour)
+	if pruned := pi.PrunePeers(); len(pruned) != 0 {
+		t.Errorf("Nodes added to our configuration should not be pruned, pruned %v", pruned)
+	}
+}
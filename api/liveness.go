@@ -0,0 +1,146 @@
+package api
+
+import (
+	"encoding/base64"
+	"fmt"
+	"github.com/blk-io/crux/utils"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// upcheckPath is the endpoint requested to determine whether a node is up.
+const upcheckPath = "/upcheck"
+
+// EnablePruning removes nodes from the parties we know of, along with the recipients they host,
+// once requests to them have failed for longer than after. Nodes provided to InitPartyInfo or
+// CreatePartyInfo are never removed.
+// This must be called before the PartyInfo is copied, i.e. before it is passed to an enclave.
+func (s *PartyInfo) EnablePruning(after time.Duration) {
+	s.pruneAfter = after
+}
+
+// UpcheckPeers requests the upcheck of all other nodes concurrently, recording whether each is
+// up as it would any other request. Unhealthy nodes are only upchecked once they are due to be
+// probed.
+func (s *PartyInfo) UpcheckPeers() {
+	s.mu.RLock()
+	urls := s.copyParties()
+	s.mu.RUnlock()
+
+	var wg sync.WaitGroup
+	for rawUrl := range urls {
+		if rawUrl == s.url || s.AllowRequest(rawUrl) != nil {
+			continue
+		}
+		wg.Add(1)
+		go func(rawUrl string) {
+			defer wg.Done()
+			start := time.Now()
+			err := s.upcheck(rawUrl)
+			s.RecordRequest(rawUrl, time.Since(start), err)
+			if err != nil {
+				log.WithField("url", rawUrl).Debugf("Upcheck failed, %v", err)
+			}
+		}(rawUrl)
+	}
+	wg.Wait()
+}
+
+func (s *PartyInfo) upcheck(rawUrl string) error {
+	endPoint, err := utils.BuildUrl(rawUrl, upcheckPath)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("GET", endPoint, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("non-200 status code: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// PrunePeers removes the nodes which requests have failed to for longer than the period provided
+// to EnablePruning, along with the recipients they host, returning their URLs. Nothing is removed
+// if pruning is not enabled.
+// Pruned nodes are added again if another node announces them, but are removed again unless they
+// have since recovered.
+func (s *PartyInfo) PrunePeers() []string {
+	if s.pruneAfter <= 0 {
+		return nil
+	}
+
+	var pruned []string
+	s.mu.Lock()
+	for url := range s.parties {
+		if url == s.url || s.static[url] || !s.health.dead(url, s.pruneAfter) {
+			continue
+		}
+		delete(s.parties, url)
+		for publicKey, recipientUrl := range s.recipients {
+			if recipientUrl == url {
+				delete(s.recipients, publicKey)
+			}
+		}
+		pruned = append(pruned, url)
+	}
+	s.mu.Unlock()
+
+	if len(pruned) > 0 {
+		sort.Strings(pruned)
+		log.Infof("Pruned nodes which have not responded for %v: %v", s.pruneAfter, pruned)
+		s.listener.notify()
+	}
+	return pruned
+}
+
+// GetPeerStatus returns the liveness of all other nodes we know of, ordered by URL. Nodes we have
+// not made requests to yet are reported as down.
+func (s *PartyInfo) GetPeerStatus() []PeerStatus {
+	keys := make(map[string][]string)
+	var urls []string
+	s.mu.RLock()
+	for publicKey, url := range s.recipients {
+		keys[url] = append(keys[url], base64.StdEncoding.EncodeToString(publicKey[:]))
+	}
+	for url := range s.parties {
+		if url != s.url {
+			urls = append(urls, url)
+		}
+	}
+	s.mu.RUnlock()
+	sort.Strings(urls)
+
+	peers := make([]PeerStatus, 0, len(urls))
+	for _, url := range urls {
+		status := PeerStatus{Url: url, PublicKeys: keys[url]}
+		if status.PublicKeys == nil {
+			status.PublicKeys = []string{}
+		}
+		sort.Strings(status.PublicKeys)
+
+		if health, seen := s.health.get(url); seen {
+			status.Up = health.Failures == 0
+			status.Latency = health.Latency
+			if !health.LastSeen.IsZero() {
+				lastSeen := health.LastSeen
+				status.LastSeen = &lastSeen
+			}
+		}
+		peers = append(peers, status)
+	}
+	return peers
+}
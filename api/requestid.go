@@ -0,0 +1,24 @@
+package api
+
+import (
+	"golang.org/x/net/context"
+)
+
+// RequestIdHeader is the header used to correlate requests across clients and nodes.
+const RequestIdHeader = "X-Request-ID"
+
+type contextKey int
+
+const requestIdKey contextKey = iota
+
+// WithRequestId returns a copy of ctx carrying the request ID id, which is sent to other nodes
+// in the RequestIdHeader of requests made with it.
+func WithRequestId(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIdKey, id)
+}
+
+// RequestIdFromContext returns the request ID stored in ctx, or an empty string if there is none.
+func RequestIdFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIdKey).(string)
+	return id
+}
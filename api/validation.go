@@ -0,0 +1,88 @@
+package api
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"github.com/blk-io/crux/utils"
+	"github.com/kevinburke/nacl"
+	"github.com/kevinburke/nacl/box"
+	"io/ioutil"
+	"net/http"
+)
+
+// ValidatePath is the endpoint nodes use to answer a PartyInfoChallenge.
+const ValidatePath = "/partyinfo/validate"
+
+const challengeSize = 32
+
+// ChallengeTag prefixes the contents of every PartyInfoChallenge box.
+const ChallengeTag = "crux-partyinfo-validate"
+
+// EnableValidation requires that recipients announced by other nodes are validated before they
+// are accepted. The node at the announced URL is challenged to prove it holds the private key
+// for the recipient's public key, which prevents other nodes from redirecting payloads intended
+// for a recipient to themselves.
+// This must be called before the PartyInfo is copied, i.e. before it is passed to an enclave.
+func (s *PartyInfo) EnableValidation() {
+	s.validate = true
+}
+
+// validateRecipient challenges the node at rawUrl to prove that it holds the private key for
+// publicKey.
+func (s *PartyInfo) validateRecipient(rawUrl string, publicKey [nacl.KeySize]byte) error {
+	ephemeralPubKey, ephemeralPrivKey, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	challenge := make([]byte, challengeSize)
+	_, err = rand.Read(challenge)
+	if err != nil {
+		return err
+	}
+
+	recipientKey := publicKey
+	encoded, err := json.Marshal(PartyInfoChallenge{
+		PublicKey:    recipientKey[:],
+		EphemeralKey: (*ephemeralPubKey)[:],
+		Box:          box.EasySeal(append([]byte(ChallengeTag), challenge...), &recipientKey, ephemeralPrivKey),
+	})
+	if err != nil {
+		return err
+	}
+
+	endPoint, err := utils.BuildUrl(rawUrl, ValidatePath)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", endPoint, bytes.NewReader(encoded))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	logRequest(req)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("non-200 status code received: %d", resp.StatusCode)
+	}
+
+	if subtle.ConstantTimeCompare(body, challenge) != 1 {
+		return fmt.Errorf("%s failed to prove ownership of recipient key", rawUrl)
+	}
+	return nil
+}
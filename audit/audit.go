@@ -0,0 +1,126 @@
+// Package audit maintains an append-only log of the privacy-relevant operations performed by a
+// crux node, for compliance reviews.
+//
+// Each operation is recorded as a line of JSON, with the digest of the payload involved and the
+// public key it was requested for, but never the payload's contents.
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/blk-io/crux/api"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Log is an audit log stored in a file which is only ever appended to, safe for concurrent use.
+type Log struct {
+	path string
+	mu   sync.Mutex
+	file *os.File
+}
+
+// Filter selects the entries returned by Query, zero values match every entry.
+type Filter struct {
+	Operation string
+	PublicKey string
+	Key       string
+	Since     time.Time // Entries recorded at or after this time
+	Until     time.Time // Entries recorded before this time
+	Limit     int       // Maximum number of entries, the most recent are returned
+}
+
+// Open opens the audit log at path for appending, creating it if required. An entry left
+// incomplete by the node stopping while it was written is terminated, so it is not corrupted
+// further by subsequent entries.
+func Open(path string) (*Log, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	if info, err := file.Stat(); err == nil && info.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err = file.ReadAt(last, info.Size()-1); err == nil && last[0] != '\n' {
+			_, err = file.Write([]byte{'\n'})
+		}
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	return &Log{path: path, file: file}, nil
+}
+
+// Record appends entry to the log, syncing it to disk before returning. If the entry does not
+// specify a time, the current time is used.
+func (l *Log) Record(entry api.AuditEntry) error {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now().UTC()
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err = l.file.Write(line); err != nil {
+		return err
+	}
+	return l.file.Sync()
+}
+
+// Query returns the entries in the log matching filter, oldest first. Incomplete entries are
+// skipped.
+func (l *Log) Query(filter Filter) ([]api.AuditEntry, error) {
+	file, err := os.Open(l.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	entries := []api.AuditEntry{}
+	reader := bufio.NewReader(file)
+	for n := 1; ; n++ {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// A final line without a newline is still being written
+			return entries, nil
+		} else if err != nil {
+			return entries, err
+		}
+
+		var entry api.AuditEntry
+		if err = json.Unmarshal(line, &entry); err != nil {
+			log.Warnf("Skipping invalid entry on line %d of audit log %s, %v", n, l.path, err)
+			continue
+		}
+		if !filter.matches(entry) {
+			continue
+		}
+		entries = append(entries, entry)
+		if filter.Limit > 0 && len(entries) > filter.Limit {
+			entries = entries[1:]
+		}
+	}
+}
+
+func (f Filter) matches(entry api.AuditEntry) bool {
+	return (f.Operation == "" || entry.Operation == f.Operation) &&
+		(f.PublicKey == "" || entry.PublicKey == f.PublicKey) &&
+		(f.Key == "" || entry.Key == f.Key) &&
+		(f.Since.IsZero() || !entry.Time.Before(f.Since)) &&
+		(f.Until.IsZero() || entry.Time.Before(f.Until))
+}
+
+// Close closes the log.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
@@ -0,0 +1,111 @@
+package audit
+
+import (
+	"github.com/blk-io/crux/api"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const (
+	key1 = "BULeR8JyUWhiuuCMU/HLA0Q5pzkYT+cHII3ZKBey3Bo="
+	key2 = "QfeDAys9MPDs2XHExtc84jKGHxZg/aj52DTh0vtA3Xc="
+)
+
+func TestQuery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, err := Open(path.Join(dir, "crux.audit"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2018, 7, 1, 0, 0, 0, 0, time.UTC)
+	entries := []api.AuditEntry{
+		{Time: start, Operation: api.AuditSend, PublicKey: key1, Key: "digest1"},
+		{Time: start.Add(time.Hour), Operation: api.AuditPush, PublicKey: key2, Key: "digest2"},
+		{Time: start.Add(2 * time.Hour), Operation: api.AuditReceive, PublicKey: key1, Key: "digest2"},
+		{Time: start.Add(3 * time.Hour), Operation: api.AuditDelete, Key: "digest1"},
+	}
+	for _, entry := range entries {
+		if err = l.Record(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l.Close()
+
+	// Reopening appends to the existing log
+	l, err = Open(l.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if err = l.Record(api.AuditEntry{Operation: api.AuditResend, PublicKey: key2}); err != nil {
+		t.Fatal(err)
+	}
+
+	all, err := l.Query(Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 5 || !reflect.DeepEqual(all[:4], entries) {
+		t.Errorf("Unexpected entries %v", all)
+	}
+	if all[4].Time.IsZero() {
+		t.Error("Entries should be recorded with the current time by default")
+	}
+
+	tests := []struct {
+		filter   Filter
+		expected []api.AuditEntry
+	}{
+		{Filter{PublicKey: key1}, []api.AuditEntry{entries[0], entries[2]}},
+		{Filter{Key: "digest1"}, []api.AuditEntry{entries[0], entries[3]}},
+		{Filter{Operation: api.AuditPush}, []api.AuditEntry{entries[1]}},
+		{Filter{Since: start.Add(time.Hour), Until: start.Add(3 * time.Hour)}, entries[1:3]},
+		{Filter{Until: start.Add(3 * time.Hour), Limit: 2}, entries[1:3]},
+		{Filter{PublicKey: key1, Operation: api.AuditDelete}, []api.AuditEntry{}},
+	}
+	for _, test := range tests {
+		result, err := l.Query(test.filter)
+		if err != nil || !reflect.DeepEqual(result, test.expected) {
+			t.Errorf("Query %+v returned %v, expected %v, error: %v", test.filter, result, test.expected, err)
+		}
+	}
+}
+
+func TestQueryIncompleteEntry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := path.Join(dir, "crux.audit")
+	data := `{"time":"2018-07-01T00:00:00Z","operation":"send","key":"digest1"}` + "\n" +
+		`{"time":"2018-07-01T01:00:00Z","operation":"se`
+	if err = ioutil.WriteFile(file, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if err = l.Record(api.AuditEntry{Operation: api.AuditReceive, Key: "digest2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The incomplete entry is skipped, without corrupting the entry recorded after it
+	entries, err := l.Query(Filter{})
+	if err != nil || len(entries) != 2 || entries[0].Key != "digest1" || entries[1].Key != "digest2" {
+		t.Errorf("Expected the complete entries only, got %v, error: %v", entries, err)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"github.com/blk-io/crux/config"
+	"github.com/blk-io/crux/enclave"
+	log "github.com/sirupsen/logrus"
+	"os"
+)
+
+// Commands to export the node's storage, and import an export of it, which must be run while the
+// node is stopped, e.g. crux --workdir ... export --out backup.tar
+const (
+	exportCommand = "export"
+	importCommand = "import"
+)
+
+// backup runs the export or import command against the enclave's storage.
+func backup(command string, enc *enclave.SecureEnclave) error {
+	if command == exportCommand {
+		return export(enc, config.GetString(config.ExportOut))
+	}
+
+	in := os.Stdin
+	if file := config.GetString(config.ImportIn); file != "" {
+		var err error
+		if in, err = os.Open(file); err != nil {
+			return err
+		}
+		defer in.Close()
+	}
+
+	entries, err := enc.Import(in)
+	if err != nil {
+		log.Errorf("Import failed after importing %v", entries)
+		return err
+	}
+	log.Printf("Imported %v", entries)
+	return nil
+}
+
+// export writes an export of the enclave's storage to file, or standard output if it is empty.
+// The file is removed if the export fails.
+func export(enc *enclave.SecureEnclave, file string) error {
+	if file == "" {
+		entries, err := enc.Export(os.Stdout)
+		if err == nil {
+			log.Printf("Exported %v", entries)
+		}
+		return err
+	}
+
+	out, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	entries, err := enc.Export(out)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file)
+		return err
+	}
+	log.Printf("Exported %v to %s", entries, file)
+	return nil
+}
@@ -0,0 +1,312 @@
+// Package client provides an HTTP client for communicating with crux nodes.
+//
+// A Client pools connections to each node, applies timeouts and retries requests which fail due
+// to network errors or a temporarily unavailable node. It is used by crux for propagating
+// payloads, polling party info and requesting resends, and can be used by other Go programs via
+// Node to talk to crux nodes programmatically.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"github.com/blk-io/crux/api"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/http2"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config contains the settings for a Client.
+type Config struct {
+	Timeout             time.Duration // Timeout for each attempt of a request, including reading the body
+	DialTimeout         time.Duration // Timeout for establishing a connection
+	MaxIdleConnsPerHost int           // Idle connections kept open to each node
+	IdleConnTimeout     time.Duration // Time after which idle connections are closed
+	Retries             int           // Number of times a failed request is retried
+	RetryBackoff        time.Duration // Delay before the first retry, doubled for each subsequent one
+	MaxRetryAfter       time.Duration // Longest Retry-After delay to wait for, requests aren't retried beyond it
+	TLSConfig           *tls.Config   // TLS settings for connecting to nodes over https, if required
+	// PinnedRoots are the only certificates trusted when connecting to specific nodes over https,
+	// in place of TLSConfig's RootCAs, keyed by their host and port, such as "node1:9001".
+	PinnedRoots map[string]*x509.CertPool
+	// Http2 multiplexes concurrent requests to each node over a single connection, for nodes
+	// connected to over https which support HTTP/2. Plain http connections always use HTTP/1.1.
+	Http2 bool
+	// Proxy is the http, https or socks5 proxy all requests are made via, see ParseProxy. If nil,
+	// the proxy configured by the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables is used.
+	Proxy *url.URL
+	// Dial establishes connections to nodes, or to the proxy if there is one, in place of a
+	// net.Dialer, in which case DialTimeout is not applied.
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// DefaultConfig returns the Config used by crux for inter-node communication.
+func DefaultConfig() Config {
+	return Config{
+		Timeout:             10 * time.Second,
+		DialTimeout:         5 * time.Second,
+		MaxIdleConnsPerHost: 16,
+		IdleConnTimeout:     90 * time.Second,
+		Retries:             2,
+		RetryBackoff:        250 * time.Millisecond,
+		MaxRetryAfter:       10 * time.Second,
+		Http2:               true,
+	}
+}
+
+// LowMemoryConfig returns a Config for constrained devices, which keeps fewer idle connections
+// open to other nodes.
+func LowMemoryConfig() Config {
+	conf := DefaultConfig()
+	conf.MaxIdleConnsPerHost = 2
+	conf.IdleConnTimeout = 30 * time.Second
+	return conf
+}
+
+// Client is an HTTP client for crux nodes, safe for concurrent use.
+type Client struct {
+	http          *http.Client
+	pinned        map[string]*http.Client // Clients for hosts with PinnedRoots
+	retries       int
+	retryBackoff  time.Duration
+	maxRetryAfter time.Duration
+}
+
+// New creates a new Client with the provided configuration.
+func New(conf Config) *Client {
+	dial := conf.Dial
+	if dial == nil {
+		dialer := &net.Dialer{
+			Timeout:   conf.DialTimeout,
+			KeepAlive: 30 * time.Second,
+		}
+		dial = dialer.DialContext
+	}
+	proxy := http.ProxyFromEnvironment
+	if conf.Proxy != nil {
+		proxy = http.ProxyURL(conf.Proxy)
+	}
+	return newClient(conf, dial, proxy)
+}
+
+// ParseProxy parses the URL of a proxy to connect to nodes via. http and https proxies are sent a
+// CONNECT request for nodes connected to over https, and socks5 proxies resolve the addresses of
+// nodes themselves. Credentials may be provided in the URL's user info.
+func ParseProxy(rawUrl string) (*url.URL, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy url %q: %v", rawUrl, err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("invalid proxy url %q: an http, https or socks5 url is required", rawUrl)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid proxy url %q: a host is required", rawUrl)
+	}
+	return u, nil
+}
+
+func newClient(conf Config,
+	dial func(ctx context.Context, network, addr string) (net.Conn, error),
+	proxy func(*http.Request) (*url.URL, error)) *Client {
+
+	pinned := make(map[string]*http.Client, len(conf.PinnedRoots))
+	for host, roots := range conf.PinnedRoots {
+		tlsConfig := conf.TLSConfig.Clone()
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		}
+		tlsConfig.RootCAs = roots
+		pinned[host] = newHttpClient(conf, tlsConfig, dial, proxy)
+	}
+
+	return &Client{
+		http:          newHttpClient(conf, conf.TLSConfig.Clone(), dial, proxy),
+		pinned:        pinned,
+		retries:       conf.Retries,
+		retryBackoff:  conf.RetryBackoff,
+		maxRetryAfter: conf.MaxRetryAfter,
+	}
+}
+
+func newHttpClient(conf Config, tlsConfig *tls.Config,
+	dial func(ctx context.Context, network, addr string) (net.Conn, error),
+	proxy func(*http.Request) (*url.URL, error)) *http.Client {
+
+	transport := &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           dial,
+		MaxIdleConns:          conf.MaxIdleConnsPerHost * 8,
+		MaxIdleConnsPerHost:   conf.MaxIdleConnsPerHost,
+		IdleConnTimeout:       conf.IdleConnTimeout,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   conf.DialTimeout,
+		ExpectContinueTimeout: time.Second,
+	}
+	// HTTP/2 is not enabled by default for transports with a custom dialer or TLS configuration
+	if conf.Http2 {
+		if err := http2.ConfigureTransport(transport); err != nil {
+			log.Warnf("Unable to enable HTTP/2, error: %v", err)
+		}
+	}
+	return &http.Client{Transport: transport, Timeout: conf.Timeout}
+}
+
+// Do sends req, retrying it if the request fails due to a network error or the node responds
+// with a status code indicating it is temporarily unavailable. A Retry-After header in the
+// response is honoured, up to the configured maximum. Requests with a body are only retried if
+// the body can be replayed, which is the case for those created by http.NewRequest with a
+// bytes.Buffer, bytes.Reader or strings.Reader.
+//
+// All crux inter-node requests are idempotent, so may be safely retried. Sends to the private API
+// are made idempotent with an Idempotency-Key header.
+func (c *Client) Do(req *http.Request) (*http.Response, error) {
+	httpClient, ok := c.pinned[req.URL.Host]
+	if !ok {
+		httpClient = c.http
+	}
+	for attempt := 0; ; attempt++ {
+		resp, err := httpClient.Do(req)
+		if attempt >= c.retries || !retryable(resp, err) {
+			return resp, err
+		}
+
+		delay := c.retryBackoff << uint(attempt)
+		if wait, ok := retryAfter(resp); ok {
+			if wait > c.maxRetryAfter {
+				return resp, err
+			}
+			if wait > delay {
+				delay = wait
+			}
+		}
+
+		if !rewind(req) {
+			return resp, err
+		}
+
+		if resp != nil {
+			resp.Body.Close()
+		}
+		log.WithFields(log.Fields{
+			"url": req.URL.String(), "attempt": attempt + 1}).Debugf(
+			"Retrying request, %v", describe(resp, err))
+
+		select {
+		case <-time.After(delay):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+// Post sends body to endPoint, returning the response body if the request succeeded.
+func (c *Client) Post(endPoint, contentType string, body []byte) ([]byte, error) {
+	req, err := http.NewRequest("POST", endPoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	return readResponse(c.Do(req))
+}
+
+func readResponse(resp *http.Response, err error) ([]byte, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		var errResp api.ErrorResponse
+		if json.Unmarshal(body, &errResp) == nil && errResp.Code != "" {
+			return nil, &Error{StatusCode: resp.StatusCode, ErrorResponse: errResp}
+		}
+		return nil, fmt.Errorf("non-200 status code received: %d, %s",
+			resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
+
+// Error is returned for requests which a node rejected with an error response, so that callers
+// can inspect its Code, and the Field it relates to.
+type Error struct {
+	StatusCode int
+	api.ErrorResponse
+}
+
+func (e *Error) Error() string {
+	if e.Field != "" {
+		return fmt.Sprintf("non-200 status code received: %d, %s (%s): %s",
+			e.StatusCode, e.Code, e.Field, e.Message)
+	}
+	return fmt.Sprintf("non-200 status code received: %d, %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+func retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// retryAfter returns the delay requested by the Retry-After header of resp, if present. The
+// header may contain either a number of seconds or a date.
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	if resp == nil {
+		return 0, false
+	}
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return time.Until(date), true
+	}
+	return 0, false
+}
+
+// rewind resets the body of req so it can be sent again, returning false if this isn't possible.
+func rewind(req *http.Request) bool {
+	if req.Body == nil || req.Body == http.NoBody {
+		return true
+	}
+	if req.GetBody == nil {
+		return false
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return false
+	}
+	req.Body = body
+	return true
+}
+
+func describe(resp *http.Response, err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return fmt.Sprintf("status code %d", resp.StatusCode)
+}
@@ -0,0 +1,127 @@
+package client
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/blk-io/crux/api"
+	"github.com/kevinburke/nacl"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+)
+
+// tlsServer starts a server for handler over TLS, which supports HTTP/2, returning a client
+// for it which uses HTTP/2 if http2 is set.
+func tlsServer(handler http.Handler, http2 bool) (*httptest.Server, *Client) {
+	server := httptest.NewUnstartedServer(handler)
+	server.TLS = &tls.Config{NextProtos: []string{"h2", "http/1.1"}}
+	server.StartTLS()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(server.Certificate())
+	conf := DefaultConfig()
+	conf.TLSConfig = &tls.Config{RootCAs: pool}
+	conf.Http2 = http2
+	return server, New(conf)
+}
+
+func TestHttp2(t *testing.T) {
+	for _, http2 := range []bool{true, false} {
+		var proto int
+		server, client := tlsServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			proto = r.ProtoMajor
+		}), http2)
+
+		if _, err := client.Post(server.URL, "text/plain", []byte("payload")); err != nil {
+			t.Fatal(err)
+		}
+		expected := 1
+		if http2 {
+			expected = 2
+		}
+		if proto != expected {
+			t.Errorf("Request was made over HTTP/%d with Http2 %v", proto, http2)
+		}
+		server.Close()
+	}
+}
+
+func TestPinnedRoots(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	pinned := httptest.NewTLSServer(handler)
+	defer pinned.Close()
+	other := httptest.NewTLSServer(handler)
+	defer other.Close()
+
+	u, err := url.Parse(pinned.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(pinned.Certificate())
+	conf := DefaultConfig()
+	conf.PinnedRoots = map[string]*x509.CertPool{u.Host: pool}
+	client := New(conf)
+
+	if _, err = client.Post(pinned.URL, "text/plain", []byte("payload")); err != nil {
+		t.Errorf("Pinned certificate should be trusted for its host, error: %v", err)
+	}
+	if _, err = client.Post(other.URL, "text/plain", []byte("payload")); err == nil {
+		t.Error("Pinned certificate should not be trusted for other hosts")
+	}
+}
+
+const (
+	benchmarkPushes     = 1000
+	benchmarkGoroutines = 50
+)
+
+func benchmarkPush(b *testing.B, http2 bool) {
+	server, client := tlsServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}), http2)
+	defer server.Close()
+
+	encoded := api.EncodePayloadWithRecipients(api.EncryptedPayload{
+		Sender:         nacl.NewKey(),
+		CipherText:     []byte("payload"),
+		Nonce:          nacl.NewNonce(),
+		RecipientBoxes: [][]byte{[]byte("box")},
+		RecipientNonce: nacl.NewNonce(),
+	}, [][]byte{})
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pushes := make(chan struct{}, benchmarkPushes)
+		for j := 0; j < benchmarkPushes; j++ {
+			pushes <- struct{}{}
+		}
+		close(pushes)
+
+		var wg sync.WaitGroup
+		for j := 0; j < benchmarkGoroutines; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for range pushes {
+					if _, err := api.Push(encoded, server.URL, client); err != nil {
+						b.Error(err)
+					}
+				}
+			}()
+		}
+		wg.Wait()
+	}
+}
+
+// BenchmarkPushHttp1 pushes 1000 small payloads concurrently to a node over HTTP/1.1.
+func BenchmarkPushHttp1(b *testing.B) {
+	benchmarkPush(b, false)
+}
+
+// BenchmarkPushHttp2 pushes 1000 small payloads concurrently to a node over HTTP/2.
+func BenchmarkPushHttp2(b *testing.B) {
+	benchmarkPush(b, true)
+}
@@ -0,0 +1,187 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/blk-io/crux/api"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// ipcBaseUrl is the base URL of requests sent over the IPC socket, the host is ignored.
+const ipcBaseUrl = "http://crux"
+
+const (
+	hFrom           = "c11n-from"
+	hTo             = "c11n-to"
+	hIdempotencyKey = "Idempotency-Key"
+	hAuthorization  = "Authorization"
+)
+
+// IpcClient provides access to the private API of a crux node over its IPC socket. Keys and
+// payloads are passed as raw bytes, with the base64 encoding used by the API handled internally.
+// Each send is given a unique idempotency key, so that failed requests can be retried without
+// the node creating duplicate transactions.
+type IpcClient struct {
+	client *Client
+	token  string
+}
+
+// NewIpcClient creates a new IpcClient for the crux node serving its private API at socketPath.
+func NewIpcClient(socketPath string) *IpcClient {
+	return NewIpcClientWithToken(socketPath, "")
+}
+
+// NewIpcClientWithToken creates a new IpcClient which presents token as a bearer token, for nodes
+// started with an IPC token.
+func NewIpcClientWithToken(socketPath, token string) *IpcClient {
+	conf := DefaultConfig()
+	dialer := &net.Dialer{Timeout: conf.DialTimeout}
+	dial := func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return dialer.DialContext(ctx, "unix", socketPath)
+	}
+	return &IpcClient{client: newClient(conf, dial, nil), token: token}
+}
+
+// Send encrypts payload from the sender public key for the recipient public keys, returning the
+// key the transaction can be retrieved with. If from is nil, the node's default key is used.
+func (c *IpcClient) Send(payload, from []byte, to [][]byte) ([]byte, error) {
+	sendReq := api.SendRequest{
+		Payload: encode(payload),
+		From:    encode(from),
+		To:      encodeAll(to),
+	}
+
+	var sendResp api.SendResponse
+	err := c.postJson("/send", sendReq, &sendResp, true)
+	if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(sendResp.Key)
+}
+
+// SendAsync is equivalent to Send, but returns as soon as the node has accepted the payload, with
+// an id which SendStatus reports the progress of the send for. Asynchronous sends are not given an
+// idempotency key, so failed requests should not be retried blindly.
+func (c *IpcClient) SendAsync(payload, from []byte, to [][]byte) (string, error) {
+	sendReq := api.SendRequest{
+		Payload: encode(payload),
+		From:    encode(from),
+		To:      encodeAll(to),
+	}
+
+	var sendResp api.SendAsyncResponse
+	err := c.postJson("/sendasync", sendReq, &sendResp, false)
+	return sendResp.Id, err
+}
+
+// SendStatus returns the status of the asynchronous send with the given id.
+func (c *IpcClient) SendStatus(id string) (api.SendStatus, error) {
+	var status api.SendStatus
+	req, err := http.NewRequest("GET", ipcBaseUrl+"/sendstatus/"+url.PathEscape(id), nil)
+	if err != nil {
+		return status, err
+	}
+
+	body, err := readResponse(c.do(req))
+	if err != nil {
+		return status, err
+	}
+	err = json.Unmarshal(body, &status)
+	return status, err
+}
+
+// SendRaw is equivalent to Send, using the raw endpoint where the payload is sent as is, and the
+// sender and recipients in headers.
+func (c *IpcClient) SendRaw(payload, from []byte, to [][]byte) ([]byte, error) {
+	req, err := http.NewRequest("POST", ipcBaseUrl+"/sendraw", bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set(hIdempotencyKey, newIdempotencyKey())
+	if from != nil {
+		req.Header.Set(hFrom, encode(from))
+	}
+	for _, recipient := range to {
+		req.Header.Add(hTo, encode(recipient))
+	}
+
+	body, err := readResponse(c.do(req))
+	if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(string(body))
+}
+
+// Receive decrypts the payload of the transaction with the given key for the recipient public
+// key to. If to is nil, the node's default key is used.
+func (c *IpcClient) Receive(key, to []byte) ([]byte, error) {
+	receiveReq := api.ReceiveRequest{Key: encode(key), To: encode(to)}
+
+	var receiveResp api.ReceiveResponse
+	err := c.postJson("/receive", receiveReq, &receiveResp, false)
+	if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(receiveResp.Payload)
+}
+
+// Delete deletes the transaction with the given key from the node.
+func (c *IpcClient) Delete(key []byte) error {
+	return c.postJson("/delete", api.DeleteRequest{Key: encode(key)}, nil, false)
+}
+
+// postJson sends body encoded as JSON to path, decoding the response into result if provided.
+func (c *IpcClient) postJson(path string, body, result interface{}, idempotent bool) error {
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", ipcBaseUrl+path, bytes.NewReader(encoded))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if idempotent {
+		req.Header.Set(hIdempotencyKey, newIdempotencyKey())
+	}
+
+	resp, err := readResponse(c.do(req))
+	if err != nil || result == nil {
+		return err
+	}
+	return json.Unmarshal(resp, result)
+}
+
+// do sends req, with the client's token if it has one.
+func (c *IpcClient) do(req *http.Request) (*http.Response, error) {
+	if c.token != "" {
+		req.Header.Set(hAuthorization, "Bearer "+c.token)
+	}
+	return c.client.Do(req)
+}
+
+func newIdempotencyKey() string {
+	key := make([]byte, 16)
+	rand.Read(key)
+	return hex.EncodeToString(key)
+}
+
+func encode(value []byte) string {
+	return base64.StdEncoding.EncodeToString(value)
+}
+
+func encodeAll(values [][]byte) []string {
+	encoded := make([]string, len(values))
+	for i, value := range values {
+		encoded[i] = encode(value)
+	}
+	return encoded
+}
@@ -0,0 +1,156 @@
+package client
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/blk-io/crux/api"
+	"github.com/blk-io/crux/utils"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var (
+	testPayload = []byte("payload")
+	testFrom    = []byte("from")
+	testTo      = []byte("to")
+	testKey     = []byte("key")
+)
+
+// ipcTestHandler emulates the private API, checking the encoding of requests.
+func ipcTestHandler(t *testing.T) http.Handler {
+	b64 := base64.StdEncoding.EncodeToString
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/send", func(w http.ResponseWriter, r *http.Request) {
+		var sendReq api.SendRequest
+		json.NewDecoder(r.Body).Decode(&sendReq)
+		if r.Header.Get(hIdempotencyKey) == "" {
+			t.Error("Send should include an idempotency key")
+		}
+		if sendReq.Payload != b64(testPayload) || sendReq.From != b64(testFrom) ||
+			len(sendReq.To) != 1 || sendReq.To[0] != b64(testTo) {
+			t.Errorf("Unexpected send request: %v", sendReq)
+		}
+		json.NewEncoder(w).Encode(api.SendResponse{Key: b64(testKey)})
+	})
+
+	mux.HandleFunc("/sendraw", func(w http.ResponseWriter, r *http.Request) {
+		payload, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get(hIdempotencyKey) == "" {
+			t.Error("SendRaw should include an idempotency key")
+		}
+		if !bytes.Equal(payload, testPayload) || r.Header.Get(hFrom) != b64(testFrom) ||
+			r.Header.Get(hTo) != b64(testTo) {
+			t.Errorf("Unexpected sendraw request: %s, %v", payload, r.Header)
+		}
+		w.Write([]byte(b64(testKey)))
+	})
+
+	mux.HandleFunc("/receive", func(w http.ResponseWriter, r *http.Request) {
+		var receiveReq api.ReceiveRequest
+		json.NewDecoder(r.Body).Decode(&receiveReq)
+		if receiveReq.Key != b64(testKey) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(api.ReceiveResponse{Payload: b64(testPayload)})
+	})
+
+	mux.HandleFunc("/delete", func(w http.ResponseWriter, r *http.Request) {
+		var deleteReq api.DeleteRequest
+		json.NewDecoder(r.Body).Decode(&deleteReq)
+		if deleteReq.Key != b64(testKey) {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	})
+
+	return mux
+}
+
+func TestIpcClient(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestIpcClient")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ipcPath := filepath.Join(dir, "crux.ipc")
+	listener, err := utils.CreateIpcSocket(ipcPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go http.Serve(listener, ipcTestHandler(t))
+
+	c := NewIpcClient(ipcPath)
+
+	key, err := c.Send(testPayload, testFrom, [][]byte{testTo})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(key, testKey) {
+		t.Errorf("Send returned key %s, expected %s", key, testKey)
+	}
+
+	key, err = c.SendRaw(testPayload, testFrom, [][]byte{testTo})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(key, testKey) {
+		t.Errorf("SendRaw returned key %s, expected %s", key, testKey)
+	}
+
+	payload, err := c.Receive(testKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(payload, testPayload) {
+		t.Errorf("Receive returned payload %s, expected %s", payload, testPayload)
+	}
+
+	if _, err = c.Receive([]byte("unknown"), nil); err == nil {
+		t.Error("Receive of an unknown key should fail")
+	}
+
+	if err = c.Delete(testKey); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestIpcClientToken(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestIpcClientToken")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ipcPath := filepath.Join(dir, "crux.ipc")
+	listener, err := utils.CreateIpcSocket(ipcPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(hAuthorization) != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		ipcTestHandler(t).ServeHTTP(w, r)
+	}))
+
+	if _, err = NewIpcClient(ipcPath).Send(testPayload, testFrom, [][]byte{testTo}); err == nil {
+		t.Error("Send without the token should fail")
+	}
+
+	c := NewIpcClientWithToken(ipcPath, "secret")
+	if _, err = c.Send(testPayload, testFrom, [][]byte{testTo}); err != nil {
+		t.Error(err)
+	}
+	if _, err = c.SendRaw(testPayload, testFrom, [][]byte{testTo}); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,70 @@
+package client
+
+import (
+	"github.com/blk-io/crux/api"
+	"github.com/blk-io/crux/utils"
+	"net/http"
+	"strings"
+)
+
+// Node provides access to the public API of a remote crux node.
+type Node struct {
+	Url    string
+	client *Client
+}
+
+// NewNode creates a new Node for the crux node at url, using client for requests.
+func NewNode(url string, client *Client) *Node {
+	return &Node{Url: url, client: client}
+}
+
+// Upcheck returns nil if the node is up.
+func (n *Node) Upcheck() error {
+	_, err := n.get("/upcheck")
+	return err
+}
+
+// Version returns the API version of the node.
+func (n *Node) Version() (string, error) {
+	body, err := n.get("/version")
+	return strings.TrimSpace(string(body)), err
+}
+
+// PartyInfo exchanges party information with the node, sending encoded and returning the node's
+// view of the network.
+func (n *Node) PartyInfo(encoded []byte) (api.PartyInfo, error) {
+	endPoint, err := utils.BuildUrl(n.Url, "/partyinfo")
+	if err != nil {
+		return api.PartyInfo{}, err
+	}
+
+	resp, err := n.client.Post(endPoint, "application/octet-stream", encoded)
+	if err != nil {
+		return api.PartyInfo{}, err
+	}
+	return api.DecodePartyInfo(resp)
+}
+
+// Push propagates the encoded payload to the node, returning the key it is stored under.
+func (n *Node) Push(encoded []byte) (string, error) {
+	return api.Push(encoded, n.Url, n.client)
+}
+
+// Resend requests that the node resends transactions as per resendReq. For individual requests
+// the encoded payload is returned.
+func (n *Node) Resend(resendReq api.ResendRequest) ([]byte, error) {
+	return api.Resend(resendReq, n.Url, n.client)
+}
+
+func (n *Node) get(path string) ([]byte, error) {
+	endPoint, err := utils.BuildUrl(n.Url, path)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("GET", endPoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	return readResponse(n.client.Do(req))
+}
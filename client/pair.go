@@ -0,0 +1,102 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/blk-io/crux/api"
+	"github.com/blk-io/crux/peers"
+	"github.com/blk-io/crux/utils"
+	"net/http"
+)
+
+// Pair pairs the node described by self with this Node. The Node's details are retrieved and
+// passed to verify, which must accept them, typically by checking their fingerprint, before self
+// is sent to the Node, authenticated by token.
+// If the Node is contacted over https, its details must include the certificate it presented, so
+// a Client which does not verify certificates can be used to pair with nodes using self-signed
+// certificates.
+func (n *Node) Pair(self api.PairInfo, token string, verify func(api.PairInfo) error) (api.PairInfo, error) {
+	endPoint, err := utils.BuildUrl(n.Url, "/pair")
+	if err != nil {
+		return api.PairInfo{}, err
+	}
+
+	req, err := http.NewRequest("GET", endPoint, nil)
+	if err != nil {
+		return api.PairInfo{}, err
+	}
+	remote, err := n.pairInfo(req)
+	if err != nil {
+		return api.PairInfo{}, err
+	}
+	if err = verify(remote); err != nil {
+		return api.PairInfo{}, err
+	}
+	fingerprint, err := peers.Fingerprint(remote)
+	if err != nil {
+		return api.PairInfo{}, err
+	}
+
+	body, err := json.Marshal(self)
+	if err != nil {
+		return api.PairInfo{}, err
+	}
+	req, err = http.NewRequest("POST", endPoint, bytes.NewReader(body))
+	if err != nil {
+		return api.PairInfo{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	paired, err := n.pairInfo(req)
+	if err != nil {
+		return api.PairInfo{}, err
+	}
+
+	// The node must not have changed since its details were verified
+	pairedFingerprint, err := peers.Fingerprint(paired)
+	if err != nil {
+		return api.PairInfo{}, err
+	}
+	if pairedFingerprint != fingerprint {
+		return api.PairInfo{}, errors.New("node details changed during pairing")
+	}
+	return paired, nil
+}
+
+// pairInfo makes a pairing request, checking the node's details against its TLS certificate.
+func (n *Node) pairInfo(req *http.Request) (api.PairInfo, error) {
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return api.PairInfo{}, err
+	}
+	var tlsCertificate []byte
+	if resp.TLS != nil && len(resp.TLS.PeerCertificates) > 0 {
+		tlsCertificate = resp.TLS.PeerCertificates[0].Raw
+	}
+
+	body, err := readResponse(resp, nil)
+	if err != nil {
+		return api.PairInfo{}, err
+	}
+	var info api.PairInfo
+	if err = json.Unmarshal(body, &info); err != nil {
+		return api.PairInfo{}, err
+	}
+
+	if tlsCertificate != nil {
+		if info.Certificate == "" {
+			return api.PairInfo{}, errors.New("node did not provide its TLS certificate")
+		}
+		cert, err := peers.ParseCertificate(info.Certificate)
+		if err != nil {
+			return api.PairInfo{}, err
+		}
+		if !bytes.Equal(cert.Raw, tlsCertificate) {
+			return api.PairInfo{}, fmt.Errorf(
+				"certificate provided by %s does not match its TLS certificate", n.Url)
+		}
+	}
+	return info, nil
+}
@@ -0,0 +1,72 @@
+package client
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"github.com/blk-io/crux/api"
+	"github.com/blk-io/crux/peers"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPair(t *testing.T) {
+	var remote, received api.PairInfo
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			if r.Header.Get("Authorization") != "Bearer secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			json.NewDecoder(r.Body).Decode(&received)
+		}
+		json.NewEncoder(w).Encode(remote)
+	}))
+	server.StartTLS()
+	defer server.Close()
+
+	remote = api.PairInfo{
+		Url:        server.URL,
+		PublicKeys: []string{"QfeDAys9MPDs2XHExtc84jKGHxZg/aj52DTh0vtA3Xc="},
+		Certificate: string(pem.EncodeToMemory(
+			&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})),
+	}
+	self := api.PairInfo{
+		Url:        "http://node1:9001/",
+		PublicKeys: []string{"BULeR8JyUWhiuuCMU/HLA0Q5pzkYT+cHII3ZKBey3Bo="},
+	}
+	fingerprint, err := peers.Fingerprint(remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conf := DefaultConfig()
+	conf.TLSConfig = &tls.Config{InsecureSkipVerify: true}
+	node := NewNode(server.URL, New(conf))
+
+	verify := func(info api.PairInfo) error {
+		if f, _ := peers.Fingerprint(info); f != fingerprint {
+			return errors.New("unexpected fingerprint")
+		}
+		return nil
+	}
+	paired, err := node.Pair(self, "secret", verify)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if paired.Url != remote.Url || received.Url != self.Url {
+		t.Errorf("Unexpected pairing, got %v, sent %v", paired, received)
+	}
+
+	if _, err = node.Pair(self, "invalid", verify); err == nil {
+		t.Error("Pairing should fail with an invalid token")
+	}
+
+	// The certificate provided must be the one presented over TLS
+	remote.Certificate = ""
+	if _, err = node.Pair(self, "secret", func(api.PairInfo) error { return nil }); err == nil {
+		t.Error("Pairing should fail if the node does not provide its certificate")
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 	"os"
+	"strings"
 )
 
 const (
@@ -21,6 +22,10 @@ const (
 	PrivateKeys        = "privatekeys"
 	Port               = "port"
 	Socket             = "socket"
+	SocketMode         = "socketmode"
+	SocketGroup        = "socketgroup"
+	SocketUsers        = "socketusers"
+	IpcToken           = "ipctoken"
 
 	GenerateKeys = "generate-keys"
 
@@ -38,7 +43,73 @@ const (
 	TlsClientChain  = "tlsclientchain"
 	TlsClientKey    = "tlsclientkey"
 	TlsClientTrust  = "tlsclienttrust"
+	Http2           = "http2"
+	Proxy           = "proxy"
 	TlsServerKey    = "tlsserverkey"
+
+	VaultAddr  = "vaultaddr"
+	VaultToken = "vaulttoken"
+
+	ValidatePartyInfo = "validatepartyinfo"
+
+	MaxRequestSize = "maxrequestsize"
+	RateLimit      = "ratelimit"
+	RateBurst      = "rateburst"
+	MaxConcurrent  = "maxconcurrent"
+
+	LowMemory = "lowmemory"
+
+	StorageKey = "storagekey"
+
+	Compression = "compression"
+
+	Hash   = "hash"
+	Cipher = "cipher"
+
+	CorsOrigins    = "corsorigins"
+	TrustedProxies = "trustedproxies"
+	PathPrefix     = "pathprefix"
+
+	AllowIps = "allowips"
+	DenyIps  = "denyips"
+
+	AdminAddr  = "adminaddr"
+	AdminToken = "admintoken"
+
+	UsageTokens = "usagetokens"
+
+	ReplayLog    = "replaylog"
+	ReplayLogKey = "replaylogkey"
+	Replay       = "replay"
+
+	AuditLog = "auditlog"
+
+	Peers       = "peers"
+	PairToken   = "pairtoken"
+	Fingerprint = "fingerprint"
+
+	WatchdogTimeout = "watchdogtimeout"
+	AlertUrl        = "alerturl"
+	ReadyPeers      = "readypeers"
+
+	PersistPartyInfo = "persistpartyinfo"
+	PrunePeers       = "prunepeers"
+
+	ReadTimeout     = "readtimeout"
+	WriteTimeout    = "writetimeout"
+	IdleTimeout     = "idletimeout"
+	MaxHeaderBytes  = "maxheaderbytes"
+	IpcReadTimeout  = "ipcreadtimeout"
+	IpcWriteTimeout = "ipcwritetimeout"
+	IpcIdleTimeout  = "ipcidletimeout"
+	StoreTimeout    = "storetimeout"
+	RetrieveTimeout = "retrievetimeout"
+
+	ExportOut = "out"
+	ImportIn  = "in"
+
+	MigrateFrom = "from"
+	MigrateDir  = "dir"
 )
 
 // InitFlags initializes all supported command line flags.
@@ -47,7 +118,13 @@ func InitFlags() {
 	flag.String(Url, "", "The URL to advertise to other nodes (reachable by them)")
 	flag.Int(Port, -1, "The local port to listen on")
 	flag.String(WorkDir, ".", "The folder to put stuff in ")
-	flag.String(Socket, "crux.ipc", "IPC socket to create for access to the Private API")
+	flag.String(Socket, "crux.ipc",
+		"IPC socket to create for access to the Private API, prefix with @ for a Linux abstract socket")
+	flag.String(SocketMode, "0600", "Permissions of the IPC socket file")
+	flag.String(SocketGroup, "", "Group to give ownership of the IPC socket file to")
+	flag.String(SocketUsers, "",
+		"Users permitted to connect to the IPC socket, checked via their peer credentials on Linux")
+	flag.String(IpcToken, "", "Bearer token required by the private API")
 	flag.String(OtherNodes, "", "\"Boot nodes\" to connect to to discover the network")
 	flag.String(PublicKeys, "", "Public keys hosted by this node")
 	flag.String(PrivateKeys, "", "Private keys hosted by this node")
@@ -62,7 +139,70 @@ func InitFlags() {
 	flag.Bool(Tls, false, "Use TLS to secure HTTP communications")
 	flag.String(TlsServerCert, "", "The server certificate to be used")
 	flag.String(TlsServerKey, "", "The server private key")
+	flag.Bool(Http2, true, "Use HTTP/2 for TLS connections with other nodes")
+	flag.String(Proxy, "",
+		"URL of an http, https or socks5 proxy to connect to other nodes via, defaults to the HTTP_PROXY environment variables")
 	flag.Int(GrpcJsonPort, -1, "The local port to listen on for JSON extensions of gRPC")
+	flag.String(VaultAddr, "", "Address of the Hashicorp Vault server holding private keys")
+	flag.String(VaultToken, "", "Token used to authenticate with Vault")
+	flag.Bool(ValidatePartyInfo, false,
+		"Require nodes to prove they hold the keys they announce before routing to them")
+	flag.Int(MaxRequestSize, 64*1024*1024,
+		"Maximum size in bytes of requests to the public API, 0 for no limit")
+	flag.Int(RateLimit, 0, "Requests per second permitted from each client IP, 0 for no limit")
+	flag.Int(RateBurst, 100, "Requests permitted in excess of the rate limit in a burst")
+	flag.Int(MaxConcurrent, 0, "Maximum requests to the public API served concurrently, 0 for no limit")
+	flag.String(StorageKey, "",
+		"Key to encrypt stored payloads with, a private key file or a reference such as env:VARIABLE")
+	flag.String(Compression, "none",
+		"Compression of stored values and payloads pushed to other nodes, none or gzip")
+	flag.String(Hash, "sha3-512",
+		"Hash algorithm payloads are stored under the digest of, sha3-512 or sha256")
+	flag.String(Cipher, "secretbox", "Cipher payloads are encrypted with, secretbox or aes-gcm")
+	flag.Bool(LowMemory, false,
+		"Reduce memory usage for constrained devices, at the expense of throughput")
+	flag.String(CorsOrigins, "", "Origins permitted to make cross-origin requests to the public API")
+	flag.String(TrustedProxies, "",
+		"IPs or CIDR ranges of reverse proxies whose X-Forwarded-For/Proto headers are trusted")
+	flag.String(PathPrefix, "", "URL path prefix to serve the public API under")
+	flag.String(AllowIps, "",
+		"IPs or CIDR ranges permitted to push payloads, request resends and exchange party info, all if not set")
+	flag.String(DenyIps, "",
+		"IPs or CIDR ranges denied from pushing payloads, requesting resends and exchanging party info")
+	flag.String(AdminAddr, "", "Address or socket path to serve the admin API on, disabled if not set")
+	flag.String(AdminToken, "", "Bearer token required by the admin API")
+	flag.String(ReplayLog, "", "File to append an encrypted log of all changes to storage to")
+	flag.String(ReplayLogKey, "",
+		"Key to encrypt the replay log with, a private key file or a reference such as env:VARIABLE, defaults to the storage key")
+	flag.Bool(Replay, false, "Rebuild empty storage from the replay log and exit")
+	flag.String(AuditLog, "",
+		"File to append a log of the payloads sent, received, deleted, pushed and resent to, disabled if not set")
+	flag.String(Peers, "crux.peers", "File recording the nodes this node has paired with")
+	flag.String(PairToken, "", "Token nodes must present to pair with this node, or when pairing with another")
+	flag.String(Fingerprint, "", "Expected fingerprint of the node to pair with, prompted for if not set")
+	flag.String(UsageTokens, "",
+		"Tokens permitting applications to view the usage of their sender keys, as publickey:token pairs")
+	flag.Int(WatchdogTimeout, 600,
+		"Seconds a background loop may make no progress before it is restarted, 0 to disable")
+	flag.String(AlertUrl, "", "URL to POST an alert to when a stuck background loop is restarted")
+	flag.Bool(ReadyPeers, false, "Only report the node as ready once it has received the party info of another node")
+	flag.Bool(PersistPartyInfo, false,
+		"Save the recipients and nodes learned from other nodes to storage, restoring them on startup")
+	flag.Int(PrunePeers, 24,
+		"Hours a node learned from other nodes may be unresponsive before it is forgotten, 0 to never forget nodes")
+	flag.Int(ReadTimeout, 60, "Seconds permitted to read a request to the public API, 0 for no limit")
+	flag.Int(WriteTimeout, 0, "Seconds permitted to respond to a request to the public API, 0 for no limit")
+	flag.Int(IdleTimeout, 120, "Seconds an idle connection to the public API is kept open, 0 for no limit")
+	flag.Int(MaxHeaderBytes, 1<<20, "Maximum size in bytes of request headers to the public and private APIs")
+	flag.Int(IpcReadTimeout, 60, "Seconds permitted to read a request to the private API, 0 for no limit")
+	flag.Int(IpcWriteTimeout, 0, "Seconds permitted to respond to a request to the private API, 0 for no limit")
+	flag.Int(IpcIdleTimeout, 120, "Seconds an idle connection to the private API is kept open, 0 for no limit")
+	flag.Int(StoreTimeout, 0, "Seconds permitted to store and push a payload sent via the private API, 0 for no limit")
+	flag.Int(RetrieveTimeout, 0, "Seconds permitted to retrieve a payload received via the private API, 0 for no limit")
+	flag.String(ExportOut, "", "File to write the export command's archive to, defaults to standard output")
+	flag.String(ImportIn, "", "Archive for the import command to read, defaults to standard input")
+	flag.String(MigrateFrom, "constellation", "Implementation the migrate command imports storage and keys from")
+	flag.String(MigrateDir, "", "Data directory for the migrate command to import storage and keys from")
 
 	// storage not currently supported as we use LevelDB
 
@@ -77,10 +217,54 @@ func Usage() {
 	pflag.PrintDefaults()
 }
 
-// ParseCommandLine parses all provided command line arguments.
-func ParseCommandLine() {
+// EnvPrefix prefixes the names of the environment variables which override settings, such as
+// CRUX_PORT for port and CRUX_GENERATE_KEYS for generate-keys.
+const EnvPrefix = "CRUX_"
+
+// EnvName returns the name of the environment variable which overrides the named setting.
+func EnvName(name string) string {
+	return EnvPrefix + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// ParseCommandLine parses all provided command line arguments, then applies any settings provided
+// by environment variables. Settings are taken from environment variables in preference to the
+// command line, and from either in preference to the configuration file.
+func ParseCommandLine() error {
 	pflag.Parse()
 	viper.BindPFlags(pflag.CommandLine)
+	return applyEnv()
+}
+
+// EnvProvided reports whether any settings are provided by environment variables.
+func EnvProvided() bool {
+	provided := false
+	pflag.VisitAll(func(f *pflag.Flag) {
+		if _, ok := os.LookupEnv(EnvName(f.Name)); ok {
+			provided = true
+		}
+	})
+	return provided
+}
+
+// applyEnv sets the flag of each setting provided by an environment variable, validating its
+// value as the flag would be on the command line.
+func applyEnv() error {
+	var err error
+	pflag.VisitAll(func(f *pflag.Flag) {
+		value, ok := os.LookupEnv(EnvName(f.Name))
+		if !ok || err != nil {
+			return
+		}
+		if setErr := pflag.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf("invalid value %q for %s, %v", value, EnvName(f.Name), setErr)
+		}
+	})
+	return err
+}
+
+// Args returns the command line arguments remaining after flags have been parsed.
+func Args() []string {
+	return pflag.Args()
 }
 
 // LoadConfig loads all configuration settings in the provided configPath location.
@@ -90,6 +274,14 @@ func LoadConfig(configPath string) error {
 	return viper.ReadInConfig()
 }
 
+// ReloadConfig re-reads the configuration file previously loaded by LoadConfig, if any.
+func ReloadConfig() error {
+	if viper.ConfigFileUsed() == "" {
+		return nil
+	}
+	return viper.ReadInConfig()
+}
+
 func AllSettings() map[string]interface{} {
 	return viper.AllSettings()
 }
@@ -109,3 +301,22 @@ func GetString(key string) string {
 func GetStringSlice(key string) []string {
 	return viper.GetStringSlice(key)
 }
+
+// GetStringList returns a list setting, which may be provided as a comma-separated string, such
+// as on the command line, or as a list in a configuration file. Empty items are omitted.
+func GetStringList(key string) []string {
+	var items []string
+	if _, ok := viper.Get(key).([]interface{}); ok {
+		items = viper.GetStringSlice(key)
+	} else {
+		items = strings.Split(viper.GetString(key), ",")
+	}
+
+	var list []string
+	for _, item := range items {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
@@ -1,7 +1,11 @@
 package config
 
 import (
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"os"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -93,3 +97,62 @@ func TestGetIntConfig(t *testing.T) {
 		t.Errorf("Port num 9001 is expected but we got %d", GetInt(Port))
 	}
 }
+
+func TestGetStringList(t *testing.T) {
+	// Lists are provided as arrays in configuration files
+	if keys := GetStringList(PublicKeys); !reflect.DeepEqual(keys, []string{"foo.pub"}) {
+		t.Errorf("Expected public keys [foo.pub], got %v", keys)
+	}
+
+	// and as comma-separated strings on the command line
+	viper.Set(AllowIps, "10.0.0.1, 10.0.0.2,")
+	defer viper.Set(AllowIps, "")
+	if ips := GetStringList(AllowIps); !reflect.DeepEqual(ips, []string{"10.0.0.1", "10.0.0.2"}) {
+		t.Errorf("Expected IPs [10.0.0.1 10.0.0.2], got %v", ips)
+	}
+
+	if list := GetStringList(DenyIps); list != nil {
+		t.Errorf("Expected an empty list, got %v", list)
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	os.Setenv(EnvName(Port), "9500")
+	os.Setenv(EnvName(OtherNodes), "http://node1:9000/,http://node2:9000/")
+	os.Setenv(EnvName(UseGRPC), "false")
+	defer func() {
+		for _, name := range []string{Port, OtherNodes, UseGRPC} {
+			os.Unsetenv(EnvName(name))
+			f := pflag.Lookup(name)
+			f.Value.Set(f.DefValue)
+			f.Changed = false
+		}
+	}()
+
+	if !EnvProvided() {
+		t.Error("Settings should be provided by environment variables")
+	}
+
+	// Environment variables take precedence over the configuration file
+	if err := applyEnv(); err != nil {
+		t.Fatal(err)
+	}
+	if port := GetInt(Port); port != 9500 {
+		t.Errorf("Expected port 9500, got %d", port)
+	}
+	if nodes := GetStringList(OtherNodes); !reflect.DeepEqual(
+		nodes, []string{"http://node1:9000/", "http://node2:9000/"}) {
+		t.Errorf("Unexpected other nodes %v", nodes)
+	}
+	if GetBool(UseGRPC) {
+		t.Error("gRPC should be disabled")
+	}
+	if name := EnvName(GenerateKeys); name != "CRUX_GENERATE_KEYS" {
+		t.Errorf("Unexpected environment variable name %s", name)
+	}
+
+	os.Setenv(EnvName(Port), "none")
+	if err := applyEnv(); err == nil || !strings.Contains(err.Error(), "CRUX_PORT") {
+		t.Errorf("Expected an invalid CRUX_PORT error, got %v", err)
+	}
+}
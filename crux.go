@@ -1,25 +1,53 @@
 package main
 
 import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
 	"github.com/blk-io/crux/api"
+	"github.com/blk-io/crux/audit"
+	"github.com/blk-io/crux/client"
 	"github.com/blk-io/crux/config"
+	"github.com/blk-io/crux/crypt"
 	"github.com/blk-io/crux/enclave"
+	"github.com/blk-io/crux/peers"
 	"github.com/blk-io/crux/server"
 	"github.com/blk-io/crux/storage"
+	"github.com/blk-io/crux/utils"
+	"github.com/blk-io/crux/watchdog"
+	"github.com/kevinburke/nacl"
 	log "github.com/sirupsen/logrus"
 	"net/http"
 	"os"
+	"os/signal"
 	"path"
+	"runtime/debug"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 )
 
+// Names of the stores recorded in the replay log.
+const (
+	replayLogPayloads = "payloads"
+	replayLogMeta     = "meta"
+)
+
+// Settings applied in low memory mode.
+const (
+	lowMemoryGCPercent     = 50
+	lowMemoryMaxConcurrent = 16
+)
+
 func main() {
 
 	config.InitFlags()
 
+	// Containers may be configured entirely via environment variables
 	args := os.Args
-	if len(args) == 1 {
+	if len(args) == 1 && !config.EnvProvided() {
 		exit()
 	}
 
@@ -32,7 +60,9 @@ func main() {
 			break
 		}
 	}
-	config.ParseCommandLine()
+	if err := config.ParseCommandLine(); err != nil {
+		log.Fatalln(err)
+	}
 
 	verbosity := 1
 	if config.GetInt(config.Verbosity) > config.GetInt(config.VerbosityShorthand) {
@@ -55,6 +85,15 @@ func main() {
 	}
 	log.SetLevel(level)
 
+	// Both must match those of other nodes, and be left as the defaults to exchange payloads
+	// with Constellation nodes
+	if err := utils.SetDigestHash(config.GetString(config.Hash)); err != nil {
+		log.Fatalln(err)
+	}
+	if err := crypt.SetCipher(config.GetString(config.Cipher)); err != nil {
+		log.Fatalln(err)
+	}
+
 	keyFile := config.GetString(config.GenerateKeys)
 	if keyFile != "" {
 		err := enclave.DoKeyGeneration(keyFile)
@@ -66,16 +105,49 @@ func main() {
 	}
 
 	workDir := config.GetString(config.WorkDir)
+	if args := config.Args(); len(args) > 0 && args[0] == pairCommand {
+		if len(args) != 2 {
+			log.Fatalln("The URL of the node to pair with must be specified")
+		}
+		if err := pair(workDir, args[1]); err != nil {
+			log.Fatalf("Unable to pair with %s, error: %v", args[1], err)
+		}
+		os.Exit(0)
+	}
+
 	dbStorage := config.GetString(config.Storage)
 	ipcFile := config.GetString(config.Socket)
 	storagePath := path.Join(workDir, dbStorage)
-	ipcPath := path.Join(workDir, ipcFile)
+	ipcPath := ipcFile
+	if !path.IsAbs(ipcFile) && !utils.IsAbstractSocket(ipcFile) {
+		ipcPath = path.Join(workDir, ipcFile)
+	}
+	ipcMode, err := strconv.ParseUint(config.GetString(config.SocketMode), 8, 32)
+	if err != nil {
+		log.Fatalf("Invalid IPC socket mode %s, error: %v", config.GetString(config.SocketMode), err)
+	}
+	// Guard against another process using the same storage, cleaning up after any crashed one
+	lockFile := storagePath + ".pid"
+	err = utils.AcquirePidFile(lockFile)
+	if err != nil {
+		log.Fatalf("Unable to lock storage, error: %v", err)
+	}
+	defer utils.ReleasePidFile(lockFile)
+
+	lowMemory := config.GetBool(config.LowMemory)
+	initLevelDb := storage.InitLevelDb
+	if lowMemory {
+		log.Info("Running in low memory mode")
+		initLevelDb = storage.InitLevelDbLowMemory
+		// Collect garbage more often, keeping the heap closer to the live data size
+		debug.SetGCPercent(lowMemoryGCPercent)
+	}
+
 	var db storage.DataStore
-	var err error
 	if config.GetBool(config.BerkeleyDb) {
 		db, err = storage.InitBerkeleyDb(storagePath)
 	} else {
-		db, err = storage.InitLevelDb(storagePath)
+		db, err = initLevelDb(storagePath)
 	}
 
 	if err != nil {
@@ -83,8 +155,17 @@ func main() {
 	}
 	defer db.Close()
 
-	allOtherNodes := config.GetString(config.OtherNodes)
-	otherNodes := strings.Split(allOtherNodes, ",")
+	// Metadata about payloads, such as their provenance, is kept apart from the payloads
+	metaDb, err := initLevelDb(storagePath + "-meta")
+	if err != nil {
+		log.Fatalf("Unable to initialise metadata storage, error: %v", err)
+	}
+	defer metaDb.Close()
+
+	otherNodes := config.GetStringList(config.OtherNodes)
+	paired := peersFile(workDir)
+	pairedPeers := loadPeers(paired)
+	otherNodes = append(otherNodes, peers.Urls(pairedPeers)...)
 	url := config.GetString(config.Url)
 	if url == "" {
 		log.Fatalln("URL must be specified")
@@ -93,17 +174,112 @@ func main() {
 	if port < 0 {
 		log.Fatalln("Port must be specified")
 	}
-	httpClient := &http.Client{
-		Timeout: time.Second * 10,
+	clientConfig := client.DefaultConfig()
+	if lowMemory {
+		clientConfig = client.LowMemoryConfig()
+	}
+	clientConfig.Http2 = config.GetBool(config.Http2)
+	if proxyUrl := config.GetString(config.Proxy); proxyUrl != "" {
+		proxy, err := client.ParseProxy(proxyUrl)
+		if err != nil {
+			log.Fatalf("Invalid proxy, error: %v", err)
+		}
+		clientConfig.Proxy = proxy
+	}
+	// Trust the certificates of paired nodes, which may be self-signed, for those nodes only
+	pinnedRoots, err := peers.PinnedRoots(pairedPeers)
+	if err != nil {
+		log.Fatalf("Invalid certificate for paired node, error: %v", err)
 	}
+	clientConfig.PinnedRoots = pinnedRoots
+	httpClient := client.New(clientConfig)
 	grpc := config.GetBool(config.UseGRPC)
 
 	pi := api.InitPartyInfo(url, otherNodes, httpClient, grpc)
+	if config.GetBool(config.ValidatePartyInfo) {
+		if grpc {
+			log.Fatalln("Party info validation is not supported with gRPC")
+		}
+		pi.EnableValidation()
+	}
+	if pruneAfter := config.GetInt(config.PrunePeers); pruneAfter > 0 {
+		pi.EnablePruning(time.Duration(pruneAfter) * time.Hour)
+	}
+
+	vaultAddr := config.GetString(config.VaultAddr)
+	if vaultAddr == "" {
+		vaultAddr = os.Getenv("VAULT_ADDR")
+	}
+	if vaultAddr != "" {
+		vaultToken := config.GetString(config.VaultToken)
+		if vaultToken == "" {
+			vaultToken = os.Getenv("VAULT_TOKEN")
+		}
+		enclave.RegisterKeyProvider("vault",
+			enclave.NewVaultKeyProvider(vaultAddr, vaultToken, httpClient))
+	}
 
-	privKeys := config.GetString(config.PrivateKeys)
-	pubKeys := config.GetString(config.PublicKeys)
-	pubKeyFiles := strings.Split(pubKeys, ",")
-	privKeyFiles := strings.Split(privKeys, ",")
+	// Private keys are resolved once all KeyProviders are registered
+	pubKeyFiles, privKeyFiles := keyFiles(workDir)
+
+	var meta storage.DataStore = metaDb
+	storageKey := config.GetString(config.StorageKey)
+	if storageKey != "" {
+		key := loadKey(workDir, storageKey, "storage")
+		db = storage.WithEncryption(db, key)
+		meta = storage.WithEncryption(meta, key)
+		log.Info("Encrypting storage at rest")
+	}
+
+	// Values are compressed before they are encrypted, as encrypted values do not compress
+	compression := config.GetString(config.Compression)
+	switch compression {
+	case utils.CompressionNone:
+	case utils.CompressionGzip:
+		db = storage.WithCompression(db)
+		meta = storage.WithCompression(meta)
+		log.Infof("Compressing storage and pushed payloads with %s", compression)
+	default:
+		log.Fatalf("Unsupported compression %s, it must be none or gzip", compression)
+	}
+
+	if replayLogPath := config.GetString(config.ReplayLog); replayLogPath != "" {
+		if !path.IsAbs(replayLogPath) {
+			replayLogPath = path.Join(workDir, replayLogPath)
+		}
+		replayLogKey := config.GetString(config.ReplayLogKey)
+		if replayLogKey == "" {
+			replayLogKey = storageKey
+		}
+		if replayLogKey == "" {
+			log.Fatalln("A replay log key or storage key must be provided to use a replay log")
+		}
+		key := loadKey(workDir, replayLogKey, "replay log")
+
+		if config.GetBool(config.Replay) {
+			replay(replayLogPath, key, db, meta)
+			return
+		}
+
+		replayLog, err := storage.OpenReplayLog(replayLogPath, key)
+		if err != nil {
+			log.Fatalf("Unable to open replay log, error: %v", err)
+		}
+		defer replayLog.Close()
+		db = replayLog.Wrap(replayLogPayloads, db)
+		meta = replayLog.Wrap(replayLogMeta, meta)
+		log.Infof("Recording changes to storage in %s", replayLogPath)
+	} else if config.GetBool(config.Replay) {
+		log.Fatalln("A replay log must be provided to replay")
+	}
+
+	// Keys are migrated along with storage, so need not be provided yet
+	if args := config.Args(); len(args) > 0 && args[0] == migrateCommand {
+		if err := migrate(workDir, db, meta); err != nil {
+			log.Fatalf("Unable to migrate, error: %v", err)
+		}
+		return
+	}
 
 	if len(privKeyFiles) != len(pubKeyFiles) {
 		log.Fatalln("Private keys provided must have corresponding public keys")
@@ -113,17 +289,28 @@ func main() {
 		log.Fatalln("Node key files must be provided")
 	}
 
-	for i, keyFile := range privKeyFiles {
-		privKeyFiles[i] = path.Join(workDir, keyFile)
-	}
+	enc := enclave.Init(db, pubKeyFiles, privKeyFiles, pi, httpClient, grpc)
+	enc.Meta = meta
+	enc.PushCompression = compression
 
-	for i, keyFile := range pubKeyFiles {
-		pubKeyFiles[i] = path.Join(workDir, keyFile)
+	if args := config.Args(); len(args) > 0 && (args[0] == exportCommand || args[0] == importCommand) {
+		if err := backup(args[0], enc); err != nil {
+			log.Fatalf("Unable to %s storage, error: %v", args[0], err)
+		}
+		return
 	}
 
-	enc := enclave.Init(db, pubKeyFiles, privKeyFiles, pi, http.DefaultClient, grpc)
+	// Payloads stored before they were indexed by sender and recipient are indexed once
+	if err := enc.IndexPayloads(); err != nil {
+		log.Fatalf("Unable to index payloads, error: %v", err)
+	}
 
-	pi.RegisterPublicKeys(enc.PubKeys)
+	pi.RegisterPublicKeys(enc.ActivePubKeys())
+	if config.GetBool(config.PersistPartyInfo) {
+		if err := enc.PersistPartyInfo(); err != nil {
+			log.Fatalf("Unable to persist party info, error: %v", err)
+		}
+	}
 
 	tls := config.GetBool(config.Tls)
 	var tlsCertFile, tlsKeyFile string
@@ -138,17 +325,295 @@ func main() {
 		tlsCertFile = path.Join(workDir, servCert)
 		tlsKeyFile = path.Join(workDir, servKey)
 	}
-	grpcJsonport := config.GetInt(config.GrpcJsonPort)
-	_, err = server.Init(enc, port, ipcPath, grpc, grpcJsonport, tls, tlsCertFile, tlsKeyFile)
+	maxConcurrent := config.GetInt(config.MaxConcurrent)
+	if lowMemory && maxConcurrent == 0 {
+		maxConcurrent = lowMemoryMaxConcurrent
+	}
+	ipcOptions := utils.IpcSocketOptions{
+		Mode:  os.FileMode(ipcMode),
+		Group: config.GetString(config.SocketGroup),
+		Users: config.GetStringList(config.SocketUsers),
+	}
+	usageTokens, err := parseUsageTokens(config.GetStringList(config.UsageTokens))
+	if err != nil {
+		log.Fatalf("Invalid usage tokens, error: %v", err)
+	}
+	adminToken := config.GetString(config.AdminToken)
+	if adminToken == "" {
+		adminToken = os.Getenv("CRUX_ADMIN_TOKEN")
+	}
+	ipcToken := config.GetString(config.IpcToken)
+	if ipcToken == "" {
+		ipcToken = os.Getenv("CRUX_IPC_TOKEN")
+	}
+	selfInfo, err := selfPairInfo(workDir)
+	if err != nil {
+		log.Fatalf("Unable to load details for pairing, error: %v", err)
+	}
+
+	var auditLog *audit.Log
+	if auditLogPath := config.GetString(config.AuditLog); auditLogPath != "" {
+		if !path.IsAbs(auditLogPath) {
+			auditLogPath = path.Join(workDir, auditLogPath)
+		}
+		auditLog, err = audit.Open(auditLogPath)
+		if err != nil {
+			log.Fatalf("Unable to open audit log %s, error: %v", auditLogPath, err)
+		}
+		defer auditLog.Close()
+		log.Infof("Recording privacy-relevant operations in %s", auditLogPath)
+	}
+
+	var monitor *watchdog.Watchdog
+	if config.GetInt(config.WatchdogTimeout) > 0 {
+		// Party info is polled every PollInterval, only reporting progress around each round
+		if seconds(config.WatchdogTimeout) <= api.PollInterval {
+			log.Fatalf("The watchdog timeout must be greater than the party info poll interval of %v",
+				api.PollInterval)
+		}
+		monitor = watchdog.New(alerter(config.GetString(config.AlertUrl), httpClient))
+	}
+
+	var tm server.TransactionManager
+	reload := func() error {
+		return reloadConfig(workDir, &pi, enc, &tm)
+	}
+	tm, err = server.Init(enc, server.ServerConfig{
+		Port:           port,
+		IpcPath:        ipcPath,
+		IpcOptions:     ipcOptions,
+		IpcToken:       ipcToken,
+		Grpc:           grpc,
+		GrpcJsonPort:   config.GetInt(config.GrpcJsonPort),
+		Tls:            tls,
+		CertFile:       tlsCertFile,
+		KeyFile:        tlsKeyFile,
+		DisableHttp2:   !config.GetBool(config.Http2),
+		MaxRequestSize: int64(config.GetInt(config.MaxRequestSize)),
+		RateLimit:      float64(config.GetInt(config.RateLimit)),
+		RateBurst:      config.GetInt(config.RateBurst),
+		MaxConcurrent:  maxConcurrent,
+		PublicTimeouts: server.HttpTimeouts{
+			Read:           seconds(config.ReadTimeout),
+			Write:          seconds(config.WriteTimeout),
+			Idle:           seconds(config.IdleTimeout),
+			MaxHeaderBytes: config.GetInt(config.MaxHeaderBytes),
+		},
+		IpcTimeouts: server.HttpTimeouts{
+			Read:           seconds(config.IpcReadTimeout),
+			Write:          seconds(config.IpcWriteTimeout),
+			Idle:           seconds(config.IpcIdleTimeout),
+			MaxHeaderBytes: config.GetInt(config.MaxHeaderBytes),
+		},
+		StoreTimeout:    seconds(config.StoreTimeout),
+		RetrieveTimeout: seconds(config.RetrieveTimeout),
+		CorsOrigins:     config.GetStringList(config.CorsOrigins),
+		TrustedProxies:  config.GetStringList(config.TrustedProxies),
+		PathPrefix:      config.GetString(config.PathPrefix),
+		AllowIps:        config.GetStringList(config.AllowIps),
+		DenyIps:         config.GetStringList(config.DenyIps),
+		AdminAddr:       config.GetString(config.AdminAddr),
+		AdminToken:      adminToken,
+		UsageTokens:     usageTokens,
+		Reload:          reload,
+		PairInfo:        selfInfo,
+		PairToken:       pairToken(),
+		Peers:           paired,
+		Watchdog:        monitor,
+		Audit:           auditLog,
+		ReadyPeers:      config.GetBool(config.ReadyPeers),
+
+		ValidatePartyInfo: config.GetBool(config.ValidatePartyInfo),
+	})
 	if err != nil {
 		log.Fatalf("Error starting server: %v\n", err)
 	}
 
-	pi.PollPartyInfo()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		log.Infof("Received %s, shutting down", sig)
+		db.Close()
+		metaDb.Close()
+		if !utils.IsAbstractSocket(ipcPath) {
+			os.Remove(ipcPath)
+		}
+		utils.ReleasePidFile(lockFile)
+		os.Exit(0)
+	}()
+
+	hups := make(chan os.Signal, 1)
+	signal.Notify(hups, syscall.SIGHUP)
+	go func() {
+		for range hups {
+			log.Info("Received SIGHUP, reloading configuration")
+			if err := reload(); err != nil {
+				log.Errorf("Unable to reload configuration, error: %v", err)
+			}
+		}
+	}()
+
+	if monitor != nil {
+		timeout := seconds(config.WatchdogTimeout)
+		monitor.Go("partyinfo", timeout, pi.PollPartyInfo)
+		go monitor.Watch(watchdogInterval, nil)
+	} else {
+		go pi.PollPartyInfo(nil, func() {})
+	}
 
 	select {}
 }
 
+// watchdogInterval is how often the watchdog checks for stuck background loops.
+const watchdogInterval = 30 * time.Second
+
+// alerter returns a function which POSTs the status of a restarted background loop to alertUrl,
+// or nil if no URL is configured, in which case restarts are only logged.
+func alerter(alertUrl string, httpClient utils.HttpClient) func(api.SubsystemStatus) {
+	if alertUrl == "" {
+		return nil
+	}
+	return func(status api.SubsystemStatus) {
+		body, err := json.Marshal(status)
+		if err != nil {
+			log.Errorf("Unable to encode alert, error: %v", err)
+			return
+		}
+		req, err := http.NewRequest("POST", alertUrl, bytes.NewReader(body))
+		if err != nil {
+			log.Errorf("Unable to create alert, error: %v", err)
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			log.Errorf("Unable to send alert to %s, error: %v", alertUrl, err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			log.Errorf("Unable to send alert to %s, status code: %d", alertUrl, resp.StatusCode)
+		}
+	}
+}
+
+// keyFiles returns the configured public and private key files, relative to workDir. Private keys
+// held by a KeyProvider are returned as is.
+func keyFiles(workDir string) ([]string, []string) {
+	pubKeyFiles := config.GetStringList(config.PublicKeys)
+	privKeyFiles := config.GetStringList(config.PrivateKeys)
+
+	for i, keyFile := range privKeyFiles {
+		if enclave.IsKeyFile(keyFile) {
+			privKeyFiles[i] = path.Join(workDir, keyFile)
+		}
+	}
+
+	for i, keyFile := range pubKeyFiles {
+		pubKeyFiles[i] = path.Join(workDir, keyFile)
+	}
+	return pubKeyFiles, privKeyFiles
+}
+
+// reloadConfig re-reads the configuration file, connecting to any nodes added to othernodes,
+// loading any keypairs added, and reloading the TLS certificate. Servers continue running
+// throughout, so in-flight requests are unaffected.
+func reloadConfig(
+	workDir string, pi *api.PartyInfo, enc *enclave.SecureEnclave, tm *server.TransactionManager) error {
+
+	if err := config.ReloadConfig(); err != nil {
+		return err
+	}
+
+	otherNodes := config.GetStringList(config.OtherNodes)
+	otherNodes = append(otherNodes, peers.Urls(loadPeers(peersFile(workDir)))...)
+	added := pi.AddParties(otherNodes)
+	if len(added) > 0 {
+		log.Infof("Added nodes %s", strings.Join(added, ", "))
+		go pi.GetPartyInfo()
+	}
+
+	pubKeyFiles, privKeyFiles := keyFiles(workDir)
+	keys, err := enc.AddKeys(pubKeyFiles, privKeyFiles)
+	if err != nil {
+		return fmt.Errorf("unable to load keys, %v", err)
+	}
+	for _, key := range keys {
+		log.Infof("Added public key %s", base64.StdEncoding.EncodeToString((*key)[:]))
+	}
+
+	if err = tm.ReloadCertificate(); err != nil {
+		return fmt.Errorf("unable to reload TLS certificate, %v", err)
+	}
+	return nil
+}
+
+// loadKey loads the key identified by ref, which is relative to workDir if it is a file.
+func loadKey(workDir, ref, name string) nacl.Key {
+	if enclave.IsKeyFile(ref) {
+		ref = path.Join(workDir, ref)
+	}
+	key, err := enclave.LoadKey(ref)
+	if err != nil {
+		log.Fatalf("Unable to load %s key, error: %v", name, err)
+	}
+	return key
+}
+
+// replay rebuilds the payload and metadata stores from the replay log at replayLogPath. The
+// stores must be empty, so that the result matches the state the log was recorded from.
+func replay(replayLogPath string, key nacl.Key, db, meta storage.DataStore) {
+	for _, store := range []storage.DataStore{db, meta} {
+		empty := true
+		err := store.ReadAll(func(key, value *[]byte) {
+			empty = false
+		})
+		if err != nil {
+			log.Fatalf("Unable to read storage, error: %v", err)
+		}
+		if !empty {
+			log.Fatalln("Storage must be empty to replay a replay log")
+		}
+	}
+
+	applied, err := storage.Replay(replayLogPath, key, map[string]storage.DataStore{
+		replayLogPayloads: db,
+		replayLogMeta:     meta,
+	})
+	if err == storage.ErrReplayLogTruncated {
+		log.Warn(err)
+	} else if err != nil {
+		log.Fatalf("Unable to replay %s after %d records, error: %v", replayLogPath, applied, err)
+	}
+	log.Printf("Replayed %d records from %s", applied, replayLogPath)
+}
+
+// seconds returns the duration of the named setting, configured in seconds.
+func seconds(name string) time.Duration {
+	return time.Duration(config.GetInt(name)) * time.Second
+}
+
+// parseUsageTokens parses publickey:token pairs, returning the public keys associated with each
+// token.
+func parseUsageTokens(pairs []string) (map[string][][]byte, error) {
+	tokens := make(map[string][][]byte)
+	for _, pair := range pairs {
+		i := strings.Index(pair, ":")
+		if i < 0 || i == len(pair)-1 {
+			return nil, fmt.Errorf("expected publickey:token, got %s", pair)
+		}
+		key, err := base64.StdEncoding.DecodeString(pair[:i])
+		if err != nil {
+			return nil, err
+		}
+		token := pair[i+1:]
+		tokens[token] = append(tokens[token], key)
+	}
+	return tokens, nil
+}
+
 func exit() {
 	config.Usage()
 	os.Exit(1)
@@ -0,0 +1,95 @@
+package crypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+	"github.com/kevinburke/nacl"
+	"github.com/kevinburke/nacl/secretbox"
+	"sync"
+)
+
+// Ciphers which can be configured to seal payloads. Nodes must use the same cipher to exchange
+// payloads, and Constellation nodes use NaCl secretbox.
+const (
+	CipherSecretbox = "secretbox"
+	CipherAesGcm    = "aes-gcm"
+)
+
+// Cipher is an authenticated cipher with 32 byte keys and 24 byte nonces. It seals payloads with
+// their master key, and master keys with the key shared between the sender and each recipient.
+type Cipher interface {
+	// Seal returns message encrypted and authenticated with key and nonce.
+	Seal(message []byte, nonce nacl.Nonce, key nacl.Key) []byte
+
+	// Open returns the message sealed with key and nonce, reporting whether it was authentic.
+	Open(sealed []byte, nonce nacl.Nonce, key nacl.Key) ([]byte, bool)
+}
+
+var (
+	cipherMu      sync.RWMutex
+	ciphers       = map[string]Cipher{CipherSecretbox: secretboxCipher{}, CipherAesGcm: aesGcmCipher{}}
+	payloadCipher = ciphers[CipherSecretbox]
+)
+
+// RegisterCipher makes a Cipher available to SetCipher under name, replacing any Cipher already
+// registered under it.
+func RegisterCipher(name string, c Cipher) {
+	cipherMu.Lock()
+	defer cipherMu.Unlock()
+	ciphers[name] = c
+}
+
+// SetCipher sets the Cipher payloads are sealed with to the one registered under name.
+func SetCipher(name string) error {
+	cipherMu.Lock()
+	defer cipherMu.Unlock()
+	c, ok := ciphers[name]
+	if !ok {
+		return fmt.Errorf("unsupported cipher %s", name)
+	}
+	payloadCipher = c
+	return nil
+}
+
+func currentCipher() Cipher {
+	cipherMu.RLock()
+	defer cipherMu.RUnlock()
+	return payloadCipher
+}
+
+// secretboxCipher is NaCl secretbox, as used by Constellation.
+type secretboxCipher struct{}
+
+func (secretboxCipher) Seal(message []byte, nonce nacl.Nonce, key nacl.Key) []byte {
+	return secretbox.Seal([]byte{}, message, nonce, key)
+}
+
+func (secretboxCipher) Open(sealed []byte, nonce nacl.Nonce, key nacl.Key) ([]byte, bool) {
+	return secretbox.Open(nil, sealed, nonce, key)
+}
+
+// aesGcmCipher is AES-256 in Galois/Counter Mode, using the full 24 byte nonce.
+type aesGcmCipher struct{}
+
+func (aesGcmCipher) aead(key nacl.Key) cipher.AEAD {
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		// Only possible for invalid key sizes
+		panic(err)
+	}
+	aead, err := cipher.NewGCMWithNonceSize(block, nacl.NonceSize)
+	if err != nil {
+		panic(err)
+	}
+	return aead
+}
+
+func (c aesGcmCipher) Seal(message []byte, nonce nacl.Nonce, key nacl.Key) []byte {
+	return c.aead(key).Seal([]byte{}, nonce[:], message, nil)
+}
+
+func (c aesGcmCipher) Open(sealed []byte, nonce nacl.Nonce, key nacl.Key) ([]byte, bool) {
+	opened, err := c.aead(key).Open(nil, nonce[:], sealed, nil)
+	return opened, err == nil
+}
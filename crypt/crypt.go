@@ -0,0 +1,90 @@
+// Package crypt implements the encryption of transaction payloads.
+//
+// Payloads are encrypted using the same construction as Constellation, so they can be exchanged
+// with Constellation nodes:
+//   - the payload is sealed with a random master key and nonce using NaCl secretbox
+//   - the master key is sealed for each recipient with NaCl box, between the sender's key pair
+//     and the recipient's public key, using a single random recipient nonce
+//
+// The resulting api.EncryptedPayload holds the sender's public key, the sealed payload, both
+// nonces and a box for each recipient.
+//
+// SetCipher replaces secretbox, for both the payload and its recipient boxes, with another
+// Cipher, such as AES-GCM. The keys shared with recipients are still agreed using NaCl box.
+package crypt
+
+import (
+	"errors"
+	"github.com/blk-io/crux/api"
+	"github.com/kevinburke/nacl"
+	"github.com/kevinburke/nacl/box"
+)
+
+// SharedKey computes the key shared between the holder of privateKey and the holder of the
+// private key corresponding to publicKey. It is the same for both parties, and is used to seal
+// and open master keys.
+func SharedKey(privateKey, publicKey nacl.Key) nacl.Key {
+	return box.Precompute(publicKey, privateKey)
+}
+
+// NewPayload seals message with a newly generated master key, returning a payload with space for
+// the given number of recipient boxes, along with the master key to seal in them.
+func NewPayload(message []byte, senderPubKey nacl.Key, recipients int) (api.EncryptedPayload, nacl.Key) {
+	nonce := nacl.NewNonce()
+	masterKey := nacl.NewKey()
+	recipientNonce := nacl.NewNonce()
+
+	return api.EncryptedPayload{
+		Sender:         senderPubKey,
+		CipherText:     currentCipher().Seal(message, nonce, masterKey),
+		Nonce:          nonce,
+		RecipientBoxes: make([][]byte, recipients),
+		RecipientNonce: recipientNonce,
+	}, masterKey
+}
+
+// SealMasterKey seals masterKey for a recipient, using the key shared between the sender and
+// recipient.
+func SealMasterKey(masterKey nacl.Key, recipientNonce nacl.Nonce, sharedKey nacl.Key) []byte {
+	return currentCipher().Seal((*masterKey)[:], recipientNonce, sharedKey)
+}
+
+// OpenMasterKey opens a recipient box, using the key shared between the sender and recipient.
+func OpenMasterKey(recipientBox []byte, recipientNonce nacl.Nonce, sharedKey nacl.Key) (nacl.Key, error) {
+	opened, ok := currentCipher().Open(recipientBox, recipientNonce, sharedKey)
+	if !ok || len(opened) != nacl.KeySize {
+		return nil, errors.New("unable to open master key secret box")
+	}
+	masterKey := new([nacl.KeySize]byte)
+	copy(masterKey[:], opened)
+	return masterKey, nil
+}
+
+// Encrypt encrypts message from the sender for each of the recipients.
+func Encrypt(message []byte, senderPubKey, senderPrivKey nacl.Key, recipients []nacl.Key) api.EncryptedPayload {
+	epl, masterKey := NewPayload(message, senderPubKey, len(recipients))
+	for i, recipient := range recipients {
+		epl.RecipientBoxes[i] = SealMasterKey(
+			masterKey, epl.RecipientNonce, SharedKey(senderPrivKey, recipient))
+	}
+	return epl
+}
+
+// Decrypt decrypts epl using the recipient box at boxIndex, and the key shared between the sender
+// and the recipient of that box.
+func Decrypt(epl api.EncryptedPayload, boxIndex int, sharedKey nacl.Key) ([]byte, error) {
+	if boxIndex < 0 || boxIndex >= len(epl.RecipientBoxes) {
+		return nil, errors.New("payload does not contain the requested recipient box")
+	}
+
+	masterKey, err := OpenMasterKey(epl.RecipientBoxes[boxIndex], epl.RecipientNonce, sharedKey)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, ok := currentCipher().Open(epl.CipherText, epl.Nonce, masterKey)
+	if !ok {
+		return nil, errors.New("unable to open payload secret box")
+	}
+	return payload, nil
+}
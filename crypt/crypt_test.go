@@ -0,0 +1,120 @@
+package crypt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"github.com/blk-io/crux/api"
+	"github.com/kevinburke/nacl"
+	"github.com/kevinburke/nacl/box"
+	"github.com/kevinburke/nacl/secretbox"
+	"testing"
+)
+
+var message = []byte("Test message")
+
+func generateKey(t *testing.T) (nacl.Key, nacl.Key) {
+	pubKey, privKey, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pubKey, privKey
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	senderPub, senderPriv := generateKey(t)
+	rcpt1Pub, rcpt1Priv := generateKey(t)
+	rcpt2Pub, rcpt2Priv := generateKey(t)
+
+	epl := Encrypt(message, senderPub, senderPriv, []nacl.Key{rcpt1Pub, rcpt2Pub})
+
+	if len(epl.RecipientBoxes) != 2 {
+		t.Fatalf("Expected 2 recipient boxes, found %d", len(epl.RecipientBoxes))
+	}
+
+	for i, rcptPriv := range []nacl.Key{rcpt1Priv, rcpt2Priv} {
+		// Recipients compute the shared key from their private key and the sender's public key
+		payload, err := Decrypt(epl, i, SharedKey(rcptPriv, epl.Sender))
+		if err != nil {
+			t.Fatalf("Recipient %d unable to decrypt payload, %v", i, err)
+		}
+		if !bytes.Equal(payload, message) {
+			t.Errorf("Recipient %d decrypted %s, expected %s", i, payload, message)
+		}
+	}
+
+	// The sender can also decrypt each box
+	_, err := Decrypt(epl, 1, SharedKey(senderPriv, rcpt2Pub))
+	if err != nil {
+		t.Errorf("Sender unable to decrypt payload, %v", err)
+	}
+
+	_, err = Decrypt(epl, 0, SharedKey(rcpt2Priv, epl.Sender))
+	if err == nil {
+		t.Error("Box should not open with another recipient's key")
+	}
+
+	_, err = Decrypt(epl, 2, SharedKey(rcpt1Priv, epl.Sender))
+	if err == nil {
+		t.Error("Decrypting a missing box should fail")
+	}
+}
+
+// TestCompatibility checks payloads can be opened using standard NaCl primitives, as
+// Constellation does.
+func TestCompatibility(t *testing.T) {
+	senderPub, senderPriv := generateKey(t)
+	rcptPub, rcptPriv := generateKey(t)
+
+	epl := Encrypt(message, senderPub, senderPriv, []nacl.Key{rcptPub})
+
+	// Round trip through the wire format
+	decoded, err := api.DecodePayload(api.EncodePayload(epl))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	masterKey, ok := box.Open(nil, decoded.RecipientBoxes[0], decoded.RecipientNonce,
+		decoded.Sender, rcptPriv)
+	if !ok {
+		t.Fatal("Unable to open recipient box with box.Open")
+	}
+
+	key := new([nacl.KeySize]byte)
+	copy(key[:], masterKey)
+	payload, ok := secretbox.Open(nil, decoded.CipherText, decoded.Nonce, key)
+	if !ok {
+		t.Fatal("Unable to open payload with secretbox")
+	}
+	if !bytes.Equal(payload, message) {
+		t.Errorf("Decrypted %s, expected %s", payload, message)
+	}
+}
+
+func TestAesGcmCipher(t *testing.T) {
+	if err := SetCipher(CipherAesGcm); err != nil {
+		t.Fatal(err)
+	}
+	defer SetCipher(CipherSecretbox)
+
+	senderPub, senderPriv := generateKey(t)
+	rcptPub, rcptPriv := generateKey(t)
+
+	epl := Encrypt(message, senderPub, senderPriv, []nacl.Key{rcptPub})
+	payload, err := Decrypt(epl, 0, SharedKey(rcptPriv, epl.Sender))
+	if err != nil || !bytes.Equal(payload, message) {
+		t.Fatalf("Decrypted %s, expected %s, error: %v", payload, message, err)
+	}
+
+	// Payloads sealed with AES-GCM cannot be opened with secretbox
+	if _, ok := secretbox.Open(nil, epl.CipherText, epl.Nonce, nacl.NewKey()); ok {
+		t.Error("Payload should not open with secretbox")
+	}
+	epl.CipherText[0] ^= 1
+	if _, err = Decrypt(epl, 0, SharedKey(rcptPriv, epl.Sender)); err == nil {
+		t.Error("Tampered payload should not be decrypted")
+	}
+
+	if err = SetCipher("rot13"); err == nil {
+		t.Error("Unregistered ciphers should not be set")
+	}
+}
@@ -0,0 +1,126 @@
+package enclave
+
+import (
+	"errors"
+	"github.com/blk-io/crux/api"
+	"github.com/blk-io/crux/storage"
+	"io"
+	"time"
+)
+
+// Names of the enclave's stores in exports.
+const (
+	exportPayloads = "payloads"
+	exportMeta     = "meta"
+)
+
+// StorageStats returns the number of payloads held by the enclave and their total size in bytes.
+func (s *SecureEnclave) StorageStats() (api.StorageStats, error) {
+	var stats api.StorageStats
+	err := s.Db.ReadAll(func(key, value *[]byte) {
+		stats.Entries++
+		stats.Bytes += int64(len(*key) + len(*value))
+	})
+	return stats, err
+}
+
+// Compact reclaims the space used by deleted payloads and metadata, if the underlying storage
+// supports it.
+func (s *SecureEnclave) Compact() error {
+	c, ok := s.Db.(storage.Compacter)
+	if !ok {
+		return errors.New("storage does not support compaction")
+	}
+	if err := c.Compact(); err != nil {
+		return err
+	}
+
+	if meta, ok := s.Meta.(storage.Compacter); ok {
+		return meta.Compact()
+	}
+	return nil
+}
+
+// Purge deletes payloads which were first recorded by this node before the given time, along
+// with their provenance. The age of a payload is taken from its earliest provenance hop, so
+// payloads without any recorded provenance are retained and counted as having an unknown age.
+func (s *SecureEnclave) Purge(before time.Time) (api.PurgeResponse, error) {
+	var result api.PurgeResponse
+	if s.Meta == nil {
+		return result, errors.New("no metadata store configured")
+	}
+
+	// Collect the keys first, as the underlying iterator does not permit concurrent deletes
+	var keys [][]byte
+	err := s.Db.ReadAll(func(key, value *[]byte) {
+		keys = append(keys, append([]byte(nil), *key...))
+	})
+	if err != nil {
+		return result, err
+	}
+
+	provenance := storage.WithPrefix(s.Meta, provenancePrefix)
+	payloadGroups := storage.WithPrefix(s.Meta, payloadGroupPrefix)
+	for _, key := range keys {
+		key := key
+		hops, err := s.Provenance(key)
+		if err != nil {
+			return result, err
+		}
+		if len(hops) == 0 {
+			result.UnknownAge++
+			continue
+		}
+
+		firstSeen := hops[0].Time
+		for _, hop := range hops[1:] {
+			if hop.Time.Before(firstSeen) {
+				firstSeen = hop.Time
+			}
+		}
+		if !firstSeen.Before(before) {
+			continue
+		}
+
+		if err = s.Db.Delete(&key); err != nil {
+			return result, err
+		}
+		if err = s.unindexPayload(key); err != nil {
+			return result, err
+		}
+		s.metaMu.Lock()
+		err = provenance.Delete(&key)
+		if err == nil {
+			err = payloadGroups.Delete(&key)
+		}
+		s.metaMu.Unlock()
+		if err != nil {
+			return result, err
+		}
+		result.Purged++
+	}
+
+	return result, nil
+}
+
+// Export writes all stored payloads and metadata to w as a tar archive, which can be restored
+// with Import, returning the number of entries exported from each store.
+func (s *SecureEnclave) Export(w io.Writer) (map[string]int, error) {
+	return storage.Export(w, s.exportStores())
+}
+
+// Import restores the payloads and metadata of an export read from r, returning the number of
+// entries imported into each store. Updates to metadata are blocked until the import completes.
+func (s *SecureEnclave) Import(r io.Reader) (map[string]int, error) {
+	s.metaMu.Lock()
+	defer s.metaMu.Unlock()
+	return storage.Import(r, s.exportStores())
+}
+
+func (s *SecureEnclave) exportStores() map[string]storage.DataStore {
+	stores := map[string]storage.DataStore{exportPayloads: s.Db}
+	if s.Meta != nil {
+		stores[exportMeta] = s.Meta
+	}
+	return stores
+}
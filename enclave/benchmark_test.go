@@ -0,0 +1,203 @@
+package enclave
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"github.com/blk-io/crux/api"
+	"github.com/blk-io/crux/storage"
+	"github.com/kevinburke/nacl"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// pushClient delivers the payloads pushed by one enclave straight to another, so payloads can be
+// sent and received by both concurrently without a server.
+type pushClient struct {
+	receiver *SecureEnclave
+}
+
+func (c *pushClient) Do(req *http.Request) (*http.Response, error) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	status, respBody := http.StatusOK, []byte{}
+	if strings.HasSuffix(req.URL.Path, "/push") {
+		digest, err := c.receiver.StorePayload(body)
+		if err != nil {
+			status = http.StatusInternalServerError
+		}
+		respBody = []byte(base64.StdEncoding.EncodeToString(digest))
+	}
+	return &http.Response{
+		StatusCode: status, Body: ioutil.NopCloser(bytes.NewReader(respBody))}, nil
+}
+
+// initPair creates a sending enclave and a receiving enclave hosting the key rcpt1, returning
+// them along with rcpt1, and a function to remove their storage.
+func initPair(t testing.TB) (*SecureEnclave, *SecureEnclave, []byte, func()) {
+	dir, err := ioutil.TempDir("", "enclavePair")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pubKeys, err := loadPubKeys([]string{"testdata/rcpt1.pub"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rcpt1 := pubKeys[0]
+
+	db, err := storage.InitLevelDb(dir + "/receiver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiverPi := api.InitPartyInfo("http://localhost:8001", nil, &MockClient{}, false)
+	receiver := Init(db, []string{"testdata/rcpt1.pub"}, []string{"testdata/rcpt1"},
+		receiverPi, &MockClient{}, false)
+
+	client := &pushClient{receiver: receiver}
+	senderPi := api.CreatePartyInfo("http://localhost:8000",
+		[]string{"http://localhost:8001"}, []nacl.Key{rcpt1}, client)
+	sender := initEnclave(t, dir+"/sender", senderPi, client)
+
+	return sender, receiver, (*rcpt1)[:], func() {
+		sender.Db.Close()
+		receiver.Db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// TestConcurrentSendReceive exercises the enclave from many goroutines, as it is by the server's
+// request handlers, and is intended to be run with the race detector.
+func TestConcurrentSendReceive(t *testing.T) {
+	sender, receiver, rcpt1, cleanup := initPair(t)
+	defer cleanup()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				msg := []byte(fmt.Sprintf("message %d-%d", i, j))
+				digest, err := sender.Store(&msg, nil, [][]byte{rcpt1})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+
+				received, err := receiver.Retrieve(&digest, &rcpt1)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if !bytes.Equal(received, msg) {
+					t.Errorf("Received %s whereas %s was sent", received, msg)
+				}
+
+				update := api.CreatePartyInfo(fmt.Sprintf("http://localhost:%d", 9000+i),
+					[]string{"http://localhost:9000"}, []nacl.Key{nacl.NewKey()}, nil)
+				if err = sender.UpdatePartyInfo(api.EncodePartyInfo(update)); err != nil {
+					t.Error(err)
+				}
+				sender.GetEncodedPartyInfo()
+				sender.Usage(nil)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	usage := sender.Usage(nil)
+	if len(usage) != 1 || usage[0].Payloads != 8*20 {
+		t.Errorf("Unexpected usage %v", usage)
+	}
+}
+
+func BenchmarkStore(b *testing.B) {
+	sender, _, rcpt1, cleanup := initPair(b)
+	defer cleanup()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		msg := make([]byte, 1024)
+		for pb.Next() {
+			if _, err := sender.Store(&msg, nil, [][]byte{rcpt1}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkRetrieve(b *testing.B) {
+	sender, receiver, rcpt1, cleanup := initPair(b)
+	defer cleanup()
+
+	msg := make([]byte, 1024)
+	digest, err := sender.Store(&msg, nil, [][]byte{rcpt1})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := receiver.Retrieve(&digest, &rcpt1); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkPush(b *testing.B) {
+	sender, receiver, rcpt1, cleanup := initPair(b)
+	defer cleanup()
+
+	// Capture distinct payloads to push, as a payload is stored under the hash of its cipher text
+	client := &MockClient{}
+	sender.client = client
+	for i := 0; i < b.N; i++ {
+		msg := []byte(fmt.Sprintf("message %d", i))
+		if _, err := sender.Store(&msg, nil, [][]byte{rcpt1}); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	var next int
+	var mu sync.Mutex
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			mu.Lock()
+			encoded := client.requests[next]
+			next++
+			mu.Unlock()
+			if _, err := receiver.StorePayload(encoded); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkUpdatePartyInfo(b *testing.B) {
+	pi := api.InitPartyInfo("http://localhost:8000", nil, &MockClient{}, false)
+	encoded := api.EncodePartyInfo(api.CreatePartyInfo("http://localhost:8001",
+		[]string{"http://localhost:8001"}, []nacl.Key{nacl.NewKey()}, nil))
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if err := pi.UpdatePartyInfo(encoded); err != nil {
+				b.Fatal(err)
+			}
+			if _, ok := pi.GetRecipient(nacl.NewKey()); ok {
+				b.Fatal("Unexpected recipient")
+			}
+		}
+	})
+}
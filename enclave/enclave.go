@@ -3,6 +3,7 @@ package enclave
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/hex"
@@ -10,30 +11,48 @@ import (
 	"errors"
 	"fmt"
 	"github.com/blk-io/crux/api"
+	"github.com/blk-io/crux/crypt"
 	"github.com/blk-io/crux/storage"
 	"github.com/blk-io/crux/utils"
 	"github.com/kevinburke/nacl"
 	"github.com/kevinburke/nacl/box"
-	"github.com/kevinburke/nacl/secretbox"
 	log "github.com/sirupsen/logrus"
 	"io/ioutil"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 )
 
 // SecureEnclave is the secure transaction enclave.
 type SecureEnclave struct {
-	Db         storage.DataStore                  // The underlying key-value datastore for encrypted transactions
-	PubKeys    []nacl.Key                         // Public keys associated with this enclave
-	PrivKeys   []nacl.Key                         // Private keys associated with this enclave
-	selfPubKey nacl.Key                           // An ephemeral key used for transactions only intended for this enclave
-	PartyInfo  api.PartyInfo                      // Details of all other nodes (or parties) on the network
-	keyCache   map[nacl.Key]map[nacl.Key]nacl.Key // Maps sender -> recipient -> shared key
-	client     utils.HttpClient                   // The underlying HTTP client used to propagate requests
+	Db         storage.DataStore                   // The underlying key-value datastore for encrypted transactions
+	Meta       storage.DataStore                   // Optional datastore for metadata about transactions
+	PubKeys    []nacl.Key                          // Public keys associated with this enclave
+	PrivKeys   []nacl.Key                          // Private keys associated with this enclave
+	selfPubKey nacl.Key                            // An ephemeral key used for transactions only intended for this enclave
+	PartyInfo  api.PartyInfo                       // Details of all other nodes (or parties) on the network
+	keyCache   map[nacl.Key]map[nacl.Key]nacl.Key  // Maps sender -> recipient -> shared key
+	delegates  map[[nacl.KeySize]byte]delegatedKey // Private keys held by a KeyProvider
+	client     utils.HttpClient                    // The underlying HTTP client used to propagate requests
 	grpc       bool
+	metaMu     sync.RWMutex
+
+	// PushCompression is the compression applied to payloads pushed to other nodes over HTTP,
+	// one of the utils.Compression algorithms, none if empty.
+	PushCompression string
+
+	idempotencyLocks keyedMutex
+	usage            usageStats
+	keysMu           sync.RWMutex // Guards PubKeys, PrivKeys and delegates, as keys can be added
+	keyCacheMu       sync.RWMutex // Guards keyCache, shared keys are computed without holding it
+	partyInfoMu      sync.Mutex   // Serialises saves of the PartyInfo, see PersistPartyInfo
 }
 
 // Init creates a new instance of the SecureEnclave.
+// Private keys are loaded from the provided files, or from a registered KeyProvider if the
+// reference includes its scheme.
 func Init(
 	db storage.DataStore,
 	pubKeyFiles, privKeyFiles []string,
@@ -49,7 +68,7 @@ func Init(
 
 	// Key format:
 	// {"data":{"bytes":"Wl+xSyXVuuqzpvznOS7dOobhcn4C5auxkFRi7yLtgtA="},"type":"unlocked"}
-	privKeys, err := loadPrivKeys(privKeyFiles)
+	privKeys, delegates, err := loadPrivKeyRefs(pubKeys, privKeyFiles)
 	if err != nil {
 		log.Fatalf("Unable to load private key files: %s, error: %v", privKeyFiles, err)
 	}
@@ -59,6 +78,7 @@ func Init(
 		PubKeys:   pubKeys,
 		PrivKeys:  privKeys,
 		PartyInfo: pi,
+		delegates: delegates,
 		client:    client,
 		grpc:      grpc,
 	}
@@ -87,15 +107,19 @@ func Init(
 
 	enc.selfPubKey = nacl.NewKey()
 
-	for _, pubKey := range enc.PubKeys {
+	for i, pubKey := range enc.PubKeys {
 		enc.keyCache[pubKey] = make(map[nacl.Key]nacl.Key)
 
 		// We have a once off generated key which we use for storing payloads which are addressed
 		// only to ourselves. We have to do this, as we cannot use box.Seal with a public and
 		// private key-pair.
 		//
-		// We pre-compute these keys on startup.
-		enc.resolveSharedKey(enc.PrivKeys[0], pubKey, enc.selfPubKey)
+		// We pre-compute these keys on startup, for each of our keypairs.
+		_, err = enc.resolveSharedKey(enc.PrivKeys[i], pubKey, enc.selfPubKey)
+		if err != nil {
+			log.Fatalf("Unable to compute shared key for public key: %s, error: %v",
+				hex.EncodeToString((*pubKey)[:]), err)
+		}
 	}
 
 	return &enc
@@ -107,14 +131,35 @@ func Init(
 // The hash of the encrypted payload is returned to the sender.
 func (s *SecureEnclave) Store(
 	message *[]byte, sender []byte, recipients [][]byte) ([]byte, error) {
+	return s.StoreContext(context.Background(), message, sender, recipients)
+}
+
+// StoreContext is equivalent to Store, on behalf of ctx. If ctx is done before the payload has
+// been stored, ctx.Err() is returned, and any pushes to its recipients still in progress once it
+// is done are abandoned.
+func (s *SecureEnclave) StoreContext(
+	ctx context.Context, message *[]byte, sender []byte, recipients [][]byte) ([]byte, error) {
+	return s.storeNotify(ctx, message, sender, recipients, nil)
+}
+
+// StoreNotify is equivalent to Store, but if delivered is not nil it is called with the outcome
+// of publishing the payload to each recipient, before StoreNotify returns.
+func (s *SecureEnclave) StoreNotify(
+	message *[]byte, sender []byte, recipients [][]byte,
+	delivered func(recipient []byte, err error)) ([]byte, error) {
+	return s.storeNotify(context.Background(), message, sender, recipients, delivered)
+}
+
+func (s *SecureEnclave) storeNotify(
+	ctx context.Context, message *[]byte, sender []byte, recipients [][]byte,
+	delivered func(recipient []byte, err error)) ([]byte, error) {
 
 	var err error
 	var senderPubKey, senderPrivKey nacl.Key
 
 	if len(sender) == 0 {
 		// from address is either default or specified on communication
-		senderPubKey = s.PubKeys[0]
-		senderPrivKey = s.PrivKeys[0]
+		senderPubKey, senderPrivKey = s.defaultKeyPair()
 	} else {
 		senderPubKey, err = utils.ToKey(sender)
 		if err != nil {
@@ -129,17 +174,25 @@ func (s *SecureEnclave) Store(
 				"Unable to locate private key for sender public key, %v", err)
 			return nil, err
 		}
+		if s.isRetiring(senderPubKey) {
+			return nil, fmt.Errorf("sender public key %s is retiring", encodeKey(sender))
+		}
 	}
 
-	return s.store(message, senderPubKey, senderPrivKey, recipients)
+	start := time.Now()
+	digest, err := s.store(ctx, message, senderPubKey, senderPrivKey, recipients, delivered)
+	s.usage.record(senderPubKey, len(*message), time.Since(start), err)
+	return digest, err
 }
 
 func (s *SecureEnclave) store(
+	ctx context.Context,
 	message *[]byte,
 	senderPubKey, senderPrivKey nacl.Key,
-	recipients [][]byte) ([]byte, error) {
+	recipients [][]byte,
+	delivered func(recipient []byte, err error)) ([]byte, error) {
 
-	epl, masterKey := createEncryptedPayload(message, senderPubKey, recipients)
+	epl, masterKey := crypt.NewPayload(*message, senderPubKey, len(recipients))
 
 	for i, recipient := range recipients {
 
@@ -157,8 +210,11 @@ func (s *SecureEnclave) store(
 			continue
 		}
 
-		sharedKey := s.resolveSharedKey(senderPrivKey, senderPubKey, recipientKey)
-		sealedBox := sealPayload(epl.RecipientNonce, masterKey, sharedKey)
+		sharedKey, err := s.resolveSharedKey(senderPrivKey, senderPubKey, recipientKey)
+		if err != nil {
+			return nil, err
+		}
+		sealedBox := crypt.SealMasterKey(masterKey, epl.RecipientNonce, sharedKey)
 
 		epl.RecipientBoxes[i] = sealedBox
 	}
@@ -178,13 +234,37 @@ func (s *SecureEnclave) store(
 			"Unable to load recipient, %v", err)
 	}
 
-	sharedKey := s.resolveSharedKey(senderPrivKey, senderPubKey, recipientKey)
+	sharedKey, err := s.resolveSharedKey(senderPrivKey, senderPubKey, recipientKey)
+	if err != nil {
+		return nil, err
+	}
 
-	sealedBox := sealPayload(epl.RecipientNonce, masterKey, sharedKey)
-	epl.RecipientBoxes = [][]byte{sealedBox}
+	sealedBox := crypt.SealMasterKey(masterKey, epl.RecipientNonce, sharedKey)
+	if toSelf {
+		epl.RecipientBoxes = [][]byte{sealedBox}
+	} else {
+		epl.RecipientBoxes[0] = sealedBox
+	}
 
-	encodedEpl := api.EncodePayloadWithRecipients(epl, recipients)
-	digest, err := s.storePayload(epl, encodedEpl)
+	// The stored payload also holds a box sealed for the sender, so we can retrieve it regardless
+	// of its recipients
+	sharedKey, err = s.resolveSharedKey(senderPrivKey, senderPubKey, senderPubKey)
+	if err != nil {
+		return nil, err
+	}
+	storedEpl := epl
+	storedEpl.RecipientBoxes = append(append([][]byte{}, epl.RecipientBoxes...),
+		crypt.SealMasterKey(masterKey, epl.RecipientNonce, sharedKey))
+
+	encodedEpl := api.EncodePayloadWithRecipients(storedEpl, recipients)
+	digest, err := s.storePayload(storage.WithContext(ctx, s.Db), storedEpl, encodedEpl)
+	if err == nil {
+		s.recordProvenance(digest, api.ProvenanceHop{
+			Action: api.ProvenanceSend,
+			From:   s.selfUrl(),
+			Sender: encodeKey((*senderPubKey)[:]),
+		})
+	}
 
 	if !toSelf {
 		for i, recipient := range recipients {
@@ -196,74 +276,103 @@ func (s *SecureEnclave) store(
 				RecipientNonce: epl.RecipientNonce,
 			}
 
-			log.WithFields(log.Fields{
+			logger := log.WithFields(log.Fields{
 				"recipient": hex.EncodeToString(recipient), "digest": hex.EncodeToString(digest),
-			}).Debug("Publishing payload")
+			})
+			logger.Debug("Publishing payload")
 
-			s.publishPayload(recipientEpl, recipient)
+			pubErr := s.publishPayload(ctx, recipientEpl, recipient)
+			if pubErr != nil {
+				logger.Errorf("Unable to publish payload, %v", pubErr)
+			}
+			if delivered != nil {
+				delivered(recipient, pubErr)
+			}
 		}
 	}
 
 	return digest, err
 }
 
-func createEncryptedPayload(
-	message *[]byte, senderPubKey nacl.Key, recipients [][]byte) (api.EncryptedPayload, nacl.Key) {
-
-	nonce := nacl.NewNonce()
-	masterKey := nacl.NewKey()
-	recipientNonce := nacl.NewNonce()
-
-	sealedMessage := secretbox.Seal([]byte{}, *message, nonce, masterKey)
-
-	return api.EncryptedPayload{
-		Sender:         senderPubKey,
-		CipherText:     sealedMessage,
-		Nonce:          nonce,
-		RecipientBoxes: make([][]byte, len(recipients)),
-		RecipientNonce: recipientNonce,
-	}, masterKey
-}
-
-func (s *SecureEnclave) publishPayload(epl api.EncryptedPayload, recipient []byte) {
+func (s *SecureEnclave) publishPayload(
+	ctx context.Context, epl api.EncryptedPayload, recipient []byte) error {
 
 	key, err := utils.ToKey(recipient)
 	if err != nil {
-		log.WithField("recipient", recipient).Errorf(
-			"Unable to decode key for recipient, error: %v", err)
+		return fmt.Errorf("unable to decode key for recipient, error: %v", err)
 	}
 
-	if url, ok := s.PartyInfo.GetRecipient(key); ok {
-		encoded := api.EncodePayloadWithRecipients(epl, [][]byte{})
-		if s.grpc {
-			api.PushGrpc(encoded, url, epl)
-		} else {
-			api.Push(encoded, url, s.client)
-		}
+	url, ok := s.PartyInfo.GetRecipient(key)
+	if !ok {
+		return fmt.Errorf("unable to resolve host for recipient: %s",
+			hex.EncodeToString(recipient))
+	}
+
+	// Fail fast rather than waiting on a node which is known to be down
+	if err = s.PartyInfo.AllowRequest(url); err != nil {
+		return err
+	}
+	return s.publishPayloadTo(ctx, epl, recipient, url)
+}
+
+func (s *SecureEnclave) publishPayloadTo(
+	ctx context.Context, epl api.EncryptedPayload, recipient []byte, url string) error {
+	var err error
+	encoded := api.EncodePayloadWithRecipients(epl, [][]byte{})
+	start := time.Now()
+	if s.grpc {
+		err = api.PushGrpcContext(ctx, encoded, url, epl)
 	} else {
-		log.WithField("recipientKey", hex.EncodeToString(recipient)).Error("Unable to resolve host")
+		_, err = api.PushContext(ctx, encoded, url, s.client, s.PushCompression)
+	}
+	s.PartyInfo.RecordRequest(url, time.Since(start), err)
+	if err == nil {
+		s.recordProvenance(utils.Digest(epl.CipherText), api.ProvenanceHop{
+			Action:    api.ProvenancePush,
+			From:      s.selfUrl(),
+			To:        url,
+			Sender:    encodeKey((*epl.Sender)[:]),
+			Recipient: encodeKey(recipient),
+		})
 	}
+	return err
 }
 
 func (s *SecureEnclave) resolveSharedKey(
-	senderPrivKey, senderPubKey, recipientPubKey nacl.Key) nacl.Key {
+	senderPrivKey, senderPubKey, recipientPubKey nacl.Key) (nacl.Key, error) {
+
+	s.keyCacheMu.RLock()
+	sharedKey, ok := s.keyCache[senderPubKey][recipientPubKey]
+	s.keyCacheMu.RUnlock()
+	if ok {
+		return sharedKey, nil
+	}
+
+	// Computing the key may require a request to a KeyProvider, so other senders and recipients
+	// should not wait on it. Concurrent requests for the same pair compute the same key.
+	sharedKey, err := s.precompute(senderPrivKey, senderPubKey, recipientPubKey)
+	if err != nil {
+		return nil, err
+	}
 
+	s.keyCacheMu.Lock()
+	defer s.keyCacheMu.Unlock()
 	keyCache, ok := s.keyCache[senderPubKey]
 	if !ok {
 		keyCache = make(map[nacl.Key]nacl.Key)
 		s.keyCache[senderPubKey] = keyCache
 	}
-
-	sharedKey, ok := keyCache[recipientPubKey]
-	if !ok {
-		sharedKey = box.Precompute(recipientPubKey, senderPrivKey)
-		keyCache[recipientPubKey] = sharedKey
+	if cached, ok := keyCache[recipientPubKey]; ok {
+		return cached, nil
 	}
-
-	return sharedKey
+	keyCache[recipientPubKey] = sharedKey
+	return sharedKey, nil
 }
 
 func (s *SecureEnclave) resolvePrivateKey(publicKey nacl.Key) (nacl.Key, error) {
+	s.keysMu.RLock()
+	defer s.keysMu.RUnlock()
+
 	for i, key := range s.PubKeys {
 		if bytes.Equal((*publicKey)[:], (*key)[:]) {
 			return s.PrivKeys[i], nil
@@ -278,93 +387,153 @@ func (s *SecureEnclave) resolvePrivateKey(publicKey nacl.Key) (nacl.Key, error)
 // transaction. I.e. it is not the original recipient of the transaction, but one of the recipients
 // it is intended for.
 func (s *SecureEnclave) StorePayload(encoded []byte) ([]byte, error) {
-	epl, _ := api.DecodePayloadWithRecipients(encoded)
-	return s.storePayload(epl, encoded)
+	epl, _, err := api.DecodePayloadWithRecipients(encoded)
+	if err != nil {
+		return nil, err
+	}
+	return s.storePayload(s.Db, epl, encoded)
 }
 
-func (s *SecureEnclave) StorePayloadGrpc(epl api.EncryptedPayload, encoded []byte) ([]byte, error) {
-	return s.storePayload(epl, encoded)
+// StoreDecodedPayload is equivalent to StorePayload, for callers which have already decoded the
+// payload, which must be the decoding of encoded.
+func (s *SecureEnclave) StoreDecodedPayload(epl api.EncryptedPayload, encoded []byte) ([]byte, error) {
+	return s.storePayload(s.Db, epl, encoded)
 }
 
-func (s *SecureEnclave) storePayload(epl api.EncryptedPayload, encoded []byte) ([]byte, error) {
-	digestHash := utils.Sha3Hash(epl.CipherText)
-	err := s.Db.Write(&digestHash, &encoded)
-	return digestHash, err
+// StorePayloadGrpc stores a payload pushed via gRPC, which provides the payload both decoded and
+// encoded. The encoded payload is stored under the digest of the decoded payload's cipher text,
+// so they must match.
+func (s *SecureEnclave) StorePayloadGrpc(epl api.EncryptedPayload, encoded []byte) ([]byte, error) {
+	decoded, _, err := api.DecodePayloadWithRecipients(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(decoded.CipherText, epl.CipherText) {
+		return nil, errors.New("encoded payload does not match the payload pushed")
+	}
+	return s.storePayload(s.Db, decoded, encoded)
 }
 
-func sealPayload(
-	recipientNonce nacl.Nonce,
-	masterKey nacl.Key,
-	sharedKey nacl.Key) []byte {
-
-	return box.SealAfterPrecomputation(
-		[]byte{},
-		(*masterKey)[:],
-		recipientNonce,
-		sharedKey)
+func (s *SecureEnclave) storePayload(
+	db storage.DataStore, epl api.EncryptedPayload, encoded []byte) ([]byte, error) {
+	digestHash := utils.Digest(epl.CipherText)
+	err := db.Write(&digestHash, &encoded)
+	if err == nil {
+		if indexErr := s.indexPayload(digestHash, encoded); indexErr != nil {
+			log.WithField("digest", encodeKey(digestHash)).Errorf(
+				"Unable to index payload, %v", indexErr)
+		}
+	}
+	return digestHash, err
 }
 
-// RetrieveDefault is used to retrieve the provided payload. It attempts to use a default key
-// value of the first public key associated with this SecureEnclave instance.
+// RetrieveDefault is used to retrieve the provided payload, when the recipient it is retrieved
+// for is not known. Payloads sent to us by other nodes are decrypted with each of our keys in
+// turn, until one succeeds.
 // If the payload cannot be found, or decrypted successfully an error is returned.
 func (s *SecureEnclave) RetrieveDefault(digestHash *[]byte) ([]byte, error) {
-	// to address is either default or specified on communication
-	key := (*s.PubKeys[0])[:]
-	return s.Retrieve(digestHash, &key)
+	return s.Retrieve(digestHash, nil)
 }
 
-// Retrieve is used to retrieve the provided payload.
+// Retrieve is used to retrieve the provided payload. For payloads sent to us by other nodes, to
+// is the public key of the recipient to decrypt it for, if it is nil or empty each of our keys
+// is tried.
 // If the payload cannot be found, or decrypted successfully an error is returned.
 func (s *SecureEnclave) Retrieve(digestHash *[]byte, to *[]byte) ([]byte, error) {
+	return s.RetrieveContext(context.Background(), digestHash, to)
+}
 
-	encoded, err := s.Db.Read(digestHash)
+// RetrieveContext is equivalent to Retrieve, on behalf of ctx. If ctx is done before the payload
+// has been read, ctx.Err() is returned.
+func (s *SecureEnclave) RetrieveContext(
+	ctx context.Context, digestHash *[]byte, to *[]byte) ([]byte, error) {
+
+	encoded, err := storage.WithContext(ctx, s.Db).Read(digestHash)
 	if err != nil {
 		return nil, err
 	}
 
-	epl, recipients := api.DecodePayloadWithRecipients(*encoded)
-
-	masterKey := new([nacl.KeySize]byte)
-
-	var senderPubKey, senderPrivKey, recipientPubKey, sharedKey nacl.Key
+	epl, recipients, err := api.DecodePayloadWithRecipients(*encoded)
+	if err != nil {
+		return nil, err
+	}
 
-	if len(recipients) == 0 {
-		// This is a payload originally sent to us by another node
-		recipientPubKey = epl.Sender
-		senderPubKey, err = utils.ToKey(*to)
+	if len(recipients) > 0 {
+		// This is a payload that originated from us
+		if i := senderBox(epl, recipients); i >= 0 {
+			return s.decrypt(epl, i, epl.Sender, epl.Sender)
+		}
+		recipientPubKey, err := utils.ToKey(recipients[0])
 		if err != nil {
 			return nil, err
 		}
-	} else {
-		// This is a payload that originated from us
-		senderPubKey = epl.Sender
-		recipientPubKey, err = utils.ToKey(recipients[0])
+		return s.decrypt(epl, 0, epl.Sender, recipientPubKey)
+	}
+
+	// This is a payload originally sent to us by another node
+	if to != nil && len(*to) > 0 {
+		pubKey, err := utils.ToKey(*to)
 		if err != nil {
 			return nil, err
 		}
+		payload, err := s.decrypt(epl, 0, pubKey, epl.Sender)
+
+		// Payloads for a retiring key may have been resealed for the key which replaced it, or
+		// its own replacement in turn
+		s.keysMu.RLock()
+		maxReplacements := len(s.PubKeys)
+		s.keysMu.RUnlock()
+		for i := 0; err != nil && i < maxReplacements; i++ {
+			replacement, ok := s.replacement(pubKey)
+			if !ok {
+				break
+			}
+			pubKey = replacement
+			if replaced, replacedErr := s.decrypt(epl, 0, pubKey, epl.Sender); replacedErr == nil {
+				return replaced, nil
+			}
+		}
+		return payload, err
+	}
+
+	s.keysMu.RLock()
+	pubKeys := append([]nacl.Key{}, s.PubKeys...)
+	s.keysMu.RUnlock()
+	for _, pubKey := range pubKeys {
+		if payload, err := s.decrypt(epl, 0, pubKey, epl.Sender); err == nil {
+			return payload, nil
+		}
 	}
+	return nil, errors.New("payload could not be decrypted with any of this node's keys")
+}
 
-	senderPrivKey, err = s.resolvePrivateKey(senderPubKey)
+// senderBox returns the index of the box sealed for the sender of a payload that originated from
+// us, or -1 if it was stored without one.
+func senderBox(epl api.EncryptedPayload, recipients [][]byte) int {
+	if len(epl.RecipientBoxes) > len(recipients) {
+		return len(recipients)
+	}
+	return -1
+}
+
+// decrypt decrypts epl using the box at boxIndex, shared between the holder of pubKey, one of our
+// keys, and otherPubKey.
+func (s *SecureEnclave) decrypt(
+	epl api.EncryptedPayload, boxIndex int, pubKey, otherPubKey nacl.Key) ([]byte, error) {
+
+	privKey, err := s.resolvePrivateKey(pubKey)
 	if err != nil {
 		return nil, err
 	}
 
 	// we might not have the key in our cache if constellation was restarted, hence we may
 	// need to recreate
-	sharedKey = s.resolveSharedKey(senderPrivKey, senderPubKey, recipientPubKey)
-
-	_, ok := secretbox.Open(masterKey[:0], epl.RecipientBoxes[0], epl.RecipientNonce, sharedKey)
-	if !ok {
-		return nil, errors.New("unable to open master key secret box")
-	}
-
-	var payload []byte
-	payload, ok = secretbox.Open(payload[:0], epl.CipherText, epl.Nonce, masterKey)
-	if !ok {
-		return payload, errors.New("unable to open payload secret box")
+	sharedKey, err := s.resolveSharedKey(privKey, pubKey, otherPubKey)
+	if err != nil {
+		return nil, err
 	}
 
-	return payload, nil
+	return crypt.Decrypt(epl, boxIndex, sharedKey)
 }
 
 // RetrieveFor retrieves a payload with the given digestHash for a specific recipient who was one
@@ -375,33 +544,73 @@ func (s *SecureEnclave) RetrieveFor(digestHash *[]byte, reqRecipient *[]byte) (*
 		return nil, err
 	}
 
-	epl, recipients := api.DecodePayloadWithRecipients(*encoded)
+	recipientEpl, err := recipientPayload(*encoded, *reqRecipient)
+	if err != nil {
+		return nil, err
+	}
+	encodedEpl := api.EncodePayload(recipientEpl)
+	return &encodedEpl, nil
+}
+
+// recipientPayload extracts the payload for a recipient from a payload that originated with us,
+// containing only the recipient's box.
+func recipientPayload(encoded []byte, reqRecipient []byte) (api.EncryptedPayload, error) {
+	epl, recipients, err := api.DecodePayloadWithRecipients(encoded)
+	if err != nil {
+		return api.EncryptedPayload{}, err
+	}
 
 	for i, recipient := range recipients {
-		if bytes.Equal(*reqRecipient, recipient) {
-			recipientEpl := api.EncryptedPayload{
+		if bytes.Equal(reqRecipient, recipient) && i < len(epl.RecipientBoxes) {
+			return api.EncryptedPayload{
 				Sender:         epl.Sender,
 				CipherText:     epl.CipherText,
 				Nonce:          epl.Nonce,
 				RecipientBoxes: [][]byte{epl.RecipientBoxes[i]},
 				RecipientNonce: epl.RecipientNonce,
-			}
-			encoded := api.EncodePayload(recipientEpl)
-			return &encoded, nil
+			}, nil
 		}
 	}
-	return nil, fmt.Errorf("invalid recipient %x requested for payload", reqRecipient)
+	return api.EncryptedPayload{}, fmt.Errorf("invalid recipient %x requested for payload", reqRecipient)
+}
+
+// Repush pushes the payload with the given digestHash to a single recipient, for use when
+// delivery to that recipient failed. The payload is pushed to url if provided, otherwise to the
+// URL associated with the recipient.
+func (s *SecureEnclave) Repush(digestHash []byte, recipient []byte, url string) error {
+	encoded, err := s.Db.Read(&digestHash)
+	if err != nil {
+		return err
+	}
+
+	recipientEpl, err := recipientPayload(*encoded, recipient)
+	if err != nil {
+		return err
+	}
+
+	if url == "" {
+		return s.publishPayload(context.Background(), recipientEpl, recipient)
+	}
+	return s.publishPayloadTo(context.Background(), recipientEpl, recipient, url)
 }
 
 // RetrieveAllFor retrieves all payloads that the specified recipient was an original recipient
 // for.
-// Each payload found is published to the specified recipient.
+// Each payload found is published to the specified recipient. An error is returned if any of the
+// payloads could not be delivered.
 func (s *SecureEnclave) RetrieveAllFor(reqRecipient *[]byte) error {
-	return s.Db.ReadAll(func(key, value *[]byte) {
-		epl, recipients := api.DecodePayloadWithRecipients(*value)
+	var published, failed int
+	err := s.Db.ReadAll(func(key, value *[]byte) {
+		epl, recipients, err := api.DecodePayloadWithRecipients(*value)
+		if err != nil {
+			log.WithField("digest", hex.EncodeToString(*key)).Errorf(
+				"Unable to decode stored payload, %v", err)
+			failed++
+			return
+		}
 
 		for i, recipient := range recipients {
-			if bytes.Equal(*reqRecipient, recipient) {
+			if bytes.Equal(*reqRecipient, recipient) && i < len(epl.RecipientBoxes) {
 				recipientEpl := api.EncryptedPayload{
 					Sender:         epl.Sender,
 					CipherText:     epl.CipherText,
@@ -409,23 +618,177 @@ func (s *SecureEnclave) RetrieveAllFor(reqRecipient *[]byte) error {
 					RecipientBoxes: [][]byte{epl.RecipientBoxes[i]},
 					RecipientNonce: epl.RecipientNonce,
 				}
-				func() {
-					go s.publishPayload(recipientEpl, *reqRecipient)
-				}()
+
+				err := s.publishPayload(context.Background(), recipientEpl, *reqRecipient)
+				if err != nil {
+					log.WithFields(log.Fields{
+						"recipient": hex.EncodeToString(*reqRecipient),
+						"digest":    hex.EncodeToString(*key),
+					}).Errorf("Unable to resend payload, %v", err)
+					failed++
+				} else {
+					published++
+				}
 			}
 		}
 	})
+	if err != nil {
+		return err
+	}
+
+	log.WithField("recipient", hex.EncodeToString(*reqRecipient)).Infof(
+		"Resent %d payloads, %d failed", published, failed)
+
+	if failed > 0 {
+		return fmt.Errorf("unable to resend %d of %d payloads", failed, published+failed)
+	}
+	return nil
+}
+
+// RequestResend asks other nodes on the network to resend payloads for publicKey.
+// If digestHash is provided, peers are asked for that payload in order of health, falling back
+// to the next peer until one is able to provide it. The payload is then stored locally.
+// Otherwise every peer is asked to push all payloads they hold for publicKey.
+func (s *SecureEnclave) RequestResend(publicKey []byte, digestHash []byte) error {
+	peers := s.PartyInfo.RankPeers()
+	if len(peers) == 0 {
+		return errors.New("no peers available to request resend from")
+	}
+
+	if digestHash == nil {
+		var failed int
+		for _, url := range peers {
+			_, err := s.requestResend(url, "all", publicKey, nil)
+			if err != nil {
+				log.WithField("url", url).Errorf("Unable to request resend, %v", err)
+				failed++
+			}
+		}
+		if failed == len(peers) {
+			return errors.New("unable to request resend from any peer")
+		}
+		return nil
+	}
+
+	for _, url := range peers {
+		encoded, err := s.requestResend(url, "individual", publicKey, digestHash)
+		if err != nil {
+			log.WithFields(log.Fields{"url": url, "digest": hex.EncodeToString(digestHash)}).Debugf(
+				"Unable to request resend, %v", err)
+			continue
+		}
+
+		epl, err := decodeResentPayload(encoded)
+		if err != nil || !bytes.Equal(utils.Digest(epl.CipherText), digestHash) {
+			log.WithField("url", url).Warnf("Invalid payload received in response to resend")
+			continue
+		}
+
+		_, err = s.storePayload(s.Db, epl, api.EncodePayloadWithRecipients(epl, [][]byte{}))
+		if err == nil {
+			s.recordProvenance(digestHash, api.ProvenanceHop{
+				Action:    api.ProvenanceResend,
+				From:      url,
+				To:        s.selfUrl(),
+				Sender:    encodeKey((*epl.Sender)[:]),
+				Recipient: encodeKey(publicKey),
+			})
+		}
+		return err
+	}
+
+	return fmt.Errorf("no peer was able to resend payload %s", hex.EncodeToString(digestHash))
+}
+
+func (s *SecureEnclave) requestResend(
+	url, resendType string, publicKey, digestHash []byte) ([]byte, error) {
+
+	var encoded []byte
+	var err error
+	start := time.Now()
+	if s.grpc {
+		encoded, err = api.ResendGrpc(resendType, publicKey, digestHash, url)
+	} else {
+		resendReq := api.ResendRequest{
+			Type:      resendType,
+			PublicKey: base64.StdEncoding.EncodeToString(publicKey),
+		}
+		if digestHash != nil {
+			resendReq.Key = base64.StdEncoding.EncodeToString(digestHash)
+		}
+		encoded, err = api.Resend(resendReq, url, s.client)
+	}
+	s.PartyInfo.RecordRequest(url, time.Since(start), err)
+	return encoded, err
+}
+
+// decodeResentPayload decodes a payload resent by a remote node, which should contain only our
+// recipient box.
+func decodeResentPayload(encoded []byte) (api.EncryptedPayload, error) {
+	epl, err := api.DecodePayload(encoded)
+	if err == nil && len(epl.RecipientBoxes) != 1 {
+		err = fmt.Errorf("expected a single recipient box, found %d", len(epl.RecipientBoxes))
+	}
+	return epl, err
+}
+
+// Exists reports whether a payload with the given digestHash is held by the SecureEnclave,
+// without decoding or decrypting it.
+func (s *SecureEnclave) Exists(digestHash *[]byte) (bool, error) {
+	return s.Db.Has(digestHash)
+}
+
+// AnswerChallenge proves that we hold the private key for the challenge's public key, by opening
+// the box it contains. Only boxes beginning with api.ChallengeTag are answered, with the contents
+// following it.
+func (s *SecureEnclave) AnswerChallenge(challenge api.PartyInfoChallenge) ([]byte, error) {
+	pubKey, err := utils.ToKey(challenge.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	ephemeralKey, err := utils.ToKey(challenge.EphemeralKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(challenge.Box) < nacl.NonceSize {
+		return nil, errors.New("challenge box is too short")
+	}
+
+	privKey, err := s.resolvePrivateKey(pubKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// The ephemeral key is single use, so the shared key is not cached
+	sharedKey, err := s.precompute(privKey, pubKey, ephemeralKey)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := new([nacl.NonceSize]byte)
+	copy(nonce[:], challenge.Box[:nacl.NonceSize])
+	opened, ok := box.OpenAfterPrecomputation(nil, challenge.Box[nacl.NonceSize:], nonce, sharedKey)
+	if !ok {
+		return nil, errors.New("unable to open challenge box")
+	}
+	if !bytes.HasPrefix(opened, []byte(api.ChallengeTag)) {
+		return nil, errors.New("challenge box does not contain a party info challenge")
+	}
+	return opened[len(api.ChallengeTag):], nil
 }
 
 // Delete deletes the payload associated with the given digestHash from the SecureEnclave's store.
 func (s *SecureEnclave) Delete(digestHash *[]byte) error {
-	return s.Db.Delete(digestHash)
+	if err := s.Db.Delete(digestHash); err != nil {
+		return err
+	}
+	return s.unindexPayload(*digestHash)
 }
 
 // UpdatePartyInfo applies the provided binary encoded party details to the SecureEnclave's
 // own party details store.
-func (s *SecureEnclave) UpdatePartyInfo(encoded []byte) {
-	s.PartyInfo.UpdatePartyInfo(encoded)
+func (s *SecureEnclave) UpdatePartyInfo(encoded []byte) error {
+	return s.PartyInfo.UpdatePartyInfo(encoded)
 }
 
 func (s *SecureEnclave) UpdatePartyInfoGrpc(url string, recipients map[[nacl.KeySize]byte]string, parties map[string]bool) {
@@ -449,6 +812,19 @@ func (s *SecureEnclave) GetPartyInfo() (string, map[[nacl.KeySize]byte]string, m
 	return s.PartyInfo.GetAllValues()
 }
 
+// PeerHealth returns the observed health of the nodes the SecureEnclave has made requests to,
+// ordered by URL.
+func (s *SecureEnclave) PeerHealth() []api.PeerHealth {
+	peers := s.PartyInfo.GetPeerHealth()
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Url < peers[j].Url })
+	return peers
+}
+
+// PeerStatus returns the liveness of the other nodes the SecureEnclave knows of, ordered by URL.
+func (s *SecureEnclave) PeerStatus() []api.PeerStatus {
+	return s.PartyInfo.GetPeerStatus()
+}
+
 func loadPubKeys(pubKeyFiles []string) ([]nacl.Key, error) {
 	return loadKeys(
 		pubKeyFiles,
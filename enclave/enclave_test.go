@@ -2,14 +2,23 @@ package enclave
 
 import (
 	"bytes"
+	"context"
+	crand "crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"github.com/blk-io/crux/api"
+	"github.com/blk-io/crux/crypt"
 	"github.com/blk-io/crux/storage"
 	"github.com/blk-io/crux/utils"
 	"github.com/kevinburke/nacl"
+	"github.com/kevinburke/nacl/box"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"path"
+	"reflect"
+	"sort"
 	"sync"
 	"testing"
 	"time"
@@ -33,7 +42,7 @@ func (c *MockClient) Do(req *http.Request) (*http.Response, error) {
 	c.serviceMu.Unlock()
 
 	respBody := ioutil.NopCloser(bytes.NewReader([]byte("")))
-	return &http.Response{Body: respBody}, nil
+	return &http.Response{StatusCode: http.StatusOK, Body: respBody}, nil
 }
 
 func (c *MockClient) reqCount() int {
@@ -42,8 +51,24 @@ func (c *MockClient) reqCount() int {
 	return len(c.requests)
 }
 
+func decodePayload(t *testing.T, encoded []byte) api.EncryptedPayload {
+	epl, err := api.DecodePayload(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return epl
+}
+
+func decodePayloadWithRecipients(t *testing.T, encoded []byte) (api.EncryptedPayload, [][]byte) {
+	epl, recipients, err := api.DecodePayloadWithRecipients(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return epl, recipients
+}
+
 func initEnclave(
-	t *testing.T,
+	t testing.TB,
 	dbPath string,
 	pi api.PartyInfo,
 	client utils.HttpClient) *SecureEnclave {
@@ -123,7 +148,7 @@ func TestStoreAndRetrieve(t *testing.T) {
 	}
 
 	propagatedPl := mockClient.requests[0]
-	epl, recipients := api.DecodePayloadWithRecipients(propagatedPl)
+	epl, recipients := decodePayloadWithRecipients(t, propagatedPl)
 
 	if len(recipients) != 0 {
 		t.Errorf("Recipients should be empty in data sent to other nodes, actual size: %d\n",
@@ -195,6 +220,128 @@ func TestStoreAndRetrieveSelf(t *testing.T) {
 	}
 }
 
+func TestRetrieveAnyKey(t *testing.T) {
+	dbPath, err := ioutil.TempDir("", "TestRetrieveAnyKey")
+
+	if err != nil {
+		t.Fatal(err)
+	} else {
+		defer os.RemoveAll(dbPath)
+	}
+
+	mockClient := &MockClient{}
+	pubKeys, err := loadPubKeys([]string{"testdata/rcpt1.pub"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rcpt1 := pubKeys[0]
+
+	pi := api.CreatePartyInfo(
+		"http://localhost:8000",
+		[]string{"http://localhost:8001"},
+		[]nacl.Key{rcpt1},
+		mockClient)
+	enc := initEnclave(t, dbPath, pi, mockClient)
+
+	digest, err := enc.Store(&message, []byte{}, [][]byte{(*rcpt1)[:]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mockClient.reqCount() != 1 {
+		t.Fatalf("Expected the payload to be pushed to rcpt1, requests: %d", mockClient.reqCount())
+	}
+
+	// The receiving node holds rcpt1 alongside its default key
+	db, err := storage.InitLevelDb(dbPath + "2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc2 := Init(
+		db,
+		[]string{"testdata/key.pub", "testdata/rcpt1.pub"},
+		[]string{"testdata/key", "testdata/rcpt1"},
+		pi,
+		mockClient, false)
+
+	if _, err = enc2.StorePayload(mockClient.requests[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, to := range []*[]byte{nil, {}} {
+		returned, err := enc2.Retrieve(&digest, to)
+		if err != nil || !bytes.Equal(returned, message) {
+			t.Errorf("Retrieved message %s does not match %s, error: %v", returned, message, err)
+		}
+	}
+	returned, err := enc2.RetrieveDefault(&digest)
+	if err != nil || !bytes.Equal(returned, message) {
+		t.Errorf("Retrieved message %s does not match %s, error: %v", returned, message, err)
+	}
+
+	// A node without the recipient's key cannot decrypt it with any of its keys
+	db3, err := storage.InitLevelDb(dbPath + "3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc3 := Init(db3, []string{"testdata/key.pub"}, []string{"testdata/key"}, pi, mockClient, false)
+	if _, err = enc3.StorePayload(mockClient.requests[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = enc3.RetrieveDefault(&digest); err == nil {
+		t.Error("Payload should not be decrypted without the recipient's key")
+	}
+}
+
+func TestRetrieveSenderBox(t *testing.T) {
+	dbPath, err := ioutil.TempDir("", "TestRetrieveSenderBox")
+
+	if err != nil {
+		t.Fatal(err)
+	} else {
+		defer os.RemoveAll(dbPath)
+	}
+
+	enc := initDefaultEnclave(t, dbPath)
+	recipients, err := loadPubKeys([]string{"testdata/rcpt1.pub", "testdata/rcpt2.pub"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	digest, err := enc.Store(&message, []byte{}, [][]byte{(*recipients[0])[:], (*recipients[1])[:]})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encoded := readPayload(t, enc, digest)
+	epl, stored := decodePayloadWithRecipients(t, *encoded)
+	if len(stored) != 2 || len(epl.RecipientBoxes) != 3 {
+		t.Fatalf("Expected boxes for 2 recipients and the sender, found %d boxes, %d recipients",
+			len(epl.RecipientBoxes), len(stored))
+	}
+
+	// The sender box is sealed for the sender alone
+	sharedKey := crypt.SharedKey(enc.PrivKeys[0], enc.PubKeys[0])
+	returned, err := crypt.Decrypt(epl, 2, sharedKey)
+	if err != nil || !bytes.Equal(returned, message) {
+		t.Errorf("Sender box should decrypt %s, got %s, error: %v", message, returned, err)
+	}
+	returned, err = enc.RetrieveDefault(&digest)
+	if err != nil || !bytes.Equal(returned, message) {
+		t.Errorf("Retrieved message %s does not match %s, error: %v", returned, message, err)
+	}
+
+	// Payloads stored without a sender box are retrieved using the first recipient's box
+	epl.RecipientBoxes = epl.RecipientBoxes[:2]
+	legacy := api.EncodePayloadWithRecipients(epl, stored)
+	if err = enc.Db.Write(&digest, &legacy); err != nil {
+		t.Fatal(err)
+	}
+	returned, err = enc.RetrieveDefault(&digest)
+	if err != nil || !bytes.Equal(returned, message) {
+		t.Errorf("Retrieved message %s does not match %s, error: %v", returned, message, err)
+	}
+}
+
 func TestStoreNotAuthorised(t *testing.T) {
 	dbPath, err := ioutil.TempDir("", "TestStoreNotAuthorised")
 
@@ -335,10 +482,15 @@ func TestRetrieveFor(t *testing.T) {
 		t.Fatal(err)
 	}
 
+	exists, err := enc.Exists(&digest)
+	if err != nil || !exists {
+		t.Errorf("Payload should exist, error: %v", err)
+	}
+
 	var returned *[]byte
 	returned, err = enc.RetrieveFor(&digest, &rcpt1)
 
-	epl := api.DecodePayload(*returned)
+	epl := decodePayload(t, *returned)
 
 	if len(epl.RecipientBoxes) != 1 {
 		t.Errorf("Retrieved record does not contain a single box, total: %d",
@@ -372,6 +524,61 @@ func TestRetrieveForInvalid(t *testing.T) {
 	}
 }
 
+func TestRepush(t *testing.T) {
+	dbPath, err := ioutil.TempDir("", "TestRepush")
+
+	if err != nil {
+		t.Fatal(err)
+	} else {
+		defer os.RemoveAll(dbPath)
+	}
+
+	mockClient := &MockClient{requests: [][]byte{}}
+
+	pubKeys, err := loadPubKeys([]string{"testdata/rcpt1.pub", "testdata/rcpt2.pub"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rcpt1, rcpt2 := (*pubKeys[0])[:], (*pubKeys[1])[:]
+
+	pi := api.CreatePartyInfo(
+		"http://localhost:8000",
+		[]string{"http://localhost:8001", "http://localhost:8002"},
+		pubKeys,
+		mockClient)
+
+	enc := initEnclave(t, dbPath, pi, mockClient)
+
+	digest, err := enc.Store(&message, []byte{}, [][]byte{rcpt1, rcpt2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = enc.Repush(digest, rcpt2, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if mockClient.reqCount() != 3 {
+		t.Fatalf("Three requests should have been captured, actual: %d\n", mockClient.reqCount())
+	}
+
+	repushed, _ := decodePayloadWithRecipients(t, mockClient.requests[2])
+	expected, err := enc.RetrieveFor(&digest, &rcpt2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(repushed, decodePayload(t, *expected)) {
+		t.Error("Repushed payload does not match the recipient's payload")
+	}
+
+	rcpt3 := (*nacl.NewKey())[:]
+	err = enc.Repush(digest, rcpt3, "http://localhost:8003")
+	if err == nil {
+		t.Error("No error returned pushing to a key that is not a recipient")
+	}
+}
+
 func TestRetrieveAllFor(t *testing.T) {
 	dbPath, err := ioutil.TempDir("", "TestRetrieveAllFor")
 
@@ -416,16 +623,14 @@ func TestRetrieveAllFor(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	// we need to wait for the replay go-routines to complete
-	time.Sleep(1 * time.Millisecond)
 	if mockClient.reqCount() != 4 {
 		t.Errorf("Four requests should have been captured, actual: %d\n",
 			len(mockClient.requests))
 	}
 }
 
-func TestDoKeyGeneration(t *testing.T) {
-	dbPath, err := ioutil.TempDir("", "TestDoKeyGeneration")
+func TestRetrieveAllForMultipleRecipients(t *testing.T) {
+	dbPath, err := ioutil.TempDir("", "TestRetrieveAllForMultipleRecipients")
 
 	if err != nil {
 		t.Fatal(err)
@@ -433,20 +638,1639 @@ func TestDoKeyGeneration(t *testing.T) {
 		defer os.RemoveAll(dbPath)
 	}
 
-	keyFiles := path.Join(dbPath, "testKey")
-	err = DoKeyGeneration(keyFiles)
+	mockClient := &MockClient{requests: [][]byte{}}
 
+	pubKeys, err := loadPubKeys([]string{"testdata/rcpt1.pub", "testdata/rcpt2.pub"})
 	if err != nil {
 		t.Fatal(err)
 	}
+	rcpt1, rcpt2 := (*pubKeys[0])[:], (*pubKeys[1])[:]
 
-	_, err = loadPubKeys([]string{keyFiles + ".pub"})
+	pi := api.CreatePartyInfo(
+		"http://localhost:8000",
+		[]string{"http://localhost:8001", "http://localhost:8002"},
+		pubKeys,
+		mockClient)
+
+	enc := initEnclave(t, dbPath, pi, mockClient)
+
+	digest, err := enc.Store(&message, []byte{}, [][]byte{rcpt1, rcpt2})
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	_, err = loadPrivKeys([]string{keyFiles + ".key"})
+	if mockClient.reqCount() != 2 {
+		t.Errorf("Two requests should have been captured, actual: %d\n", mockClient.reqCount())
+	}
+
+	err = enc.RetrieveAllFor(&rcpt2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if mockClient.reqCount() != 3 {
+		t.Errorf("Three requests should have been captured, actual: %d\n", mockClient.reqCount())
+	}
+
+	// The payload resent to the second recipient must contain its own box
+	resent, _ := decodePayloadWithRecipients(t, mockClient.requests[2])
+	expected, err := enc.RetrieveFor(&digest, &rcpt2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(resent.RecipientBoxes[0], decodePayload(t, *expected).RecipientBoxes[0]) {
+		t.Error("Resent payload does not contain the recipient's box")
+	}
+}
+
+// resendClient serves resend requests from the provided enclave for a single host, requests to
+// any other host fail.
+type resendClient struct {
+	host string
+	enc  *SecureEnclave
+}
+
+func (c *resendClient) Do(req *http.Request) (*http.Response, error) {
+	if req.URL.Host != c.host {
+		return nil, errors.New("connection refused")
+	}
+
+	var resendReq api.ResendRequest
+	err := json.NewDecoder(req.Body).Decode(&resendReq)
+	if err != nil {
+		return nil, err
+	}
+	key, _ := base64.StdEncoding.DecodeString(resendReq.Key)
+	publicKey, _ := base64.StdEncoding.DecodeString(resendReq.PublicKey)
+
+	encoded, err := c.enc.RetrieveFor(&key, &publicKey)
+	if err != nil {
+		respBody := ioutil.NopCloser(bytes.NewReader([]byte(err.Error())))
+		return &http.Response{StatusCode: http.StatusBadRequest, Body: respBody}, nil
+	}
+	respBody := ioutil.NopCloser(bytes.NewReader(*encoded))
+	return &http.Response{StatusCode: http.StatusOK, Body: respBody}, nil
+}
+
+func TestRequestResend(t *testing.T) {
+	dbPath, err := ioutil.TempDir("", "TestRequestResend")
+
+	if err != nil {
+		t.Fatal(err)
+	} else {
+		defer os.RemoveAll(dbPath)
+	}
+
+	senderEnc := initDefaultEnclave(t, path.Join(dbPath, "sender"))
+
+	pubKeys, err := loadPubKeys([]string{"testdata/rcpt1.pub"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rcpt1 := (*pubKeys[0])[:]
+
+	digest, err := senderEnc.Store(&message, []byte{}, [][]byte{rcpt1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &resendClient{host: "localhost:8002", enc: senderEnc}
+	pi := api.InitPartyInfo(
+		"http://localhost:8000",
+		[]string{"http://localhost:8001", "http://localhost:8002"}, client, false)
+
+	db, err := storage.InitLevelDb(path.Join(dbPath, "recipient"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc := Init(db, []string{"testdata/rcpt1.pub"}, []string{"testdata/rcpt1"}, pi, client, false)
+
+	_, err = enc.Retrieve(&digest, &rcpt1)
+	if err == nil {
+		t.Fatal("Payload should not be present before resend")
+	}
+
+	err = enc.RequestResend(rcpt1, digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	returned, err := enc.Retrieve(&digest, &rcpt1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(message, returned) {
+		t.Errorf("Retrieved message is not the same as original:\n"+
+			"Original: %v\nRetrieved: %v", message, returned)
+	}
+
+	// The failing peer should now be tried last
+	ranked := enc.PartyInfo.RankPeers()
+	expected := []string{"http://localhost:8002", "http://localhost:8001"}
+	if !reflect.DeepEqual(ranked, expected) {
+		t.Errorf("Peers not ranked by health, expected: %v, actual: %v", expected, ranked)
+	}
+
+	missing := utils.Digest([]byte("missing"))
+	err = enc.RequestResend(rcpt1, missing)
+	if err == nil {
+		t.Error("No error returned requesting resend of unknown payload")
+	}
+}
+
+func TestProvenance(t *testing.T) {
+	dbPath, err := ioutil.TempDir("", "TestProvenance")
+
+	if err != nil {
+		t.Fatal(err)
+	} else {
+		defer os.RemoveAll(dbPath)
+	}
+
+	pubKeys, err := loadPubKeys([]string{"testdata/rcpt1.pub"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rcpt1 := (*pubKeys[0])[:]
+
+	client := &MockClient{}
+	pi := api.CreatePartyInfo(
+		"http://localhost:8000",
+		[]string{"http://localhost:8001"},
+		pubKeys,
+		client)
+
+	enc := initEnclave(t, path.Join(dbPath, "payloads"), pi, client)
+	enc.Meta, err = storage.InitLevelDb(path.Join(dbPath, "meta"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	digest, err := enc.Store(&message, []byte{}, [][]byte{rcpt1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hops, err := enc.Provenance(digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sender := encodeKey((*enc.PubKeys[0])[:])
+	expected := []api.ProvenanceHop{
+		{Action: api.ProvenanceSend, From: "http://localhost:8000", Sender: sender},
+		{
+			Action:    api.ProvenancePush,
+			From:      "http://localhost:8000",
+			To:        "http://localhost:8001",
+			Sender:    sender,
+			Recipient: encodeKey(rcpt1),
+		},
+	}
+
+	if len(hops) != len(expected) {
+		t.Fatalf("Expected %d hops, found: %v", len(expected), hops)
+	}
+	for i, hop := range hops {
+		if hop.Time.IsZero() {
+			t.Errorf("Hop %d has no time recorded", i)
+		}
+		hop.Time = expected[i].Time
+		if hop != expected[i] {
+			t.Errorf("Hop %d is %v, expected %v", i, hop, expected[i])
+		}
+	}
+
+	// The sender is populated from the payload if not provided
+	err = enc.RecordProvenance(digest, api.ProvenanceHop{Action: api.ProvenanceReceive})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hops, err = enc.Provenance(digest)
 	if err != nil {
 		t.Fatal(err)
 	}
+	if len(hops) != 3 || hops[2].Sender != sender {
+		t.Errorf("Received hop not recorded with sender, hops: %v", hops)
+	}
+}
+
+// challengeClient answers party info challenges using the provided enclave.
+type challengeClient struct {
+	enc *SecureEnclave
+}
+
+func (c *challengeClient) Do(req *http.Request) (*http.Response, error) {
+	var challenge api.PartyInfoChallenge
+	err := json.NewDecoder(req.Body).Decode(&challenge)
+	if err != nil {
+		return nil, err
+	}
+
+	answer, err := c.enc.AnswerChallenge(challenge)
+	if err != nil {
+		respBody := ioutil.NopCloser(bytes.NewReader([]byte(err.Error())))
+		return &http.Response{StatusCode: http.StatusBadRequest, Body: respBody}, nil
+	}
+	respBody := ioutil.NopCloser(bytes.NewReader(answer))
+	return &http.Response{StatusCode: http.StatusOK, Body: respBody}, nil
+}
+
+func TestPartyInfoValidation(t *testing.T) {
+	dbPath, err := ioutil.TempDir("", "TestPartyInfoValidation")
+
+	if err != nil {
+		t.Fatal(err)
+	} else {
+		defer os.RemoveAll(dbPath)
+	}
+
+	enc := initDefaultEnclave(t, dbPath)
+
+	pubKeys, err := loadPubKeys([]string{"testdata/key.pub", "testdata/rcpt1.pub"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	held, notHeld := pubKeys[0], pubKeys[1]
+
+	pi := api.InitPartyInfo(
+		"http://localhost:8002", []string{}, &challengeClient{enc: enc}, false)
+	pi.EnableValidation()
+
+	announced := api.CreatePartyInfo(
+		"http://localhost:8000",
+		[]string{"http://localhost:8000", "http://localhost:8000"},
+		[]nacl.Key{held, notHeld},
+		&MockClient{})
+
+	err = pi.UpdatePartyInfo(api.EncodePartyInfo(announced))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if url, ok := pi.GetRecipient(held); !ok || url != "http://localhost:8000" {
+		t.Errorf("Validated recipient was not accepted, url: %s", url)
+	}
+	if url, ok := pi.GetRecipient(notHeld); ok {
+		t.Errorf("Recipient which could not be validated was accepted, url: %s", url)
+	}
+
+	// Challenges cannot be used to open the recipient boxes of payloads sent to us
+	otherPubKey, otherPrivKey, err := box.GenerateKey(crand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	epl := crypt.Encrypt(message, otherPubKey, otherPrivKey, []nacl.Key{held})
+	answer, err := enc.AnswerChallenge(api.PartyInfoChallenge{
+		PublicKey:    (*held)[:],
+		EphemeralKey: (*otherPubKey)[:],
+		Box:          append(append([]byte{}, (*epl.RecipientNonce)[:]...), epl.RecipientBoxes[0]...),
+	})
+	if err == nil {
+		t.Errorf("Challenge opening a recipient box was answered with %v", answer)
+	}
+}
+
+func TestDoKeyGeneration(t *testing.T) {
+	dbPath, err := ioutil.TempDir("", "TestDoKeyGeneration")
+
+	if err != nil {
+		t.Fatal(err)
+	} else {
+		defer os.RemoveAll(dbPath)
+	}
+
+	keyFiles := path.Join(dbPath, "testKey")
+	err = DoKeyGeneration(keyFiles)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = loadPubKeys([]string{keyFiles + ".pub"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = loadPrivKeys([]string{keyFiles + ".key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStoreIdempotent(t *testing.T) {
+	dbPath, err := ioutil.TempDir("", "TestStoreIdempotent")
+
+	if err != nil {
+		t.Fatal(err)
+	} else {
+		defer os.RemoveAll(dbPath)
+	}
+
+	pubKeys, err := loadPubKeys([]string{"testdata/rcpt1.pub"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rcpt1 := (*pubKeys[0])[:]
+
+	client := &MockClient{}
+	pi := api.CreatePartyInfo(
+		"http://localhost:8000",
+		[]string{"http://localhost:8001"},
+		pubKeys,
+		client)
+
+	enc := initEnclave(t, path.Join(dbPath, "payloads"), pi, client)
+	enc.Meta, err = storage.InitLevelDb(path.Join(dbPath, "meta"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	digest, replayed, err := enc.StoreIdempotent(&message, []byte{}, [][]byte{rcpt1}, "key1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replayed {
+		t.Error("First request should not be replayed")
+	}
+
+	retried, replayed, err := enc.StoreIdempotent(&message, []byte{}, [][]byte{rcpt1}, "key1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !replayed || !bytes.Equal(retried, digest) {
+		t.Errorf("Retried request should replay %v, got %v, replayed: %v", digest, retried, replayed)
+	}
+	if client.reqCount() != 1 {
+		t.Errorf("Payload should only be propagated once, propagated %d times", client.reqCount())
+	}
+
+	other := []byte("another message")
+	_, _, err = enc.StoreIdempotent(&other, []byte{}, [][]byte{rcpt1}, "key1")
+	if err != api.ErrIdempotencyKeyReused {
+		t.Errorf("Reusing a key for a different request should fail, got: %v", err)
+	}
+
+	fresh, replayed, err := enc.StoreIdempotent(&message, []byte{}, [][]byte{rcpt1}, "key2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replayed || bytes.Equal(fresh, digest) {
+		t.Error("A new idempotency key should create a new transaction")
+	}
+
+	// Moving bytes between the message and recipients is a different request
+	shifted := append(append([]byte{}, message...), rcpt1...)
+	_, _, err = enc.StoreIdempotent(&shifted, []byte{}, [][]byte{}, "key2")
+	if err != api.ErrIdempotencyKeyReused {
+		t.Errorf("Reusing a key for a different request should fail, got: %v", err)
+	}
+}
+
+func TestListPayloadsLogged(t *testing.T) {
+	dbPath, err := ioutil.TempDir("", "TestListPayloadsLogged")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dbPath)
+
+	meta, err := storage.InitLevelDb(path.Join(dbPath, "meta"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := nacl.NewKey()
+	replayLog, err := storage.OpenReplayLog(path.Join(dbPath, "crux.replay"), secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replayLog.Close()
+
+	// The metadata store is wrapped as crux wraps it, with the replay log outermost
+	enc := initDefaultEnclave(t, path.Join(dbPath, "payloads"))
+	enc.Meta = replayLog.Wrap("meta", storage.WithCompression(storage.WithEncryption(meta, secret)))
+	if err = enc.IndexPayloads(); err != nil {
+		t.Fatal(err)
+	}
+	sender := (*enc.PubKeys[0])[:]
+	var sent [][]byte
+	for i := 0; i < 3; i++ {
+		payload := []byte{byte(i)}
+		digest, err := enc.Store(&payload, sender, [][]byte{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sent = append(sent, digest)
+	}
+	sort.Slice(sent, func(i, j int) bool { return bytes.Compare(sent[i], sent[j]) < 0 })
+
+	// Unrelated entries which cannot be decrypted are not read when listing payloads
+	key, value := []byte("zzz/undecryptable"), []byte("value")
+	if err = storage.WithEncryption(meta, nacl.NewKey()).Write(&key, &value); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := enc.ListPayloads(api.PartySender, sender, nil, 2)
+	if err != nil || !reflect.DeepEqual(keys, sent[:2]) {
+		t.Errorf("Listed %v, expected %v, error: %v", keys, sent[:2], err)
+	}
+	keys, err = enc.ListPayloads(api.PartySender, sender, sent[1], 2)
+	if err != nil || !reflect.DeepEqual(keys, sent[2:]) {
+		t.Errorf("Listed %v after %v, expected %v, error: %v", keys, sent[1], sent[2:], err)
+	}
+}
+
+func TestEncryptedStorage(t *testing.T) {
+	dbPath, err := ioutil.TempDir("", "TestEncryptedStorage")
+
+	if err != nil {
+		t.Fatal(err)
+	} else {
+		defer os.RemoveAll(dbPath)
+	}
+
+	db, err := storage.InitLevelDb(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	legacyKey, legacyValue := []byte("legacy"), []byte("written before encryption")
+	err = db.Write(&legacyKey, &legacyValue)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storageKey, err := LoadKey("testdata/key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted := storage.WithEncryption(db, storageKey)
+
+	client := &MockClient{}
+	pi := api.InitPartyInfo(
+		"http://localhost:8000",
+		[]string{"http://localhost:8001"}, client, false)
+	enc := Init(encrypted, []string{"testdata/key.pub"}, []string{"testdata/key"}, pi, client, false)
+
+	digest, err := enc.Store(&message, []byte{}, [][]byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := db.Read(&digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = api.DecodePayloadWithRecipients(*raw); err == nil {
+		t.Error("Payload should not be stored in its plain encoding")
+	}
+
+	returned, err := enc.RetrieveDefault(&digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(returned, message) {
+		t.Errorf("Retrieved message %s does not match %s", returned, message)
+	}
+
+	value, err := encrypted.Read(&legacyKey)
+	if err != nil || !bytes.Equal(*value, legacyValue) {
+		t.Errorf("Values written before encryption should be readable, got %v, %v", value, err)
+	}
+
+	otherKey, err := LoadKey("testdata/rcpt1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = storage.WithEncryption(db, otherKey).Read(&digest)
+	if err == nil {
+		t.Error("Reading with the wrong storage key should fail")
+	}
+}
+
+func TestCompressedStorage(t *testing.T) {
+	dbPath, err := ioutil.TempDir("", "TestCompressedStorage")
+
+	if err != nil {
+		t.Fatal(err)
+	} else {
+		defer os.RemoveAll(dbPath)
+	}
+
+	db, err := storage.InitLevelDb(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	legacyKey, legacyValue := []byte("legacy"), []byte("written before compression")
+	err = db.Write(&legacyKey, &legacyValue)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storageKey, err := LoadKey("testdata/key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressed := storage.WithCompression(storage.WithEncryption(db, storageKey))
+
+	client := &MockClient{}
+	pi := api.InitPartyInfo(
+		"http://localhost:8000",
+		[]string{"http://localhost:8001"}, client, false)
+	enc := Init(compressed, []string{"testdata/key.pub"}, []string{"testdata/key"}, pi, client, false)
+
+	large := bytes.Repeat(message, 1000)
+	digest, err := enc.Store(&large, []byte{}, [][]byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	returned, err := enc.RetrieveDefault(&digest)
+	if err != nil || !bytes.Equal(returned, large) {
+		t.Errorf("Retrieved %d bytes, expected %d, error: %v", len(returned), len(large), err)
+	}
+
+	key, value := []byte("metadata"), bytes.Repeat([]byte(`{"action":"send"}`), 100)
+	if err = compressed.Write(&key, &value); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := db.Read(&key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*raw) >= len(value) {
+		t.Errorf("Compressible value of %d bytes was stored as %d bytes", len(value), len(*raw))
+	}
+	read, err := compressed.Read(&key)
+	if err != nil || !bytes.Equal(*read, value) {
+		t.Errorf("Compressed value was not read back, error: %v", err)
+	}
+
+	read, err = compressed.Read(&legacyKey)
+	if err != nil || !bytes.Equal(*read, legacyValue) {
+		t.Errorf("Values written before compression should be readable, got %v, %v", read, err)
+	}
+
+	values := readAll(t, compressed)
+	if len(values) != 3 || values[string(key)] != string(value) {
+		t.Errorf("Expected to read all 3 values, read %d", len(values))
+	}
+}
+
+func TestPurge(t *testing.T) {
+	dbPath, err := ioutil.TempDir("", "TestPurge")
+
+	if err != nil {
+		t.Fatal(err)
+	} else {
+		defer os.RemoveAll(dbPath)
+	}
+
+	pubKeys, err := loadPubKeys([]string{"testdata/rcpt1.pub"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rcpt1 := (*pubKeys[0])[:]
+
+	client := &MockClient{}
+	pi := api.CreatePartyInfo(
+		"http://localhost:8000",
+		[]string{"http://localhost:8001"},
+		pubKeys,
+		client)
+
+	enc := initEnclave(t, path.Join(dbPath, "payloads"), pi, client)
+	enc.Meta, err = storage.InitLevelDb(path.Join(dbPath, "meta"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recent, err := enc.Store(&message, []byte{}, [][]byte{rcpt1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, err := enc.Store(&[]byte{'o', 'l', 'd'}, []byte{}, [][]byte{rcpt1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = enc.RecordProvenance(old, api.ProvenanceHop{
+		Action: api.ProvenanceReceive, Time: time.Now().AddDate(0, 0, -10)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	unknown, value := []byte("unknown"), []byte("value")
+	if err = enc.Db.Write(&unknown, &value); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := enc.StorageStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Entries != 3 || stats.Bytes == 0 {
+		t.Errorf("Unexpected storage stats %v", stats)
+	}
+
+	result, err := enc.Purge(time.Now().AddDate(0, 0, -5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := api.PurgeResponse{Purged: 1, UnknownAge: 1}
+	if result != expected {
+		t.Errorf("Purge returned %v, expected %v", result, expected)
+	}
+
+	for _, test := range []struct {
+		key      []byte
+		expected bool
+	}{{recent, true}, {old, false}, {unknown, true}} {
+		exists, err := enc.Exists(&test.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exists != test.expected {
+			t.Errorf("Payload %s exists: %v, expected %v", encodeKey(test.key), exists, test.expected)
+		}
+	}
+
+	hops, err := enc.Provenance(old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hops) != 0 {
+		t.Errorf("Expected provenance of purged payload to be removed, got %v", hops)
+	}
+
+	if err = enc.Compact(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUsage(t *testing.T) {
+	dbPath, err := ioutil.TempDir("", "TestUsage")
+
+	if err != nil {
+		t.Fatal(err)
+	} else {
+		defer os.RemoveAll(dbPath)
+	}
+
+	enc := initDefaultEnclave(t, dbPath)
+
+	pubKeys, err := loadPubKeys([]string{"testdata/rcpt1.pub"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rcpt1 := (*pubKeys[0])[:]
+	sender := (*enc.PubKeys[0])[:]
+
+	for i := 0; i < 2; i++ {
+		_, err = enc.Store(&message, []byte{}, [][]byte{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The enclave does not hold the private key for rcpt1, so cannot send from it
+	_, err = enc.Store(&message, rcpt1, [][]byte{})
+	if err == nil {
+		t.Fatal("SecureEnclave is not authorised to store messages")
+	}
+
+	usage := enc.Usage([][]byte{sender, rcpt1})
+	if len(usage) != 2 {
+		t.Fatalf("Expected usage for 2 keys, got %v", usage)
+	}
+	if usage[0].PublicKey != encodeKey(sender) || usage[0].Payloads != 2 ||
+		usage[0].Bytes != int64(2*len(message)) || usage[0].Failures != 0 {
+		t.Errorf("Unexpected usage for sender %v", usage[0])
+	}
+	if usage[0].AverageLatencyMs <= 0 || usage[0].MaxLatencyMs < usage[0].AverageLatencyMs {
+		t.Errorf("Unexpected latencies for sender %v", usage[0])
+	}
+	expected := api.KeyUsage{PublicKey: encodeKey(rcpt1)}
+	if usage[1] != expected {
+		t.Errorf("Usage for unused key is %v, expected %v", usage[1], expected)
+	}
+
+	all := enc.Usage(nil)
+	if len(all) != 1 || all[0] != usage[0] {
+		t.Errorf("Usage of all keys is %v, expected %v", all, usage[:1])
+	}
+}
+
+func TestReplayLog(t *testing.T) {
+	dbPath, err := ioutil.TempDir("", "TestReplayLog")
+
+	if err != nil {
+		t.Fatal(err)
+	} else {
+		defer os.RemoveAll(dbPath)
+	}
+
+	key, err := LoadKey("testdata/key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logPath := path.Join(dbPath, "replay.log")
+	replayLog, err := storage.OpenReplayLog(logPath, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := storage.InitLevelDb(path.Join(dbPath, "payloads"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := storage.InitLevelDb(path.Join(dbPath, "meta"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &MockClient{}
+	pi := api.InitPartyInfo(
+		"http://localhost:8000",
+		[]string{"http://localhost:8001"}, client, false)
+	enc := Init(replayLog.Wrap("payloads", db),
+		[]string{"testdata/key.pub"}, []string{"testdata/key"}, pi, client, false)
+	enc.Meta = replayLog.Wrap("meta", meta)
+
+	kept, err := enc.Store(&message, []byte{}, [][]byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deleted, err := enc.Store(&[]byte{'d', 'e', 'l'}, []byte{}, [][]byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = enc.Delete(&deleted); err != nil {
+		t.Fatal(err)
+	}
+	if err = replayLog.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Changes which cannot be logged are not applied
+	if _, err = enc.Store(&[]byte{'u', 'n', 'l', 'o', 'g', 'g', 'e', 'd'}, []byte{}, [][]byte{}); err == nil {
+		t.Error("Storing a payload should fail once the replay log is closed")
+	}
+	if err = enc.Delete(&kept); err == nil {
+		t.Error("Deleting a payload should fail once the replay log is closed")
+	}
+
+	replayedDb, err := storage.InitLevelDb(path.Join(dbPath, "replayed"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayedMeta, err := storage.InitLevelDb(path.Join(dbPath, "replayed-meta"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = storage.Replay(logPath, key, map[string]storage.DataStore{
+		"payloads": replayedDb,
+		"meta":     replayedMeta,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, stores := range [][2]storage.DataStore{{db, replayedDb}, {meta, replayedMeta}} {
+		original, replayed := readAll(t, stores[0]), readAll(t, stores[1])
+		if !reflect.DeepEqual(original, replayed) {
+			t.Errorf("Replayed store %v does not match original %v", replayed, original)
+		}
+	}
+
+	enc.Db, enc.Meta = replayedDb, replayedMeta
+	returned, err := enc.RetrieveDefault(&kept)
+	if err != nil || !bytes.Equal(returned, message) {
+		t.Errorf("Retrieved message %s does not match %s, error: %v", returned, message, err)
+	}
+	if exists, _ := enc.Exists(&deleted); exists {
+		t.Error("Deleted payload should not be replayed")
+	}
+
+	otherKey, err := LoadKey("testdata/rcpt1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = storage.Replay(logPath, otherKey, map[string]storage.DataStore{})
+	if err == nil {
+		t.Error("The replay log should not be readable with another key")
+	}
+}
+
+func readAll(t *testing.T, db storage.DataStore) map[string]string {
+	entries := make(map[string]string)
+	err := db.ReadAll(func(key, value *[]byte) {
+		entries[string(*key)] = string(*value)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+func TestAddKeys(t *testing.T) {
+	dbPath, err := ioutil.TempDir("", "TestAddKeys")
+
+	if err != nil {
+		t.Fatal(err)
+	} else {
+		defer os.RemoveAll(dbPath)
+	}
+
+	enc := initDefaultEnclave(t, dbPath)
+	pubKeyFiles := []string{"testdata/key.pub", "testdata/rcpt1.pub"}
+	privKeyFiles := []string{"testdata/key", "testdata/rcpt1"}
+
+	added, err := enc.AddKeys(pubKeyFiles, privKeyFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(added) != 1 || len(enc.PubKeys) != 2 || len(enc.PrivKeys) != 2 {
+		t.Fatalf("Expected only rcpt1 to be added, added %d keys", len(added))
+	}
+	rcpt1 := (*added[0])[:]
+
+	url, ok := enc.PartyInfo.GetRecipient(added[0])
+	if !ok || url != "http://localhost:8000" {
+		t.Errorf("Added key should be announced with our URL, got %s", url)
+	}
+
+	// We can now send from the added key
+	digest, err := enc.Store(&message, rcpt1, [][]byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	returned, err := enc.Retrieve(&digest, &rcpt1)
+	if err != nil || !bytes.Equal(returned, message) {
+		t.Errorf("Retrieved message %s does not match %s, error: %v", returned, message, err)
+	}
+
+	added, err = enc.AddKeys(pubKeyFiles, privKeyFiles)
+	if err != nil || len(added) != 0 {
+		t.Errorf("Reloading the same keys should not add any, added %d, error: %v", len(added), err)
+	}
+
+	_, err = enc.AddKeys(pubKeyFiles, privKeyFiles[:1])
+	if err == nil {
+		t.Error("Public keys without corresponding private keys should be rejected")
+	}
+}
+
+func TestRotateKey(t *testing.T) {
+	dbPath, err := ioutil.TempDir("", "TestRotateKey")
+
+	if err != nil {
+		t.Fatal(err)
+	} else {
+		defer os.RemoveAll(dbPath)
+	}
+
+	db, err := storage.InitLevelDb(path.Join(dbPath, "payloads"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rcpt2, err := loadPubKeys([]string{"testdata/rcpt2.pub"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &MockClient{}
+	pi := api.CreatePartyInfo(
+		"http://localhost:8000",
+		[]string{"http://localhost:8001"},
+		rcpt2,
+		client)
+	enc := Init(db, []string{"testdata/key.pub", "testdata/rcpt1.pub"},
+		[]string{"testdata/key", "testdata/rcpt1"}, pi, client, false)
+	enc.Meta, err = storage.InitLevelDb(path.Join(dbPath, "meta"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldKey, newKey := (*enc.PubKeys[0])[:], (*enc.PubKeys[1])[:]
+
+	sent, err := enc.Store(&[]byte{'s', 'e', 'n', 't'}, oldKey, [][]byte{(*rcpt2[0])[:]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	toSelf, err := enc.Store(&message, oldKey, [][]byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Payloads pushed to us by another node, for the old and new keys
+	otherPubKey, otherPrivKey, err := box.GenerateKey(crand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pushed := map[string][]byte{}
+	for _, recipient := range [][]byte{oldKey, newKey} {
+		recipientKey, _ := utils.ToKey(recipient)
+		epl := crypt.Encrypt(recipient, otherPubKey, otherPrivKey, []nacl.Key{recipientKey})
+		digest, err := enc.StorePayload(api.EncodePayloadWithRecipients(epl, [][]byte{}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		pushed[string(recipient)] = digest
+	}
+
+	enc.PartyInfo.RegisterPublicKeys(enc.PubKeys)
+	result, err := enc.RotateKey(oldKey, newKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := api.RotateKeyResponse{Reencrypted: 3, Unchanged: 1}
+	if result != expected {
+		t.Errorf("RotateKey returned %v, expected %v", result, expected)
+	}
+
+	for _, test := range []struct {
+		digest   []byte
+		to       []byte
+		expected []byte
+	}{
+		{sent, nil, []byte("sent")},
+		{toSelf, nil, message},
+		{pushed[string(oldKey)], newKey, oldKey},
+		{pushed[string(newKey)], newKey, newKey},
+	} {
+		to := test.to
+		returned, err := enc.Retrieve(&test.digest, &to)
+		if err != nil || !bytes.Equal(returned, test.expected) {
+			t.Errorf("Retrieved %s after rotation, expected %s, error: %v", returned, test.expected, err)
+		}
+	}
+
+	// Clients may still retrieve payloads for the old key, which are decrypted with the new key
+	digest := pushed[string(oldKey)]
+	if returned, err := enc.Retrieve(&digest, &oldKey); err != nil || !bytes.Equal(returned, oldKey) {
+		t.Errorf("Retrieved %s for the old key after rotation, expected %s, error: %v",
+			returned, oldKey, err)
+	}
+	if _, ok := enc.PartyInfo.GetRecipient(enc.PubKeys[0]); ok {
+		t.Error("Retiring keys should no longer be announced to other nodes")
+	}
+	if _, ok := enc.PartyInfo.GetRecipient(enc.PubKeys[1]); !ok {
+		t.Error("The new key should still be announced to other nodes")
+	}
+	if active := enc.ActivePubKeys(); len(active) != 1 || *active[0] != *enc.PubKeys[1] {
+		t.Errorf("Expected only the new key to be active, active keys: %v", active)
+	}
+	recipientEpl, err := recipientPayload(*readPayload(t, enc, sent), (*rcpt2[0])[:])
+	if err != nil || !bytes.Equal((*recipientEpl.Sender)[:], newKey) {
+		t.Errorf("Payloads sent from the old key should be sent from the new key, error: %v", err)
+	}
+
+	if _, err = enc.Store(&message, oldKey, [][]byte{}); err == nil {
+		t.Error("Retiring keys should not be used to send payloads")
+	}
+	if defaultKey, _ := enc.defaultKeyPair(); !bytes.Equal((*defaultKey)[:], newKey) {
+		t.Error("Retiring keys should not be used as the default key")
+	}
+
+	// Rotation can be repeated safely
+	result, err = enc.RotateKey(oldKey, newKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = api.RotateKeyResponse{Unchanged: 4}
+	if result != expected {
+		t.Errorf("Repeated RotateKey returned %v, expected %v", result, expected)
+	}
+}
+
+func readPayload(t *testing.T, enc *SecureEnclave, digest []byte) *[]byte {
+	encoded, err := enc.Db.Read(&digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encoded
+}
+
+func TestPrivacyGroups(t *testing.T) {
+	dbPath, err := ioutil.TempDir("", "TestPrivacyGroups")
+	if err != nil {
+		t.Fatal(err)
+	} else {
+		defer os.RemoveAll(dbPath)
+	}
+
+	pubKeys, err := loadPubKeys([]string{"testdata/rcpt1.pub", "testdata/rcpt2.pub"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rcpt1, rcpt2 := (*pubKeys[0])[:], (*pubKeys[1])[:]
+
+	client := &MockClient{}
+	pi := api.CreatePartyInfo(
+		"http://localhost:8000",
+		[]string{"http://localhost:8001"},
+		pubKeys,
+		client)
+
+	enc := initEnclave(t, path.Join(dbPath, "payloads"), pi, client)
+	enc.Meta, err = storage.InitLevelDb(path.Join(dbPath, "meta"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	self, _ := enc.defaultKeyPair()
+	selfKey := (*self)[:]
+
+	group, err := enc.CreatePrivacyGroup(nil, [][]byte{rcpt1, rcpt2, rcpt1}, "name", "description")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(group.Members) != 3 || group.Name != "name" || group.Description != "description" {
+		t.Errorf("Unexpected privacy group created: %v", group)
+	}
+	other, err := enc.CreatePrivacyGroup(selfKey, [][]byte{rcpt1}, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = enc.CreatePrivacyGroup(rcpt1, [][]byte{rcpt2}, "", ""); err == nil {
+		t.Error("Privacy groups should only be created on behalf of the node's own keys")
+	}
+
+	found, err := enc.FindPrivacyGroups([][]byte{rcpt2, selfKey, rcpt1})
+	if err != nil || !reflect.DeepEqual(found, []api.PrivacyGroup{group}) {
+		t.Errorf("Found privacy groups %v, expected %v, error: %v", found, group, err)
+	}
+
+	id, _ := base64.StdEncoding.DecodeString(group.PrivacyGroupId)
+	recipients, err := enc.PrivacyGroupRecipients(id, nil)
+	if err != nil || !reflect.DeepEqual(recipients, [][]byte{rcpt1, rcpt2}) &&
+		!reflect.DeepEqual(recipients, [][]byte{rcpt2, rcpt1}) {
+		t.Errorf("Privacy group resolved to %v, expected %v, error: %v",
+			recipients, [][]byte{rcpt1, rcpt2}, err)
+	}
+
+	digest, err := enc.Store(&message, selfKey, recipients)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = enc.RecordPrivacyGroup(digest, id); err != nil {
+		t.Fatal(err)
+	}
+	recorded, err := enc.PayloadPrivacyGroup(digest)
+	if err != nil || !bytes.Equal(recorded, id) {
+		t.Errorf("Payload privacy group was %v, expected %v, error: %v", recorded, id, err)
+	}
+
+	if err = enc.DeletePrivacyGroup(id, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = enc.PrivacyGroupRecipients(id, nil); err != api.ErrPrivacyGroupNotFound {
+		t.Errorf("Deleted privacy group should not be found, error: %v", err)
+	}
+	if err = enc.DeletePrivacyGroup(id, nil); err != api.ErrPrivacyGroupNotFound {
+		t.Errorf("Deleted privacy group should not be found, error: %v", err)
+	}
+
+	found, err = enc.FindPrivacyGroups([][]byte{selfKey, rcpt1})
+	if err != nil || len(found) != 1 || found[0].PrivacyGroupId != other.PrivacyGroupId {
+		t.Errorf("Found privacy groups %v, expected %v, error: %v", found, other, err)
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	dbPath, err := ioutil.TempDir("", "TestExportImport")
+	if err != nil {
+		t.Fatal(err)
+	} else {
+		defer os.RemoveAll(dbPath)
+	}
+
+	pubKeys, err := loadPubKeys([]string{"testdata/rcpt1.pub"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rcpt1 := (*pubKeys[0])[:]
+
+	client := &MockClient{}
+	pi := api.CreatePartyInfo(
+		"http://localhost:8000",
+		[]string{"http://localhost:8001"},
+		pubKeys,
+		client)
+
+	enc := initEnclave(t, path.Join(dbPath, "payloads"), pi, client)
+	enc.Meta, err = storage.InitLevelDb(path.Join(dbPath, "meta"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var digests [][]byte
+	for i := 0; i < 3; i++ {
+		digest, err := enc.Store(&message, []byte{}, [][]byte{rcpt1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		digests = append(digests, digest)
+	}
+
+	var exported bytes.Buffer
+	entries, err := enc.Export(&exported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each payload's metadata includes its provenance, and its sender, recipient and parties index entries
+	expected := map[string]int{exportPayloads: 3, exportMeta: 12}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Errorf("Exported %v, expected %v", entries, expected)
+	}
+
+	restored := initEnclave(t, path.Join(dbPath, "restored"), pi, client)
+	restored.Meta, err = storage.InitLevelDb(path.Join(dbPath, "restored-meta"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Exports which are corrupt or incomplete are rejected
+	corrupt := append([]byte{}, exported.Bytes()...)
+	i := bytes.Index(corrupt, *readPayload(t, enc, digests[0]))
+	corrupt[i] ^= 0xff
+	if _, err = restored.Import(bytes.NewReader(corrupt)); err == nil {
+		t.Error("Importing a corrupt export should fail")
+	}
+	manifest := bytes.Index(exported.Bytes(), []byte("manifest.json"))
+	truncated := exported.Bytes()[:manifest-manifest%512]
+	if _, err = restored.Import(bytes.NewReader(truncated)); err != storage.ErrExportIncomplete {
+		t.Errorf("Importing a truncated export should fail, error: %v", err)
+	}
+
+	entries, err = restored.Import(&exported)
+	if err != nil || !reflect.DeepEqual(entries, expected) {
+		t.Errorf("Imported %v, expected %v, error: %v", entries, expected, err)
+	}
+	for _, digest := range digests {
+		digest := digest
+		returned, err := restored.RetrieveDefault(&digest)
+		if err != nil || !bytes.Equal(returned, message) {
+			t.Errorf("Retrieved %s after import, expected %s, error: %v", returned, message, err)
+		}
+		original, _ := enc.Provenance(digest)
+		hops, err := restored.Provenance(digest)
+		if err != nil || !reflect.DeepEqual(hops, original) {
+			t.Errorf("Provenance of imported payload was %v, expected %v, error: %v", hops, original, err)
+		}
+	}
+}
+
+func TestStorePayloadGrpc(t *testing.T) {
+	dbPath, err := ioutil.TempDir("", "TestStorePayloadGrpc")
+	if err != nil {
+		t.Fatal(err)
+	} else {
+		defer os.RemoveAll(dbPath)
+	}
+	enc := initDefaultEnclave(t, dbPath)
+
+	epl := api.EncryptedPayload{
+		Sender:         nacl.NewKey(),
+		CipherText:     message,
+		Nonce:          nacl.NewNonce(),
+		RecipientBoxes: [][]byte{message},
+		RecipientNonce: nacl.NewNonce(),
+	}
+	encoded := api.EncodePayloadWithRecipients(epl, [][]byte{})
+
+	digest, err := enc.StorePayloadGrpc(epl, encoded)
+	if err != nil || !bytes.Equal(digest, utils.Digest(message)) {
+		t.Errorf("Payload stored under %x, expected its digest, error: %v", digest, err)
+	}
+
+	tampered := epl
+	tampered.CipherText = []byte("Tampered message")
+	if _, err = enc.StorePayloadGrpc(tampered, encoded); err == nil {
+		t.Error("Payloads which do not match their encoding should not be stored")
+	}
+	tamperedDigest := utils.Digest(tampered.CipherText)
+	if exists, _ := enc.Exists(&tamperedDigest); exists {
+		t.Error("Tampered payload should not be stored")
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	dbPath, err := ioutil.TempDir("", "TestMigrate")
+
+	if err != nil {
+		t.Fatal(err)
+	} else {
+		defer os.RemoveAll(dbPath)
+	}
+
+	enc := initDefaultEnclave(t, path.Join(dbPath, "source"))
+	digest, err := enc.Store(&message, []byte{}, [][]byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded := readPayload(t, enc, digest)
+
+	// Constellation's directory storage holds a file per payload
+	dir := path.Join(dbPath, "storage")
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{
+		"payload": []byte(base64.StdEncoding.EncodeToString(*encoded)),
+		"invalid": []byte("invalid"),
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(path.Join(dir, name), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db, err := storage.InitLevelDb(path.Join(dbPath, "target"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := storage.InitLevelDb(path.Join(dbPath, "meta"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The node has already been started, so has indexed the payloads it held
+	enc2 := Init(db, []string{"testdata/key.pub"}, []string{"testdata/key"}, enc.PartyInfo, enc.client, false)
+	enc2.Meta = meta
+	if err = enc2.IndexPayloads(); err != nil {
+		t.Fatal(err)
+	}
+
+	readAll := func(f func(key, value *[]byte)) error {
+		return storage.ReadDirectory(dir, f)
+	}
+	result, err := Migrate(readAll, db, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := MigrateResult{Migrated: 1, Invalid: 1}
+	if result != expected {
+		t.Errorf("Expected migration result %+v, got %+v", expected, result)
+	}
+
+	returned, err := enc2.RetrieveDefault(&digest)
+	if err != nil || !bytes.Equal(returned, message) {
+		t.Errorf("Retrieved message %s does not match %s, error: %v", returned, message, err)
+	}
+
+	// Migrated payloads are indexed when the node is next started
+	if err = enc2.IndexPayloads(); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := enc2.ListPayloads(api.PartySender, (*enc2.PubKeys[0])[:], nil, 0)
+	if err != nil || !reflect.DeepEqual(keys, [][]byte{digest}) {
+		t.Errorf("Listed %v after migrating, expected %v, error: %v", keys, [][]byte{digest}, err)
+	}
+
+	// Payloads already held are left untouched, so migrations can be repeated
+	result, err = Migrate(readAll, db, meta)
+	expected = MigrateResult{Existing: 1, Invalid: 1}
+	if err != nil || result != expected {
+		t.Errorf("Expected migration result %+v, got %+v, error: %v", expected, result, err)
+	}
+}
+
+func TestStoreContext(t *testing.T) {
+	dbPath, err := ioutil.TempDir("", "TestStoreContext")
+
+	if err != nil {
+		t.Fatal(err)
+	} else {
+		defer os.RemoveAll(dbPath)
+	}
+
+	enc := initDefaultEnclave(t, dbPath)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	digest, err := enc.StoreContext(ctx, &message, []byte{}, [][]byte{})
+	if err != context.Canceled {
+		t.Fatalf("Expected %v storing with a cancelled context, got %v", context.Canceled, err)
+	}
+	if exists, err := enc.Exists(&digest); err != nil || exists {
+		t.Errorf("Payload should not be stored with a cancelled context, error: %v", err)
+	}
+
+	digest, err = enc.Store(&message, []byte{}, [][]byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = enc.RetrieveContext(ctx, &digest, nil); err != context.Canceled {
+		t.Errorf("Expected %v retrieving with a cancelled context, got %v", context.Canceled, err)
+	}
+	returned, err := enc.RetrieveContext(context.Background(), &digest, nil)
+	if err != nil || !bytes.Equal(returned, message) {
+		t.Errorf("Retrieved message %s does not match %s, error: %v", returned, message, err)
+	}
+}
+
+// cancellingStore cancels a context as a write to it starts, before completing the write.
+type cancellingStore struct {
+	storage.DataStore
+	cancel func()
+}
+
+func (s *cancellingStore) Write(key *[]byte, value *[]byte) error {
+	s.cancel()
+	time.Sleep(10 * time.Millisecond)
+	return s.DataStore.Write(key, value)
+}
+
+func TestStoreContextCancelledWrite(t *testing.T) {
+	dbPath, err := ioutil.TempDir("", "TestStoreContextCancelledWrite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dbPath)
+
+	enc := initDefaultEnclave(t, dbPath)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	enc.Db = &cancellingStore{DataStore: enc.Db, cancel: cancel}
+
+	// A write which has started is completed, and reported as such
+	digest, err := enc.StoreContext(ctx, &message, []byte{}, [][]byte{})
+	if err != nil {
+		t.Fatalf("Payload written as the context was cancelled should be stored, error: %v", err)
+	}
+	if exists, err := enc.Exists(&digest); err != nil || !exists {
+		t.Errorf("Payload should be stored, error: %v", err)
+	}
+}
+
+func TestStoreSelfMultipleKeys(t *testing.T) {
+	dbPath, err := ioutil.TempDir("", "TestStoreSelfMultipleKeys")
+
+	if err != nil {
+		t.Fatal(err)
+	} else {
+		defer os.RemoveAll(dbPath)
+	}
+
+	db, err := storage.InitLevelDb(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &MockClient{}
+	pi := api.InitPartyInfo("http://localhost:8000", []string{}, client, false)
+	enc := Init(db,
+		[]string{"testdata/key.pub", "testdata/rcpt1.pub"},
+		[]string{"testdata/key", "testdata/rcpt1"},
+		pi, client, false)
+
+	// Payloads sent only to ourselves from our second key are sealed with that key
+	rcpt1 := (*enc.PubKeys[1])[:]
+	digest, err := enc.Store(&message, rcpt1, [][]byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	epl, _ := decodePayloadWithRecipients(t, *readPayload(t, enc, digest))
+	if !bytes.Equal((*epl.Sender)[:], rcpt1) {
+		t.Errorf("Payload should be sent from %v, got %v", rcpt1, (*epl.Sender)[:])
+	}
+	sharedKey := crypt.SharedKey(enc.PrivKeys[1], enc.selfPubKey)
+	if returned, err := crypt.Decrypt(epl, 0, sharedKey); err != nil || !bytes.Equal(returned, message) {
+		t.Errorf("Box should be sealed with the sender's key, got %s, error: %v", returned, err)
+	}
+
+	returned, err := enc.RetrieveDefault(&digest)
+	if err != nil || !bytes.Equal(returned, message) {
+		t.Errorf("Retrieved message %s does not match %s, error: %v", returned, message, err)
+	}
+}
+
+// failingClient fails every request, counting them.
+type failingClient struct {
+	requests int
+}
+
+func (c *failingClient) Do(req *http.Request) (*http.Response, error) {
+	c.requests++
+	return nil, errors.New("connection refused")
+}
+
+func TestSkipUnhealthyPeer(t *testing.T) {
+	dbPath, err := ioutil.TempDir("", "TestSkipUnhealthyPeer")
+
+	if err != nil {
+		t.Fatal(err)
+	} else {
+		defer os.RemoveAll(dbPath)
+	}
+
+	pubKeys, err := loadPubKeys([]string{"testdata/rcpt1.pub"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rcpt1 := (*pubKeys[0])[:]
+
+	client := &failingClient{}
+	pi := api.CreatePartyInfo(
+		"http://localhost:8000",
+		[]string{"http://localhost:8001"},
+		pubKeys,
+		client)
+
+	db, err := storage.InitLevelDb(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc := Init(db, []string{"testdata/key.pub"}, []string{"testdata/key"}, pi, client, false)
+
+	for i := 0; i <= api.UnhealthyFailures; i++ {
+		var deliveryErr error
+		_, err = enc.StoreNotify(&message, []byte{}, [][]byte{rcpt1}, func(recipient []byte, err error) {
+			deliveryErr = err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == api.UnhealthyFailures && deliveryErr != api.ErrPeerUnavailable {
+			t.Errorf("Push to an unhealthy peer should be skipped, got: %v", deliveryErr)
+		} else if deliveryErr == nil {
+			t.Error("Push should fail")
+		}
+	}
+	if client.requests != api.UnhealthyFailures {
+		t.Errorf("Expected %d requests, got %d", api.UnhealthyFailures, client.requests)
+	}
+
+	health := enc.PeerHealth()
+	if len(health) != 1 || health[0].Url != "http://localhost:8001" || health[0].Healthy {
+		t.Errorf("Unexpected peer health %+v", health)
+	}
+}
+
+func TestPersistPartyInfo(t *testing.T) {
+	dbPath, err := ioutil.TempDir("", "TestPersistPartyInfo")
+
+	if err != nil {
+		t.Fatal(err)
+	} else {
+		defer os.RemoveAll(dbPath)
+	}
+
+	db, err := storage.InitLevelDb(path.Join(dbPath, "payloads"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := storage.InitLevelDb(path.Join(dbPath, "meta"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &MockClient{}
+	start := func(url string) *SecureEnclave {
+		pi := api.InitPartyInfo(url, []string{}, client, false)
+		enc := Init(db, []string{"testdata/key.pub"}, []string{"testdata/key"}, pi, client, false)
+		enc.Meta = meta
+		enc.PartyInfo.RegisterPublicKeys(enc.PubKeys)
+		if err := enc.PersistPartyInfo(); err != nil {
+			t.Fatal(err)
+		}
+		return enc
+	}
+
+	enc := start("http://localhost:8000")
+	remoteKey := nacl.NewKey()
+	remote := api.CreatePartyInfo(
+		"http://localhost:8001", []string{"http://localhost:8001"}, []nacl.Key{remoteKey}, client)
+	if err = enc.UpdatePartyInfo(api.EncodePartyInfo(remote)); err != nil {
+		t.Fatal(err)
+	}
+
+	// A restarted node can route to the recipients it learned of
+	enc = start("http://localhost:8000")
+	if url, ok := enc.PartyInfo.GetRecipient(remoteKey); !ok || url != "http://localhost:8001" {
+		t.Errorf("Recipient was not restored, url: %s", url)
+	}
+	if url, ok := enc.PartyInfo.GetRecipient(enc.PubKeys[0]); !ok || url != "http://localhost:8000" {
+		t.Errorf("Own recipient should be unchanged, url: %s", url)
+	}
+
+	// Party info saved for another URL is discarded
+	enc = start("http://localhost:9000")
+	if _, ok := enc.PartyInfo.GetRecipient(remoteKey); ok {
+		t.Error("Party info saved for a different URL should not be restored")
+	}
+}
+
+func TestListPayloads(t *testing.T) {
+	dbPath, err := ioutil.TempDir("", "TestListPayloads")
+
+	if err != nil {
+		t.Fatal(err)
+	} else {
+		defer os.RemoveAll(dbPath)
+	}
+
+	db, err := storage.InitLevelDb(path.Join(dbPath, "payloads"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rcpt2, err := loadPubKeys([]string{"testdata/rcpt2.pub"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &MockClient{}
+	pi := api.CreatePartyInfo(
+		"http://localhost:8000",
+		[]string{"http://localhost:8001"},
+		rcpt2,
+		client)
+	enc := Init(db, []string{"testdata/key.pub", "testdata/rcpt1.pub"},
+		[]string{"testdata/key", "testdata/rcpt1"}, pi, client, false)
+	sender, rcpt1, recipient := (*enc.PubKeys[0])[:], (*enc.PubKeys[1])[:], (*rcpt2[0])[:]
+
+	// Payloads stored before there was a metadata store are indexed by IndexPayloads
+	var sent [][]byte
+	digest, err := enc.Store(&message, sender, [][]byte{recipient})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent = append(sent, digest)
+
+	enc.Meta, err = storage.InitLevelDb(path.Join(dbPath, "meta"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = enc.IndexPayloads(); err != nil {
+		t.Fatal(err)
+	}
+
+	digest, err = enc.Store(&[]byte{'s', 'e', 'n', 't'}, sender, [][]byte{recipient})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent = append(sent, digest)
+	sort.Slice(sent, func(i, j int) bool { return bytes.Compare(sent[i], sent[j]) < 0 })
+
+	// A payload pushed to us by another node
+	otherPubKey, otherPrivKey, err := box.GenerateKey(crand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rcpt1Key, _ := utils.ToKey(rcpt1)
+	epl := crypt.Encrypt(message, otherPubKey, otherPrivKey, []nacl.Key{rcpt1Key})
+	pushed, err := enc.StorePayload(api.EncodePayloadWithRecipients(epl, [][]byte{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, keyCache := range enc.keyCache {
+		for pubKey := range keyCache {
+			if *pubKey == *otherPubKey {
+				t.Error("Indexing a pushed payload should not cache the key shared with its sender")
+			}
+		}
+	}
+
+	tests := []struct {
+		role      string
+		publicKey []byte
+		expected  [][]byte
+	}{
+		{api.PartySender, sender, sent},
+		{api.PartyRecipient, recipient, sent},
+		{api.PartySender, (*otherPubKey)[:], [][]byte{pushed}},
+		{api.PartyRecipient, rcpt1, [][]byte{pushed}},
+		{api.PartyRecipient, sender, [][]byte{}},
+	}
+	for _, test := range tests {
+		keys, err := enc.ListPayloads(test.role, test.publicKey, nil, 0)
+		if err != nil || !reflect.DeepEqual(keys, test.expected) {
+			t.Errorf("Listed %v for %s %v, expected %v, error: %v",
+				keys, test.role, test.publicKey, test.expected, err)
+		}
+	}
+
+	// Payloads are listed in pages following the last key listed
+	keys, err := enc.ListPayloads(api.PartySender, sender, nil, 1)
+	if err != nil || !reflect.DeepEqual(keys, sent[:1]) {
+		t.Errorf("Listed %v with a limit of 1, expected %v, error: %v", keys, sent[:1], err)
+	}
+	keys, err = enc.ListPayloads(api.PartySender, sender, keys[0], 1)
+	if err != nil || !reflect.DeepEqual(keys, sent[1:]) {
+		t.Errorf("Listed %v after %v, expected %v, error: %v", keys, sent[0], sent[1:], err)
+	}
+
+	if _, err = enc.ListPayloads("owner", sender, nil, 0); err == nil {
+		t.Error("Listing payloads for an invalid role should fail")
+	}
+
+	// Deleted payloads are no longer listed
+	if err = enc.Delete(&sent[0]); err != nil {
+		t.Fatal(err)
+	}
+	for _, role := range []string{api.PartySender, api.PartyRecipient} {
+		publicKey := sender
+		if role == api.PartyRecipient {
+			publicKey = recipient
+		}
+		keys, err = enc.ListPayloads(role, publicKey, nil, 0)
+		if err != nil || !reflect.DeepEqual(keys, sent[1:]) {
+			t.Errorf("Listed %v for %s after deletion, expected %v, error: %v",
+				keys, role, sent[1:], err)
+		}
+	}
 }
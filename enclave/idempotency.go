@@ -0,0 +1,138 @@
+package enclave
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"github.com/blk-io/crux/api"
+	"github.com/blk-io/crux/storage"
+	"github.com/blk-io/crux/utils"
+	"sync"
+)
+
+const idempotencyPrefix = "idempotency/"
+
+// idempotentSend is the result of a send recorded against an idempotency key.
+type idempotentSend struct {
+	Key         []byte `json:"key"`
+	RequestHash []byte `json:"requestHash"`
+}
+
+// StoreIdempotent is equivalent to Store, but the resulting key is recorded against
+// idempotencyKey, so that a retry of the same request returns the original transaction rather
+// than creating and propagating another. replayed is true if the result of an earlier request is
+// returned, and api.ErrIdempotencyKeyReused is returned if the key was used for a different
+// request.
+// Idempotency keys are scoped to the sender. If the SecureEnclave does not have a metadata store
+// the request is processed as per Store.
+func (s *SecureEnclave) StoreIdempotent(
+	message *[]byte, sender []byte, recipients [][]byte,
+	idempotencyKey string) (key []byte, replayed bool, err error) {
+	return s.StoreIdempotentContext(context.Background(), message, sender, recipients, idempotencyKey)
+}
+
+// StoreIdempotentContext is equivalent to StoreIdempotent, on behalf of ctx, as per StoreContext.
+func (s *SecureEnclave) StoreIdempotentContext(
+	ctx context.Context, message *[]byte, sender []byte, recipients [][]byte,
+	idempotencyKey string) (key []byte, replayed bool, err error) {
+
+	if s.Meta == nil || idempotencyKey == "" {
+		key, err = s.StoreContext(ctx, message, sender, recipients)
+		return key, false, err
+	}
+
+	scoped := sender
+	if len(scoped) == 0 {
+		pubKey, _ := s.defaultKeyPair()
+		scoped = (*pubKey)[:]
+	}
+	recordKey := utils.Digest(append(append([]byte{}, scoped...), idempotencyKey...))
+	requestHash := hashRequest(*message, recipients)
+
+	// Concurrent requests with the same key wait for the first to complete
+	unlock := s.idempotencyLocks.lock(string(recordKey))
+	defer unlock()
+
+	store := storage.WithPrefix(s.Meta, idempotencyPrefix)
+	exists, err := store.Has(&recordKey)
+	if err != nil {
+		return nil, false, err
+	}
+	if exists {
+		encoded, err := store.Read(&recordKey)
+		if err != nil {
+			return nil, false, err
+		}
+		var previous idempotentSend
+		err = json.Unmarshal(*encoded, &previous)
+		if err != nil {
+			return nil, false, err
+		}
+		if !bytes.Equal(previous.RequestHash, requestHash) {
+			return nil, false, api.ErrIdempotencyKeyReused
+		}
+		return previous.Key, true, nil
+	}
+
+	key, err = s.StoreContext(ctx, message, sender, recipients)
+	if err != nil {
+		return nil, false, err
+	}
+
+	encoded, err := json.Marshal(idempotentSend{Key: key, RequestHash: requestHash})
+	if err == nil {
+		err = store.Write(&recordKey, &encoded)
+	}
+	return key, false, err
+}
+
+// hashRequest returns the digest of a send's message and recipients. Each is prefixed with its
+// length, so that different requests cannot produce the same hash.
+func hashRequest(message []byte, recipients [][]byte) []byte {
+	var encoded bytes.Buffer
+	for _, field := range append([][]byte{message}, recipients...) {
+		var length [8]byte
+		binary.BigEndian.PutUint64(length[:], uint64(len(field)))
+		encoded.Write(length[:])
+		encoded.Write(field)
+	}
+	return utils.Digest(encoded.Bytes())
+}
+
+// keyedMutex provides a mutex for each key, which exists while it is locked or waited on.
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	sync.Mutex
+	refs int
+}
+
+// lock locks the mutex for key, returning a function which unlocks it.
+func (k *keyedMutex) lock(key string) func() {
+	k.mu.Lock()
+	if k.locks == nil {
+		k.locks = make(map[string]*keyedLock)
+	}
+	l, ok := k.locks[key]
+	if !ok {
+		l = &keyedLock{}
+		k.locks[key] = l
+	}
+	l.refs++
+	k.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		k.mu.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(k.locks, key)
+		}
+		k.mu.Unlock()
+	}
+}
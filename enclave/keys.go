@@ -0,0 +1,218 @@
+package enclave
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/blk-io/crux/crypt"
+	"github.com/blk-io/crux/utils"
+	"github.com/kevinburke/nacl"
+	"os"
+	"strings"
+)
+
+// KeyProvider is a source of private keys for a SecureEnclave.
+// Private key references of the form "scheme:ref" are resolved by the provider registered for
+// that scheme, e.g. "vault:secret/data/crux/node1#key". All other references are treated as
+// key files on disk.
+type KeyProvider interface {
+	// PrivateKey retrieves the private key identified by ref. Providers which implement
+	// KeyAgreement may return a nil key, in which case the private key never leaves the provider.
+	PrivateKey(ref string) (nacl.Key, error)
+}
+
+// KeyAgreement is implemented by a KeyProvider which computes shared keys on behalf of the
+// enclave, such as a PKCS#11 HSM which does not release private key material.
+type KeyAgreement interface {
+	// SharedKey computes the shared key between the private key identified by ref and the
+	// provided public key.
+	SharedKey(ref string, pubKey nacl.Key) (nacl.Key, error)
+}
+
+var keyProviders = map[string]KeyProvider{
+	"env": envKeyProvider{},
+}
+
+// RegisterKeyProvider makes a KeyProvider available for private key references with the given
+// scheme.
+func RegisterKeyProvider(scheme string, provider KeyProvider) {
+	keyProviders[scheme] = provider
+}
+
+// IsKeyFile reports whether the private key reference is a file on disk, as opposed to a key
+// held by a registered KeyProvider.
+func IsKeyFile(ref string) bool {
+	_, _, ok := resolveKeyProvider(ref)
+	return !ok
+}
+
+func resolveKeyProvider(ref string) (KeyProvider, string, bool) {
+	i := strings.Index(ref, ":")
+	if i < 0 {
+		return nil, "", false
+	}
+	provider, ok := keyProviders[ref[:i]]
+	return provider, ref[i+1:], ok
+}
+
+// delegatedKey is a private key which is held by a KeyProvider.
+type delegatedKey struct {
+	ref       string
+	agreement KeyAgreement
+}
+
+// LoadKey loads the key identified by ref, which is either a private key file, or a reference to
+// a key held by a registered KeyProvider such as "env:CRUX_STORAGE_KEY".
+func LoadKey(ref string) (nacl.Key, error) {
+	provider, keyRef, ok := resolveKeyProvider(ref)
+	if !ok {
+		provider, keyRef = fileKeyProvider{}, ref
+	}
+
+	key, err := provider.PrivateKey(keyRef)
+	if err == nil && key == nil {
+		err = fmt.Errorf("key %s is not available outside of its provider", ref)
+	}
+	return key, err
+}
+
+// envKeyProvider reads base64 encoded keys from environment variables, for references of the
+// form "env:VARIABLE".
+type envKeyProvider struct{}
+
+func (envKeyProvider) PrivateKey(ref string) (nacl.Key, error) {
+	value, ok := os.LookupEnv(ref)
+	if !ok {
+		return nil, fmt.Errorf("environment variable %s is not set", ref)
+	}
+	return utils.LoadBase64Key(strings.TrimSpace(value))
+}
+
+type fileKeyProvider struct{}
+
+func (fileKeyProvider) PrivateKey(ref string) (nacl.Key, error) {
+	keys, err := loadPrivKeys([]string{ref})
+	if err != nil {
+		return nil, err
+	}
+	return keys[0], nil
+}
+
+// loadPrivKeyRefs loads the private keys corresponding to pubKeys. Keys which are held by a
+// KeyProvider implementing KeyAgreement are returned as nil, with their details provided in the
+// delegates map.
+func loadPrivKeyRefs(
+	pubKeys []nacl.Key, refs []string) ([]nacl.Key, map[[nacl.KeySize]byte]delegatedKey, error) {
+
+	privKeys := make([]nacl.Key, len(refs))
+	delegates := make(map[[nacl.KeySize]byte]delegatedKey)
+
+	for i, ref := range refs {
+		provider, keyRef, ok := resolveKeyProvider(ref)
+		if !ok {
+			provider, keyRef = fileKeyProvider{}, ref
+		}
+
+		key, err := provider.PrivateKey(keyRef)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if key == nil {
+			agreement, ok := provider.(KeyAgreement)
+			if !ok || i >= len(pubKeys) {
+				return nil, nil, fmt.Errorf("no private key provided for: %s", ref)
+			}
+			delegates[*pubKeys[i]] = delegatedKey{ref: keyRef, agreement: agreement}
+		}
+		privKeys[i] = key
+	}
+
+	return privKeys, delegates, nil
+}
+
+// precompute computes the shared key between the sender and recipient, delegating to the
+// sender's KeyProvider if we do not hold the private key ourselves.
+func (s *SecureEnclave) precompute(
+	senderPrivKey, senderPubKey, recipientPubKey nacl.Key) (nacl.Key, error) {
+
+	if senderPrivKey != nil {
+		return crypt.SharedKey(senderPrivKey, recipientPubKey), nil
+	}
+
+	s.keysMu.RLock()
+	delegate, ok := s.delegates[*senderPubKey]
+	s.keysMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("no private key available for public key: %s",
+			hex.EncodeToString((*senderPubKey)[:]))
+	}
+	return delegate.agreement.SharedKey(delegate.ref, recipientPubKey)
+}
+
+// defaultKeyPair returns the first keypair associated with the enclave which is not retiring,
+// used when a sender or recipient is not specified.
+func (s *SecureEnclave) defaultKeyPair() (nacl.Key, nacl.Key) {
+	s.keysMu.RLock()
+	defer s.keysMu.RUnlock()
+	for i, pubKey := range s.PubKeys {
+		if !s.isRetiring(pubKey) {
+			return pubKey, s.PrivKeys[i]
+		}
+	}
+	return s.PubKeys[0], s.PrivKeys[0]
+}
+
+// AddKeys loads the keypairs in the provided files which the enclave does not already hold,
+// announcing them to other nodes via its PartyInfo, and returns the public keys added.
+// Keys are never removed, as they may still be needed to decrypt stored payloads.
+func (s *SecureEnclave) AddKeys(pubKeyFiles, privKeyFiles []string) ([]nacl.Key, error) {
+	if len(pubKeyFiles) != len(privKeyFiles) {
+		return nil, errors.New("private keys provided must have corresponding public keys")
+	}
+
+	pubKeys, err := loadPubKeys(pubKeyFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	s.keysMu.RLock()
+	var newPubKeys []nacl.Key
+	var newPrivKeyFiles []string
+	for i, pubKey := range pubKeys {
+		if !containsKey(s.PubKeys, pubKey) && !containsKey(newPubKeys, pubKey) {
+			newPubKeys = append(newPubKeys, pubKey)
+			newPrivKeyFiles = append(newPrivKeyFiles, privKeyFiles[i])
+		}
+	}
+	s.keysMu.RUnlock()
+
+	if len(newPubKeys) == 0 {
+		return nil, nil
+	}
+	privKeys, delegates, err := loadPrivKeyRefs(newPubKeys, newPrivKeyFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	s.keysMu.Lock()
+	// Readers may hold the existing slices, so they are copied rather than appended to
+	s.PubKeys = append(append([]nacl.Key{}, s.PubKeys...), newPubKeys...)
+	s.PrivKeys = append(append([]nacl.Key{}, s.PrivKeys...), privKeys...)
+	for key, delegate := range delegates {
+		s.delegates[key] = delegate
+	}
+	s.keysMu.Unlock()
+
+	s.PartyInfo.RegisterPublicKeys(newPubKeys)
+	return newPubKeys, nil
+}
+
+func containsKey(keys []nacl.Key, key nacl.Key) bool {
+	for _, k := range keys {
+		if *k == *key {
+			return true
+		}
+	}
+	return false
+}
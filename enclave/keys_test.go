@@ -0,0 +1,146 @@
+package enclave
+
+import (
+	"bytes"
+	"encoding/base64"
+	"github.com/blk-io/crux/api"
+	"github.com/blk-io/crux/storage"
+	"github.com/kevinburke/nacl"
+	"github.com/kevinburke/nacl/box"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+// mockHsm holds private keys on behalf of the enclave, only providing shared keys.
+type mockHsm struct{}
+
+func (mockHsm) PrivateKey(ref string) (nacl.Key, error) {
+	return nil, nil
+}
+
+func (mockHsm) SharedKey(ref string, pubKey nacl.Key) (nacl.Key, error) {
+	privKeys, err := loadPrivKeys([]string{ref})
+	if err != nil {
+		return nil, err
+	}
+	return box.Precompute(pubKey, privKeys[0]), nil
+}
+
+func TestDelegatedKeyAgreement(t *testing.T) {
+	dbPath, err := ioutil.TempDir("", "TestDelegatedKeyAgreement")
+	if err != nil {
+		t.Fatal(err)
+	} else {
+		defer os.RemoveAll(dbPath)
+	}
+
+	RegisterKeyProvider("hsm", mockHsm{})
+	if IsKeyFile("hsm:testdata/key") {
+		t.Error("Key reference should resolve to registered provider")
+	}
+
+	db, err := storage.InitLevelDb(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &MockClient{}
+	pi := api.InitPartyInfo(
+		"http://localhost:8000",
+		[]string{"http://localhost:8001"}, client, false)
+
+	enc := Init(db, []string{"testdata/key.pub"}, []string{"hsm:testdata/key"}, pi, client, false)
+
+	if enc.PrivKeys[0] != nil {
+		t.Error("Private key material should not be held by the enclave")
+	}
+
+	digest, err := enc.Store(&message, []byte{}, [][]byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	returned, err := enc.Retrieve(&digest, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(message, returned) {
+		t.Errorf(
+			"Retrieved message is not the same as original:\n"+
+				"Original: %v\nRetrieved: %v",
+			message, returned)
+	}
+}
+
+func TestVaultKeyProvider(t *testing.T) {
+	privKeys, err := loadPrivKeys([]string{"testdata/key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b64Key := base64.StdEncoding.EncodeToString((*privKeys[0])[:])
+
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if r.URL.Path != "/v1/secret/data/crux" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"data":{"data":{"privatekey":"` + b64Key + `"}}}`))
+	}))
+	defer vault.Close()
+
+	provider := NewVaultKeyProvider(vault.URL, "token", http.DefaultClient)
+
+	key, err := provider.PrivateKey("secret/data/crux#privatekey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal((*key)[:], (*privKeys[0])[:]) {
+		t.Errorf("Vault key %v does not match expected %v", key, privKeys[0])
+	}
+
+	_, err = provider.PrivateKey("secret/data/crux")
+	if err == nil {
+		t.Error("Missing vault field should not resolve a key")
+	}
+
+	_, err = NewVaultKeyProvider(vault.URL, "invalid", http.DefaultClient).PrivateKey(
+		"secret/data/crux#privatekey")
+	if err == nil {
+		t.Error("Unauthorised vault request should fail")
+	}
+}
+
+func TestLoadKey(t *testing.T) {
+	fileKey, err := LoadKey("testdata/key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("CRUX_TEST_KEY", base64.StdEncoding.EncodeToString((*fileKey)[:]))
+	defer os.Unsetenv("CRUX_TEST_KEY")
+
+	envKey, err := LoadKey("env:CRUX_TEST_KEY")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *envKey != *fileKey {
+		t.Error("Key loaded from the environment does not match")
+	}
+
+	if _, err = LoadKey("env:CRUX_TEST_MISSING_KEY"); err == nil {
+		t.Error("Loading a key from an unset variable should fail")
+	}
+
+	RegisterKeyProvider("hsm", mockHsm{})
+	if _, err = LoadKey("hsm:testdata/key"); err == nil {
+		t.Error("Loading a key which never leaves its provider should fail")
+	}
+}
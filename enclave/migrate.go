@@ -0,0 +1,68 @@
+package enclave
+
+import (
+	"github.com/blk-io/crux/api"
+	"github.com/blk-io/crux/storage"
+	"github.com/blk-io/crux/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+// MigrateResult counts the payloads read by Migrate.
+type MigrateResult struct {
+	// Migrated payloads were written to storage.
+	Migrated int
+	// Existing payloads were already held in storage, so were left untouched.
+	Existing int
+	// Invalid entries could not be decoded as payloads, so were skipped.
+	Invalid int
+}
+
+// Migrate imports the payloads read by readAll, such as the ReadAll of a Constellation
+// BerkeleyDB store or a storage.ReadDirectory of its directory storage, into db. Payloads share
+// Constellation's encoding, so are stored as they are, under the digest of their cipher text
+// rather than the key they were read with.
+// Keys are not loaded while migrating, so migrated payloads cannot be indexed by sender and
+// recipient. Instead, if any are migrated and meta is not nil, they are indexed along with the
+// rest of db by the next IndexPayloads.
+func Migrate(
+	readAll func(f func(key, value *[]byte)) error, db, meta storage.DataStore) (MigrateResult, error) {
+
+	var result MigrateResult
+	var writeErr error
+	err := readAll(func(key, value *[]byte) {
+		if writeErr != nil {
+			return
+		}
+		epl, _, err := api.DecodePayloadWithRecipients(*value)
+		if err != nil {
+			log.WithField("key", string(*key)).Warnf("Skipping invalid payload, error: %v", err)
+			result.Invalid++
+			return
+		}
+
+		digestHash := utils.Digest(epl.CipherText)
+		exists, err := db.Has(&digestHash)
+		if err != nil {
+			writeErr = err
+			return
+		}
+		if exists {
+			result.Existing++
+			return
+		}
+		encoded := append([]byte(nil), *value...)
+		if writeErr = db.Write(&digestHash, &encoded); writeErr == nil {
+			result.Migrated++
+		}
+	})
+	if err == nil {
+		err = writeErr
+	}
+	if result.Migrated > 0 && meta != nil {
+		marker := []byte(payloadIndexedMarker)
+		if indexErr := storage.WithPrefix(meta, payloadIndexPrefix).Delete(&marker); err == nil {
+			err = indexErr
+		}
+	}
+	return result, err
+}
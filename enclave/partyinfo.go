@@ -0,0 +1,77 @@
+package enclave
+
+import (
+	"errors"
+	"github.com/blk-io/crux/api"
+	"github.com/blk-io/crux/storage"
+	log "github.com/sirupsen/logrus"
+)
+
+const partyInfoPrefix = "partyinfo/"
+
+// partyInfoKey is the key the SecureEnclave's party info is persisted under.
+var partyInfoKey = []byte("self")
+
+// PersistPartyInfo saves the recipients and parties known to the SecureEnclave to its metadata
+// store whenever they change, restoring any previously saved first, so a restarted node can
+// route payloads before it has heard from other nodes again.
+// The saved party info is merged as if it was announced by this node, so recipients announced
+// since by their own nodes take precedence, and recipients are validated if validation is
+// enabled.
+func (s *SecureEnclave) PersistPartyInfo() error {
+	if s.Meta == nil {
+		return errors.New("no metadata store configured")
+	}
+
+	store := storage.WithPrefix(s.Meta, partyInfoPrefix)
+	exists, err := store.Has(&partyInfoKey)
+	if err != nil {
+		return err
+	}
+	if exists {
+		encoded, err := store.Read(&partyInfoKey)
+		if err != nil {
+			return err
+		}
+		if err = s.restorePartyInfo(*encoded); err != nil {
+			return err
+		}
+	}
+
+	s.PartyInfo.OnUpdate(func() {
+		if err := s.savePartyInfo(); err != nil {
+			log.Errorf("Unable to save party info, %v", err)
+		}
+	})
+	return s.savePartyInfo()
+}
+
+func (s *SecureEnclave) restorePartyInfo(encoded []byte) error {
+	saved, err := api.DecodePartyInfo(encoded)
+	if err != nil {
+		return err
+	}
+
+	// Recipients saved under another URL would be treated as another node's, so are discarded
+	// if this node's URL has changed
+	savedUrl, recipients, parties := saved.GetAllValues()
+	if savedUrl != s.selfUrl() {
+		log.Warnf("Discarding party info saved for %s", savedUrl)
+		return nil
+	}
+	if err = s.PartyInfo.UpdatePartyInfo(encoded); err != nil {
+		return err
+	}
+	log.Infof("Restored party info with %d recipients and %d parties", len(recipients), len(parties))
+	return nil
+}
+
+// savePartyInfo writes the current party info to the metadata store. Saves are serialised, so
+// the last to complete reflects the latest changes.
+func (s *SecureEnclave) savePartyInfo() error {
+	s.partyInfoMu.Lock()
+	defer s.partyInfoMu.Unlock()
+
+	encoded := api.EncodePartyInfo(s.PartyInfo)
+	return storage.WithPrefix(s.Meta, partyInfoPrefix).Write(&partyInfoKey, &encoded)
+}
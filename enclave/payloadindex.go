@@ -0,0 +1,203 @@
+package enclave
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/blk-io/crux/api"
+	"github.com/blk-io/crux/crypt"
+	"github.com/blk-io/crux/storage"
+	"github.com/kevinburke/nacl"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	payloadIndexPrefix   = "payloadindex/"
+	payloadPartiesKey    = "parties/" // Maps a payload's digest to the keys it is indexed under
+	payloadIndexedMarker = "indexed"  // Present once payloads stored before indexing are indexed
+)
+
+// payloadParties are the public keys a payload is indexed under.
+type payloadParties struct {
+	Sender     []byte   `json:"sender"`
+	Recipients [][]byte `json:"recipients"`
+}
+
+func (s *SecureEnclave) payloadIndex(role string) *storage.Index {
+	return storage.NewIndex(storage.WithPrefix(s.Meta, payloadIndexPrefix+role+"/"))
+}
+
+// ListPayloads returns the digests of the payloads stored with publicKey in the given role,
+// api.PartySender or api.PartyRecipient, in order. Only digests following after are returned if
+// it is not nil, and at most limit if it is greater than 0.
+func (s *SecureEnclave) ListPayloads(role string, publicKey, after []byte, limit int) ([][]byte, error) {
+	if s.Meta == nil {
+		return nil, errors.New("no metadata store configured")
+	}
+	if role != api.PartySender && role != api.PartyRecipient {
+		return nil, fmt.Errorf("invalid role %s", role)
+	}
+
+	s.metaMu.RLock()
+	defer s.metaMu.RUnlock()
+	return s.payloadIndex(role).Keys(publicKey, after, limit)
+}
+
+// IndexPayloads indexes the payloads stored before payloads were indexed by sender and
+// recipient, which is only done once. Payloads stored since are indexed as they are stored.
+func (s *SecureEnclave) IndexPayloads() error {
+	if s.Meta == nil {
+		return nil
+	}
+	store := storage.WithPrefix(s.Meta, payloadIndexPrefix)
+	marker := []byte(payloadIndexedMarker)
+	if indexed, err := store.Has(&marker); err != nil || indexed {
+		return err
+	}
+
+	// Collect the digests first, as the underlying iterator does not permit concurrent writes,
+	// reading each payload only as it is indexed so they are not all held in memory
+	var digests [][]byte
+	err := s.Db.ReadAll(func(key, value *[]byte) {
+		digests = append(digests, append([]byte(nil), *key...))
+	})
+	if err != nil {
+		return err
+	}
+	for _, digest := range digests {
+		encoded, err := s.Db.Read(&digest)
+		if err != nil {
+			return err
+		}
+		if err = s.indexPayload(digest, *encoded); err != nil {
+			return err
+		}
+	}
+	log.Infof("Indexed %d payloads by sender and recipient", len(digests))
+
+	value := []byte{}
+	s.metaMu.Lock()
+	defer s.metaMu.Unlock()
+	return store.Write(&marker, &value)
+}
+
+// indexPayload indexes the encoded payload stored under digest by its sender and recipients,
+// if the SecureEnclave has a metadata store.
+func (s *SecureEnclave) indexPayload(digest, encoded []byte) error {
+	if s.Meta == nil {
+		return nil
+	}
+	parties, err := s.payloadParties(encoded)
+	if err != nil {
+		return err
+	}
+	value, err := json.Marshal(parties)
+	if err != nil {
+		return err
+	}
+
+	s.metaMu.Lock()
+	defer s.metaMu.Unlock()
+	if err = s.unindex(digest); err != nil {
+		return err
+	}
+	if err = s.payloadIndex(api.PartySender).Add(parties.Sender, digest); err != nil {
+		return err
+	}
+	for _, recipient := range parties.Recipients {
+		if err = s.payloadIndex(api.PartyRecipient).Add(recipient, digest); err != nil {
+			return err
+		}
+	}
+	return storage.WithPrefix(s.Meta, payloadIndexPrefix+payloadPartiesKey).Write(&digest, &value)
+}
+
+// unindexPayload removes the payload stored under digest from the indexes, if the SecureEnclave
+// has a metadata store.
+func (s *SecureEnclave) unindexPayload(digest []byte) error {
+	if s.Meta == nil {
+		return nil
+	}
+	s.metaMu.Lock()
+	defer s.metaMu.Unlock()
+	return s.unindex(digest)
+}
+
+// unindex removes the payload stored under digest from the indexes, holding metaMu.
+func (s *SecureEnclave) unindex(digest []byte) error {
+	store := storage.WithPrefix(s.Meta, payloadIndexPrefix+payloadPartiesKey)
+	exists, err := store.Has(&digest)
+	if err != nil || !exists {
+		return err
+	}
+	value, err := store.Read(&digest)
+	if err != nil {
+		return err
+	}
+	var parties payloadParties
+	if err = json.Unmarshal(*value, &parties); err != nil {
+		return err
+	}
+
+	if err = s.payloadIndex(api.PartySender).Remove(parties.Sender, digest); err != nil {
+		return err
+	}
+	for _, recipient := range parties.Recipients {
+		if err = s.payloadIndex(api.PartyRecipient).Remove(recipient, digest); err != nil {
+			return err
+		}
+	}
+	return store.Delete(&digest)
+}
+
+// payloadParties returns the sender and recipients of an encoded payload. The recipients of
+// payloads sent by other nodes are not stored with them, so are whichever of our keys can open
+// the payload's recipient box.
+func (s *SecureEnclave) payloadParties(encoded []byte) (payloadParties, error) {
+	epl, recipients, err := api.DecodePayloadWithRecipients(encoded)
+	if err != nil {
+		return payloadParties{}, err
+	}
+	parties := payloadParties{Sender: (*epl.Sender)[:], Recipients: [][]byte{}}
+
+	if len(recipients) > 0 {
+		for _, recipient := range recipients {
+			// Payloads sent only to ourselves are stored for our ephemeral key
+			if s.selfPubKey == nil || !bytes.Equal(recipient, (*s.selfPubKey)[:]) {
+				parties.Recipients = append(parties.Recipients, recipient)
+			}
+		}
+		return parties, nil
+	}
+
+	if len(epl.RecipientBoxes) == 0 {
+		return parties, nil
+	}
+	s.keysMu.RLock()
+	pubKeys := append([]nacl.Key{}, s.PubKeys...)
+	s.keysMu.RUnlock()
+	for _, pubKey := range pubKeys {
+		if s.canOpen(epl, pubKey) {
+			parties.Recipients = append(parties.Recipients, (*pubKey)[:])
+			break
+		}
+	}
+	return parties, nil
+}
+
+// canOpen reports whether pubKey, one of our keys, can open the recipient box of a payload sent
+// by another node.
+func (s *SecureEnclave) canOpen(epl api.EncryptedPayload, pubKey nacl.Key) bool {
+	privKey, err := s.resolvePrivateKey(pubKey)
+	if err != nil {
+		return false
+	}
+	// The sender is chosen by the node which pushed the payload, so the shared key is not cached
+	sharedKey, err := s.precompute(privKey, pubKey, epl.Sender)
+	if err != nil {
+		return false
+	}
+	_, err = crypt.OpenMasterKey(epl.RecipientBoxes[0], epl.RecipientNonce, sharedKey)
+	return err == nil
+}
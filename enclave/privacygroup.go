@@ -0,0 +1,249 @@
+package enclave
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/blk-io/crux/api"
+	"github.com/blk-io/crux/storage"
+	"github.com/blk-io/crux/utils"
+	"github.com/kevinburke/nacl"
+	"sort"
+)
+
+const (
+	privacyGroupPrefix = "privacygroup/"
+	payloadGroupPrefix = "payloadgroup/" // Maps a payload's digest to the group it was sent to
+)
+
+// CreatePrivacyGroup creates a privacy group of the provided members, on behalf of from, which
+// must be one of the enclave's keys, and is added to the members if not already present. If from
+// is empty the enclave's default key is used.
+// Each group is assigned a unique ID, so several groups may have the same members.
+func (s *SecureEnclave) CreatePrivacyGroup(
+	from []byte, members [][]byte, name, description string) (api.PrivacyGroup, error) {
+
+	if s.Meta == nil {
+		return api.PrivacyGroup{}, errors.New("no metadata store configured")
+	}
+	from, err := s.memberKey(from)
+	if err != nil {
+		return api.PrivacyGroup{}, err
+	}
+
+	encoded := []string{encodeKey(from)}
+	for _, member := range members {
+		if len(member) != nacl.KeySize {
+			return api.PrivacyGroup{}, fmt.Errorf("invalid member public key %s", encodeKey(member))
+		}
+		encoded = append(encoded, encodeKey(member))
+	}
+	encoded = uniqueSorted(encoded)
+
+	id := make([]byte, 32)
+	if _, err = rand.Read(id); err != nil {
+		return api.PrivacyGroup{}, err
+	}
+
+	group := api.PrivacyGroup{
+		PrivacyGroupId: encodeKey(id),
+		Name:           name,
+		Description:    description,
+		Members:        encoded,
+	}
+	value, err := json.Marshal(group)
+	if err != nil {
+		return api.PrivacyGroup{}, err
+	}
+
+	s.metaMu.Lock()
+	defer s.metaMu.Unlock()
+	err = storage.WithPrefix(s.Meta, privacyGroupPrefix).Write(&id, &value)
+	return group, err
+}
+
+// FindPrivacyGroups returns the privacy groups whose members are exactly those provided.
+func (s *SecureEnclave) FindPrivacyGroups(members [][]byte) ([]api.PrivacyGroup, error) {
+	if s.Meta == nil {
+		return nil, errors.New("no metadata store configured")
+	}
+
+	encoded := make([]string, len(members))
+	for i, member := range members {
+		encoded[i] = encodeKey(member)
+	}
+	expected := fmt.Sprint(uniqueSorted(encoded))
+
+	groups := []api.PrivacyGroup{}
+	var decodeErr error
+	s.metaMu.Lock()
+	err := storage.WithPrefix(s.Meta, privacyGroupPrefix).ReadAll(func(key, value *[]byte) {
+		var group api.PrivacyGroup
+		if err := json.Unmarshal(*value, &group); err != nil {
+			decodeErr = err
+			return
+		}
+		if fmt.Sprint(group.Members) == expected {
+			groups = append(groups, group)
+		}
+	})
+	s.metaMu.Unlock()
+	if err == nil {
+		err = decodeErr
+	}
+
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].PrivacyGroupId < groups[j].PrivacyGroupId
+	})
+	return groups, err
+}
+
+// DeletePrivacyGroup deletes the privacy group with the given ID on behalf of from, which must
+// be one of its members, and one of the enclave's keys. Payloads already sent to the group are
+// unaffected.
+func (s *SecureEnclave) DeletePrivacyGroup(id, from []byte) error {
+	group, err := s.privacyGroup(id)
+	if err != nil {
+		return err
+	}
+	if err = s.checkMember(group, from); err != nil {
+		return err
+	}
+
+	s.metaMu.Lock()
+	defer s.metaMu.Unlock()
+	return storage.WithPrefix(s.Meta, privacyGroupPrefix).Delete(&id)
+}
+
+// PrivacyGroupRecipients returns the members of the privacy group with the given ID, other than
+// sender, to send a payload to. sender must be a member of the group, if it is empty the
+// enclave's default key is used.
+func (s *SecureEnclave) PrivacyGroupRecipients(id, sender []byte) ([][]byte, error) {
+	group, err := s.privacyGroup(id)
+	if err != nil {
+		return nil, err
+	}
+	if err = s.checkMember(group, sender); err != nil {
+		return nil, err
+	}
+	sender, _ = s.memberKey(sender)
+
+	var recipients [][]byte
+	for _, member := range group.Members {
+		key, err := base64.StdEncoding.DecodeString(member)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(key, sender) {
+			recipients = append(recipients, key)
+		}
+	}
+	return recipients, nil
+}
+
+// RecordPrivacyGroup records that the payload with the given digestHash was sent to the privacy
+// group with the given ID.
+func (s *SecureEnclave) RecordPrivacyGroup(digestHash, id []byte) error {
+	if s.Meta == nil {
+		return errors.New("no metadata store configured")
+	}
+
+	s.metaMu.Lock()
+	defer s.metaMu.Unlock()
+	return storage.WithPrefix(s.Meta, payloadGroupPrefix).Write(&digestHash, &id)
+}
+
+// PayloadPrivacyGroup returns the ID of the privacy group the payload with the given digestHash
+// was sent to, or nil if it was not sent to a group by this node.
+func (s *SecureEnclave) PayloadPrivacyGroup(digestHash []byte) ([]byte, error) {
+	if s.Meta == nil {
+		return nil, nil
+	}
+
+	s.metaMu.RLock()
+	defer s.metaMu.RUnlock()
+	store := storage.WithPrefix(s.Meta, payloadGroupPrefix)
+	exists, err := store.Has(&digestHash)
+	if err != nil || !exists {
+		return nil, err
+	}
+	id, err := store.Read(&digestHash)
+	if err != nil {
+		return nil, err
+	}
+	return *id, nil
+}
+
+func (s *SecureEnclave) privacyGroup(id []byte) (api.PrivacyGroup, error) {
+	if s.Meta == nil {
+		return api.PrivacyGroup{}, errors.New("no metadata store configured")
+	}
+
+	s.metaMu.RLock()
+	defer s.metaMu.RUnlock()
+	store := storage.WithPrefix(s.Meta, privacyGroupPrefix)
+	exists, err := store.Has(&id)
+	if err != nil {
+		return api.PrivacyGroup{}, err
+	}
+	if !exists {
+		return api.PrivacyGroup{}, api.ErrPrivacyGroupNotFound
+	}
+
+	encoded, err := store.Read(&id)
+	if err != nil {
+		return api.PrivacyGroup{}, err
+	}
+	var group api.PrivacyGroup
+	err = json.Unmarshal(*encoded, &group)
+	return group, err
+}
+
+// checkMember ensures that key, or the default key if it is empty, is a member of group.
+func (s *SecureEnclave) checkMember(group api.PrivacyGroup, key []byte) error {
+	key, err := s.memberKey(key)
+	if err != nil {
+		return err
+	}
+	encoded := encodeKey(key)
+	for _, member := range group.Members {
+		if member == encoded {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s is not a member of privacy group %s", encoded, group.PrivacyGroupId)
+}
+
+// memberKey returns key, or the default key if it is empty, ensuring it is one of the
+// enclave's keys.
+func (s *SecureEnclave) memberKey(key []byte) ([]byte, error) {
+	if len(key) == 0 {
+		pubKey, _ := s.defaultKeyPair()
+		return (*pubKey)[:], nil
+	}
+
+	pubKey, err := utils.ToKey(key)
+	if err != nil {
+		return nil, err
+	}
+	s.keysMu.RLock()
+	defer s.keysMu.RUnlock()
+	if !containsKey(s.PubKeys, pubKey) {
+		return nil, fmt.Errorf("%s is not one of this node's keys", encodeKey(key))
+	}
+	return key, nil
+}
+
+func uniqueSorted(values []string) []string {
+	sort.Strings(values)
+	unique := values[:0]
+	for i, value := range values {
+		if i == 0 || value != values[i-1] {
+			unique = append(unique, value)
+		}
+	}
+	return unique
+}
@@ -0,0 +1,97 @@
+package enclave
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/blk-io/crux/api"
+	"github.com/blk-io/crux/storage"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+const provenancePrefix = "provenance/"
+
+// RecordProvenance appends hop to the provenance of the payload with the given digestHash.
+// If the hop does not specify a sender or time, they are populated from the stored payload and
+// the current time respectively.
+// Nothing is recorded if the SecureEnclave does not have a metadata store.
+func (s *SecureEnclave) RecordProvenance(digestHash []byte, hop api.ProvenanceHop) error {
+	if s.Meta == nil {
+		return nil
+	}
+
+	if hop.Time.IsZero() {
+		hop.Time = time.Now().UTC()
+	}
+	if hop.Sender == "" {
+		encoded, err := s.Db.Read(&digestHash)
+		if err == nil {
+			epl, _, err := api.DecodePayloadWithRecipients(*encoded)
+			if err == nil {
+				hop.Sender = encodeKey((*epl.Sender)[:])
+			}
+		}
+	}
+
+	s.metaMu.Lock()
+	defer s.metaMu.Unlock()
+
+	hops, err := s.readProvenance(digestHash)
+	if err != nil {
+		return err
+	}
+	hops = append(hops, hop)
+
+	encoded, err := json.Marshal(hops)
+	if err != nil {
+		return err
+	}
+	return storage.WithPrefix(s.Meta, provenancePrefix).Write(&digestHash, &encoded)
+}
+
+// Provenance returns the recorded hops for the payload with the given digestHash, oldest first.
+func (s *SecureEnclave) Provenance(digestHash []byte) ([]api.ProvenanceHop, error) {
+	if s.Meta == nil {
+		return nil, errors.New("no metadata store configured")
+	}
+
+	s.metaMu.RLock()
+	defer s.metaMu.RUnlock()
+	return s.readProvenance(digestHash)
+}
+
+func (s *SecureEnclave) readProvenance(digestHash []byte) ([]api.ProvenanceHop, error) {
+	store := storage.WithPrefix(s.Meta, provenancePrefix)
+
+	exists, err := store.Has(&digestHash)
+	if err != nil || !exists {
+		return []api.ProvenanceHop{}, err
+	}
+
+	encoded, err := store.Read(&digestHash)
+	if err != nil {
+		return nil, err
+	}
+
+	var hops []api.ProvenanceHop
+	err = json.Unmarshal(*encoded, &hops)
+	return hops, err
+}
+
+func (s *SecureEnclave) recordProvenance(digestHash []byte, hop api.ProvenanceHop) {
+	err := s.RecordProvenance(digestHash, hop)
+	if err != nil {
+		log.WithField("digest", encodeKey(digestHash)).Errorf(
+			"Unable to record provenance, %v", err)
+	}
+}
+
+func encodeKey(key []byte) string {
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+func (s *SecureEnclave) selfUrl() string {
+	url, _, _ := s.PartyInfo.GetAllValues()
+	return url
+}
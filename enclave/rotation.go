@@ -0,0 +1,240 @@
+package enclave
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/blk-io/crux/api"
+	"github.com/blk-io/crux/crypt"
+	"github.com/blk-io/crux/storage"
+	"github.com/blk-io/crux/utils"
+	"github.com/kevinburke/nacl"
+	log "github.com/sirupsen/logrus"
+)
+
+const retiringPrefix = "retiring/"
+
+// RotateKey retires the key oldPubKey in favour of newPubKey, both of which must be held by the
+// enclave. The recipient boxes of stored payloads which the enclave opens with the old key are
+// re-encrypted to the new key, so they remain readable after the old key is removed:
+//   - payloads pushed to us for the old key are resealed for the new key, and are subsequently
+//     retrieved with it
+//   - payloads sent from the old key are resealed for all their recipients, with the new key as
+//     their sender
+//
+// The old key is marked as retiring, so it is no longer used as the default key, cannot be used to
+// send new payloads, and is no longer announced to other nodes. Payloads retrieved for the old
+// key are decrypted with the new key if they have been resealed for it. Rotation can safely be
+// repeated to re-encrypt any payloads received for the old key while it was in progress.
+func (s *SecureEnclave) RotateKey(oldPubKey, newPubKey []byte) (api.RotateKeyResponse, error) {
+	var result api.RotateKeyResponse
+	if s.Meta == nil {
+		return result, errors.New("no metadata store configured")
+	}
+
+	oldKey, err := utils.ToKey(oldPubKey)
+	if err != nil {
+		return result, err
+	}
+	newKey, err := utils.ToKey(newPubKey)
+	if err != nil {
+		return result, err
+	}
+	if *oldKey == *newKey {
+		return result, errors.New("a key cannot be rotated to itself")
+	}
+
+	oldPrivKey, err := s.resolvePrivateKey(oldKey)
+	if err != nil {
+		return result, err
+	}
+	newPrivKey, err := s.resolvePrivateKey(newKey)
+	if err != nil {
+		return result, err
+	}
+	if s.isRetiring(newKey) {
+		return result, errors.New("cannot rotate to a retiring key")
+	}
+
+	// The new key is recorded as the old key's replacement
+	replacement := append([]byte(nil), newPubKey...)
+	err = storage.WithPrefix(s.Meta, retiringPrefix).Write(&oldPubKey, &replacement)
+	if err != nil {
+		return result, err
+	}
+	s.PartyInfo.UnregisterPublicKeys([]nacl.Key{oldKey})
+	log.WithField("publicKey", encodeKey(oldPubKey)).Info("Key marked as retiring")
+
+	// Collect the keys first, as the underlying iterator does not permit concurrent writes
+	var digests [][]byte
+	err = s.Db.ReadAll(func(key, value *[]byte) {
+		digests = append(digests, append([]byte(nil), *key...))
+	})
+	if err != nil {
+		return result, err
+	}
+
+	rotation := keyRotation{
+		enclave: s,
+		oldKey:  oldKey, oldPrivKey: oldPrivKey,
+		newKey: newKey, newPrivKey: newPrivKey,
+	}
+	for _, digest := range digests {
+		digest := digest
+		encoded, err := s.Db.Read(&digest)
+		if err != nil {
+			return result, err
+		}
+
+		rotated, ok, err := rotation.rotate(*encoded)
+		if err != nil {
+			log.WithField("digest", encodeKey(digest)).Errorf(
+				"Unable to re-encrypt payload, %v", err)
+			result.Failed++
+			continue
+		}
+		if !ok {
+			result.Unchanged++
+			continue
+		}
+
+		if err = s.Db.Write(&digest, &rotated); err != nil {
+			return result, err
+		}
+		if err = s.indexPayload(digest, rotated); err != nil {
+			return result, err
+		}
+		result.Reencrypted++
+	}
+
+	return result, nil
+}
+
+// keyRotation re-encrypts payloads from an old keypair to a new one.
+type keyRotation struct {
+	enclave            *SecureEnclave
+	oldKey, oldPrivKey nacl.Key
+	newKey, newPrivKey nacl.Key
+}
+
+// rotate returns the re-encrypted encoding of the payload, or false if it does not use the old
+// key.
+func (r *keyRotation) rotate(encoded []byte) ([]byte, bool, error) {
+	epl, recipients, err := api.DecodePayloadWithRecipients(encoded)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(epl.RecipientBoxes) == 0 {
+		return nil, false, nil
+	}
+
+	if len(recipients) == 0 {
+		// A payload pushed to us, which may be for the old key
+		sharedKey, err := r.enclave.precompute(r.oldPrivKey, r.oldKey, epl.Sender)
+		if err != nil {
+			return nil, false, err
+		}
+		masterKey, err := crypt.OpenMasterKey(epl.RecipientBoxes[0], epl.RecipientNonce, sharedKey)
+		if err != nil {
+			// Addressed to another of our keys
+			return nil, false, nil
+		}
+
+		sharedKey, err = r.enclave.precompute(r.newPrivKey, r.newKey, epl.Sender)
+		if err != nil {
+			return nil, false, err
+		}
+		epl.RecipientBoxes[0] = crypt.SealMasterKey(masterKey, epl.RecipientNonce, sharedKey)
+		return api.EncodePayloadWithRecipients(epl, recipients), true, nil
+	}
+
+	if !bytes.Equal((*epl.Sender)[:], (*r.oldKey)[:]) {
+		return nil, false, nil
+	}
+
+	// A payload sent from the old key, which is resealed for each recipient from the new key
+	recipientKeys := make([]nacl.Key, len(recipients))
+	for i, recipient := range recipients {
+		if recipientKeys[i], err = utils.ToKey(recipient); err != nil {
+			return nil, false, err
+		}
+	}
+
+	sharedKey, err := r.enclave.precompute(r.oldPrivKey, r.oldKey, recipientKeys[0])
+	if err != nil {
+		return nil, false, err
+	}
+	masterKey, err := crypt.OpenMasterKey(epl.RecipientBoxes[0], epl.RecipientNonce, sharedKey)
+	if err != nil {
+		return nil, false, fmt.Errorf("unable to open payload sent from the old key, %v", err)
+	}
+
+	for i := range epl.RecipientBoxes {
+		if i >= len(recipientKeys) {
+			break
+		}
+		sharedKey, err = r.enclave.precompute(r.newPrivKey, r.newKey, recipientKeys[i])
+		if err != nil {
+			return nil, false, err
+		}
+		epl.RecipientBoxes[i] = crypt.SealMasterKey(masterKey, epl.RecipientNonce, sharedKey)
+	}
+	if i := senderBox(epl, recipients); i >= 0 {
+		sharedKey, err = r.enclave.precompute(r.newPrivKey, r.newKey, r.newKey)
+		if err != nil {
+			return nil, false, err
+		}
+		epl.RecipientBoxes[i] = crypt.SealMasterKey(masterKey, epl.RecipientNonce, sharedKey)
+	}
+	epl.Sender = r.newKey
+	return api.EncodePayloadWithRecipients(epl, recipients), true, nil
+}
+
+// isRetiring reports whether pubKey has been retired by a key rotation.
+func (s *SecureEnclave) isRetiring(pubKey nacl.Key) bool {
+	if s.Meta == nil {
+		return false
+	}
+	key := (*pubKey)[:]
+	retiring, err := storage.WithPrefix(s.Meta, retiringPrefix).Has(&key)
+	if err != nil {
+		log.WithField("publicKey", encodeKey(key)).Errorf(
+			"Unable to determine if key is retiring, %v", err)
+	}
+	return retiring
+}
+
+// replacement returns the key which replaced pubKey when it was retired. Keys retired before
+// replacements were recorded have none.
+func (s *SecureEnclave) replacement(pubKey nacl.Key) (nacl.Key, bool) {
+	if s.Meta == nil {
+		return nil, false
+	}
+	key := (*pubKey)[:]
+	store := storage.WithPrefix(s.Meta, retiringPrefix)
+	if retiring, err := store.Has(&key); err != nil || !retiring {
+		return nil, false
+	}
+	value, err := store.Read(&key)
+	if err != nil {
+		return nil, false
+	}
+	replacement, err := utils.ToKey(*value)
+	return replacement, err == nil
+}
+
+// ActivePubKeys returns the public keys of the enclave which are not retiring, which are those
+// announced to other nodes.
+func (s *SecureEnclave) ActivePubKeys() []nacl.Key {
+	s.keysMu.RLock()
+	pubKeys := append([]nacl.Key{}, s.PubKeys...)
+	s.keysMu.RUnlock()
+
+	var active []nacl.Key
+	for _, pubKey := range pubKeys {
+		if !s.isRetiring(pubKey) {
+			active = append(active, pubKey)
+		}
+	}
+	return active
+}
@@ -0,0 +1,85 @@
+package enclave
+
+import (
+	"encoding/base64"
+	"github.com/blk-io/crux/api"
+	"github.com/kevinburke/nacl"
+	"sync"
+	"time"
+)
+
+// keyUsage accumulates the payloads sent with a single sender key.
+type keyUsage struct {
+	payloads     int64
+	failures     int64
+	bytes        int64
+	totalLatency time.Duration
+	maxLatency   time.Duration
+}
+
+// usageStats tracks payload encryption by sender key since the enclave was started.
+type usageStats struct {
+	mu   sync.Mutex
+	keys map[[nacl.KeySize]byte]*keyUsage
+}
+
+func (u *usageStats) record(sender nacl.Key, size int, latency time.Duration, err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.keys == nil {
+		u.keys = make(map[[nacl.KeySize]byte]*keyUsage)
+	}
+	usage, ok := u.keys[*sender]
+	if !ok {
+		usage = &keyUsage{}
+		u.keys[*sender] = usage
+	}
+
+	if err != nil {
+		usage.failures++
+		return
+	}
+	usage.payloads++
+	usage.bytes += int64(size)
+	usage.totalLatency += latency
+	if latency > usage.maxLatency {
+		usage.maxLatency = latency
+	}
+}
+
+// Usage returns statistics on the payloads sent by each of the given public keys since the
+// enclave was started. If no keys are provided, the usage of every sender key is returned.
+func (s *SecureEnclave) Usage(publicKeys [][]byte) []api.KeyUsage {
+	s.usage.mu.Lock()
+	defer s.usage.mu.Unlock()
+
+	if len(publicKeys) == 0 {
+		for key := range s.usage.keys {
+			publicKeys = append(publicKeys, append([]byte(nil), key[:]...))
+		}
+	}
+
+	result := make([]api.KeyUsage, 0, len(publicKeys))
+	for _, publicKey := range publicKeys {
+		keyUsage := api.KeyUsage{PublicKey: base64.StdEncoding.EncodeToString(publicKey)}
+		var key [nacl.KeySize]byte
+		copy(key[:], publicKey)
+
+		if usage, ok := s.usage.keys[key]; len(publicKey) == nacl.KeySize && ok {
+			keyUsage.Payloads = usage.payloads
+			keyUsage.Failures = usage.failures
+			keyUsage.Bytes = usage.bytes
+			keyUsage.MaxLatencyMs = milliseconds(usage.maxLatency)
+			if usage.payloads > 0 {
+				keyUsage.AverageLatencyMs = milliseconds(usage.totalLatency) / float64(usage.payloads)
+			}
+		}
+		result = append(result, keyUsage)
+	}
+	return result
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,78 @@
+package enclave
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/blk-io/crux/utils"
+	"github.com/kevinburke/nacl"
+	"net/http"
+	"path"
+	"strings"
+)
+
+const defaultVaultField = "key"
+
+// VaultKeyProvider retrieves private keys from a Hashicorp Vault key/value secrets engine.
+// Key references take the form "<secret path>#<field>", e.g. "secret/data/crux/node1#key", where
+// the field holds the base64 encoded private key. If the field is omitted, "key" is used.
+type VaultKeyProvider struct {
+	addr   string
+	token  string
+	client utils.HttpClient
+}
+
+// NewVaultKeyProvider creates a new VaultKeyProvider for the Vault server at addr.
+func NewVaultKeyProvider(addr, token string, client utils.HttpClient) *VaultKeyProvider {
+	return &VaultKeyProvider{addr: addr, token: token, client: client}
+}
+
+// PrivateKey reads the private key held in the Vault secret identified by ref.
+func (v *VaultKeyProvider) PrivateKey(ref string) (nacl.Key, error) {
+	secretPath, field := ref, defaultVaultField
+	if i := strings.LastIndex(ref, "#"); i >= 0 {
+		secretPath, field = ref[:i], ref[i+1:]
+	}
+
+	endPoint, err := utils.BuildUrl(v.addr, path.Join("/v1", secretPath))
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("GET", endPoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", v.token)
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read secret %s from vault, error: %v", secretPath, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unable to read secret %s from vault, status code: %d",
+			secretPath, resp.StatusCode)
+	}
+
+	var secret struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&secret)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode secret %s from vault, error: %v", secretPath, err)
+	}
+
+	// Version 2 of the key/value engine nests the secret in a further data field
+	data := secret.Data
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		data = nested
+	}
+
+	value, ok := data[field].(string)
+	if !ok {
+		return nil, fmt.Errorf("field %s not present in vault secret %s", field, secretPath)
+	}
+
+	return utils.LoadBase64Key(value)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/blk-io/crux/config"
+	"github.com/blk-io/crux/enclave"
+	"github.com/blk-io/crux/storage"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// migrateCommand imports the storage and keys of another implementation's node into this one,
+// which must be run while both nodes are stopped, e.g.
+// crux --workdir ... migrate --from constellation --dir /path/to/cdata
+const migrateCommand = "migrate"
+
+// Constellation's default storage location within its data directory, and the file its
+// BerkeleyDB storage is held in.
+const (
+	constellationStorage    = "storage"
+	constellationBerkeleyDb = "payload.db"
+)
+
+// migrate imports the payloads and key pairs found in the Constellation data directory
+// configured, into db and workDir respectively. The payloads are indexed in meta when the node
+// is next started.
+func migrate(workDir string, db, meta storage.DataStore) error {
+	if from := config.GetString(config.MigrateFrom); from != "constellation" {
+		return fmt.Errorf("unsupported implementation %s, only constellation can be migrated from", from)
+	}
+	dir := config.GetString(config.MigrateDir)
+	if dir == "" {
+		return errors.New("the data directory to migrate from must be provided")
+	}
+
+	keys, err := migrateKeys(dir, workDir)
+	if err != nil {
+		return err
+	}
+
+	storageDir := dir
+	if info, err := os.Stat(path.Join(dir, constellationStorage)); err == nil && info.IsDir() {
+		storageDir = path.Join(dir, constellationStorage)
+	}
+	readAll := func(f func(key, value *[]byte)) error {
+		return storage.ReadDirectory(storageDir, f)
+	}
+	if _, err := os.Stat(path.Join(storageDir, constellationBerkeleyDb)); err == nil {
+		bdb, err := storage.InitBerkeleyDb(path.Join(storageDir, constellationBerkeleyDb))
+		if err != nil {
+			return err
+		}
+		defer bdb.Close()
+		readAll = bdb.ReadAll
+	}
+
+	result, err := enclave.Migrate(readAll, db, meta)
+	if err != nil {
+		log.Errorf("Migration failed after migrating %d payloads", result.Migrated)
+		return err
+	}
+	log.Printf("Migrated %d payloads and %d key files from %s, %d payloads were already held "+
+		"and %d invalid entries were skipped", result.Migrated, keys, dir, result.Existing, result.Invalid)
+	return nil
+}
+
+// migrateKeys copies the key pairs in dir, public keys with a .pub extension and their private
+// keys with a .key extension, to workDir, returning the number of files copied. Files already
+// present in workDir are left untouched.
+func migrateKeys(dir, workDir string) (int, error) {
+	pubKeys, err := filepath.Glob(path.Join(dir, "*.pub"))
+	if err != nil {
+		return 0, err
+	}
+
+	copied := 0
+	for _, pubKey := range pubKeys {
+		privKey := strings.TrimSuffix(pubKey, ".pub") + ".key"
+		if _, err := os.Stat(privKey); err != nil {
+			log.Warnf("Skipping public key %s without a private key", pubKey)
+			continue
+		}
+		for _, file := range []string{pubKey, privKey} {
+			ok, err := copyFile(file, path.Join(workDir, path.Base(file)))
+			if err != nil {
+				return copied, err
+			}
+			if ok {
+				copied++
+			} else {
+				log.Warnf("Not migrating %s, as %s already exists", file, path.Base(file))
+			}
+		}
+	}
+	return copied, nil
+}
+
+// copyFile copies src to dst with the same permissions, unless dst already exists.
+func copyFile(src, dst string) (bool, error) {
+	info, err := os.Stat(src)
+	if err != nil {
+		return false, err
+	}
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return false, err
+	}
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if os.IsExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	_, err = out.Write(data)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err == nil, err
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"github.com/blk-io/crux/api"
+	"github.com/blk-io/crux/client"
+	"github.com/blk-io/crux/config"
+	"github.com/blk-io/crux/peers"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// pairCommand pairs this node with another, e.g. crux --url ... pair https://node2:9001/
+const pairCommand = "pair"
+
+// pair performs the pairing handshake with the node at peerUrl, recording it in our peers file
+// once its fingerprint has been verified, either against the fingerprint flag, or interactively.
+func pair(workDir, peerUrl string) error {
+	self, err := selfPairInfo(workDir)
+	if err != nil {
+		return err
+	}
+	selfFingerprint, err := peers.Fingerprint(self)
+	if err != nil {
+		return err
+	}
+
+	token := pairToken()
+	if token == "" {
+		return fmt.Errorf("the pairing token configured on %s must be provided", peerUrl)
+	}
+
+	// The node's certificate is verified by its fingerprint, so it may be self-signed
+	conf := client.DefaultConfig()
+	conf.TLSConfig = &tls.Config{InsecureSkipVerify: true}
+	if proxyUrl := config.GetString(config.Proxy); proxyUrl != "" {
+		if conf.Proxy, err = client.ParseProxy(proxyUrl); err != nil {
+			return err
+		}
+	}
+	node := client.NewNode(peerUrl, client.New(conf))
+
+	remote, err := node.Pair(self, token, verifyPeer)
+	if err != nil {
+		return err
+	}
+
+	peer, err := peersFile(workDir).Add(remote)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Paired with %s (%s)\n", peer.Url, peer.Fingerprint)
+	fmt.Printf("The operator of %s can confirm this node's fingerprint is %s\n",
+		peer.Url, selfFingerprint)
+	return nil
+}
+
+// verifyPeer checks the details of a node we are pairing with against the fingerprint flag, or
+// asks the operator to confirm them if it is not set.
+func verifyPeer(remote api.PairInfo) error {
+	fingerprint, err := peers.Fingerprint(remote)
+	if err != nil {
+		return err
+	}
+
+	if expected := config.GetString(config.Fingerprint); expected != "" {
+		if expected != fingerprint {
+			return fmt.Errorf("fingerprint of %s is %s, expected %s", remote.Url, fingerprint, expected)
+		}
+		return nil
+	}
+
+	fmt.Printf("Node:        %s\n", remote.Url)
+	fmt.Printf("Public keys: %s\n", strings.Join(remote.PublicKeys, ", "))
+	fmt.Printf("Fingerprint: %s\n", fingerprint)
+	fmt.Print("Pair with this node? [y/N] ")
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if answer = strings.ToLower(strings.TrimSpace(answer)); answer != "y" && answer != "yes" {
+		return fmt.Errorf("pairing with %s was not confirmed", remote.Url)
+	}
+	return nil
+}
+
+// pairToken returns the pairing token, which may be provided by the environment.
+func pairToken() string {
+	token := config.GetString(config.PairToken)
+	if token == "" {
+		token = os.Getenv("CRUX_PAIR_TOKEN")
+	}
+	return token
+}
+
+// selfPairInfo describes this node to those pairing with it.
+func selfPairInfo(workDir string) (api.PairInfo, error) {
+	info := api.PairInfo{Url: config.GetString(config.Url)}
+	if info.Url == "" {
+		return info, fmt.Errorf("URL must be specified")
+	}
+
+	pubKeyFiles, _ := keyFiles(workDir)
+	for _, keyFile := range pubKeyFiles {
+		data, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return info, err
+		}
+		info.PublicKeys = append(info.PublicKeys, strings.TrimSpace(string(data)))
+	}
+
+	if config.GetBool(config.Tls) {
+		cert, err := ioutil.ReadFile(path.Join(workDir, config.GetString(config.TlsServerCert)))
+		if err != nil {
+			return info, err
+		}
+		info.Certificate = string(cert)
+	}
+	return info, nil
+}
+
+// peersFile returns the file recording the nodes we have paired with.
+func peersFile(workDir string) *peers.File {
+	peersPath := config.GetString(config.Peers)
+	if !path.IsAbs(peersPath) {
+		peersPath = path.Join(workDir, peersPath)
+	}
+	return peers.Open(peersPath)
+}
+
+// loadPeers returns the nodes we have paired with, logging any error reading them.
+func loadPeers(file *peers.File) []peers.Peer {
+	paired, err := file.Load()
+	if err != nil {
+		log.Errorf("Unable to load paired nodes, error: %v", err)
+	}
+	return paired
+}
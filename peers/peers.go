@@ -0,0 +1,175 @@
+// Package peers maintains the list of nodes a crux node has paired with.
+//
+// Pairing exchanges the URLs, public keys and TLS certificates of two nodes, after their
+// operators have verified each other's fingerprints. Paired nodes are contacted on startup in
+// addition to othernodes, and their certificates are trusted only when connecting to them over
+// https, so nodes with self-signed certificates can communicate.
+package peers
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"github.com/blk-io/crux/api"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Peer is a node we have paired with.
+type Peer struct {
+	api.PairInfo
+	Fingerprint string    `json:"fingerprint"`
+	Paired      time.Time `json:"paired"`
+}
+
+// File is a list of peers stored as JSON on disk, safe for concurrent use.
+type File struct {
+	path string
+	mu   sync.Mutex
+}
+
+// Open returns the peers file at path, which need not exist yet.
+func Open(path string) *File {
+	return &File{path: path}
+}
+
+// Load returns the peers in the file, which is empty if it does not exist.
+func (f *File) Load() ([]Peer, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.load()
+}
+
+func (f *File) load() ([]Peer, error) {
+	data, err := ioutil.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var peers []Peer
+	err = json.Unmarshal(data, &peers)
+	return peers, err
+}
+
+// Add records the node described by info as a peer, replacing any existing entry with the same
+// URL.
+func (f *File) Add(info api.PairInfo) (Peer, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	fingerprint, err := Fingerprint(info)
+	if err != nil {
+		return Peer{}, err
+	}
+	peer := Peer{PairInfo: info, Fingerprint: fingerprint, Paired: time.Now().UTC()}
+
+	existing, err := f.load()
+	if err != nil {
+		return Peer{}, err
+	}
+	peers := []Peer{peer}
+	for _, p := range existing {
+		if p.Url != peer.Url {
+			peers = append(peers, p)
+		}
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Url < peers[j].Url })
+
+	data, err := json.MarshalIndent(peers, "", "  ")
+	if err != nil {
+		return Peer{}, err
+	}
+
+	// Write to a temporary file first, so the file is never left partially written
+	tmp, err := ioutil.TempFile(filepath.Dir(f.path), filepath.Base(f.path))
+	if err != nil {
+		return Peer{}, err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), f.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return Peer{}, err
+	}
+	return peer, nil
+}
+
+// Fingerprint identifies a node by its TLS certificate and public keys, for operators to verify
+// when pairing. It is of the form "SHA256:" followed by a base64 encoded digest.
+func Fingerprint(info api.PairInfo) (string, error) {
+	hash := sha256.New()
+	if info.Certificate != "" {
+		cert, err := ParseCertificate(info.Certificate)
+		if err != nil {
+			return "", err
+		}
+		hash.Write(cert.Raw)
+	}
+
+	keys := append([]string{}, info.PublicKeys...)
+	sort.Strings(keys)
+	for _, key := range keys {
+		decoded, err := base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			return "", err
+		}
+		hash.Write(decoded)
+	}
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(hash.Sum(nil)), nil
+}
+
+// PinnedRoots returns a pool containing only the certificate of each peer which has one, keyed by
+// the host and port of its URL, so each certificate is only trusted for the peer it belongs to.
+func PinnedRoots(peers []Peer) (map[string]*x509.CertPool, error) {
+	pinned := make(map[string]*x509.CertPool)
+	for _, peer := range peers {
+		if peer.Certificate == "" {
+			continue
+		}
+		cert, err := ParseCertificate(peer.Certificate)
+		if err != nil {
+			return nil, err
+		}
+		u, err := url.Parse(peer.Url)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		pool.AddCert(cert)
+		pinned[u.Host] = pool
+	}
+	return pinned, nil
+}
+
+// Urls returns the URLs of peers.
+func Urls(peers []Peer) []string {
+	urls := make([]string, len(peers))
+	for i, peer := range peers {
+		urls[i] = peer.Url
+	}
+	return urls
+}
+
+// ParseCertificate parses a PEM encoded certificate.
+func ParseCertificate(encoded string) (*x509.Certificate, error) {
+	block, _ := pem.Decode([]byte(encoded))
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("invalid PEM encoded certificate")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
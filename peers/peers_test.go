@@ -0,0 +1,78 @@
+package peers
+
+import (
+	"github.com/blk-io/crux/api"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+const (
+	key1 = "BULeR8JyUWhiuuCMU/HLA0Q5pzkYT+cHII3ZKBey3Bo="
+	key2 = "QfeDAys9MPDs2XHExtc84jKGHxZg/aj52DTh0vtA3Xc="
+)
+
+func TestAdd(t *testing.T) {
+	dir, err := ioutil.TempDir("", "peers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := Open(path.Join(dir, "crux.peers"))
+	peers, err := file.Load()
+	if err != nil || len(peers) != 0 {
+		t.Fatalf("Expected no peers in a new file, got %v, error %v", peers, err)
+	}
+
+	node2 := api.PairInfo{Url: "http://node2:9001/", PublicKeys: []string{key1}}
+	node1 := api.PairInfo{Url: "http://node1:9001/", PublicKeys: []string{key2}}
+	for _, info := range []api.PairInfo{node2, node1} {
+		if _, err = file.Add(info); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Pairing again replaces the existing entry
+	node2.PublicKeys = []string{key1, key2}
+	peer, err := file.Add(node2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	peers, err = Open(file.path).Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if urls := Urls(peers); !reflect.DeepEqual(urls, []string{node1.Url, node2.Url}) {
+		t.Errorf("Unexpected peers %v", urls)
+	}
+	if !reflect.DeepEqual(peers[1].PublicKeys, node2.PublicKeys) ||
+		peers[1].Fingerprint != peer.Fingerprint {
+		t.Errorf("Peer was not replaced, got %v want %v", peers[1], peer)
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	fingerprint := func(keys ...string) string {
+		f, err := Fingerprint(api.PairInfo{Url: "http://node1:9001/", PublicKeys: keys})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+
+	if fingerprint(key1, key2) != fingerprint(key2, key1) {
+		t.Error("Fingerprint should not depend on the order of keys")
+	}
+	if fingerprint(key1) == fingerprint(key2) {
+		t.Error("Fingerprints of different keys should differ")
+	}
+
+	_, err := Fingerprint(api.PairInfo{PublicKeys: []string{key1}, Certificate: "invalid"})
+	if err == nil {
+		t.Error("Fingerprint should fail for an invalid certificate")
+	}
+}
@@ -0,0 +1,324 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/blk-io/crux/api"
+	"github.com/blk-io/crux/utils"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Paths served by the admin API.
+const (
+	adminPeers   = "/peers"
+	adminKeys    = "/keys"
+	adminStorage = "/storage"
+	adminCompact = "/storage/compact"
+	adminPurge   = "/storage/purge"
+	adminExport  = "/storage/export"
+	adminImport  = "/storage/import"
+	adminReload  = "/reload"
+	adminRotate  = "/keys/rotate"
+	adminAudit   = "/audit"
+	adminHealth  = "/peers/health"
+	adminStatus  = "/peers/status"
+	adminMetrics = "/metrics"
+)
+
+const hAuthorization = "Authorization"
+
+// startAdminServer starts the admin API on conf.AdminAddr, which is either a TCP address, or the
+// path of a unix socket. All requests must present conf.AdminToken as a bearer token.
+func (tm *TransactionManager) startAdminServer(conf ServerConfig) error {
+	addr := conf.AdminAddr
+	var listener net.Listener
+	var err error
+	if utils.IsAbstractSocket(addr) || strings.Contains(addr, "/") {
+		listener, err = utils.CreateIpcSocketWithOptions(addr, conf.IpcOptions)
+	} else {
+		listener, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+
+	handler := tm.adminHandler(conf.AdminToken, conf.Reload)
+	go func() {
+		log.Fatal(http.Serve(listener, closeBody(requestId(requestLogger(handler)))))
+	}()
+	log.Infof("Admin server is running at: %s", addr)
+	return nil
+}
+
+// adminHandler serves the admin API, the reload endpoint is only available if reload is provided.
+func (tm *TransactionManager) adminHandler(token string, reload func() error) http.Handler {
+	adminServer := http.NewServeMux()
+	adminServer.HandleFunc(adminPeers, tm.adminPeers)
+	adminServer.HandleFunc(adminKeys, tm.adminKeys)
+	adminServer.HandleFunc(adminStorage, tm.adminStorage)
+	adminServer.HandleFunc(adminCompact, tm.adminCompact)
+	adminServer.HandleFunc(adminPurge, tm.adminPurge)
+	adminServer.HandleFunc(adminExport, tm.adminExport)
+	adminServer.HandleFunc(adminImport, tm.adminImport)
+	adminServer.HandleFunc(adminRotate, tm.adminRotate)
+	adminServer.HandleFunc(adminAudit, tm.adminAudit)
+	adminServer.HandleFunc(adminHealth, tm.adminHealth)
+	adminServer.HandleFunc(adminStatus, tm.adminStatus)
+	adminServer.HandleFunc(adminMetrics, tm.adminMetrics)
+	adminServer.HandleFunc(usage, tm.adminUsage)
+	if reload != nil {
+		adminServer.HandleFunc(adminReload, func(w http.ResponseWriter, req *http.Request) {
+			if !allowMethod(w, req, http.MethodPost) {
+				return
+			}
+			if err := reload(); err != nil {
+				internalServerError(w, req, fmt.Sprintf("Unable to reload, error: %s\n", err))
+			}
+		})
+	}
+	return authenticate(token, adminServer)
+}
+
+// authenticate rejects requests which do not provide token in a bearer Authorization header.
+func authenticate(token string, handler http.Handler) http.Handler {
+	expected := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		provided := []byte(r.Header.Get(hAuthorization))
+		if subtle.ConstantTimeCompare(provided, expected) != 1 {
+			requestLog(r).Warnf("Unauthorised request to %s from %s", r.URL.Path, r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// adminPeers lists the nodes we know of, along with the public keys they host.
+func (s *TransactionManager) adminPeers(w http.ResponseWriter, req *http.Request) {
+	if !allowMethod(w, req, http.MethodGet) {
+		return
+	}
+
+	_, recipients, parties := s.Enclave.GetPartyInfo()
+	keys := make(map[string][]string)
+	for key, url := range recipients {
+		keys[url] = append(keys[url], base64.StdEncoding.EncodeToString(key[:]))
+	}
+
+	peers := make([]api.Peer, 0, len(parties))
+	for url := range parties {
+		sort.Strings(keys[url])
+		peers = append(peers, api.Peer{Url: url, PublicKeys: keys[url]})
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Url < peers[j].Url })
+
+	writeJson(w, peers)
+}
+
+// adminHealth reports the observed health of the nodes we have made requests to.
+func (s *TransactionManager) adminHealth(w http.ResponseWriter, req *http.Request) {
+	if !allowMethod(w, req, http.MethodGet) {
+		return
+	}
+	writeJson(w, s.Enclave.PeerHealth())
+}
+
+// adminStatus reports the liveness of the other nodes we know of, as determined by upchecking them.
+func (s *TransactionManager) adminStatus(w http.ResponseWriter, req *http.Request) {
+	if !allowMethod(w, req, http.MethodGet) {
+		return
+	}
+	writeJson(w, s.Enclave.PeerStatus())
+}
+
+// adminKeys lists the public keys hosted by this node.
+func (s *TransactionManager) adminKeys(w http.ResponseWriter, req *http.Request) {
+	if !allowMethod(w, req, http.MethodGet) {
+		return
+	}
+
+	self, recipients, _ := s.Enclave.GetPartyInfo()
+	keys := []string{}
+	for key, url := range recipients {
+		if url == self {
+			keys = append(keys, base64.StdEncoding.EncodeToString(key[:]))
+		}
+	}
+	sort.Strings(keys)
+
+	writeJson(w, keys)
+}
+
+func (s *TransactionManager) adminStorage(w http.ResponseWriter, req *http.Request) {
+	if !allowMethod(w, req, http.MethodGet) {
+		return
+	}
+
+	stats, err := s.Enclave.StorageStats()
+	if err != nil {
+		internalServerError(w, req, fmt.Sprintf("Unable to read storage, error: %s\n", err))
+		return
+	}
+	writeJson(w, stats)
+}
+
+func (s *TransactionManager) adminCompact(w http.ResponseWriter, req *http.Request) {
+	if !allowMethod(w, req, http.MethodPost) {
+		return
+	}
+
+	err := s.Enclave.Compact()
+	if err != nil {
+		internalServerError(w, req, fmt.Sprintf("Unable to compact storage, error: %s\n", err))
+	}
+}
+
+// adminPurge deletes payloads first seen more than the number of days provided in the days
+// query parameter ago.
+func (s *TransactionManager) adminPurge(w http.ResponseWriter, req *http.Request) {
+	if !allowMethod(w, req, http.MethodPost) {
+		return
+	}
+
+	value := req.URL.Query().Get("days")
+	days, err := strconv.Atoi(value)
+	if err != nil || days < 0 {
+		badRequest(w, req, fmt.Sprintf("Invalid number of days: %q\n", value))
+		return
+	}
+
+	before := time.Now().UTC().AddDate(0, 0, -days)
+	result, err := s.Enclave.Purge(before)
+	if err != nil {
+		internalServerError(w, req, fmt.Sprintf("Unable to purge storage, error: %s\n", err))
+		return
+	}
+
+	requestLog(req).Infof("Purged %d payloads recorded before %s", result.Purged, before)
+	writeJson(w, result)
+}
+
+// adminExport streams an export of the node's storage as a tar archive. The response has
+// already started if exporting fails, in which case the archive has no manifest, and is
+// rejected on import.
+func (s *TransactionManager) adminExport(w http.ResponseWriter, req *http.Request) {
+	if !allowMethod(w, req, http.MethodGet) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Content-Disposition", `attachment; filename="crux-export.tar"`)
+	entries, err := s.Enclave.Export(w)
+	if err != nil {
+		requestLog(req).Errorf("Unable to export storage, error: %v", err)
+		return
+	}
+	requestLog(req).Infof("Exported storage, entries: %v", entries)
+}
+
+// adminImport restores an export of a node's storage, provided as the request body.
+func (s *TransactionManager) adminImport(w http.ResponseWriter, req *http.Request) {
+	if !allowMethod(w, req, http.MethodPost) {
+		return
+	}
+
+	entries, err := s.Enclave.Import(req.Body)
+	if err != nil {
+		badRequest(w, req, fmt.Sprintf("Unable to import storage, imported: %v, error: %s",
+			entries, err))
+		return
+	}
+
+	requestLog(req).Infof("Imported storage, entries: %v", entries)
+	writeJson(w, api.ImportResponse{Entries: entries})
+}
+
+// adminRotate retires one of the node's keys in favour of another, re-encrypting stored payloads
+// to the new key.
+func (s *TransactionManager) adminRotate(w http.ResponseWriter, req *http.Request) {
+	if !allowMethod(w, req, http.MethodPost) {
+		return
+	}
+
+	var rotateReq api.RotateKeyRequest
+	err := json.NewDecoder(req.Body).Decode(&rotateReq)
+	if err != nil {
+		invalidBody(w, req, err)
+		return
+	}
+
+	from, err := base64.StdEncoding.DecodeString(rotateReq.From)
+	if err != nil {
+		decodeError(w, req, "from", rotateReq.From, err)
+		return
+	}
+	to, err := base64.StdEncoding.DecodeString(rotateReq.To)
+	if err != nil {
+		decodeError(w, req, "to", rotateReq.To, err)
+		return
+	}
+
+	result, err := s.Enclave.RotateKey(from, to)
+	if err != nil {
+		internalServerError(w, req, fmt.Sprintf("Unable to rotate key, error: %s\n", err))
+		return
+	}
+
+	requestLog(req).Infof("Rotated key %s to %s, re-encrypted %d payloads, %d failed",
+		rotateReq.From, rotateReq.To, result.Reencrypted, result.Failed)
+	writeJson(w, result)
+}
+
+// adminUsage reports the usage of every sender key.
+func (s *TransactionManager) adminUsage(w http.ResponseWriter, req *http.Request) {
+	if !allowMethod(w, req, http.MethodGet) {
+		return
+	}
+	writeJson(w, s.Enclave.Usage(nil))
+}
+
+// scopedUsage reports the usage of the public keys associated with the bearer token provided by
+// the client, so applications sharing a node cannot view each other's activity.
+func (s *TransactionManager) scopedUsage(tokens map[string][][]byte) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !allowMethod(w, req, http.MethodGet) {
+			return
+		}
+
+		provided := []byte(req.Header.Get(hAuthorization))
+		var publicKeys [][]byte
+		for token, keys := range tokens {
+			// Compare every token, so the response time does not reveal which were close
+			if subtle.ConstantTimeCompare(provided, []byte("Bearer "+token)) == 1 {
+				publicKeys = keys
+			}
+		}
+		if len(publicKeys) == 0 {
+			requestLog(req).Warn("Unauthorised usage request")
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		writeJson(w, s.Enclave.Usage(publicKeys))
+	})
+}
+
+// allowMethod responds with a 405 if the request does not use method.
+func allowMethod(w http.ResponseWriter, req *http.Request, method string) bool {
+	if req.Method != method {
+		w.Header().Set("Allow", method)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"encoding/base64"
+	"fmt"
+	"github.com/blk-io/crux/api"
+	"github.com/blk-io/crux/audit"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// audit records an operation performed for req in the audit log, if one is configured.
+func (s *TransactionManager) audit(req *http.Request, operation string, publicKey, key []byte) {
+	recordAudit(s.auditLog, requestLog(req), operation, req.RemoteAddr, RequestId(req), publicKey, key)
+}
+
+// recordAudit records an operation requested by remote in l, if it is not nil. The operation has
+// already been performed, so failures to record it are logged rather than returned.
+func recordAudit(
+	l *audit.Log, logger *log.Entry, operation, remote, requestId string, publicKey, key []byte) {
+
+	if l == nil {
+		return
+	}
+	entry := api.AuditEntry{Operation: operation, Remote: remote, RequestId: requestId}
+	if publicKey != nil {
+		entry.PublicKey = base64.StdEncoding.EncodeToString(publicKey)
+	}
+	if key != nil {
+		entry.Key = base64.StdEncoding.EncodeToString(key)
+	}
+	if err := l.Record(entry); err != nil {
+		logger.WithField("operation", operation).Errorf("Unable to record audit log entry, %v", err)
+	}
+}
+
+// adminAudit returns the entries in the audit log matching the operation, publicKey, key, since
+// and until query parameters, limited to the most recent limit entries if provided. Times are
+// in RFC 3339 format.
+func (s *TransactionManager) adminAudit(w http.ResponseWriter, req *http.Request) {
+	if !allowMethod(w, req, http.MethodGet) {
+		return
+	}
+	if s.auditLog == nil {
+		writeError(w, req, http.StatusNotFound, api.ErrorResponse{
+			Code:    api.CodeNotFound,
+			Message: "The audit log is not enabled",
+		})
+		return
+	}
+
+	query := req.URL.Query()
+	filter := audit.Filter{
+		Operation: query.Get("operation"),
+		PublicKey: query.Get("publicKey"),
+		Key:       query.Get("key"),
+	}
+	for name, t := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if value := query.Get(name); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				badRequest(w, req, fmt.Sprintf("Invalid %s time: %q\n", name, value))
+				return
+			}
+			*t = parsed
+		}
+	}
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 0 {
+			badRequest(w, req, fmt.Sprintf("Invalid limit: %q\n", value))
+			return
+		}
+		filter.Limit = limit
+	}
+
+	entries, err := s.auditLog.Query(filter)
+	if err != nil {
+		internalServerError(w, req, fmt.Sprintf("Unable to read audit log, error: %s\n", err))
+		return
+	}
+	writeJson(w, entries)
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"fmt"
+	"github.com/blk-io/crux/api"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ipFilter restricts which clients may make node to node requests by their IP address. Clients
+// must be within one of the allowed networks, if any are configured, and none of the denied ones.
+type ipFilter struct {
+	allow, deny []*net.IPNet
+}
+
+// newIpFilter parses the allowed and denied IP addresses or CIDR ranges, returning nil if neither
+// are configured. Unlike trusted proxies, invalid entries are an error rather than being ignored,
+// as ignoring them could permit clients the operator intended to exclude.
+func newIpFilter(allow, deny []string) (*ipFilter, error) {
+	var f ipFilter
+	var err error
+	if f.allow, err = parseFilterNetworks(allow); err != nil {
+		return nil, err
+	}
+	if f.deny, err = parseFilterNetworks(deny); err != nil {
+		return nil, err
+	}
+	if len(f.allow) == 0 && len(f.deny) == 0 {
+		return nil, nil
+	}
+	return &f, nil
+}
+
+func parseFilterNetworks(addrs []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, addr := range addrs {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		network, err := parseNetwork(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP address or CIDR range %s, %v", addr, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// permits reports whether a client with the provided IP address may make requests, it permits
+// all clients if f is nil.
+func (f *ipFilter) permits(ip string) bool {
+	if f == nil {
+		return true
+	}
+	if len(f.allow) > 0 && !containsIp(f.allow, ip) {
+		return false
+	}
+	return !containsIp(f.deny, ip)
+}
+
+// filter responds with a 403 to requests from clients which are not permitted, otherwise they are
+// served by handler. The client's address is taken from the request after any trusted proxies'
+// X-Forwarded-For headers have been applied.
+func (f *ipFilter) filter(handler http.HandlerFunc) http.HandlerFunc {
+	if f == nil {
+		return handler
+	}
+	return func(w http.ResponseWriter, req *http.Request) {
+		host, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			host = req.RemoteAddr
+		}
+		if !f.permits(host) {
+			writeError(w, req, http.StatusForbidden, api.ErrorResponse{
+				Code:    api.CodeForbidden,
+				Message: fmt.Sprintf("Requests from %s are not permitted", host),
+			})
+			return
+		}
+		handler(w, req)
+	}
+}
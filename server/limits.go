@@ -0,0 +1,201 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/blk-io/crux/api"
+	"github.com/blk-io/crux/utils"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// limitRequestSize rejects requests with bodies larger than maxSize bytes with a 413.
+// Bodies are buffered so that handlers can consume them as before.
+func limitRequestSize(maxSize int64, handler http.Handler) http.Handler {
+	if maxSize <= 0 {
+		return handler
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > maxSize {
+			requestTooLarge(w, r, maxSize)
+			return
+		}
+
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxSize+1))
+		if err != nil {
+			badRequest(w, r, fmt.Sprintf("Unable to read request body, error: %s\n", err))
+			return
+		}
+		if int64(len(body)) > maxSize {
+			requestTooLarge(w, r, maxSize)
+			return
+		}
+
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		handler.ServeHTTP(w, r)
+	})
+}
+
+const hContentEncoding = "Content-Encoding"
+
+// decompressRequest decompresses request bodies with a gzip Content-Encoding, so handlers receive
+// them uncompressed, rejecting other encodings with a 415. Bodies which decompress to more than
+// maxSize bytes are rejected with a 413, if maxSize is greater than 0.
+func decompressRequest(maxSize int64, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch encoding := r.Header.Get(hContentEncoding); encoding {
+		case "", "identity":
+		case utils.CompressionGzip:
+			body, err := utils.GunzipReader(r.Body, maxSize)
+			if err == utils.ErrDecompressedTooLarge {
+				requestTooLarge(w, r, maxSize)
+				return
+			} else if err != nil {
+				badRequest(w, r, fmt.Sprintf("Unable to decompress request body, error: %s\n", err))
+				return
+			}
+			r.Header.Del(hContentEncoding)
+			r.ContentLength = int64(len(body))
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		default:
+			writeError(w, r, http.StatusUnsupportedMediaType, api.ErrorResponse{
+				Code:    api.CodeUnknownEncoding,
+				Message: fmt.Sprintf("Unsupported Content-Encoding: %s", encoding),
+			})
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+func requestTooLarge(w http.ResponseWriter, req *http.Request, maxSize int64) {
+	requestLog(req).Warnf("Rejecting request from %s larger than %d bytes", req.RemoteAddr, maxSize)
+	writeJsonError(w, http.StatusRequestEntityTooLarge, api.ErrorResponse{
+		Code:    api.CodeRequestTooLarge,
+		Message: fmt.Sprintf("Request body exceeds the maximum size of %d bytes", maxSize),
+	})
+}
+
+// limitConcurrency rejects requests with a 429 while maxConcurrent requests are in progress.
+func limitConcurrency(maxConcurrent int, handler http.Handler) http.Handler {
+	if maxConcurrent <= 0 {
+		return handler
+	}
+
+	slots := make(chan struct{}, maxConcurrent)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case slots <- struct{}{}:
+			defer func() { <-slots }()
+			handler.ServeHTTP(w, r)
+		default:
+			tooManyRequests(w, r, "Too many concurrent requests")
+		}
+	})
+}
+
+// limitRate rejects requests with a 429 once a client IP exceeds rate requests per second, with
+// bursts of up to burst requests permitted.
+func limitRate(rate float64, burst int, handler http.Handler) http.Handler {
+	if rate <= 0 {
+		return handler
+	}
+
+	limiter := newRateLimiter(rate, burst)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !limiter.allow(clientIp(r), time.Now()) {
+			tooManyRequests(w, r, "Rate limit exceeded")
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+func tooManyRequests(w http.ResponseWriter, req *http.Request, message string) {
+	requestLog(req).Warnf("%s, rejecting request from %s", message, req.RemoteAddr)
+	w.Header().Set(hRetryAfter, strconv.Itoa(retryAfterSeconds))
+	writeJsonError(w, http.StatusTooManyRequests,
+		api.ErrorResponse{Code: api.CodeTooManyRequests, Message: message})
+}
+
+func clientIp(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// rateLimiter is a token bucket rate limiter, maintaining a bucket per client.
+type rateLimiter struct {
+	mu        sync.Mutex
+	rate      float64
+	burst     float64
+	buckets   map[string]*bucket
+	lastPrune time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+	}
+}
+
+func (l *rateLimiter) allow(client string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.prune(now)
+
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[client] = b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// prune removes buckets which have refilled completely, as they are equivalent to new buckets.
+func (l *rateLimiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < time.Minute {
+		return
+	}
+	l.lastPrune = now
+
+	// The builtin delete is shadowed by the /delete endpoint in this package
+	full := time.Duration(l.burst / l.rate * float64(time.Second))
+	buckets := make(map[string]*bucket)
+	for client, b := range l.buckets {
+		if now.Sub(b.last) <= full {
+			buckets[client] = b
+		}
+	}
+	l.buckets = buckets
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"fmt"
+	"github.com/blk-io/crux/api"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// peerMetric is a metric reported for each peer by /metrics.
+type peerMetric struct {
+	name  string
+	kind  string // Prometheus metric type
+	help  string
+	value func(peer api.PeerHealth) float64
+}
+
+var peerMetrics = []peerMetric{
+	{"crux_peer_healthy", "gauge", "Whether requests are being made to the peer, 0 once it is considered unhealthy.",
+		func(peer api.PeerHealth) float64 { return boolMetric(peer.Healthy) }},
+	{"crux_peer_consecutive_failures", "gauge", "Number of consecutive failed requests to the peer.",
+		func(peer api.PeerHealth) float64 { return float64(peer.Failures) }},
+	{"crux_peer_latency_seconds", "gauge", "Round trip time of the last successful request to the peer.",
+		func(peer api.PeerHealth) float64 { return peer.Latency.Seconds() }},
+	{"crux_peer_requests_total", "counter", "Number of requests made to the peer.",
+		func(peer api.PeerHealth) float64 { return float64(peer.Requests) }},
+	{"crux_peer_failures_total", "counter", "Number of failed requests to the peer.",
+		func(peer api.PeerHealth) float64 { return float64(peer.Failed) }},
+}
+
+// adminMetrics reports the health of the nodes we have made requests to, in the Prometheus text
+// exposition format.
+func (s *TransactionManager) adminMetrics(w http.ResponseWriter, req *http.Request) {
+	if !allowMethod(w, req, http.MethodGet) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writePeerMetrics(w, s.Enclave.PeerHealth())
+}
+
+func writePeerMetrics(w io.Writer, peers []api.PeerHealth) {
+	for _, metric := range peerMetrics {
+		fmt.Fprintf(w, "# HELP %s %s\n", metric.name, metric.help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", metric.name, metric.kind)
+		for _, peer := range peers {
+			fmt.Fprintf(w, "%s{url=%s} %s\n", metric.name, strconv.Quote(peer.Url),
+				strconv.FormatFloat(metric.value(peer), 'g', -1, 64))
+		}
+	}
+}
+
+func boolMetric(value bool) float64 {
+	if value {
+		return 1
+	}
+	return 0
+}
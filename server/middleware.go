@@ -0,0 +1,170 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"github.com/blk-io/crux/api"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// Middleware wraps a handler, acting on requests before they reach it, or on their responses.
+type Middleware func(http.Handler) http.Handler
+
+// Chain applies middleware to handler, with requests passing through the middleware in the order
+// provided before reaching handler.
+func Chain(handler http.Handler, middleware ...Middleware) http.Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	return handler
+}
+
+// maxDrainBytes is the most of a request body left unread by a handler which is read by closeBody,
+// allowing its connection to be reused for further requests.
+const maxDrainBytes = 256 << 10
+
+// closeBody drains and closes the body of each request once it has been handled, so handlers and
+// other middleware consuming request bodies need not close them.
+func closeBody(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := r.Body
+		handler.ServeHTTP(w, r)
+		if body != nil {
+			io.Copy(ioutil.Discard, io.LimitReader(body, maxDrainBytes))
+			body.Close()
+		}
+	})
+}
+
+// HRequestId is the header used to correlate requests across clients and nodes.
+const HRequestId = api.RequestIdHeader
+
+const hTraceParent = "traceparent"
+
+const maxRequestIdLength = 128
+
+// requestId ensures every request has an ID, echoing it back to the client in the response.
+// Clients can supply their own via the X-Request-ID or W3C traceparent headers.
+func requestId(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := resolveRequestId(r.Header.Get(HRequestId), r.Header.Get(hTraceParent))
+		w.Header().Set(HRequestId, id)
+
+		handler.ServeHTTP(w, r.WithContext(api.WithRequestId(r.Context(), id)))
+	})
+}
+
+// RequestId returns the ID associated with the request, or an empty string if there is none.
+func RequestId(req *http.Request) string {
+	return api.RequestIdFromContext(req.Context())
+}
+
+func requestLog(req *http.Request) *log.Entry {
+	return log.WithField("requestId", RequestId(req))
+}
+
+func resolveRequestId(requestId, traceParent string) string {
+	if validRequestId(requestId) {
+		return requestId
+	}
+
+	// traceparent is of the form version-traceid-parentid-flags, we use the trace id
+	parts := strings.Split(traceParent, "-")
+	if len(parts) == 4 && len(parts[1]) == 32 && validRequestId(parts[1]) {
+		return parts[1]
+	}
+
+	return newRequestId()
+}
+
+// validRequestId restricts client supplied IDs to something safe to include in logs.
+func validRequestId(id string) bool {
+	if len(id) == 0 || len(id) > maxRequestIdLength {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+			c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestId() string {
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		log.Errorf("Unable to generate request id, %v", err)
+	}
+	return hex.EncodeToString(id)
+}
+
+// requestIdInterceptor provides the same request ID handling for gRPC requests, using the
+// x-request-id and traceparent metadata keys.
+func requestIdInterceptor(
+	ctx context.Context,
+	req interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (interface{}, error) {
+
+	var requestId, traceParent string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md[strings.ToLower(HRequestId)]; len(values) > 0 {
+			requestId = values[0]
+		}
+		if values := md[hTraceParent]; len(values) > 0 {
+			traceParent = values[0]
+		}
+	}
+
+	id := resolveRequestId(requestId, traceParent)
+	grpc.SetHeader(ctx, metadata.Pairs(strings.ToLower(HRequestId), id))
+
+	ctx = api.WithRequestId(ctx, id)
+	resp, err := handler(ctx, req)
+	if err != nil {
+		log.WithFields(log.Fields{"requestId": id, "method": info.FullMethod}).Error(err)
+	}
+	return resp, err
+}
+
+// tokenInterceptor requires gRPC requests, other than the up check, to present token as a bearer
+// token in their authorization metadata before they are passed to next. If token is empty all
+// requests are passed to next.
+func tokenInterceptor(token string, next grpc.UnaryServerInterceptor) grpc.UnaryServerInterceptor {
+	if token == "" {
+		return next
+	}
+	expected := []byte("Bearer " + token)
+	return func(
+		ctx context.Context,
+		req interface{},
+		info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler) (interface{}, error) {
+
+		if !strings.HasSuffix(info.FullMethod, "/Upcheck") {
+			var provided []byte
+			if md, ok := metadata.FromIncomingContext(ctx); ok {
+				if values := md[strings.ToLower(hAuthorization)]; len(values) > 0 {
+					provided = []byte(values[0])
+				}
+			}
+			if subtle.ConstantTimeCompare(provided, expected) != 1 {
+				log.WithField("method", info.FullMethod).Warn("Unauthorised gRPC request")
+				return nil, status.Error(codes.Unauthenticated, "a valid bearer token is required")
+			}
+		}
+		return next(ctx, req, info, handler)
+	}
+}
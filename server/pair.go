@@ -0,0 +1,105 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/blk-io/crux/api"
+	"github.com/blk-io/crux/peers"
+	"github.com/blk-io/crux/utils"
+	"github.com/kevinburke/nacl"
+	"net/http"
+	"net/url"
+)
+
+// pair serves the details of this node to nodes wishing to pair with it. Nodes presenting
+// token may then send their own details to complete the pairing, which are recorded in
+// peersFile, and the node is added to the party info. Its public keys are merged as if the node
+// had announced them via /partyinfo, so are validated if party info validation is enabled.
+func (s *TransactionManager) pair(self api.PairInfo, token string, peersFile *peers.File) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case http.MethodGet:
+			writeJson(w, self)
+			return
+		case http.MethodPost:
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		if token == "" || peersFile == nil {
+			writeError(w, req, http.StatusForbidden,
+				api.ErrorResponse{Code: api.CodeForbidden, Message: "Pairing is disabled"})
+			return
+		}
+		provided := []byte(req.Header.Get(hAuthorization))
+		if subtle.ConstantTimeCompare(provided, []byte("Bearer "+token)) != 1 {
+			requestLog(req).Warnf("Unauthorised pairing request from %s", req.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		var info api.PairInfo
+		err := json.NewDecoder(req.Body).Decode(&info)
+		if err != nil {
+			invalidBody(w, req, err)
+			return
+		}
+		keys, err := pairKeys(info)
+		if err != nil {
+			badRequest(w, req, fmt.Sprintf("Invalid pairing request, error: %s", err))
+			return
+		}
+
+		peer, err := peersFile.Add(info)
+		if err != nil {
+			badRequest(w, req, fmt.Sprintf("Unable to pair, error: %s", err))
+			return
+		}
+		nodes := make([]string, len(keys))
+		for i := range nodes {
+			nodes[i] = info.Url
+		}
+		encoded := api.EncodePartyInfo(api.CreatePartyInfo(info.Url, nodes, keys, nil))
+		if err = s.Enclave.UpdatePartyInfo(encoded); err != nil {
+			badRequest(w, req, fmt.Sprintf("Unable to pair, error: %s", err))
+			return
+		}
+
+		requestLog(req).WithField("fingerprint", peer.Fingerprint).Infof("Paired with %s", info.Url)
+		writeJson(w, self)
+	})
+}
+
+// pairKeys validates the details of a node pairing with us, returning its public keys.
+func pairKeys(info api.PairInfo) ([]nacl.Key, error) {
+	parsed, err := url.Parse(info.Url)
+	if err != nil {
+		return nil, err
+	}
+	if (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return nil, fmt.Errorf("invalid URL %s", info.Url)
+	}
+	if len(info.PublicKeys) == 0 {
+		return nil, errors.New("no public keys provided")
+	}
+
+	keys := make([]nacl.Key, 0, len(info.PublicKeys))
+	for _, encoded := range info.PublicKeys {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, err
+		}
+		if len(key) != nacl.KeySize {
+			return nil, fmt.Errorf("invalid public key %s", encoded)
+		}
+		publicKey, _ := utils.ToKey(key)
+		keys = append(keys, publicKey)
+	}
+	return keys, nil
+}
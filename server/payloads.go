@@ -0,0 +1,82 @@
+package server
+
+import (
+	"encoding/base64"
+	"fmt"
+	"github.com/blk-io/crux/api"
+	"net/http"
+	"strconv"
+)
+
+const payloads = "/payloads"
+
+// Number of payload keys listed by /payloads if no limit is provided, and the most it will list.
+const (
+	defaultPayloadLimit = 100
+	maxPayloadLimit     = 1000
+)
+
+// listPayloads lists the keys of the payloads stored for the public key provided by either the
+// sender or recipient query parameter, in order. The keys following the after parameter are
+// listed, up to limit, and if there are further keys, the response's next key is passed as after
+// to list them.
+func (s *TransactionManager) listPayloads(w http.ResponseWriter, req *http.Request) {
+	if !allowMethod(w, req, http.MethodGet) {
+		return
+	}
+
+	query := req.URL.Query()
+	role, b64Key := api.PartySender, query.Get(api.PartySender)
+	if recipient := query.Get(api.PartyRecipient); recipient != "" {
+		if b64Key != "" {
+			badRequest(w, req, "Only one of sender and recipient may be provided")
+			return
+		}
+		role, b64Key = api.PartyRecipient, recipient
+	}
+	if b64Key == "" {
+		missingField(w, req, "sender")
+		return
+	}
+	publicKey, ok := decodePublicKey(w, req, role, b64Key)
+	if !ok {
+		return
+	}
+
+	var after []byte
+	if b64After := query.Get("after"); b64After != "" {
+		var err error
+		if after, err = base64.StdEncoding.DecodeString(b64After); err != nil {
+			decodeError(w, req, "after", b64After, err)
+			return
+		}
+	}
+
+	limit := defaultPayloadLimit
+	if value := query.Get("limit"); value != "" {
+		var err error
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit <= 0 || limit > maxPayloadLimit {
+			badRequest(w, req, fmt.Sprintf("Invalid limit: %q, it must be from 1 to %d",
+				value, maxPayloadLimit))
+			return
+		}
+	}
+
+	// One more key than requested is listed, to determine whether there are further keys
+	keys, err := s.Enclave.ListPayloads(role, publicKey, after, limit+1)
+	if err != nil {
+		internalServerError(w, req, fmt.Sprintf("Unable to list payloads, error: %s\n", err))
+		return
+	}
+
+	list := api.PayloadList{Keys: []string{}}
+	for i, key := range keys {
+		if i == limit {
+			list.Next = list.Keys[limit-1]
+			break
+		}
+		list.Keys = append(list.Keys, base64.StdEncoding.EncodeToString(key))
+	}
+	writeJson(w, list)
+}
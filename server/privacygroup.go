@@ -0,0 +1,145 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/blk-io/crux/api"
+	"net/http"
+)
+
+// Paths of the privacy group endpoints, served over IPC.
+const (
+	createPrivacyGroup = "/createPrivacyGroup"
+	findPrivacyGroup   = "/findPrivacyGroup"
+	deletePrivacyGroup = "/deletePrivacyGroup"
+)
+
+func (s *TransactionManager) createPrivacyGroup(w http.ResponseWriter, req *http.Request) {
+	if !allowMethod(w, req, http.MethodPost) {
+		return
+	}
+	var createReq api.CreatePrivacyGroupRequest
+	err := json.NewDecoder(req.Body).Decode(&createReq)
+	if err != nil {
+		invalidBody(w, req, err)
+		return
+	}
+
+	from, members, ok := decodeSendKeys(w, req, "from", createReq.From, "addresses", createReq.Addresses)
+	if !ok {
+		return
+	}
+
+	group, err := s.Enclave.CreatePrivacyGroup(from, members, createReq.Name, createReq.Description)
+	if err != nil {
+		badRequest(w, req, fmt.Sprintf("Unable to create privacy group, error: %s", err))
+		return
+	}
+	writeJson(w, group)
+}
+
+func (s *TransactionManager) findPrivacyGroup(w http.ResponseWriter, req *http.Request) {
+	if !allowMethod(w, req, http.MethodPost) {
+		return
+	}
+	var findReq api.FindPrivacyGroupRequest
+	err := json.NewDecoder(req.Body).Decode(&findReq)
+	if err != nil {
+		invalidBody(w, req, err)
+		return
+	}
+	if len(findReq.Addresses) == 0 {
+		missingField(w, req, "addresses")
+		return
+	}
+
+	members := make([][]byte, len(findReq.Addresses))
+	for i, value := range findReq.Addresses {
+		member, ok := decodePublicKey(w, req, "addresses", value)
+		if !ok {
+			return
+		}
+		members[i] = member
+	}
+
+	groups, err := s.Enclave.FindPrivacyGroups(members)
+	if err != nil {
+		internalServerError(w, req, fmt.Sprintf("Unable to find privacy groups, error: %s", err))
+		return
+	}
+	writeJson(w, groups)
+}
+
+func (s *TransactionManager) deletePrivacyGroup(w http.ResponseWriter, req *http.Request) {
+	if !allowMethod(w, req, http.MethodPost) {
+		return
+	}
+	var deleteReq api.DeletePrivacyGroupRequest
+	err := json.NewDecoder(req.Body).Decode(&deleteReq)
+	if err != nil {
+		invalidBody(w, req, err)
+		return
+	}
+
+	id, ok := decodePrivacyGroupId(w, req, deleteReq.PrivacyGroupId)
+	if !ok {
+		return
+	}
+	var from []byte
+	if deleteReq.From != "" {
+		if from, ok = decodePublicKey(w, req, "from", deleteReq.From); !ok {
+			return
+		}
+	}
+
+	err = s.Enclave.DeletePrivacyGroup(id, from)
+	if err == api.ErrPrivacyGroupNotFound {
+		privacyGroupNotFound(w, req, deleteReq.PrivacyGroupId)
+	} else if err != nil {
+		badRequest(w, req, fmt.Sprintf("Unable to delete privacy group, error: %s", err))
+	} else {
+		writeJson(w, deleteReq.PrivacyGroupId)
+	}
+}
+
+// privacyGroupRecipients resolves the recipients of a payload sent to the privacy group with
+// the base64 encoded id, writing an error if the group cannot be used by sender.
+func (s *TransactionManager) privacyGroupRecipients(
+	w http.ResponseWriter, req *http.Request, b64id string, sender []byte) ([]byte, [][]byte, bool) {
+
+	id, ok := decodePrivacyGroupId(w, req, b64id)
+	if !ok {
+		return nil, nil, false
+	}
+	recipients, err := s.Enclave.PrivacyGroupRecipients(id, sender)
+	if err == api.ErrPrivacyGroupNotFound {
+		privacyGroupNotFound(w, req, b64id)
+		return nil, nil, false
+	} else if err != nil {
+		badRequest(w, req, fmt.Sprintf("Unable to send to privacy group, error: %s", err))
+		return nil, nil, false
+	}
+	return id, recipients, true
+}
+
+func decodePrivacyGroupId(w http.ResponseWriter, req *http.Request, b64id string) ([]byte, bool) {
+	if b64id == "" {
+		missingField(w, req, "privacyGroupId")
+		return nil, false
+	}
+	id, err := base64.StdEncoding.DecodeString(b64id)
+	if err != nil {
+		decodeError(w, req, "privacyGroupId", b64id, err)
+		return nil, false
+	}
+	return id, true
+}
+
+func privacyGroupNotFound(w http.ResponseWriter, req *http.Request, b64id string) {
+	writeError(w, req, http.StatusNotFound, api.ErrorResponse{
+		Code:    api.CodeNotFound,
+		Message: fmt.Sprintf("Privacy group %s not found", b64id),
+		Field:   "privacyGroupId",
+	})
+}
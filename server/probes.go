@@ -0,0 +1,67 @@
+package server
+
+import (
+	"fmt"
+	"github.com/blk-io/crux/api"
+	"net/http"
+)
+
+// Paths of the liveness and readiness probes, for deployments such as Kubernetes.
+const (
+	healthz = "/healthz"
+	readyz  = "/readyz"
+)
+
+const (
+	probeOk          = "ok"
+	probeUnavailable = "unavailable"
+)
+
+// healthz reports that the process is alive and serving requests.
+func (s *TransactionManager) healthz(w http.ResponseWriter, req *http.Request) {
+	writeJson(w, api.ProbeResponse{Status: probeOk})
+}
+
+// readyz reports whether the node is ready to serve requests, responding with a 503 if its
+// storage cannot be read, or it has no keys. If readyPeers is set, the node must also have
+// received the party info of at least one other node.
+func (s *TransactionManager) readyz(w http.ResponseWriter, req *http.Request) {
+	self, recipients, _ := s.Enclave.GetPartyInfo()
+	keys, peerKeys := 0, 0
+	for _, url := range recipients {
+		if url == self {
+			keys++
+		} else {
+			peerKeys++
+		}
+	}
+
+	storage := api.ProbeCheck{Name: "storage", Ok: true}
+	if _, err := s.Enclave.Exists(&storageProbeKey); err != nil {
+		storage.Ok, storage.Detail = false, err.Error()
+	}
+	checks := []api.ProbeCheck{
+		storage,
+		{Name: "keys", Ok: keys > 0, Detail: fmt.Sprintf("public keys loaded: %d", keys)},
+	}
+	if s.readyPeers {
+		checks = append(checks, api.ProbeCheck{
+			Name:   "peers",
+			Ok:     peerKeys > 0,
+			Detail: fmt.Sprintf("public keys of other nodes: %d", peerKeys),
+		})
+	}
+
+	resp := api.ProbeResponse{Status: probeOk, Checks: checks}
+	for _, check := range checks {
+		if !check.Ok {
+			resp.Status = probeUnavailable
+		}
+	}
+
+	status := http.StatusOK
+	if resp.Status != probeOk {
+		status = http.StatusServiceUnavailable
+	}
+	writeJsonStatus(w, status, resp)
+}
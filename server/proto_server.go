@@ -13,13 +13,16 @@ import (
 	"net/http"
 )
 
-func (tm *TransactionManager) startRpcServer(port int, grpcJsonPort int, ipcPath string, tls bool, certFile, keyFile string) error {
-	lis, err := utils.CreateIpcSocket(ipcPath)
+func (tm *TransactionManager) startRpcServer(conf ServerConfig) error {
+	port, grpcJsonPort, tls, certFile, keyFile := conf.Port, conf.GrpcJsonPort, conf.Tls, conf.CertFile, conf.KeyFile
+
+	lis, err := utils.CreateIpcSocketWithOptions(conf.IpcPath, conf.IpcOptions)
 	if err != nil {
 		log.Fatalf("failed to listen: %v", err)
 	}
-	s := Server{Enclave: tm.Enclave}
-	grpcServer := grpc.NewServer()
+	s := Server{Enclave: tm.Enclave, auditLog: tm.auditLog}
+	grpcServer := grpc.NewServer(
+		grpc.UnaryInterceptor(tokenInterceptor(conf.IpcToken, requestIdInterceptor)))
 	chimera.RegisterClientServer(grpcServer, &s)
 	go func() {
 		log.Fatal(grpcServer.Serve(lis))
@@ -28,9 +31,9 @@ func (tm *TransactionManager) startRpcServer(port int, grpcJsonPort int, ipcPath
 	go func() error {
 		var err error
 		if tls {
-			err = tm.startRestServerTLS(port, certFile, keyFile, certFile)
+			err = tm.startRestServerTLS(port, certFile, keyFile, certFile, conf.MaxRequestSize)
 		} else {
-			err = tm.startRestServer(port)
+			err = tm.startRestServer(port, conf.MaxRequestSize)
 		}
 		if grpcJsonPort != -1 {
 			if tls {
@@ -67,14 +70,15 @@ func (tm *TransactionManager) startJsonServer(port int, grpcJsonPort int) error
 	return nil
 }
 
-func (tm *TransactionManager) startRestServer(port int) error {
+func (tm *TransactionManager) startRestServer(port int, maxRequestSize int64) error {
 	grpcAddress := fmt.Sprintf(":%d", port)
 	lis, err := net.Listen("tcp", grpcAddress)
 	if err != nil {
 		panic(err)
 	}
-	s := Server{Enclave: tm.Enclave}
-	grpcServer := grpc.NewServer()
+	s := Server{Enclave: tm.Enclave, auditLog: tm.auditLog}
+	opts := append(publicServerOptions(maxRequestSize), grpc.UnaryInterceptor(requestIdInterceptor))
+	grpcServer := grpc.NewServer(opts...)
 	chimera.RegisterClientServer(grpcServer, &s)
 	go func() {
 		log.Fatal(grpcServer.Serve(lis))
@@ -99,18 +103,16 @@ func (tm *TransactionManager) startJsonServerTLS(port int, grpcJsonPort int, cer
 	return nil
 }
 
-func (tm *TransactionManager) startRestServerTLS(port int, certFile, keyFile, ca string) error {
+func (tm *TransactionManager) startRestServerTLS(port int, certFile, keyFile, ca string, maxRequestSize int64) error {
 	grpcAddress := fmt.Sprintf("%s:%d", "localhost", port)
 	lis, err := net.Listen("tcp", grpcAddress)
 	if err != nil {
 		log.Fatalf("failed to start gRPC REST server: %s", err)
 	}
-	s := Server{Enclave: tm.Enclave}
-	creds, err := credentials.NewServerTLSFromFile(certFile, keyFile)
-	opts := []grpc.ServerOption{grpc.Creds(creds)}
-	if err != nil {
-		log.Fatalf("failed to load credentials : %v", err)
-	}
+	s := Server{Enclave: tm.Enclave, auditLog: tm.auditLog}
+	creds := credentials.NewTLS(tm.cert.tlsConfig())
+	opts := append(publicServerOptions(maxRequestSize),
+		grpc.Creds(creds), grpc.UnaryInterceptor(requestIdInterceptor))
 	grpcServer := grpc.NewServer(opts...)
 	chimera.RegisterClientServer(grpcServer, &s)
 	go func() {
@@ -119,6 +121,15 @@ func (tm *TransactionManager) startRestServerTLS(port int, certFile, keyFile, ca
 	return nil
 }
 
+// publicServerOptions applies the limits for the public gRPC server.
+func publicServerOptions(maxRequestSize int64) []grpc.ServerOption {
+	var opts []grpc.ServerOption
+	if maxRequestSize > 0 {
+		opts = append(opts, grpc.MaxRecvMsgSize(int(maxRequestSize)))
+	}
+	return opts
+}
+
 func GetFreePort() (int, error) {
 	addr, err := net.ResolveTCPAddr("tcp", "localhost:0")
 	if err != nil {
@@ -0,0 +1,145 @@
+package server
+
+import (
+	log "github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const (
+	hOrigin           = "Origin"
+	hForwardedFor     = "X-Forwarded-For"
+	hForwardedProto   = "X-Forwarded-Proto"
+	corsAllowMethods  = "GET, HEAD, POST, DELETE, OPTIONS"
+	corsAllowHeaders  = "Content-Type, X-Request-ID, traceparent, Idempotency-Key, c11n-from, c11n-to, c11n-key"
+	corsExposeHeaders = "X-Request-ID, Operation-ID, Idempotency-Replayed, Retry-After"
+	corsMaxAge        = "600"
+)
+
+// cors adds CORS headers to responses for requests from the allowed origins, and answers
+// preflight requests from them. An origin of "*" allows all origins.
+func cors(allowedOrigins []string, handler http.Handler) http.Handler {
+	if len(allowedOrigins) == 0 {
+		return handler
+	}
+
+	allowed := make(map[string]bool)
+	for _, origin := range allowedOrigins {
+		allowed[strings.TrimSuffix(origin, "/")] = true
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get(hOrigin)
+		if origin == "" || !(allowed["*"] || allowed[origin]) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Add("Vary", hOrigin)
+		w.Header().Set("Access-Control-Expose-Headers", corsExposeHeaders)
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", corsAllowMethods)
+			w.Header().Set("Access-Control-Allow-Headers", corsAllowHeaders)
+			w.Header().Set("Access-Control-Max-Age", corsMaxAge)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// forwarded applies the X-Forwarded-For and X-Forwarded-Proto headers set by trusted reverse
+// proxies, so that the client's address and protocol are used for logging and rate limiting.
+// Trusted proxies are specified as IP addresses or CIDR ranges.
+func forwarded(trustedProxies []string, handler http.Handler) http.Handler {
+	trusted := parseNetworks(trustedProxies)
+	if len(trusted) == 0 {
+		return handler
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, port, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil || !containsIp(trusted, host) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		// Each proxy appends the address it received the request from, so the client is the
+		// rightmost address that isn't one of our proxies
+		if forwardedFor := r.Header.Get(hForwardedFor); forwardedFor != "" {
+			addrs := strings.Split(forwardedFor, ",")
+			for i := len(addrs) - 1; i >= 0; i-- {
+				addr := strings.TrimSpace(addrs[i])
+				if net.ParseIP(addr) == nil {
+					break
+				}
+				r.RemoteAddr = net.JoinHostPort(addr, port)
+				if !containsIp(trusted, addr) {
+					break
+				}
+			}
+		}
+
+		if proto := r.Header.Get(hForwardedProto); proto == "http" || proto == "https" {
+			r.URL.Scheme = proto
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// stripPathPrefix serves the API under prefix, responding with a 404 to requests outside of it.
+func stripPathPrefix(prefix string, handler http.Handler) http.Handler {
+	prefix = "/" + strings.Trim(prefix, "/")
+	if prefix == "/" {
+		return handler
+	}
+	return http.StripPrefix(prefix, handler)
+}
+
+func parseNetworks(addrs []string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, addr := range addrs {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		network, err := parseNetwork(addr)
+		if err != nil {
+			log.Errorf("Ignoring invalid trusted proxy %s, %v", addr, err)
+			continue
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// parseNetwork parses an IP address or CIDR range, an address being a network of only itself.
+func parseNetwork(addr string) (*net.IPNet, error) {
+	if !strings.Contains(addr, "/") {
+		if ip := net.ParseIP(addr); ip != nil && ip.To4() != nil {
+			addr += "/32"
+		} else {
+			addr += "/128"
+		}
+	}
+	_, network, err := net.ParseCIDR(addr)
+	return network, err
+}
+
+func containsIp(networks []*net.IPNet, addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,196 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/blk-io/crux/api"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const sendAsync = "/sendasync"
+const sendStatus = "/sendstatus/"
+
+// maxTrackedSends is the maximum number of asynchronous sends whose status is retained, the
+// oldest are forgotten first.
+const maxTrackedSends = 10000
+
+// maxPendingSends is the number of asynchronous sends processed concurrently, further sends are
+// rejected until one completes.
+const maxPendingSends = 1000
+
+// sendTracker records the status of asynchronous sends.
+type sendTracker struct {
+	mu      sync.Mutex
+	sends   map[string]*api.SendStatus
+	order   []string // Ids of the sends tracked, oldest first
+	pending chan struct{}
+}
+
+func newSendTracker() *sendTracker {
+	return &sendTracker{
+		sends:   make(map[string]*api.SendStatus),
+		pending: make(chan struct{}, maxPendingSends),
+	}
+}
+
+// start begins tracking a send to recipients, returning its id, or an error if too many sends are
+// pending. done must be called once the send has been processed.
+func (t *sendTracker) start(recipients [][]byte) (string, error) {
+	select {
+	case t.pending <- struct{}{}:
+	default:
+		return "", errors.New("too many asynchronous sends are pending")
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		<-t.pending
+		return "", err
+	}
+	status := &api.SendStatus{
+		Id:         hex.EncodeToString(id),
+		State:      api.SendPending,
+		Recipients: make([]api.RecipientStatus, len(recipients)),
+	}
+	for i, recipient := range recipients {
+		status.Recipients[i] = api.RecipientStatus{
+			PublicKey: base64.StdEncoding.EncodeToString(recipient),
+			State:     api.SendPending,
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sends[status.Id] = status
+	t.order = append(t.order, status.Id)
+	if len(t.order) > maxTrackedSends {
+		// The builtin delete is shadowed by the /delete endpoint in this package, so the oldest
+		// tenth of the sends are forgotten at once, rebuilding the map
+		t.order = append([]string(nil), t.order[len(t.order)-maxTrackedSends*9/10:]...)
+		sends := make(map[string]*api.SendStatus, len(t.order))
+		for _, id := range t.order {
+			sends[id] = t.sends[id]
+		}
+		t.sends = sends
+	}
+	return status.Id, nil
+}
+
+// delivered records the outcome of delivering send id to recipient.
+func (t *sendTracker) delivered(id string, recipient []byte, err error) {
+	publicKey := base64.StdEncoding.EncodeToString(recipient)
+	t.update(id, func(status *api.SendStatus) {
+		for i := range status.Recipients {
+			r := &status.Recipients[i]
+			if r.PublicKey != publicKey || r.State != api.SendPending {
+				continue
+			}
+			if err != nil {
+				r.State, r.Error = api.SendFailed, err.Error()
+			} else {
+				r.State = api.SendDelivered
+			}
+			return
+		}
+	})
+}
+
+// done records the outcome of send id, which is no longer pending. If it failed, so have any
+// deliveries which were not attempted.
+func (t *sendTracker) done(id string, key []byte, err error) {
+	t.update(id, func(status *api.SendStatus) {
+		if err != nil {
+			status.State, status.Error = api.SendFailed, err.Error()
+			for i := range status.Recipients {
+				if status.Recipients[i].State == api.SendPending {
+					status.Recipients[i].State = api.SendFailed
+				}
+			}
+		} else {
+			status.State, status.Key = api.SendComplete, base64.StdEncoding.EncodeToString(key)
+		}
+	})
+	<-t.pending
+}
+
+func (t *sendTracker) update(id string, f func(status *api.SendStatus)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if status, ok := t.sends[id]; ok {
+		f(status)
+	}
+}
+
+// status returns a copy of the status of send id, if it is tracked.
+func (t *sendTracker) status(id string) (api.SendStatus, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	status, ok := t.sends[id]
+	if !ok {
+		return api.SendStatus{}, false
+	}
+	result := *status
+	result.Recipients = append([]api.RecipientStatus(nil), status.Recipients...)
+	return result, true
+}
+
+// sendAsync accepts a SendRequest, responding with an id for /sendstatus immediately, while the
+// payload is stored and published to its recipients in the background.
+func (s *TransactionManager) sendAsync(w http.ResponseWriter, req *http.Request) {
+	params, ok := s.decodeSend(w, req)
+	if !ok {
+		return
+	}
+	if params.idempotencyKey != "" {
+		writeError(w, req, http.StatusBadRequest, api.ErrorResponse{
+			Code:    api.CodeBadRequest,
+			Message: "Idempotency keys are not supported by asynchronous sends",
+			Field:   "idempotencyKey",
+		})
+		return
+	}
+
+	id, err := s.sends.start(params.recipients)
+	if err != nil {
+		serviceUnavailable(w, req, fmt.Sprintf("Unable to accept send, error: %s", err))
+		return
+	}
+
+	logger := requestLog(req).WithField("id", id)
+	go func() {
+		key, err := s.Enclave.StoreNotify(&params.payload, params.sender, params.recipients,
+			func(recipient []byte, err error) {
+				s.sends.delivered(id, recipient, err)
+			})
+		if err != nil {
+			logger.Errorf("Unable to store payload, %v", err)
+		} else {
+			s.audit(req, api.AuditSend, params.sender, key)
+			s.recordPrivacyGroup(req, key, params.groupId)
+		}
+		s.sends.done(id, key, err)
+	}()
+
+	w.Header().Set("Location", sendStatus+id)
+	writeJsonStatus(w, http.StatusAccepted, api.SendAsyncResponse{Id: id})
+}
+
+// sendStatus returns the status of the asynchronous send with the id provided in the path.
+func (s *TransactionManager) sendStatus(w http.ResponseWriter, req *http.Request) {
+	id := strings.TrimPrefix(req.URL.Path, sendStatus)
+	status, ok := s.sends.status(id)
+	if !ok {
+		writeError(w, req, http.StatusNotFound, api.ErrorResponse{
+			Code:    api.CodeNotFound,
+			Message: fmt.Sprintf("No asynchronous send with id %s", id),
+		})
+		return
+	}
+
+	writeJson(w, status)
+}
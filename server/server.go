@@ -2,42 +2,87 @@
 package server
 
 import (
+	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/blk-io/crux/api"
+	"github.com/blk-io/crux/audit"
+	"github.com/blk-io/crux/peers"
 	"github.com/blk-io/crux/utils"
+	"github.com/blk-io/crux/watchdog"
 	"github.com/kevinburke/nacl"
 	log "github.com/sirupsen/logrus"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httputil"
 	"net/textproto"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
 // Enclave is the interface used by the transaction enclaves.
 type Enclave interface {
-	Store(message *[]byte, sender []byte, recipients [][]byte) ([]byte, error)
+	StoreContext(ctx context.Context, message *[]byte, sender []byte,
+		recipients [][]byte) ([]byte, error)
+	StoreNotify(message *[]byte, sender []byte, recipients [][]byte,
+		delivered func(recipient []byte, err error)) ([]byte, error)
+	StoreIdempotentContext(ctx context.Context, message *[]byte, sender []byte, recipients [][]byte,
+		idempotencyKey string) ([]byte, bool, error)
 	StorePayloadGrpc(epl api.EncryptedPayload, encoded []byte) ([]byte, error)
-	StorePayload(encoded []byte) ([]byte, error)
-	Retrieve(digestHash *[]byte, to *[]byte) ([]byte, error)
-	RetrieveDefault(digestHash *[]byte) ([]byte, error)
+	StoreDecodedPayload(epl api.EncryptedPayload, encoded []byte) ([]byte, error)
+	RetrieveContext(ctx context.Context, digestHash *[]byte, to *[]byte) ([]byte, error)
 	RetrieveFor(digestHash *[]byte, reqRecipient *[]byte) (*[]byte, error)
 	RetrieveAllFor(reqRecipient *[]byte) error
+	Exists(digestHash *[]byte) (bool, error)
+	RecordProvenance(digestHash []byte, hop api.ProvenanceHop) error
+	Provenance(digestHash []byte) ([]api.ProvenanceHop, error)
+	AnswerChallenge(challenge api.PartyInfoChallenge) ([]byte, error)
+	RequestResend(publicKey []byte, digestHash []byte) error
+	Repush(digestHash []byte, recipient []byte, url string) error
 	Delete(digestHash *[]byte) error
-	UpdatePartyInfo(encoded []byte)
+	UpdatePartyInfo(encoded []byte) error
 	UpdatePartyInfoGrpc(url string, recipients map[[nacl.KeySize]byte]string, parties map[string]bool)
 	GetEncodedPartyInfo() []byte
 	GetEncodedPartyInfoGrpc() []byte
 	GetPartyInfo() (url string, recipients map[[nacl.KeySize]byte]string, parties map[string]bool)
+	PeerHealth() []api.PeerHealth
+	PeerStatus() []api.PeerStatus
+	StorageStats() (api.StorageStats, error)
+	Compact() error
+	Purge(before time.Time) (api.PurgeResponse, error)
+	Export(w io.Writer) (map[string]int, error)
+	Import(r io.Reader) (map[string]int, error)
+	Usage(publicKeys [][]byte) []api.KeyUsage
+	RotateKey(oldPubKey, newPubKey []byte) (api.RotateKeyResponse, error)
+	CreatePrivacyGroup(from []byte, members [][]byte, name, description string) (api.PrivacyGroup, error)
+	FindPrivacyGroups(members [][]byte) ([]api.PrivacyGroup, error)
+	DeletePrivacyGroup(id, from []byte) error
+	PrivacyGroupRecipients(id, sender []byte) ([][]byte, error)
+	RecordPrivacyGroup(digestHash, id []byte) error
+	PayloadPrivacyGroup(digestHash []byte) ([]byte, error)
+	ListPayloads(role string, publicKey, after []byte, limit int) ([][]byte, error)
 }
 
 // TransactionManager is responsible for handling all transaction requests.
 type TransactionManager struct {
-	Enclave Enclave
+	Enclave  Enclave
+	cert     *certificate       // TLS certificate of the public server, if TLS is enabled
+	watchdog *watchdog.Watchdog // Monitors background loops, may be nil
+	notifier *notifier          // Notifies subscribers of pushed payloads, may be nil
+	sends    *sendTracker       // Status of asynchronous sends
+	auditLog *audit.Log         // Records privacy-relevant operations, may be nil
+
+	readyPeers bool // Whether /readyz requires the party info of another node
+
+	storeTimeout    time.Duration // Deadline of each send to the enclave, 0 for no limit
+	retrieveTimeout time.Duration // Deadline of each receive from the enclave, 0 for no limit
 }
 
 const upCheckResponse = "I'm up!"
@@ -53,62 +98,244 @@ const sendRaw = "/sendraw"
 const receive = "/receive"
 const receiveRaw = "/receiveraw"
 const delete = "/delete"
+const requestResend = "/requestresend"
+const repush = "/repush"
+const transaction = "/transaction/"
+const provenance = "/provenance/"
+const usage = "/usage"
+const pair = "/pair"
+
+// storageProbeKey is looked up to confirm the underlying storage is readable.
+var storageProbeKey = []byte("upcheck")
 
 const hFrom = "c11n-from"
 const hTo = "c11n-to"
 const hKey = "c11n-key"
 
+// Headers supporting safe retries of requests. Sends with an Idempotency-Key are only processed
+// once, with the original response replayed for retries, and the Operation-ID identifies the
+// resulting transaction. Pushes are content addressed so are always safe to retry.
+const (
+	hIdempotencyKey      = "Idempotency-Key"
+	hIdempotencyReplayed = "Idempotency-Replayed"
+	hOperationId         = "Operation-ID"
+	hRetryAfter          = "Retry-After"
+)
+
+// retryAfterSeconds is the delay suggested to clients when the node is temporarily unavailable.
+const retryAfterSeconds = 1
+
+// maxLoggedBody is the number of bytes of a request body logged at debug level.
+const maxLoggedBody = 4096
+
+// requestLogger logs requests at debug level, with at most the first maxLoggedBody bytes of
+// their bodies, so that large bodies are not read into memory before their size is limited.
 func requestLogger(handler http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if log.GetLevel() == log.DebugLevel {
-			dump, err := httputil.DumpRequest(r, true)
+			dump, err := httputil.DumpRequest(r, false)
+			if err != nil {
+				internalServerError(w, r, fmt.Sprintf("Unable to read request, error: %s", err))
+				return
+			}
+			body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxLoggedBody))
 			if err != nil {
-				http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
+				badRequest(w, r, fmt.Sprintf("Unable to read request body, error: %s\n", err))
 				return
 			}
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
 
-			log.Debugf("%q", dump)
+			requestLog(r).Debugf("%q", append(dump, body...))
 		}
 
 		handler.ServeHTTP(w, r)
 	})
 }
 
+// ServerConfig contains the settings for the servers started by a TransactionManager.
+type ServerConfig struct {
+	Port         int    // Port of the public server
+	IpcPath      string // Path of the IPC socket for the private API
+	Grpc         bool   // Use gRPC rather than HTTP
+	GrpcJsonPort int    // Port for JSON extensions of gRPC, -1 to disable
+	Tls          bool
+	CertFile     string
+	KeyFile      string
+	DisableHttp2 bool                   // Serve only HTTP/1.1 over TLS, rather than also HTTP/2
+	IpcOptions   utils.IpcSocketOptions // Permissions of the IPC socket
+	IpcToken     string                 // Bearer token required by the private API, if set
+
+	// Limits applied to the public server, zero values disable them.
+	// Rate and concurrency limits are only supported by the HTTP server.
+	MaxRequestSize int64   // Maximum request body size in bytes
+	RateLimit      float64 // Requests per second permitted from each client IP
+	RateBurst      int     // Requests permitted in excess of RateLimit in a burst
+	MaxConcurrent  int     // Maximum number of requests served concurrently
+
+	// Timeouts applied to the HTTP servers' connections, guarding against slow clients.
+	PublicTimeouts HttpTimeouts
+	IpcTimeouts    HttpTimeouts
+
+	// Deadlines of the enclave operations performed for sends and receives via the private HTTP
+	// API, zero values disable them. Operations are also abandoned if the client disconnects.
+	StoreTimeout    time.Duration
+	RetrieveTimeout time.Duration
+
+	// Settings for running the public HTTP server behind a reverse proxy or ingress.
+	CorsOrigins    []string // Origins permitted to make cross-origin requests, "*" for any
+	TrustedProxies []string // IPs or CIDR ranges of proxies whose X-Forwarded-* headers are used
+	PathPrefix     string   // URL path prefix the public API is served under
+
+	// IPs or CIDR ranges permitted to, and denied from, making node to node requests to /push,
+	// /resend and /partyinfo, including its validation. If AllowIps is empty all clients not
+	// denied are permitted.
+	// These are only supported by the HTTP server.
+	AllowIps []string
+	DenyIps  []string
+
+	// The admin API is served separately from the public and private APIs, on a TCP address or
+	// unix socket, and is only started if AdminAddr is set.
+	AdminAddr  string // Address or socket path of the admin API
+	AdminToken string // Bearer token required by the admin API
+
+	// UsageTokens maps bearer tokens to the public keys whose usage they may view via the
+	// private API, allowing applications sharing a node to see only their own usage.
+	UsageTokens map[string][][]byte
+
+	// Reload reloads the node's configuration and keys, and is invoked via the admin API.
+	Reload func() error
+
+	// Pairing via the public HTTP API, new nodes may only pair if PairToken is set.
+	PairInfo  api.PairInfo // Details of this node provided to nodes pairing with it
+	PairToken string       // Bearer token nodes must present to pair with this node
+	Peers     *peers.File  // File paired nodes are recorded in
+
+	Watchdog *watchdog.Watchdog // Monitors background loops, reported by /upcheck if provided
+
+	// Audit records the payloads sent, received, deleted, pushed and resent, if provided.
+	Audit *audit.Log
+
+	// ValidatePartyInfo answers challenges from other nodes validating the recipients we announce.
+	ValidatePartyInfo bool
+
+	// ReadyPeers requires a node to have received the party info of another node before /readyz
+	// reports it as ready.
+	ReadyPeers bool
+
+	// Middleware applied, in order, to requests to the public and private HTTP APIs, after the
+	// built-in middleware such as request IDs, logging, limits and authentication.
+	PublicMiddleware []Middleware
+	IpcMiddleware    []Middleware
+}
+
+// HttpTimeouts limits the time an HTTP server spends on each connection, zero values disable them.
+type HttpTimeouts struct {
+	Read           time.Duration // Maximum time to read a request, including its body
+	Write          time.Duration // Maximum time from reading a request's headers to responding
+	Idle           time.Duration // Maximum time to wait for the next request on a connection
+	MaxHeaderBytes int           // Maximum size of request headers, http.DefaultMaxHeaderBytes if 0
+}
+
+// httpServer returns a server for handler, applying timeouts to its connections.
+func (timeouts HttpTimeouts) httpServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:           addr,
+		Handler:        handler,
+		ReadTimeout:    timeouts.Read,
+		WriteTimeout:   timeouts.Write,
+		IdleTimeout:    timeouts.Idle,
+		MaxHeaderBytes: timeouts.MaxHeaderBytes,
+	}
+}
+
 // Init initializes a new TransactionManager instance.
-func Init(enc Enclave, port int, ipcPath string, grpc bool, grpcJsonPort int, tls bool, certFile, keyFile string) (TransactionManager, error) {
-	tm := TransactionManager{Enclave: enc}
+func Init(enc Enclave, conf ServerConfig) (TransactionManager, error) {
+	tm := TransactionManager{
+		Enclave:    enc,
+		watchdog:   conf.Watchdog,
+		notifier:   newNotifier(),
+		sends:      newSendTracker(),
+		auditLog:   conf.Audit,
+		readyPeers: conf.ReadyPeers,
+
+		storeTimeout:    conf.StoreTimeout,
+		retrieveTimeout: conf.RetrieveTimeout,
+	}
+	if conf.AdminAddr != "" && conf.AdminToken == "" {
+		return tm, errors.New("an admin token must be provided to start the admin API")
+	}
+
 	var err error
-	if grpc == true {
-		err = tm.startRpcServer(port, grpcJsonPort, ipcPath, tls, certFile, keyFile)
+	if conf.Tls {
+		if err = CheckCertFiles(conf.CertFile, conf.KeyFile); err != nil {
+			return tm, err
+		}
+		if tm.cert, err = loadCertificate(conf.CertFile, conf.KeyFile); err != nil {
+			return tm, err
+		}
+	}
+
+	if conf.Grpc == true {
+		err = tm.startRpcServer(conf)
 
 	} else {
-		err = tm.startHttpserver(port, ipcPath, tls, certFile, keyFile)
+		err = tm.startHttpserver(conf)
+	}
+	if err == nil && conf.AdminAddr != "" {
+		err = tm.startAdminServer(conf)
 	}
 
 	return tm, err
 }
 
-func (tm *TransactionManager) startHttpserver(port int, ipcPath string, tls bool, certFile, keyFile string) error {
+func (tm *TransactionManager) startHttpserver(conf ServerConfig) error {
+	port, ipcPath, tls := conf.Port, conf.IpcPath, conf.Tls
+
+	ips, err := newIpFilter(conf.AllowIps, conf.DenyIps)
+	if err != nil {
+		return err
+	}
+
 	httpServer := http.NewServeMux()
 	httpServer.HandleFunc(upCheck, tm.upcheck)
 	httpServer.HandleFunc(version, tm.version)
-	httpServer.HandleFunc(push, tm.push)
-	httpServer.HandleFunc(resend, tm.resend)
-	httpServer.HandleFunc(partyInfo, tm.partyInfo)
+	httpServer.HandleFunc(healthz, tm.healthz)
+	httpServer.HandleFunc(readyz, tm.readyz)
+	httpServer.HandleFunc(push, ips.filter(tm.push))
+	httpServer.HandleFunc(resend, ips.filter(tm.resend))
+	httpServer.HandleFunc(partyInfo, ips.filter(tm.partyInfo))
+	if conf.ValidatePartyInfo {
+		httpServer.HandleFunc(api.ValidatePath, ips.filter(tm.validatePartyInfo))
+	}
+	httpServer.HandleFunc(pair, ips.filter(tm.pair(conf.PairInfo, conf.PairToken, conf.Peers).ServeHTTP))
+
+	publicHandler := closeBody(forwarded(conf.TrustedProxies,
+		requestId(requestLogger(
+			cors(conf.CorsOrigins,
+				limitRate(conf.RateLimit, conf.RateBurst,
+					limitConcurrency(conf.MaxConcurrent,
+						limitRequestSize(conf.MaxRequestSize,
+							decompressRequest(conf.MaxRequestSize,
+								stripPathPrefix(conf.PathPrefix,
+									Chain(httpServer, conf.PublicMiddleware...)))))))))))
 
 	serverUrl := "localhost:" + strconv.Itoa(port)
+	server := conf.PublicTimeouts.httpServer(serverUrl, publicHandler)
 	if tls {
-		err := CheckCertFiles(certFile, keyFile)
-		if err != nil {
-			log.Fatal(err)
+		server.TLSConfig = tm.cert.tlsConfig()
+		if conf.DisableHttp2 {
+			disableHttp2(server)
 		}
 		go func() {
-			log.Fatal(http.ListenAndServeTLS(serverUrl, certFile, keyFile, requestLogger(httpServer)))
+			log.Fatal(server.ListenAndServeTLS("", ""))
 		}()
 		log.Infof("HTTPS server is running at: %s", serverUrl)
 	} else {
 		go func() {
-			log.Fatal(http.ListenAndServe(serverUrl, requestLogger(httpServer)))
+			log.Fatal(server.ListenAndServe())
 		}()
 		log.Infof("HTTP server is running at: %s", serverUrl)
 	}
@@ -117,24 +344,63 @@ func (tm *TransactionManager) startHttpserver(port int, ipcPath string, tls bool
 	ipcServer := http.NewServeMux()
 	ipcServer.HandleFunc(upCheck, tm.upcheck)
 	ipcServer.HandleFunc(version, tm.version)
+	ipcServer.HandleFunc(healthz, tm.healthz)
+	ipcServer.HandleFunc(readyz, tm.readyz)
 	ipcServer.HandleFunc(send, tm.send)
 	ipcServer.HandleFunc(sendRaw, tm.sendRaw)
+	ipcServer.HandleFunc(sendAsync, tm.sendAsync)
+	ipcServer.HandleFunc(sendStatus, tm.sendStatus)
 	ipcServer.HandleFunc(receive, tm.receive)
 	ipcServer.HandleFunc(receiveRaw, tm.receiveRaw)
 	ipcServer.HandleFunc(delete, tm.delete)
+	ipcServer.HandleFunc(requestResend, tm.requestResend)
+	ipcServer.HandleFunc(repush, tm.repush)
+	ipcServer.HandleFunc(transaction, tm.transaction)
+	ipcServer.HandleFunc(provenance, tm.provenance)
+	ipcServer.HandleFunc(createPrivacyGroup, tm.createPrivacyGroup)
+	ipcServer.HandleFunc(findPrivacyGroup, tm.findPrivacyGroup)
+	ipcServer.HandleFunc(deletePrivacyGroup, tm.deletePrivacyGroup)
+	ipcServer.Handle(usage, tm.scopedUsage(conf.UsageTokens))
+	ipcServer.HandleFunc(subscribe, tm.subscribe)
+	ipcServer.HandleFunc(payloads, tm.listPayloads)
+	ipcHandler := closeBody(requestId(requestLogger(
+		authenticateIpc(conf.IpcToken, Chain(ipcServer, conf.IpcMiddleware...)))))
 
-	ipc, err := utils.CreateIpcSocket(ipcPath)
+	ipc, err := utils.CreateIpcSocketWithOptions(ipcPath, conf.IpcOptions)
 	if err != nil {
-		log.Fatalf("Failed to start IPC Server at %s", ipcPath)
+		log.Fatalf("Failed to start IPC Server at %s, error: %v", ipcPath, err)
 	}
 	go func() {
-		log.Fatal(http.Serve(ipc, requestLogger(ipcServer)))
+		log.Fatal(conf.IpcTimeouts.httpServer("", ipcHandler).Serve(ipc))
 	}()
 	log.Infof("IPC server is running at: %s", ipcPath)
 
 	return err
 }
 
+// authenticateIpc requires requests to the private API to present token as a bearer token, if it
+// is set. The up check and probes remain available without it, for monitoring.
+func authenticateIpc(token string, handler http.Handler) http.Handler {
+	if token == "" {
+		return handler
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/", authenticate(token, handler))
+	for _, path := range []string{upCheck, healthz, readyz} {
+		mux.Handle(path, handler)
+	}
+	return mux
+}
+
+// ReloadCertificate reloads the TLS certificate and key of the public server from disk. New
+// connections use the reloaded certificate, while established connections are unaffected.
+func (tm *TransactionManager) ReloadCertificate() error {
+	if tm.cert == nil {
+		return nil
+	}
+	return tm.cert.reload()
+}
+
 func CheckCertFiles(certFile, keyFile string) error {
 	if _, err := os.Stat(certFile); os.IsNotExist(err) {
 		return err
@@ -144,8 +410,100 @@ func CheckCertFiles(certFile, keyFile string) error {
 	return nil
 }
 
+// upcheck responds with a plain text message by default. Clients requesting JSON, via the
+// Accept header or a format=json query parameter, receive the node version, peer count and
+// storage health instead.
 func (s *TransactionManager) upcheck(w http.ResponseWriter, req *http.Request) {
-	fmt.Fprint(w, upCheckResponse)
+	if req.URL.Query().Get("format") != "json" &&
+		!strings.Contains(req.Header.Get("Accept"), "application/json") {
+		fmt.Fprint(w, upCheckResponse)
+		return
+	}
+
+	url, _, parties := s.Enclave.GetPartyInfo()
+	peers := 0
+	for party := range parties {
+		if party != url {
+			peers++
+		}
+	}
+
+	status := api.UpCheckResponse{Status: "up", Version: apiVersion, Peers: peers, Storage: "ok"}
+	_, err := s.Enclave.Exists(&storageProbeKey)
+	if err != nil {
+		status.Status = "degraded"
+		status.Storage = err.Error()
+	}
+	status.Subsystems = s.watchdog.Status()
+	for _, subsystem := range status.Subsystems {
+		if !subsystem.Healthy {
+			status.Status = "degraded"
+		}
+	}
+
+	code := http.StatusOK
+	if status.Status != "up" {
+		w.Header().Set(hRetryAfter, strconv.Itoa(retryAfterSeconds))
+		code = http.StatusServiceUnavailable
+	}
+	writeJsonStatus(w, code, status)
+}
+
+// transaction checks whether a payload exists for the base64 encoded key provided in the path,
+// responding with a 200 if it does and a 404 otherwise. The payload itself is not returned.
+func (s *TransactionManager) transaction(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	key, ok := decodePathKey(w, req, transaction)
+	if !ok {
+		return
+	}
+
+	exists, err := s.Enclave.Exists(&key)
+	if err != nil {
+		internalServerError(w, req, fmt.Sprintf("Unable to check for payload, error: %s\n", err))
+		return
+	}
+	if !exists {
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// provenance returns the recorded hops for the payload with the base64 encoded key provided in
+// the path, describing how it reached, or left, this node.
+func (s *TransactionManager) provenance(w http.ResponseWriter, req *http.Request) {
+	key, ok := decodePathKey(w, req, provenance)
+	if !ok {
+		return
+	}
+
+	hops, err := s.Enclave.Provenance(key)
+	if err != nil {
+		internalServerError(w, req, fmt.Sprintf("Unable to read provenance, error: %s\n", err))
+		return
+	}
+
+	writeJson(w, hops)
+}
+
+// decodePathKey decodes the base64 encoded key following prefix in the request path, writing an
+// error response if it is invalid.
+func decodePathKey(w http.ResponseWriter, req *http.Request, prefix string) ([]byte, bool) {
+	encodedKey := strings.TrimPrefix(req.URL.Path, prefix)
+	key, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil {
+		// Keys may also be provided URL safe encoded
+		key, err = base64.URLEncoding.DecodeString(encodedKey)
+	}
+	if err != nil {
+		decodeError(w, req, "key", encodedKey, err)
+		return nil, false
+	}
+	return key, true
 }
 
 func (s *TransactionManager) version(w http.ResponseWriter, req *http.Request) {
@@ -153,33 +511,100 @@ func (s *TransactionManager) version(w http.ResponseWriter, req *http.Request) {
 }
 
 func (s *TransactionManager) send(w http.ResponseWriter, req *http.Request) {
+	params, ok := s.decodeSend(w, req)
+	if !ok {
+		return
+	}
+
+	key, err := s.processSend(
+		w, req, params.sender, params.recipients, &params.payload, params.idempotencyKey)
+
+	if err == api.ErrIdempotencyKeyReused {
+		unprocessableEntity(w, req, err)
+	} else if contextError(w, req, err) {
+		return
+	} else if err != nil {
+		badRequest(w, req, fmt.Sprintf("Unable to store payload, error: %s", err))
+	} else {
+		s.recordPrivacyGroup(req, key, params.groupId)
+		encodedKey := base64.StdEncoding.EncodeToString(key)
+		writeJson(w, api.SendResponse{Key: encodedKey})
+	}
+}
+
+// sendParams are the decoded parameters of a SendRequest.
+type sendParams struct {
+	payload        []byte
+	sender         []byte
+	recipients     [][]byte
+	groupId        []byte // Privacy group the payload is sent to, if any
+	idempotencyKey string
+}
+
+// decodeSend decodes the SendRequest in the body of req, resolving the recipients of any privacy
+// group it is sent to. If the request is invalid, an error response is written and ok is false.
+func (s *TransactionManager) decodeSend(
+	w http.ResponseWriter, req *http.Request) (params sendParams, ok bool) {
+
 	var sendReq api.SendRequest
 	err := json.NewDecoder(req.Body).Decode(&sendReq)
-	req.Body.Close()
 	if err != nil {
 		invalidBody(w, req, err)
-		return
+		return params, false
 	}
 
-	payload, err := base64.StdEncoding.DecodeString(sendReq.Payload)
+	if sendReq.Payload == "" {
+		missingField(w, req, "payload")
+		return params, false
+	}
+	params.payload, err = base64.StdEncoding.DecodeString(sendReq.Payload)
 	if err != nil {
 		decodeError(w, req, "payload", sendReq.Payload, err)
-		return
+		return params, false
+	}
+	params.sender, params.recipients, ok = decodeSendKeys(w, req, "from", sendReq.From, "to", sendReq.To)
+	if !ok {
+		return params, false
 	}
 
-	var key []byte
-	key, err = s.processSend(w, req, sendReq.From, sendReq.To, &payload)
+	if sendReq.PrivacyGroupId != "" {
+		if len(sendReq.To) > 0 {
+			writeError(w, req, http.StatusBadRequest, api.ErrorResponse{
+				Code:    api.CodeBadRequest,
+				Message: "Only one of to and privacyGroupId may be provided",
+				Field:   "privacyGroupId",
+			})
+			return params, false
+		}
+		params.groupId, params.recipients, ok = s.privacyGroupRecipients(
+			w, req, sendReq.PrivacyGroupId, params.sender)
+		if !ok {
+			return params, false
+		}
+	}
 
-	if err != nil {
-		log.Error(err)
-		badRequest(w,
-			fmt.Sprintf("Unable to store key: %s, with payload: %s, error: %s\n",
-				key, payload, err))
-	} else {
-		encodedKey := base64.StdEncoding.EncodeToString(key)
-		sendResp := api.SendResponse{Key: encodedKey}
-		json.NewEncoder(w).Encode(sendResp)
-		w.Header().Set("Content-Type", "application/json")
+	params.idempotencyKey = sendReq.IdempotencyKey
+	if header := req.Header.Get(hIdempotencyKey); params.idempotencyKey == "" {
+		params.idempotencyKey = header
+	} else if header != "" && header != params.idempotencyKey {
+		writeError(w, req, http.StatusBadRequest, api.ErrorResponse{
+			Code:    api.CodeBadRequest,
+			Message: fmt.Sprintf("idempotencyKey does not match the %s header", hIdempotencyKey),
+			Field:   "idempotencyKey",
+		})
+		return params, false
+	}
+	return params, true
+}
+
+// recordPrivacyGroup records that the payload with key was sent to the privacy group groupId, if
+// it was sent to one.
+func (s *TransactionManager) recordPrivacyGroup(req *http.Request, key, groupId []byte) {
+	if groupId == nil {
+		return
+	}
+	if err := s.Enclave.RecordPrivacyGroup(key, groupId); err != nil {
+		requestLog(req).Errorf("Unable to record privacy group, %v", err)
 	}
 }
 
@@ -196,16 +621,29 @@ func (s *TransactionManager) sendRaw(w http.ResponseWriter, req *http.Request) {
 	}
 
 	payload, err := ioutil.ReadAll(req.Body)
-	req.Body.Close()
 	if err != nil {
 		invalidBody(w, req, err)
 		return
 	}
 
+	if len(payload) == 0 {
+		missingField(w, req, "payload")
+		return
+	}
+	sender, recipients, ok := decodeSendKeys(w, req, hFrom, from, hTo, to)
+	if !ok {
+		return
+	}
+
 	var key []byte
-	key, err = s.processSend(w, req, from, to, &payload)
-	if err != nil {
-		internalServerError(w, "Unable to process request")
+	key, err = s.processSend(w, req, sender, recipients, &payload, req.Header.Get(hIdempotencyKey))
+	if err == api.ErrIdempotencyKeyReused {
+		unprocessableEntity(w, req, err)
+		return
+	} else if contextError(w, req, err) {
+		return
+	} else if err != nil {
+		internalServerError(w, req, "Unable to process request")
 		return
 	}
 
@@ -217,142 +655,301 @@ func (s *TransactionManager) sendRaw(w http.ResponseWriter, req *http.Request) {
 	fmt.Fprint(w, encodedKey)
 }
 
-func (s *TransactionManager) processSend(
+// decodeSendKeys decodes the sender and recipient public keys of a send request, provided in
+// the named fields. The sender is optional, in which case the enclave's default key is used,
+// and if no recipients are provided the payload is only stored for the sender.
+// If any key is invalid a 400 is written, and false returned.
+func decodeSendKeys(
 	w http.ResponseWriter, req *http.Request,
-	b64from string,
-	b64recipients []string,
-	payload *[]byte) ([]byte, error) {
-
-	log.WithFields(log.Fields{
-		"b64From":       b64from,
-		"b64Recipients": b64recipients,
-		"payload":       hex.EncodeToString(*payload)}).Debugf(
-		"Processing send request")
+	fromField, b64from string,
+	toField string, b64recipients []string) ([]byte, [][]byte, bool) {
 
-	sender, err := base64.StdEncoding.DecodeString(b64from)
-	if err != nil {
-		decodeError(w, req, "sender", b64from, err)
-		return nil, err
+	sender := []byte{}
+	if b64from != "" {
+		var ok bool
+		if sender, ok = decodePublicKey(w, req, fromField, b64from); !ok {
+			return nil, nil, false
+		}
 	}
 
 	recipients := make([][]byte, len(b64recipients))
 	for i, value := range b64recipients {
-		recipient, err := base64.StdEncoding.DecodeString(value)
-		if err != nil {
-			decodeError(w, req, "recipient", value, err)
-			return nil, err
-		} else {
-			recipients[i] = recipient
+		recipient, ok := decodePublicKey(w, req, toField, value)
+		if !ok {
+			return nil, nil, false
+		}
+		recipients[i] = recipient
+	}
+	return sender, recipients, true
+}
+
+// decodePublicKey decodes the base64 encoded public key provided in the named field, writing a
+// 400 if it is missing or invalid.
+func decodePublicKey(w http.ResponseWriter, req *http.Request, field, value string) ([]byte, bool) {
+	if value == "" {
+		missingField(w, req, field)
+		return nil, false
+	}
+	key, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		decodeError(w, req, field, value, err)
+		return nil, false
+	}
+	if len(key) != nacl.KeySize {
+		writeError(w, req, http.StatusBadRequest, api.ErrorResponse{
+			Code: api.CodeInvalidKey,
+			Message: fmt.Sprintf("Invalid public key: %s, expected %d bytes, got %d",
+				value, nacl.KeySize, len(key)),
+			Field: field,
+		})
+		return nil, false
+	}
+	return key, true
+}
+
+func (s *TransactionManager) processSend(
+	w http.ResponseWriter, req *http.Request,
+	sender []byte,
+	recipients [][]byte,
+	payload *[]byte,
+	idempotencyKey string) ([]byte, error) {
+
+	requestLog(req).WithFields(log.Fields{
+		"from":       hex.EncodeToString(sender),
+		"recipients": len(recipients),
+		"payload":    hex.EncodeToString(*payload)}).Debugf(
+		"Processing send request")
+
+	ctx, cancel := operationContext(req, s.storeTimeout)
+	defer cancel()
+
+	if idempotencyKey == "" {
+		key, err := s.Enclave.StoreContext(ctx, payload, sender, recipients)
+		if err == nil {
+			w.Header().Set(hOperationId, base64.StdEncoding.EncodeToString(key))
+			s.audit(req, api.AuditSend, sender, key)
 		}
+		return key, err
 	}
 
-	return s.Enclave.Store(payload, sender, recipients)
+	key, replayed, err := s.Enclave.StoreIdempotentContext(
+		ctx, payload, sender, recipients, idempotencyKey)
+	if err != nil {
+		return nil, err
+	}
+	w.Header().Set(hOperationId, base64.StdEncoding.EncodeToString(key))
+	w.Header().Set(hIdempotencyReplayed, strconv.FormatBool(replayed))
+	if replayed {
+		requestLog(req).WithField("idempotencyKey", idempotencyKey).Info(
+			"Replaying response to previous send")
+	} else {
+		s.audit(req, api.AuditSend, sender, key)
+	}
+	return key, nil
 }
 
 func (s *TransactionManager) receive(w http.ResponseWriter, req *http.Request) {
 	var receiveReq api.ReceiveRequest
 	err := json.NewDecoder(req.Body).Decode(&receiveReq)
-	req.Body.Close()
 	if err != nil {
 		invalidBody(w, req, err)
 		return
 	}
 
+	key, to, ok := decodeReceiveKeys(w, req, "key", receiveReq.Key, "to", receiveReq.To)
+	if !ok {
+		return
+	}
+
 	var payload []byte
-	payload, err = s.processReceive(w, req, receiveReq.Key, receiveReq.To)
+	payload, err = s.processReceive(req, key, to)
 
-	if err != nil {
-		badRequest(w,
-			fmt.Sprintf("Unable to retrieve payload for key: %s, error: %s\n",
+	if contextError(w, req, err) {
+		return
+	} else if err != nil {
+		badRequest(w, req,
+			fmt.Sprintf("Unable to retrieve payload for key: %s, error: %s",
 				receiveReq.Key, err))
 	} else {
 		encodedPayload := base64.StdEncoding.EncodeToString(payload)
 		sendResp := api.ReceiveResponse{Payload: encodedPayload}
-		json.NewEncoder(w).Encode(sendResp)
-		w.Header().Set("Content-Type", "application/json")
+		if groupId, err := s.Enclave.PayloadPrivacyGroup(key); err != nil {
+			requestLog(req).Errorf("Unable to read privacy group, %v", err)
+		} else if groupId != nil {
+			sendResp.PrivacyGroupId = base64.StdEncoding.EncodeToString(groupId)
+		}
+		writeJson(w, sendResp)
 	}
 }
 
 func (s *TransactionManager) receiveRaw(w http.ResponseWriter, req *http.Request) {
 
-	key := req.Header.Get(hKey)
-	if key == "" {
-		badRequest(w, "key not specified")
+	key, to, ok := decodeReceiveKeys(w, req, hKey, req.Header.Get(hKey), hTo, req.Header.Get(hTo))
+	if !ok {
 		return
 	}
 
-	to := req.Header.Get(hTo)
+	payload, err := s.processReceive(req, key, to)
 
-	payload, err := s.processReceive(w, req, key, to)
-
-	if err != nil {
-		badRequest(w, fmt.Sprintln(err))
+	if contextError(w, req, err) {
+		return
+	} else if err != nil {
+		badRequest(w, req, err.Error())
 		return
 	}
 
 	w.Write(payload)
 }
 
-func (s *TransactionManager) processReceive(
-	w http.ResponseWriter, req *http.Request, b64Key, b64To string) ([]byte, error) {
+// decodeReceiveKeys decodes the key of the payload to retrieve, and the optional public key of
+// the recipient to retrieve it for, writing a 400 if either is invalid.
+func decodeReceiveKeys(
+	w http.ResponseWriter, req *http.Request,
+	keyField, b64Key string,
+	toField, b64To string) ([]byte, []byte, bool) {
 
+	if b64Key == "" {
+		missingField(w, req, keyField)
+		return nil, nil, false
+	}
 	key, err := base64.StdEncoding.DecodeString(b64Key)
 	if err != nil {
-		return nil, fmt.Errorf("unable to decode key: %s", b64Key)
+		decodeError(w, req, keyField, b64Key, err)
+		return nil, nil, false
 	}
 
-	if b64To != "" {
-		to, err := base64.StdEncoding.DecodeString(b64To)
-		if err != nil {
-			return nil, fmt.Errorf("unable to decode to: %s", b64Key)
-		}
+	if b64To == "" {
+		return key, nil, true
+	}
+	to, ok := decodePublicKey(w, req, toField, b64To)
+	return key, to, ok
+}
 
-		return s.Enclave.Retrieve(&key, &to)
+// processReceive retrieves the payload with the provided key for the recipient to, or for
+// whichever of the enclave's keys it was sent to if to is nil.
+func (s *TransactionManager) processReceive(req *http.Request, key, to []byte) ([]byte, error) {
+	ctx, cancel := operationContext(req, s.retrieveTimeout)
+	defer cancel()
+
+	var payload []byte
+	var err error
+	if to != nil {
+		payload, err = s.Enclave.RetrieveContext(ctx, &key, &to)
 	} else {
-		return s.Enclave.RetrieveDefault(&key)
+		payload, err = s.Enclave.RetrieveContext(ctx, &key, nil)
+	}
+	if err == nil {
+		s.audit(req, api.AuditReceive, to, key)
+	}
+	return payload, err
+}
+
+// operationContext returns the context of an enclave operation performed for req, which is done
+// if the client disconnects, or once timeout has elapsed if it is not zero.
+func operationContext(req *http.Request, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(req.Context())
+	}
+	return context.WithTimeout(req.Context(), timeout)
+}
+
+// contextError responds to a request whose enclave operation was abandoned as its context was
+// done, returning false if err is not due to that. Operations which timed out may be retried, so
+// a 503 is written, while the client of a cancelled operation has disconnected.
+func contextError(w http.ResponseWriter, req *http.Request, err error) bool {
+	switch err {
+	case context.DeadlineExceeded:
+		serviceUnavailable(w, req, "Timed out waiting for the enclave")
+	case context.Canceled:
+		requestLog(req).Info("Request cancelled as the client disconnected")
+	default:
+		return false
 	}
+	return true
 }
 
 func (s *TransactionManager) delete(w http.ResponseWriter, req *http.Request) {
 	var deleteReq api.DeleteRequest
 	err := json.NewDecoder(req.Body).Decode(&deleteReq)
-	req.Body.Close()
 	if err != nil {
 		invalidBody(w, req, err)
 		return
 	}
+	if deleteReq.Key == "" {
+		missingField(w, req, "key")
+		return
+	}
 	key, err := base64.StdEncoding.DecodeString(deleteReq.Key)
 	if err != nil {
 		decodeError(w, req, "key", deleteReq.Key, err)
 	} else {
 		err = s.Enclave.Delete(&key)
 		if err != nil {
-			badRequest(w, fmt.Sprintf("Unable to delete key: %s, error: %s\n", key, err))
+			badRequest(w, req, fmt.Sprintf("Unable to delete key: %s, error: %s",
+				deleteReq.Key, err))
+		} else {
+			s.audit(req, api.AuditDelete, nil, key)
 		}
 	}
 }
 
 func (s *TransactionManager) push(w http.ResponseWriter, req *http.Request) {
 	payload, err := ioutil.ReadAll(req.Body)
-	req.Body.Close()
 	if err != nil {
-		internalServerError(w, fmt.Sprintf("Unable to read request body, error: %s\n", err))
+		badRequest(w, req, fmt.Sprintf("Unable to read request body, error: %s\n", err))
 		return
 	}
 
-	digestHash, err := s.Enclave.StorePayload(payload)
+	epl, _, err := api.DecodePayloadWithRecipients(payload)
+	if err != nil {
+		badRequest(w, req, fmt.Sprintf("Invalid payload, error: %s\n", err))
+		return
+	}
+
+	// Payloads are stored under the digest of their cipher text, nodes which provide the key
+	// they expect it to be stored under have it verified
+	if b64Key := req.Header.Get(api.PushKeyHeader); b64Key != "" {
+		key, err := base64.StdEncoding.DecodeString(b64Key)
+		if err != nil {
+			decodeError(w, req, api.PushKeyHeader, b64Key, err)
+			return
+		}
+		if !utils.VerifyDigest(epl.CipherText, key) {
+			writeError(w, req, http.StatusBadRequest, api.ErrorResponse{
+				Code:    api.CodeKeyMismatch,
+				Message: fmt.Sprintf("Pushed payload does not match its key: %s", b64Key),
+				Field:   api.PushKeyHeader,
+			})
+			return
+		}
+	}
+
+	digestHash, err := s.Enclave.StoreDecodedPayload(epl, payload)
 	if err != nil {
-		badRequest(w, fmt.Sprintf("Unable to store payload, error: %s\n", err))
+		serviceUnavailable(w, req, fmt.Sprintf("Unable to store payload, error: %s\n", err))
 		return
 	}
+	w.Header().Set(hOperationId, base64.StdEncoding.EncodeToString(digestHash))
+	s.audit(req, api.AuditPush, (*epl.Sender)[:], digestHash)
+
+	err = s.Enclave.RecordProvenance(digestHash, api.ProvenanceHop{
+		Action: api.ProvenanceReceive,
+		From:   req.RemoteAddr,
+	})
+	if err != nil {
+		requestLog(req).Errorf("Unable to record provenance, %v", err)
+	}
 
+	s.notifier.notify(api.PayloadNotification{
+		Key:    base64.StdEncoding.EncodeToString(digestHash),
+		Sender: base64.StdEncoding.EncodeToString((*epl.Sender)[:]),
+	})
 	w.Write(digestHash)
 }
 
 func (s *TransactionManager) resend(w http.ResponseWriter, req *http.Request) {
 	var resendReq api.ResendRequest
 	err := json.NewDecoder(req.Body).Decode(&resendReq)
-	req.Body.Close()
 	if err != nil {
 		invalidBody(w, req, err)
 		return
@@ -368,7 +965,9 @@ func (s *TransactionManager) resend(w http.ResponseWriter, req *http.Request) {
 	if resendReq.Type == "all" {
 		err = s.Enclave.RetrieveAllFor(&publicKey)
 		if err != nil {
-			invalidBody(w, req, err)
+			internalServerError(w, req, fmt.Sprintf("Unable to resend payloads, error: %s\n", err))
+		} else {
+			s.audit(req, api.AuditResend, publicKey, nil)
 		}
 	} else if resendReq.Type == "individual" {
 		var key []byte
@@ -381,43 +980,193 @@ func (s *TransactionManager) resend(w http.ResponseWriter, req *http.Request) {
 		var encodedPl *[]byte
 		encodedPl, err = s.Enclave.RetrieveFor(&key, &publicKey)
 		if err != nil {
-			invalidBody(w, req, err)
+			badRequest(w, req, fmt.Sprintf("Unable to retrieve payload for key: %s, error: %s",
+				resendReq.Key, err))
 			return
 		}
+		s.audit(req, api.AuditResend, publicKey, key)
 		w.Write(*encodedPl)
+	} else {
+		badRequest(w, req, fmt.Sprintf("Invalid resend type: %s\n", resendReq.Type))
+	}
+}
+
+// requestResend asks the other nodes on the network to resend payloads for one of our keys,
+// allowing a node to recover transactions it is missing.
+func (s *TransactionManager) requestResend(w http.ResponseWriter, req *http.Request) {
+	var resendReq api.ResendRequest
+	err := json.NewDecoder(req.Body).Decode(&resendReq)
+	if err != nil {
+		invalidBody(w, req, err)
+		return
+	}
+
+	var publicKey []byte
+	publicKey, err = base64.StdEncoding.DecodeString(resendReq.PublicKey)
+	if err != nil {
+		decodeError(w, req, "publicKey", resendReq.PublicKey, err)
+		return
+	}
+
+	var key []byte
+	if resendReq.Type == "individual" {
+		key, err = base64.StdEncoding.DecodeString(resendReq.Key)
+		if err != nil {
+			decodeError(w, req, "key", resendReq.Key, err)
+			return
+		}
+	} else if resendReq.Type != "all" {
+		badRequest(w, req, fmt.Sprintf("Invalid resend type: %s\n", resendReq.Type))
+		return
+	}
+
+	err = s.Enclave.RequestResend(publicKey, key)
+	if err != nil {
+		internalServerError(w, req, fmt.Sprintf("Unable to request resend, error: %s\n", err))
+	}
+}
+
+// validatePartyInfo answers a challenge from another node to prove we hold the private key for
+// a public key we have announced.
+func (s *TransactionManager) validatePartyInfo(w http.ResponseWriter, req *http.Request) {
+	var challenge api.PartyInfoChallenge
+	err := json.NewDecoder(req.Body).Decode(&challenge)
+	if err != nil {
+		invalidBody(w, req, err)
+		return
+	}
+
+	answer, err := s.Enclave.AnswerChallenge(challenge)
+	if err != nil {
+		badRequest(w, req, fmt.Sprintf("Unable to answer challenge, error: %s\n", err))
+		return
+	}
+	w.Write(answer)
+}
+
+// repush pushes a single transaction to a single recipient again, for when delivery to that
+// recipient failed.
+func (s *TransactionManager) repush(w http.ResponseWriter, req *http.Request) {
+	var repushReq api.RepushRequest
+	err := json.NewDecoder(req.Body).Decode(&repushReq)
+	if err != nil {
+		invalidBody(w, req, err)
+		return
+	}
+
+	var key, to []byte
+	key, err = base64.StdEncoding.DecodeString(repushReq.Key)
+	if err != nil {
+		decodeError(w, req, "key", repushReq.Key, err)
+		return
+	}
+	to, err = base64.StdEncoding.DecodeString(repushReq.To)
+	if err != nil {
+		decodeError(w, req, "to", repushReq.To, err)
+		return
+	}
+
+	err = s.Enclave.Repush(key, to, repushReq.Url)
+	if err != nil {
+		internalServerError(w, req, fmt.Sprintf("Unable to push payload, error: %s\n", err))
 	}
 }
 
 func (s *TransactionManager) partyInfo(w http.ResponseWriter, req *http.Request) {
 	payload, err := ioutil.ReadAll(req.Body)
-	req.Body.Close()
 	if err != nil {
-		internalServerError(w, fmt.Sprintf("Unable to read request body, error: %s\n", err))
+		badRequest(w, req, fmt.Sprintf("Unable to read request body, error: %s\n", err))
 		return
-	} else {
-		s.Enclave.UpdatePartyInfo(payload)
-		w.Write(s.Enclave.GetEncodedPartyInfo())
 	}
+
+	err = s.Enclave.UpdatePartyInfo(payload)
+	if err != nil {
+		badRequest(w, req, fmt.Sprintf("Invalid party info, error: %s\n", err))
+		return
+	}
+	w.Write(s.Enclave.GetEncodedPartyInfo())
 }
 
 func invalidBody(w http.ResponseWriter, req *http.Request, err error) {
-	badRequest(w, fmt.Sprintf("Invalid request: %s, error: %s\n", req.URL, err))
+	writeError(w, req, http.StatusBadRequest, api.ErrorResponse{
+		Code:    api.CodeInvalidBody,
+		Message: fmt.Sprintf("Invalid request: %s, error: %s", req.URL, err),
+	})
 }
 
 func decodeError(w http.ResponseWriter, req *http.Request, name string, value string, err error) {
-	badRequest(w,
-		fmt.Sprintf("Invalid request: %s, unable to decode %s: %s, error: %s\n",
-			req.URL, name, value, err))
+	writeError(w, req, http.StatusBadRequest, api.ErrorResponse{
+		Code:    api.CodeInvalidEncoding,
+		Message: fmt.Sprintf("Unable to decode %s: %s, error: %s", name, value, err),
+		Field:   name,
+	})
 }
 
-func badRequest(w http.ResponseWriter, message string) {
-	log.Error(message)
-	w.WriteHeader(http.StatusBadRequest)
-	fmt.Fprintf(w, message)
+// missingField responds with a 400 for a request which does not provide the named field.
+func missingField(w http.ResponseWriter, req *http.Request, name string) {
+	writeError(w, req, http.StatusBadRequest, api.ErrorResponse{
+		Code:    api.CodeMissingField,
+		Message: fmt.Sprintf("No %s provided", name),
+		Field:   name,
+	})
+}
+
+func badRequest(w http.ResponseWriter, req *http.Request, message string) {
+	writeError(w, req, http.StatusBadRequest,
+		api.ErrorResponse{Code: api.CodeBadRequest, Message: message})
+}
+
+func unprocessableEntity(w http.ResponseWriter, req *http.Request, err error) {
+	writeError(w, req, http.StatusUnprocessableEntity,
+		api.ErrorResponse{Code: api.CodeUnprocessable, Message: err.Error()})
+}
+
+// serviceUnavailable responds with a 503, indicating the request can be retried.
+func serviceUnavailable(w http.ResponseWriter, req *http.Request, message string) {
+	w.Header().Set(hRetryAfter, strconv.Itoa(retryAfterSeconds))
+	writeError(w, req, http.StatusServiceUnavailable,
+		api.ErrorResponse{Code: api.CodeServiceUnavailable, Message: message})
+}
+
+func internalServerError(w http.ResponseWriter, req *http.Request, message string) {
+	writeError(w, req, http.StatusInternalServerError,
+		api.ErrorResponse{Code: api.CodeInternalError, Message: message})
 }
 
-func internalServerError(w http.ResponseWriter, message string) {
-	log.Error(message)
-	w.WriteHeader(http.StatusInternalServerError)
-	fmt.Fprintf(w, message)
+// writeError logs and responds with the provided error, encoded as JSON.
+func writeError(w http.ResponseWriter, req *http.Request, status int, resp api.ErrorResponse) {
+	resp.Message = strings.TrimSpace(resp.Message)
+	entry := requestLog(req).WithField("code", resp.Code)
+	if resp.Field != "" {
+		entry = entry.WithField("field", resp.Field)
+	}
+	entry.Error(resp.Message)
+	writeJsonError(w, status, resp)
+}
+
+func writeJsonError(w http.ResponseWriter, status int, resp api.ErrorResponse) {
+	writeJsonStatus(w, status, resp)
+}
+
+// writeJson responds with value encoded as JSON.
+func writeJson(w http.ResponseWriter, value interface{}) {
+	writeJsonStatus(w, http.StatusOK, value)
+}
+
+// writeJsonStatus responds with status and value encoded as JSON. The value is encoded before the
+// response is started, so that one which cannot be encoded results in a 500 rather than a
+// truncated response.
+func writeJsonStatus(w http.ResponseWriter, status int, value interface{}) {
+	body, err := json.Marshal(value)
+	if err != nil {
+		log.Errorf("Unable to encode response, error: %v", err)
+		status = http.StatusInternalServerError
+		body, _ = json.Marshal(api.ErrorResponse{
+			Code:    api.CodeInternalError,
+			Message: "Unable to encode response",
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(append(body, '\n'))
 }
@@ -7,13 +7,16 @@ import (
 	"fmt"
 	"github.com/blk-io/chimera-api/chimera"
 	"github.com/blk-io/crux/api"
+	"github.com/blk-io/crux/audit"
 	"github.com/kevinburke/nacl"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/net/context"
+	"google.golang.org/grpc/peer"
 )
 
 type Server struct {
-	Enclave Enclave
+	Enclave  Enclave
+	auditLog *audit.Log // Records privacy-relevant operations, may be nil
 }
 
 func (s *Server) Version(ctx context.Context, in *chimera.ApiVersion) (*chimera.ApiVersion, error) {
@@ -24,7 +27,7 @@ func (s *Server) Upcheck(ctx context.Context, in *chimera.UpCheckResponse) (*chi
 	return &chimera.UpCheckResponse{Message: upCheckResponse}, nil
 }
 func (s *Server) Send(ctx context.Context, in *chimera.SendRequest) (*chimera.SendResponse, error) {
-	key, err := s.processSend(in.GetFrom(), in.GetTo(), &in.Payload)
+	key, err := s.processSend(ctx, in.GetFrom(), in.GetTo(), &in.Payload)
 	var sendResp chimera.SendResponse
 	if err != nil {
 		log.Error(err)
@@ -34,7 +37,8 @@ func (s *Server) Send(ctx context.Context, in *chimera.SendRequest) (*chimera.Se
 	return &sendResp, err
 }
 
-func (s *Server) processSend(b64from string, b64recipients []string, payload *[]byte) ([]byte, error) {
+func (s *Server) processSend(
+	ctx context.Context, b64from string, b64recipients []string, payload *[]byte) ([]byte, error) {
 	log.WithFields(log.Fields{
 		"b64From":       b64from,
 		"b64Recipients": b64recipients,
@@ -58,11 +62,15 @@ func (s *Server) processSend(b64from string, b64recipients []string, payload *[]
 		}
 	}
 
-	return s.Enclave.Store(payload, sender, recipients)
+	key, err := s.Enclave.StoreContext(ctx, payload, sender, recipients)
+	if err == nil {
+		s.audit(ctx, api.AuditSend, sender, key)
+	}
+	return key, err
 }
 
 func (s *Server) Receive(ctx context.Context, in *chimera.ReceiveRequest) (*chimera.ReceiveResponse, error) {
-	payload, err := s.processReceive(in.Key, in.To)
+	payload, err := s.processReceive(ctx, in.Key, in.To)
 	var receiveResp chimera.ReceiveResponse
 	if err != nil {
 		log.Error(err)
@@ -72,17 +80,24 @@ func (s *Server) Receive(ctx context.Context, in *chimera.ReceiveRequest) (*chim
 	return &receiveResp, err
 }
 
-func (s *Server) processReceive(b64Key []byte, b64To string) ([]byte, error) {
+func (s *Server) processReceive(ctx context.Context, b64Key []byte, b64To string) ([]byte, error) {
+	var to []byte
+	var payload []byte
+	var err error
 	if b64To != "" {
-		to, err := base64.StdEncoding.DecodeString(b64To)
+		to, err = base64.StdEncoding.DecodeString(b64To)
 		if err != nil {
 			return nil, fmt.Errorf("unable to decode to: %s", b64Key)
 		}
 
-		return s.Enclave.Retrieve(&b64Key, &to)
+		payload, err = s.Enclave.RetrieveContext(ctx, &b64Key, &to)
 	} else {
-		return s.Enclave.RetrieveDefault(&b64Key)
+		payload, err = s.Enclave.RetrieveContext(ctx, &b64Key, nil)
 	}
+	if err == nil {
+		s.audit(ctx, api.AuditReceive, to, b64Key)
+	}
+	return payload, err
 }
 
 func (s *Server) UpdatePartyInfo(ctx context.Context, in *chimera.PartyInfo) (*chimera.PartyInfoResponse, error) {
@@ -120,7 +135,21 @@ func (s *Server) Push(ctx context.Context, in *chimera.PushPayload) (*chimera.Pa
 
 	digestHash, err := s.Enclave.StorePayloadGrpc(encyptedPayload, in.Encoded)
 	if err != nil {
-		log.Fatalf("Unable to store payload, error: %s\n", err)
+		log.Errorf("Unable to store payload, error: %s", err)
+		return nil, err
+	}
+	s.audit(ctx, api.AuditPush, in.Ep.Sender, digestHash)
+
+	hop := api.ProvenanceHop{
+		Action: api.ProvenanceReceive,
+		Sender: base64.StdEncoding.EncodeToString(in.Ep.Sender),
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		hop.From = p.Addr.String()
+	}
+	err = s.Enclave.RecordProvenance(digestHash, hop)
+	if err != nil {
+		log.Errorf("Unable to record provenance, %v", err)
 	}
 
 	return &chimera.PartyInfoResponse{Payload: digestHash}, nil
@@ -132,29 +161,39 @@ func (s *Server) Delete(ctx context.Context, in *chimera.DeleteRequest) (*chimer
 	if err != nil {
 		log.Fatalf("Unable to delete payload, error: %s\n", err)
 	}
+	s.audit(ctx, api.AuditDelete, nil, deleteReq.Key)
 	return &chimera.DeleteRequest{Key: deleteReq.Key}, nil
 }
 
 func (s *Server) Resend(ctx context.Context, in *chimera.ResendRequest) (*chimera.ResendResponse, error) {
-	var resendReq chimera.ResendRequest
-	var err error
-
-	if resendReq.Type == "all" {
-		err = s.Enclave.RetrieveAllFor(&resendReq.PublicKey)
+	if in.Type == "all" {
+		err := s.Enclave.RetrieveAllFor(&in.PublicKey)
 		if err != nil {
-			log.Fatalf("Invalid body, exited with %s", err)
+			return nil, err
 		}
-		return nil, err
-	} else if resendReq.Type == "individual" {
-		var encodedPl *[]byte
-		encodedPl, err = s.Enclave.RetrieveFor(&resendReq.Key, &resendReq.PublicKey)
+		s.audit(ctx, api.AuditResend, in.PublicKey, nil)
+		return &chimera.ResendResponse{}, nil
+	} else if in.Type == "individual" {
+		encodedPl, err := s.Enclave.RetrieveFor(&in.Key, &in.PublicKey)
 		if err != nil {
-			log.Fatalf("Invalid body, exited with %s", err)
 			return nil, err
 		}
+		s.audit(ctx, api.AuditResend, in.PublicKey, in.Key)
 		return &chimera.ResendResponse{Encoded: *encodedPl}, nil
 	}
-	return nil, err
+	return nil, fmt.Errorf("invalid resend type: %s", in.Type)
+}
+
+// audit records an operation performed for the client of ctx in the audit log, if one is
+// configured.
+func (s *Server) audit(ctx context.Context, operation string, publicKey, key []byte) {
+	remote := ""
+	if p, ok := peer.FromContext(ctx); ok {
+		remote = p.Addr.String()
+	}
+	requestId := api.RequestIdFromContext(ctx)
+	logger := log.WithField("requestId", requestId)
+	recordAudit(s.auditLog, logger, operation, remote, requestId, publicKey, key)
 }
 
 func decodeErrorGRPC(name string, value string, err error) {
@@ -1,50 +1,98 @@
 package server
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/blk-io/chimera-api/chimera"
 	"github.com/blk-io/crux/api"
+	"github.com/blk-io/crux/audit"
 	"github.com/blk-io/crux/enclave"
+	"github.com/blk-io/crux/peers"
 	"github.com/blk-io/crux/storage"
+	"github.com/blk-io/crux/utils"
+	"github.com/blk-io/crux/watchdog"
 	"github.com/kevinburke/nacl"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"path"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 const sender = "BULeR8JyUWhiuuCMU/HLA0Q5pzkYT+cHII3ZKBey3Bo="
 const receiver = "QfeDAys9MPDs2XHExtc84jKGHxZg/aj52DTh0vtA3Xc="
 
 var payload = []byte("payload")
+var privacyGroupId = base64.StdEncoding.EncodeToString([]byte("group"))
 var encodedPayload = base64.StdEncoding.EncodeToString(payload)
 
 type MockEnclave struct{}
 
-func (s *MockEnclave) Store(message *[]byte, sender []byte, recipients [][]byte) ([]byte, error) {
+// StoreContext waits for ctx to be done when storing the message "slow".
+func (s *MockEnclave) StoreContext(
+	ctx context.Context, message *[]byte, sender []byte, recipients [][]byte) ([]byte, error) {
+
+	if string(*message) == "slow" {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return *message, nil
+}
+
+// StoreNotify fails to deliver to recipients whose keys start with "fail".
+func (s *MockEnclave) StoreNotify(message *[]byte, sender []byte, recipients [][]byte,
+	delivered func(recipient []byte, err error)) ([]byte, error) {
+
+	for _, recipient := range recipients {
+		if bytes.HasPrefix(recipient, []byte("fail")) {
+			delivered(recipient, errors.New("recipient unavailable"))
+		} else {
+			delivered(recipient, nil)
+		}
+	}
 	return *message, nil
 }
 
-func (s *MockEnclave) StorePayload(encoded []byte) ([]byte, error) {
+// StoreIdempotentContext replays requests with the idempotency key "replay", and rejects those with
+// the key "reused".
+func (s *MockEnclave) StoreIdempotentContext(ctx context.Context,
+	message *[]byte, sender []byte, recipients [][]byte, idempotencyKey string) ([]byte, bool, error) {
+
+	if idempotencyKey == "reused" {
+		return nil, false, api.ErrIdempotencyKeyReused
+	}
+	return *message, idempotencyKey == "replay", nil
+}
+
+func (s *MockEnclave) StoreDecodedPayload(epl api.EncryptedPayload, encoded []byte) ([]byte, error) {
 	return encoded, nil
 }
 func (s *MockEnclave) StorePayloadGrpc(epl api.EncryptedPayload, encoded []byte) ([]byte, error) {
 	return encoded, nil
 }
 
-func (s *MockEnclave) Retrieve(digestHash *[]byte, to *[]byte) ([]byte, error) {
-	return *digestHash, nil
-}
-
-func (s *MockEnclave) RetrieveDefault(digestHash *[]byte) ([]byte, error) {
+// RetrieveContext waits for ctx to be done when retrieving the key "slow".
+func (s *MockEnclave) RetrieveContext(ctx context.Context, digestHash *[]byte, to *[]byte) ([]byte, error) {
+	if string(*digestHash) == "slow" {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
 	return *digestHash, nil
 }
 
@@ -56,11 +104,40 @@ func (s *MockEnclave) RetrieveAllFor(reqRecipient *[]byte) error {
 	return nil
 }
 
+func (s *MockEnclave) RequestResend(publicKey []byte, digestHash []byte) error {
+	return nil
+}
+
+func (s *MockEnclave) Exists(digestHash *[]byte) (bool, error) {
+	return bytes.Equal(*digestHash, payload), nil
+}
+
+func (s *MockEnclave) RecordProvenance(digestHash []byte, hop api.ProvenanceHop) error {
+	return nil
+}
+
+func (s *MockEnclave) Provenance(digestHash []byte) ([]api.ProvenanceHop, error) {
+	return []api.ProvenanceHop{{Action: api.ProvenanceSend}}, nil
+}
+
+func (s *MockEnclave) AnswerChallenge(challenge api.PartyInfoChallenge) ([]byte, error) {
+	return challenge.Box, nil
+}
+
+func (s *MockEnclave) Repush(digestHash []byte, recipient []byte, url string) error {
+	if !bytes.Equal(digestHash, payload) {
+		return errors.New("payload not found")
+	}
+	return nil
+}
+
 func (s *MockEnclave) Delete(digestHash *[]byte) error {
 	return nil
 }
 
-func (s *MockEnclave) UpdatePartyInfo(encoded []byte) {}
+func (s *MockEnclave) UpdatePartyInfo(encoded []byte) error {
+	return nil
+}
 
 func (s *MockEnclave) UpdatePartyInfoGrpc(string, map[[nacl.KeySize]byte]string, map[string]bool) {}
 
@@ -76,11 +153,271 @@ func (s *MockEnclave) GetPartyInfo() (string, map[[nacl.KeySize]byte]string, map
 	return "", nil, nil
 }
 
+func (s *MockEnclave) PeerHealth() []api.PeerHealth {
+	return nil
+}
+
+func (s *MockEnclave) PeerStatus() []api.PeerStatus {
+	return nil
+}
+
+func (s *MockEnclave) StorageStats() (api.StorageStats, error) {
+	return api.StorageStats{Entries: 2, Bytes: 64}, nil
+}
+
+func (s *MockEnclave) Compact() error {
+	return nil
+}
+
+func (s *MockEnclave) Purge(before time.Time) (api.PurgeResponse, error) {
+	return api.PurgeResponse{Purged: 1, UnknownAge: 1}, nil
+}
+
+func (s *MockEnclave) Export(w io.Writer) (map[string]int, error) {
+	_, err := w.Write(payload)
+	return map[string]int{"payloads": 1}, err
+}
+
+// Import only accepts exports written by Export.
+func (s *MockEnclave) Import(r io.Reader) (map[string]int, error) {
+	exported, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(exported, payload) {
+		return map[string]int{}, errors.New("invalid export")
+	}
+	return map[string]int{"payloads": 1}, nil
+}
+
+// RotateKey fails unless rotating from the sender to the receiver key.
+func (s *MockEnclave) RotateKey(oldPubKey, newPubKey []byte) (api.RotateKeyResponse, error) {
+	if base64.StdEncoding.EncodeToString(oldPubKey) != sender ||
+		base64.StdEncoding.EncodeToString(newPubKey) != receiver {
+		return api.RotateKeyResponse{}, errors.New("unknown key")
+	}
+	return api.RotateKeyResponse{Reencrypted: 2, Unchanged: 1}, nil
+}
+
+// CreatePrivacyGroup creates the group with ID privacyGroupId, of the sender and members.
+func (s *MockEnclave) CreatePrivacyGroup(
+	from []byte, members [][]byte, name, description string) (api.PrivacyGroup, error) {
+
+	group := api.PrivacyGroup{
+		PrivacyGroupId: privacyGroupId, Name: name, Description: description, Members: []string{sender}}
+	for _, member := range members {
+		group.Members = append(group.Members, base64.StdEncoding.EncodeToString(member))
+	}
+	return group, nil
+}
+
+func (s *MockEnclave) FindPrivacyGroups(members [][]byte) ([]api.PrivacyGroup, error) {
+	return []api.PrivacyGroup{{PrivacyGroupId: privacyGroupId, Members: []string{sender, receiver}}}, nil
+}
+
+func (s *MockEnclave) DeletePrivacyGroup(id, from []byte) error {
+	_, err := s.PrivacyGroupRecipients(id, from)
+	return err
+}
+
+// PrivacyGroupRecipients resolves the receiver for the group privacyGroupId, all other groups
+// do not exist.
+func (s *MockEnclave) PrivacyGroupRecipients(id, sender []byte) ([][]byte, error) {
+	if base64.StdEncoding.EncodeToString(id) != privacyGroupId {
+		return nil, api.ErrPrivacyGroupNotFound
+	}
+	key, _ := base64.StdEncoding.DecodeString(receiver)
+	return [][]byte{key}, nil
+}
+
+func (s *MockEnclave) RecordPrivacyGroup(digestHash, id []byte) error {
+	return nil
+}
+
+func (s *MockEnclave) PayloadPrivacyGroup(digestHash []byte) ([]byte, error) {
+	return nil, nil
+}
+
+// ListPayloads lists the keys 1 to 5, for the sender key only.
+func (s *MockEnclave) ListPayloads(role string, publicKey, after []byte, limit int) ([][]byte, error) {
+	keys := [][]byte{}
+	if role != api.PartySender || base64.StdEncoding.EncodeToString(publicKey) != sender {
+		return keys, nil
+	}
+	for i := byte(1); i <= 5 && (limit <= 0 || len(keys) < limit); i++ {
+		if after == nil || i > after[0] {
+			keys = append(keys, []byte{i})
+		}
+	}
+	return keys, nil
+}
+
+// Usage reports a single payload for each key, or for the sender and receiver keys if none are
+// provided.
+func (s *MockEnclave) Usage(publicKeys [][]byte) []api.KeyUsage {
+	usage := []api.KeyUsage{}
+	if len(publicKeys) == 0 {
+		return append(usage, api.KeyUsage{PublicKey: sender, Payloads: 1},
+			api.KeyUsage{PublicKey: receiver, Payloads: 1})
+	}
+	for _, key := range publicKeys {
+		usage = append(usage,
+			api.KeyUsage{PublicKey: base64.StdEncoding.EncodeToString(key), Payloads: 1})
+	}
+	return usage
+}
+
 func TestUpcheck(t *testing.T) {
 	tm := TransactionManager{}
 	runSimpleGetRequest(t, upCheck, upCheckResponse, tm.upcheck)
 }
 
+func TestUpcheckJson(t *testing.T) {
+	req, err := http.NewRequest("GET", upCheck, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	rr := httptest.NewRecorder()
+	tm := TransactionManager{Enclave: &MockEnclave{}}
+	http.HandlerFunc(tm.upcheck).ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v\n",
+			status, http.StatusOK)
+	}
+
+	var response api.UpCheckResponse
+	err = json.NewDecoder(rr.Body).Decode(&response)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := api.UpCheckResponse{Status: "up", Version: apiVersion, Storage: "ok"}
+	if !reflect.DeepEqual(response, expected) {
+		t.Errorf("handler returned unexpected response: got %v wanted %v\n",
+			response, expected)
+	}
+}
+
+func TestUpcheckWatchdog(t *testing.T) {
+	monitor := watchdog.New(nil)
+	monitor.Go("stuck", time.Millisecond, func(stop <-chan struct{}, heartbeat func()) {
+		<-stop
+	})
+	time.Sleep(5 * time.Millisecond)
+
+	req, err := http.NewRequest("GET", upCheck+"?format=json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	tm := TransactionManager{Enclave: &MockEnclave{}, watchdog: monitor}
+	http.HandlerFunc(tm.upcheck).ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusServiceUnavailable {
+		t.Errorf("handler returned wrong status code: got %v want %v\n",
+			status, http.StatusServiceUnavailable)
+	}
+
+	var response api.UpCheckResponse
+	err = json.NewDecoder(rr.Body).Decode(&response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Status != "degraded" || len(response.Subsystems) != 1 ||
+		response.Subsystems[0].Name != "stuck" || response.Subsystems[0].Healthy {
+		t.Errorf("handler returned unexpected response: %v\n", response)
+	}
+}
+
+func TestTransaction(t *testing.T) {
+	tm := TransactionManager{Enclave: &MockEnclave{}}
+	missing := base64.StdEncoding.EncodeToString([]byte("missing"))
+
+	requests := []struct {
+		method string
+		key    string
+		status int
+	}{
+		{"HEAD", encodedPayload, http.StatusOK},
+		{"GET", encodedPayload, http.StatusOK},
+		{"GET", missing, http.StatusNotFound},
+		{"GET", "not base64!", http.StatusBadRequest},
+		{"POST", encodedPayload, http.StatusMethodNotAllowed},
+	}
+
+	for _, r := range requests {
+		req, err := http.NewRequest(r.method, transaction+r.key, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(tm.transaction).ServeHTTP(rr, req)
+
+		if status := rr.Code; status != r.status {
+			t.Errorf("%s %s returned wrong status code: got %v want %v\n",
+				r.method, r.key, status, r.status)
+		}
+	}
+}
+
+func TestProvenance(t *testing.T) {
+	req, err := http.NewRequest("GET", provenance+encodedPayload, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	tm := TransactionManager{Enclave: &MockEnclave{}}
+	http.HandlerFunc(tm.provenance).ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v\n",
+			status, http.StatusOK)
+	}
+
+	var hops []api.ProvenanceHop
+	err = json.NewDecoder(rr.Body).Decode(&hops)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hops) != 1 || hops[0].Action != api.ProvenanceSend {
+		t.Errorf("handler returned unexpected provenance: %v", hops)
+	}
+}
+
+func TestRepush(t *testing.T) {
+	tm := TransactionManager{Enclave: &MockEnclave{}}
+
+	requests := map[string]int{
+		encodedPayload: http.StatusOK,
+		base64.StdEncoding.EncodeToString([]byte("missing")): http.StatusInternalServerError,
+		"not base64!": http.StatusBadRequest,
+	}
+
+	for key, expected := range requests {
+		encoded, err := json.Marshal(api.RepushRequest{Key: key, To: receiver})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest("POST", repush, bytes.NewReader(encoded))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(tm.repush).ServeHTTP(rr, req)
+
+		if status := rr.Code; status != expected {
+			t.Errorf("handler returned wrong status code for key %s: got %v want %v\n",
+				key, status, expected)
+		}
+	}
+}
+
 func TestVersion(t *testing.T) {
 	tm := TransactionManager{}
 	runSimpleGetRequest(t, version, apiVersion, tm.version)
@@ -134,6 +471,76 @@ func TestSend(t *testing.T) {
 	}
 }
 
+func TestSendAsync(t *testing.T) {
+	failing := base64.StdEncoding.EncodeToString(append([]byte("fail"), make([]byte, 28)...))
+	tm := TransactionManager{Enclave: &MockEnclave{}, sends: newSendTracker()}
+
+	sendReq := api.SendRequest{Payload: encodedPayload, To: []string{receiver, failing}}
+	encoded, err := json.Marshal(sendReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	tm.sendAsync(rr, httptest.NewRequest("POST", sendAsync, bytes.NewReader(encoded)))
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusAccepted, rr.Code, rr.Body)
+	}
+	var sendResp api.SendAsyncResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &sendResp); err != nil {
+		t.Fatal(err)
+	}
+	if location := rr.Header().Get("Location"); location != sendStatus+sendResp.Id {
+		t.Errorf("Expected location %s, got %s", sendStatus+sendResp.Id, location)
+	}
+
+	var status api.SendStatus
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		rr = httptest.NewRecorder()
+		tm.sendStatus(rr, httptest.NewRequest("GET", sendStatus+sendResp.Id, nil))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, rr.Code, rr.Body)
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &status); err != nil {
+			t.Fatal(err)
+		}
+		if status.State != api.SendPending || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	expected := api.SendStatus{
+		Id:    sendResp.Id,
+		State: api.SendComplete,
+		Key:   encodedPayload,
+		Recipients: []api.RecipientStatus{
+			{PublicKey: receiver, State: api.SendDelivered},
+			{PublicKey: failing, State: api.SendFailed, Error: "recipient unavailable"},
+		},
+	}
+	if !reflect.DeepEqual(status, expected) {
+		t.Errorf("Expected status %+v, got %+v", expected, status)
+	}
+
+	rr = httptest.NewRecorder()
+	tm.sendStatus(rr, httptest.NewRequest("GET", sendStatus+"unknown", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d for an unknown send, got %d", http.StatusNotFound, rr.Code)
+	}
+
+	// Asynchronous sends cannot be replayed, so idempotency keys are rejected
+	sendReq.IdempotencyKey = "key"
+	encoded, err = json.Marshal(sendReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	tm.sendAsync(rr, httptest.NewRequest("POST", sendAsync, bytes.NewReader(encoded)))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d with an idempotency key, got %d", http.StatusBadRequest, rr.Code)
+	}
+}
+
 func TestGRPCSend(t *testing.T) {
 	sendReqs := []chimera.SendRequest{
 		{
@@ -510,7 +917,9 @@ func testRunPartyInfo(t *testing.T, pi api.PartyInfo) {
 
 func InitgRPCServer(t *testing.T, grpc bool, port int) string {
 	ipcPath, err := ioutil.TempDir("", "TestInitIpc")
-	tm, err := Init(&MockEnclave{}, port, ipcPath, grpc, -1, false, "", "")
+	tm, err := Init(&MockEnclave{}, ServerConfig{
+		Port: port, IpcPath: ipcPath, Grpc: grpc, GrpcJsonPort: -1,
+	})
 
 	if err != nil {
 		t.Errorf("Error starting server: %v\n", err)
@@ -554,9 +963,1509 @@ func TestInit(t *testing.T) {
 		t.Error(err)
 	}
 	certFile, keyFile := "../enclave/testdata/cert/server.crt", "../enclave/testdata/cert/server.key"
-	tm, err := Init(enc, 9001, ipcPath, false, -1, true, certFile, keyFile)
+	tm, err := Init(enc, ServerConfig{
+		Port: 9001, IpcPath: ipcPath, GrpcJsonPort: -1, Tls: true, CertFile: certFile, KeyFile: keyFile,
+	})
 	if err != nil {
 		t.Errorf("Error starting server: %v\n", err)
 	}
 	runSimpleGetRequest(t, upCheck, upCheckResponse, tm.upcheck)
 }
+
+func TestRequestId(t *testing.T) {
+	tm := TransactionManager{}
+	handler := requestId(http.HandlerFunc(tm.upcheck))
+
+	traceId := "4bf92f3577b34da6a3ce929d0e0e4736"
+	requests := map[string][2]string{
+		"client-id": {HRequestId, "client-id"},
+		traceId:     {hTraceParent, "00-" + traceId + "-00f067aa0ba902b7-01"},
+		"":          {HRequestId, "invalid id\n"},
+	}
+
+	for expected, header := range requests {
+		req, err := http.NewRequest("GET", upCheck, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(header[0], header[1])
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		id := rr.Header().Get(HRequestId)
+		if expected != "" {
+			if id != expected {
+				t.Errorf("Request id %s returned, expected %s", id, expected)
+			}
+		} else if id == "" || id == header[1] {
+			t.Errorf("Request id %q should have been generated", id)
+		}
+	}
+}
+
+func TestPushRequestId(t *testing.T) {
+	epl := api.EncryptedPayload{
+		Sender:         nacl.NewKey(),
+		CipherText:     []byte(payload),
+		Nonce:          nacl.NewNonce(),
+		RecipientBoxes: [][]byte{[]byte(payload)},
+		RecipientNonce: nacl.NewNonce(),
+	}
+	encoded := api.EncodePayloadWithRecipients(epl, [][]byte{})
+	tm := TransactionManager{Enclave: &MockEnclave{}}
+
+	var received string
+	server := httptest.NewServer(requestId(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			received = RequestId(r)
+			tm.push(w, r)
+		})))
+	defer server.Close()
+
+	ctx := api.WithRequestId(context.Background(), "client-id")
+	_, err := api.PushContext(ctx, encoded, server.URL, http.DefaultClient, utils.CompressionNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received != "client-id" {
+		t.Errorf("Push was received with request id %q, expected client-id", received)
+	}
+}
+
+func TestRequestLogger(t *testing.T) {
+	level := log.GetLevel()
+	defer log.SetLevel(level)
+	log.SetLevel(log.DebugLevel)
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	var received []byte
+	handler := requestLogger(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received, _ = ioutil.ReadAll(r.Body)
+	}))
+
+	body := bytes.Repeat([]byte("a"), 10*maxLoggedBody)
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", push, bytes.NewReader(body)))
+
+	if !bytes.Equal(received, body) {
+		t.Errorf("Handler received %d bytes of the body, expected %d", len(received), len(body))
+	}
+	if logged.Len() > 2*maxLoggedBody {
+		t.Errorf("Logged %d bytes, expected the body to be truncated to %d", logged.Len(), maxLoggedBody)
+	}
+}
+
+// trackedBody records how much of a request body was read, and how many times it was closed.
+type trackedBody struct {
+	io.Reader
+	closed int
+}
+
+func (b *trackedBody) Close() error {
+	b.closed++
+	return nil
+}
+
+func TestMiddleware(t *testing.T) {
+	var order []string
+	middleware := func(name string) Middleware {
+		return func(handler http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				order = append(order, name)
+				handler.ServeHTTP(w, r)
+			})
+		}
+	}
+	// The handler reads only part of the body
+	handler := closeBody(Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		order = append(order, "handler")
+		r.Body.Read(make([]byte, 4))
+	}), middleware("first"), middleware("second")))
+
+	body := &trackedBody{Reader: strings.NewReader("unread request body")}
+	req, err := http.NewRequest("POST", push, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Body = body
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if !reflect.DeepEqual(order, []string{"first", "second", "handler"}) {
+		t.Errorf("Middleware applied in the wrong order: %v", order)
+	}
+	if n, _ := body.Read(make([]byte, 1)); n != 0 || body.closed != 1 {
+		t.Errorf("Request body should be drained and closed once, closed %d times", body.closed)
+	}
+}
+
+func TestLimitRequestSize(t *testing.T) {
+	echo := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	})
+	handler := limitRequestSize(int64(len(payload)), echo)
+
+	requests := map[int][]byte{
+		http.StatusOK:                    payload,
+		http.StatusRequestEntityTooLarge: append(payload, payload...),
+	}
+
+	for expected, body := range requests {
+		req, err := http.NewRequest("POST", push, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Chunked requests do not provide a content length
+		req.ContentLength = -1
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != expected {
+			t.Errorf("handler returned wrong status code: got %v want %v\n", status, expected)
+		}
+		if expected == http.StatusOK && !bytes.Equal(rr.Body.Bytes(), payload) {
+			t.Errorf("handler returned unexpected body: got %v wanted %v\n",
+				rr.Body.Bytes(), payload)
+		}
+	}
+}
+
+func TestLimitRate(t *testing.T) {
+	limiter := newRateLimiter(1, 2)
+	now := time.Now()
+
+	for i, expected := range []bool{true, true, false} {
+		if limiter.allow("10.0.0.1", now) != expected {
+			t.Errorf("Request %d allowed should be %v", i, expected)
+		}
+	}
+
+	if !limiter.allow("10.0.0.2", now) {
+		t.Error("Clients should be limited independently")
+	}
+
+	if !limiter.allow("10.0.0.1", now.Add(time.Second)) {
+		t.Error("Request should be allowed once the bucket has refilled")
+	}
+
+	tm := TransactionManager{}
+	handler := limitRate(1, 1, http.HandlerFunc(tm.upcheck))
+	for i, expected := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		req, err := http.NewRequest("GET", upCheck, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.RemoteAddr = "10.0.0.1:1234"
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != expected {
+			t.Errorf("Request %d returned wrong status code: got %v want %v\n", i, status, expected)
+		}
+	}
+}
+
+func TestLimitConcurrency(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	handler := limitConcurrency(1, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}))
+
+	go func() {
+		req, _ := http.NewRequest("GET", upCheck, nil)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}()
+	<-started
+
+	req, err := http.NewRequest("GET", upCheck, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	close(release)
+
+	if status := rr.Code; status != http.StatusTooManyRequests {
+		t.Errorf("handler returned wrong status code: got %v want %v\n",
+			status, http.StatusTooManyRequests)
+	}
+}
+
+func TestIpcToken(t *testing.T) {
+	tm := TransactionManager{Enclave: &MockEnclave{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc(upCheck, tm.upcheck)
+	mux.HandleFunc(healthz, tm.healthz)
+	mux.HandleFunc(delete, tm.delete)
+	handler := authenticateIpc("secret", mux)
+
+	var tests = []struct {
+		method         string
+		path           string
+		token          string
+		expectedStatus int
+	}{
+		{"GET", upCheck, "", http.StatusOK},
+		{"GET", healthz, "", http.StatusOK},
+		{"POST", delete, "", http.StatusUnauthorized},
+		{"POST", delete, "wrong", http.StatusUnauthorized},
+		{"POST", delete, "secret", http.StatusOK},
+	}
+
+	for _, test := range tests {
+		body := strings.NewReader(`{"key": "` + base64.StdEncoding.EncodeToString(payload) + `"}`)
+		req, err := http.NewRequest(test.method, test.path, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.token != "" {
+			req.Header.Set(hAuthorization, "Bearer "+test.token)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != test.expectedStatus {
+			t.Errorf("%s %s with token %q returned wrong status code: got %v want %v",
+				test.method, test.path, test.token, status, test.expectedStatus)
+		}
+	}
+
+	if authenticateIpc("", mux) != mux {
+		t.Error("Requests should not be authenticated without a token")
+	}
+}
+
+func TestTokenInterceptor(t *testing.T) {
+	interceptor := tokenInterceptor("secret", requestIdInterceptor)
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return req, nil
+	}
+
+	var tests = []struct {
+		method       string
+		token        string
+		expectedCode codes.Code
+	}{
+		{"/chimera.Client/Upcheck", "", codes.OK},
+		{"/chimera.Client/Send", "", codes.Unauthenticated},
+		{"/chimera.Client/Send", "wrong", codes.Unauthenticated},
+		{"/chimera.Client/Send", "secret", codes.OK},
+	}
+
+	for _, test := range tests {
+		ctx := context.Background()
+		if test.token != "" {
+			ctx = metadata.NewIncomingContext(ctx, metadata.Pairs("authorization", "Bearer "+test.token))
+		}
+		_, err := interceptor(ctx, nil, &grpc.UnaryServerInfo{FullMethod: test.method}, handler)
+		if code := status.Code(err); code != test.expectedCode {
+			t.Errorf("%s with token %q returned wrong code: got %v want %v",
+				test.method, test.token, code, test.expectedCode)
+		}
+	}
+}
+
+func TestCors(t *testing.T) {
+	tm := TransactionManager{}
+	handler := cors([]string{"https://app.example.com"}, http.HandlerFunc(tm.upcheck))
+
+	var tests = []struct {
+		method         string
+		origin         string
+		expectedStatus int
+		expectedOrigin string
+	}{
+		{"GET", "https://app.example.com", http.StatusOK, "https://app.example.com"},
+		{"OPTIONS", "https://app.example.com", http.StatusNoContent, "https://app.example.com"},
+		{"GET", "https://other.example.com", http.StatusOK, ""},
+		{"GET", "", http.StatusOK, ""},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest(test.method, upCheck, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.origin != "" {
+			req.Header.Set(hOrigin, test.origin)
+		}
+		if test.method == http.MethodOptions {
+			req.Header.Set("Access-Control-Request-Method", "POST")
+		}
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != test.expectedStatus {
+			t.Errorf("%s from %q returned wrong status code: got %v want %v",
+				test.method, test.origin, status, test.expectedStatus)
+		}
+		if origin := rr.Header().Get("Access-Control-Allow-Origin"); origin != test.expectedOrigin {
+			t.Errorf("%s from %q returned wrong allowed origin: got %q want %q",
+				test.method, test.origin, origin, test.expectedOrigin)
+		}
+	}
+}
+
+func TestForwarded(t *testing.T) {
+	var remoteAddr, scheme string
+	handler := forwarded([]string{"10.0.0.1", "192.168.0.0/16"},
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			remoteAddr, scheme = r.RemoteAddr, r.URL.Scheme
+		}))
+
+	var tests = []struct {
+		remoteAddr         string
+		forwardedFor       string
+		expectedRemoteAddr string
+	}{
+		{"10.0.0.1:1234", "203.0.113.7", "203.0.113.7:1234"},
+		{"10.0.0.1:1234", "1.2.3.4, 203.0.113.7, 192.168.1.1", "203.0.113.7:1234"},
+		{"10.0.0.1:1234", "not-an-ip", "10.0.0.1:1234"},
+		{"203.0.113.9:1234", "1.2.3.4", "203.0.113.9:1234"},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest("GET", upCheck, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.RemoteAddr = test.remoteAddr
+		req.Header.Set(hForwardedFor, test.forwardedFor)
+		req.Header.Set(hForwardedProto, "https")
+
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		if remoteAddr != test.expectedRemoteAddr {
+			t.Errorf("Request from %s forwarded for %q has wrong remote address: got %s want %s",
+				test.remoteAddr, test.forwardedFor, remoteAddr, test.expectedRemoteAddr)
+		}
+		trusted := test.remoteAddr == "10.0.0.1:1234"
+		if (scheme == "https") != trusted {
+			t.Errorf("Request from %s has wrong scheme: %q", test.remoteAddr, scheme)
+		}
+	}
+}
+
+func TestIpFilter(t *testing.T) {
+	tm := TransactionManager{}
+	ips, err := newIpFilter([]string{"10.0.0.0/8", "2001:db8::/32"}, []string{"10.1.0.0/16", "10.2.3.4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := ips.filter(tm.upcheck)
+
+	var tests = []struct {
+		remoteAddr     string
+		expectedStatus int
+	}{
+		{"10.0.0.1:1234", http.StatusOK},
+		{"[2001:db8::1]:1234", http.StatusOK},
+		{"10.1.2.3:1234", http.StatusForbidden},
+		{"10.2.3.4:1234", http.StatusForbidden},
+		{"10.2.3.5:1234", http.StatusOK},
+		{"203.0.113.7:1234", http.StatusForbidden},
+		{"not-an-ip", http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest("GET", upCheck, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.RemoteAddr = test.remoteAddr
+
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+
+		if status := rr.Code; status != test.expectedStatus {
+			t.Errorf("Request from %s returned wrong status code: got %v want %v",
+				test.remoteAddr, status, test.expectedStatus)
+		}
+	}
+
+	deny, err := newIpFilter(nil, []string{"203.0.113.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !deny.permits("10.0.0.1") || deny.permits("203.0.113.7") {
+		t.Error("Clients should be permitted unless denied when no networks are allowed")
+	}
+
+	if ips, err = newIpFilter([]string{" "}, nil); ips != nil || err != nil {
+		t.Errorf("Filter should be disabled without networks, got %v, error: %v", ips, err)
+	}
+	if _, err = newIpFilter([]string{"10.0.0.0/33"}, nil); err == nil {
+		t.Error("Invalid CIDR ranges should be rejected")
+	}
+	if _, err = newIpFilter(nil, []string{"not-an-ip"}); err == nil {
+		t.Error("Invalid IP addresses should be rejected")
+	}
+}
+
+func TestPathPrefix(t *testing.T) {
+	tm := TransactionManager{}
+	mux := http.NewServeMux()
+	mux.HandleFunc(upCheck, tm.upcheck)
+	handler := stripPathPrefix("/crux/", mux)
+
+	for path, expected := range map[string]int{
+		"/crux" + upCheck: http.StatusOK,
+		upCheck:           http.StatusNotFound,
+	} {
+		req, err := http.NewRequest("GET", path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != expected {
+			t.Errorf("Request to %s returned wrong status code: got %v want %v", path, status, expected)
+		}
+	}
+}
+
+func TestOperationTimeout(t *testing.T) {
+	tm := TransactionManager{
+		Enclave:         &MockEnclave{},
+		storeTimeout:    10 * time.Millisecond,
+		retrieveTimeout: 10 * time.Millisecond,
+	}
+	slow := base64.StdEncoding.EncodeToString([]byte("slow"))
+
+	sendReq, _ := json.Marshal(api.SendRequest{Payload: slow})
+	receiveReq, _ := json.Marshal(api.ReceiveRequest{Key: slow})
+	rawReceive := httptest.NewRequest("GET", receiveRaw, nil)
+	rawReceive.Header.Set(hKey, slow)
+
+	var tests = []struct {
+		name    string
+		req     *http.Request
+		handler http.HandlerFunc
+	}{
+		{send, httptest.NewRequest("POST", send, bytes.NewReader(sendReq)), tm.send},
+		{sendRaw, httptest.NewRequest("POST", sendRaw, strings.NewReader("slow")), tm.sendRaw},
+		{receive, httptest.NewRequest("POST", receive, bytes.NewReader(receiveReq)), tm.receive},
+		{receiveRaw, rawReceive, tm.receiveRaw},
+	}
+
+	for _, test := range tests {
+		rr := httptest.NewRecorder()
+		test.handler(rr, test.req)
+		if rr.Code != http.StatusServiceUnavailable {
+			t.Errorf("%s returned status %d, expected %d", test.name, rr.Code, http.StatusServiceUnavailable)
+		}
+	}
+
+	// Operations are abandoned once the client disconnects
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest("POST", sendRaw, strings.NewReader("slow")).WithContext(ctx)
+	tm.storeTimeout = 0
+	done := make(chan struct{})
+	go func() {
+		tm.sendRaw(httptest.NewRecorder(), req)
+		close(done)
+	}()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("Send was not abandoned when its request was cancelled")
+	}
+}
+
+func TestSendIdempotent(t *testing.T) {
+	tm := TransactionManager{Enclave: &MockEnclave{}}
+
+	var tests = []struct {
+		idempotencyKey   string
+		inBody           bool // Provide the key in the SendRequest, rather than the header
+		expectedStatus   int
+		expectedReplayed string
+	}{
+		{"", false, http.StatusOK, ""},
+		{"new", false, http.StatusOK, "false"},
+		{"replay", false, http.StatusOK, "true"},
+		{"reused", false, http.StatusUnprocessableEntity, ""},
+		{"new", true, http.StatusOK, "false"},
+		{"replay", true, http.StatusOK, "true"},
+		{"reused", true, http.StatusUnprocessableEntity, ""},
+	}
+
+	for _, test := range tests {
+		for _, endpoint := range []string{send, sendRaw} {
+			if test.inBody && endpoint == sendRaw {
+				continue
+			}
+			body := []byte(payload)
+			if endpoint == send {
+				sendReq := api.SendRequest{Payload: encodedPayload}
+				if test.inBody {
+					sendReq.IdempotencyKey = test.idempotencyKey
+				}
+				body, _ = json.Marshal(sendReq)
+			}
+			req, err := http.NewRequest("POST", endpoint, bytes.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.idempotencyKey != "" && !test.inBody {
+				req.Header.Set(hIdempotencyKey, test.idempotencyKey)
+			}
+
+			rr := httptest.NewRecorder()
+			handler := http.HandlerFunc(tm.send)
+			if endpoint == sendRaw {
+				handler = tm.sendRaw
+			}
+			handler.ServeHTTP(rr, req)
+
+			if status := rr.Code; status != test.expectedStatus {
+				t.Errorf("%s with key %q returned wrong status code: got %v want %v",
+					endpoint, test.idempotencyKey, status, test.expectedStatus)
+			}
+			if replayed := rr.Header().Get(hIdempotencyReplayed); replayed != test.expectedReplayed {
+				t.Errorf("%s with key %q returned wrong %s header: got %q want %q", endpoint,
+					test.idempotencyKey, hIdempotencyReplayed, replayed, test.expectedReplayed)
+			}
+			if test.expectedStatus == http.StatusOK && rr.Header().Get(hOperationId) != encodedPayload {
+				t.Errorf("%s with key %q returned wrong %s header: %q", endpoint,
+					test.idempotencyKey, hOperationId, rr.Header().Get(hOperationId))
+			}
+		}
+	}
+}
+
+// peersEnclave reports a node hosting a single key, with one peer hosting another.
+type peersEnclave struct {
+	MockEnclave
+}
+
+// PeerHealth reports the peer as unhealthy.
+func (s *peersEnclave) PeerHealth() []api.PeerHealth {
+	return []api.PeerHealth{{
+		Url:      "http://localhost:9002/",
+		Latency:  20 * time.Millisecond,
+		Failures: api.UnhealthyFailures,
+		Requests: 8,
+		Failed:   6,
+	}}
+}
+
+// PeerStatus reports the peer as down.
+func (s *peersEnclave) PeerStatus() []api.PeerStatus {
+	return []api.PeerStatus{{
+		Url:        "http://localhost:9002/",
+		PublicKeys: []string{receiver},
+		Latency:    20 * time.Millisecond,
+	}}
+}
+
+func (s *peersEnclave) GetPartyInfo() (string, map[[nacl.KeySize]byte]string, map[string]bool) {
+	var senderKey, receiverKey [nacl.KeySize]byte
+	decoded, _ := base64.StdEncoding.DecodeString(sender)
+	copy(senderKey[:], decoded)
+	decoded, _ = base64.StdEncoding.DecodeString(receiver)
+	copy(receiverKey[:], decoded)
+
+	recipients := map[[nacl.KeySize]byte]string{
+		senderKey:   "http://localhost:9001/",
+		receiverKey: "http://localhost:9002/",
+	}
+	parties := map[string]bool{"http://localhost:9001/": true, "http://localhost:9002/": true}
+	return "http://localhost:9001/", recipients, parties
+}
+
+func TestAdmin(t *testing.T) {
+	tm := TransactionManager{Enclave: &peersEnclave{}}
+	reloads := 0
+	handler := tm.adminHandler("secret", func() error {
+		reloads++
+		return nil
+	})
+
+	var tests = []struct {
+		method         string
+		path           string
+		token          string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{"GET", adminKeys, "", http.StatusUnauthorized, ""},
+		{"GET", adminKeys, "wrong", http.StatusUnauthorized, ""},
+		{"GET", adminKeys, "secret", http.StatusOK, `["` + sender + `"]`},
+		{"GET", adminPeers, "secret", http.StatusOK,
+			`[{"url":"http://localhost:9001/","publicKeys":["` + sender + `"]},` +
+				`{"url":"http://localhost:9002/","publicKeys":["` + receiver + `"]}]`},
+		{"GET", adminStorage, "secret", http.StatusOK, `{"entries":2,"bytes":64}`},
+		{"GET", adminCompact, "secret", http.StatusMethodNotAllowed, ""},
+		{"POST", adminCompact, "secret", http.StatusOK, ""},
+		{"POST", adminPurge + "?days=30", "secret", http.StatusOK, `{"purged":1,"unknownAge":1}`},
+		{"POST", adminPurge + "?days=-1", "secret", http.StatusBadRequest, ""},
+		{"POST", adminPurge, "secret", http.StatusBadRequest, ""},
+		{"GET", adminReload, "secret", http.StatusMethodNotAllowed, ""},
+		{"POST", adminReload, "", http.StatusUnauthorized, ""},
+		{"POST", adminReload, "secret", http.StatusOK, ""},
+		{"GET", usage, "secret", http.StatusOK, `[` + usageJson(sender) + `,` + usageJson(receiver) + `]`},
+		{"GET", adminExport, "secret", http.StatusOK, string(payload)},
+		{"GET", adminImport, "secret", http.StatusMethodNotAllowed, ""},
+		{"GET", adminAudit, "secret", http.StatusNotFound, ""},
+		{"GET", adminHealth, "secret", http.StatusOK,
+			`[{"url":"http://localhost:9002/","healthy":false,"latency":20000000,"failures":5,` +
+				`"lastSeen":"0001-01-01T00:00:00Z","requests":8,"failed":6}]`},
+		{"GET", adminStatus, "secret", http.StatusOK,
+			`[{"url":"http://localhost:9002/","publicKeys":["` + receiver + `"],"up":false,"latency":20000000}]`},
+		{"POST", adminStatus, "secret", http.StatusMethodNotAllowed, ""},
+		{"POST", adminMetrics, "secret", http.StatusMethodNotAllowed, ""},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest(test.method, test.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.token != "" {
+			req.Header.Set(hAuthorization, "Bearer "+test.token)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != test.expectedStatus {
+			t.Errorf("%s %s returned wrong status code: got %v want %v",
+				test.method, test.path, status, test.expectedStatus)
+		}
+		if test.expectedBody != "" && strings.TrimSpace(rr.Body.String()) != test.expectedBody {
+			t.Errorf("%s %s returned unexpected body: got %s want %s",
+				test.method, test.path, rr.Body.String(), test.expectedBody)
+		}
+	}
+
+	if reloads != 1 {
+		t.Errorf("Expected a single reload, got %d", reloads)
+	}
+
+	for _, test := range []struct {
+		body           []byte
+		expectedStatus int
+		expectedBody   string
+	}{
+		{payload, http.StatusOK, `{"entries":{"payloads":1}}`},
+		{[]byte("invalid"), http.StatusBadRequest, ""},
+	} {
+		req, err := http.NewRequest("POST", adminImport, bytes.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(hAuthorization, "Bearer secret")
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != test.expectedStatus {
+			t.Errorf("Importing %s returned wrong status code: got %v want %v",
+				test.body, rr.Code, test.expectedStatus)
+		}
+		if test.expectedBody != "" && strings.TrimSpace(rr.Body.String()) != test.expectedBody {
+			t.Errorf("Importing %s returned unexpected body: got %s want %s",
+				test.body, rr.Body.String(), test.expectedBody)
+		}
+	}
+}
+
+func TestAudit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestAudit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	auditLog, err := audit.Open(path.Join(dir, "crux.audit"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auditLog.Close()
+	tm := TransactionManager{Enclave: &MockEnclave{}, auditLog: auditLog}
+
+	var sendResp api.SendResponse
+	runJsonHandlerTest(t, &api.SendRequest{Payload: encodedPayload, From: sender, To: []string{receiver}},
+		&sendResp, &api.SendResponse{Key: encodedPayload}, send, tm.send)
+	var receiveResp api.ReceiveResponse
+	runJsonHandlerTest(t, &api.ReceiveRequest{Key: encodedPayload, To: receiver},
+		&receiveResp, &api.ReceiveResponse{Payload: encodedPayload}, receive, tm.receive)
+	var deleteResp interface{}
+	runJsonHandlerTest(t, &api.DeleteRequest{Key: encodedPayload},
+		&deleteResp, &deleteResp, delete, tm.delete)
+
+	handler := tm.adminHandler("secret", nil)
+	var tests = []struct {
+		query      string
+		operations []string
+	}{
+		{"", []string{api.AuditSend, api.AuditReceive, api.AuditDelete}},
+		{"?publicKey=" + receiver, []string{api.AuditReceive}},
+		{"?key=" + encodedPayload + "&limit=2", []string{api.AuditReceive, api.AuditDelete}},
+		{"?operation=send&until=2000-01-01T00:00:00Z", []string{}},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", adminAudit+strings.Replace(test.query, "+", "%2B", -1), nil)
+		req.Header.Set(hAuthorization, "Bearer secret")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		var entries []api.AuditEntry
+		if err := json.NewDecoder(rr.Body).Decode(&entries); err != nil || rr.Code != http.StatusOK {
+			t.Fatalf("Query %s returned status %d, error: %v", test.query, rr.Code, err)
+		}
+		operations := []string{}
+		for _, entry := range entries {
+			if entry.Key != encodedPayload || entry.Time.IsZero() {
+				t.Errorf("Unexpected audit log entry %+v", entry)
+			}
+			operations = append(operations, entry.Operation)
+		}
+		if !reflect.DeepEqual(operations, test.operations) {
+			t.Errorf("Query %s returned operations %v, expected %v", test.query, operations, test.operations)
+		}
+	}
+
+	req := httptest.NewRequest("GET", receive, nil)
+	tm.audit(req.WithContext(api.WithRequestId(req.Context(), "client-id")), api.AuditReceive, nil, nil)
+	entries, err := auditLog.Query(audit.Filter{Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].RequestId != "client-id" {
+		t.Errorf("Expected the request id to be recorded, got %+v", entries)
+	}
+
+	req = httptest.NewRequest("GET", adminAudit+"?since=yesterday", nil)
+	req.Header.Set(hAuthorization, "Bearer secret")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected an invalid time to be rejected, got status %d", rr.Code)
+	}
+}
+
+func TestAdminMetrics(t *testing.T) {
+	tm := TransactionManager{Enclave: &peersEnclave{}}
+	req := httptest.NewRequest("GET", adminMetrics, nil)
+	req.Header.Set(hAuthorization, "Bearer secret")
+	rr := httptest.NewRecorder()
+	tm.adminHandler("secret", nil).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Metrics returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	for _, expected := range []string{
+		"# TYPE crux_peer_healthy gauge\n",
+		`crux_peer_healthy{url="http://localhost:9002/"} 0` + "\n",
+		`crux_peer_consecutive_failures{url="http://localhost:9002/"} 5` + "\n",
+		`crux_peer_latency_seconds{url="http://localhost:9002/"} 0.02` + "\n",
+		`crux_peer_requests_total{url="http://localhost:9002/"} 8` + "\n",
+		`crux_peer_failures_total{url="http://localhost:9002/"} 6` + "\n",
+	} {
+		if !strings.Contains(rr.Body.String(), expected) {
+			t.Errorf("Metrics do not include %q:\n%s", expected, rr.Body.String())
+		}
+	}
+}
+
+func TestAdminRequiresToken(t *testing.T) {
+	_, err := Init(&MockEnclave{}, ServerConfig{AdminAddr: "localhost:0"})
+	if err == nil {
+		t.Error("Expected the admin API to require a token")
+	}
+}
+
+func usageJson(key string) string {
+	return `{"publicKey":"` + key + `","payloads":1,"failures":0,"bytes":0,` +
+		`"averageLatencyMs":0,"maxLatencyMs":0}`
+}
+
+func TestScopedUsage(t *testing.T) {
+	tm := TransactionManager{Enclave: &MockEnclave{}}
+	senderKey, _ := base64.StdEncoding.DecodeString(sender)
+	receiverKey, _ := base64.StdEncoding.DecodeString(receiver)
+	handler := tm.scopedUsage(map[string][][]byte{
+		"team1": {senderKey},
+		"team2": {receiverKey},
+	})
+
+	var tests = []struct {
+		token          string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{"", http.StatusUnauthorized, ""},
+		{"team3", http.StatusUnauthorized, ""},
+		{"team1", http.StatusOK, `[` + usageJson(sender) + `]`},
+		{"team2", http.StatusOK, `[` + usageJson(receiver) + `]`},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest("GET", usage, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.token != "" {
+			req.Header.Set(hAuthorization, "Bearer "+test.token)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != test.expectedStatus {
+			t.Errorf("Usage with token %q returned wrong status code: got %v want %v",
+				test.token, status, test.expectedStatus)
+		}
+		if test.expectedBody != "" && strings.TrimSpace(rr.Body.String()) != test.expectedBody {
+			t.Errorf("Usage with token %q returned unexpected body: got %s want %s",
+				test.token, rr.Body.String(), test.expectedBody)
+		}
+	}
+}
+
+func TestReloadCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestReloadCertificate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := path.Join(dir, "server.crt"), path.Join(dir, "server.key")
+	for dst, src := range map[string]string{
+		certFile: "../enclave/testdata/cert/server.crt",
+		keyFile:  "../enclave/testdata/cert/server.key",
+	} {
+		data, err := ioutil.ReadFile(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(dst, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cert, err := loadCertificate(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tm := TransactionManager{cert: cert}
+	original, _ := cert.getCertificate(nil)
+
+	if err = ioutil.WriteFile(certFile, []byte("invalid"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = tm.ReloadCertificate(); err == nil {
+		t.Error("Expected an invalid certificate to be rejected")
+	}
+	if current, _ := cert.getCertificate(nil); current != original {
+		t.Error("The certificate should be unchanged after a failed reload")
+	}
+
+	data, _ := ioutil.ReadFile("../enclave/testdata/cert/server.crt")
+	if err = ioutil.WriteFile(certFile, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = tm.ReloadCertificate(); err != nil {
+		t.Fatal(err)
+	}
+	if current, _ := cert.getCertificate(nil); current == original {
+		t.Error("The certificate should have been reloaded")
+	}
+}
+
+func TestAdminRotate(t *testing.T) {
+	tm := TransactionManager{Enclave: &MockEnclave{}}
+	handler := tm.adminHandler("secret", nil)
+
+	var tests = []struct {
+		body           string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{`{"from":"` + sender + `","to":"` + receiver + `"}`, http.StatusOK,
+			`{"reencrypted":2,"unchanged":1,"failed":0}`},
+		{`{"from":"` + receiver + `","to":"` + sender + `"}`, http.StatusInternalServerError, ""},
+		{`{"from":"invalid","to":"` + receiver + `"}`, http.StatusBadRequest, ""},
+		{`invalid`, http.StatusBadRequest, ""},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest("POST", adminRotate, bytes.NewBufferString(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(hAuthorization, "Bearer secret")
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != test.expectedStatus {
+			t.Errorf("Rotation with %s returned wrong status code: got %v want %v",
+				test.body, status, test.expectedStatus)
+		}
+		if test.expectedBody != "" && strings.TrimSpace(rr.Body.String()) != test.expectedBody {
+			t.Errorf("Rotation with %s returned unexpected body: got %s want %s",
+				test.body, rr.Body.String(), test.expectedBody)
+		}
+	}
+}
+
+func TestPair(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pair")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	peersFile := peers.Open(path.Join(dir, "crux.peers"))
+
+	self := api.PairInfo{Url: "http://node1:9001/", PublicKeys: []string{sender}}
+	tm := TransactionManager{Enclave: &MockEnclave{}}
+	handler := tm.pair(self, "secret", peersFile)
+
+	validBody := `{"url":"http://node2:9001/","publicKeys":["` + receiver + `"]}`
+	var tests = []struct {
+		handler        http.Handler
+		method         string
+		token          string
+		body           string
+		expectedStatus int
+	}{
+		{handler, "GET", "", "", http.StatusOK},
+		{tm.pair(self, "", peersFile), "POST", "secret", validBody, http.StatusForbidden},
+		{handler, "POST", "invalid", validBody, http.StatusUnauthorized},
+		{handler, "POST", "secret", `{"url":"node2","publicKeys":["` + receiver + `"]}`,
+			http.StatusBadRequest},
+		{handler, "POST", "secret", `{"url":"http://node2:9001/","publicKeys":[]}`,
+			http.StatusBadRequest},
+		{handler, "DELETE", "secret", "", http.StatusMethodNotAllowed},
+		{handler, "POST", "secret", validBody, http.StatusOK},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest(test.method, pair, bytes.NewBufferString(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(hAuthorization, "Bearer "+test.token)
+
+		rr := httptest.NewRecorder()
+		test.handler.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != test.expectedStatus {
+			t.Errorf("%s pair with %s returned wrong status code: got %v want %v",
+				test.method, test.body, status, test.expectedStatus)
+		}
+		if status := rr.Code; status == http.StatusOK {
+			var info api.PairInfo
+			if err = json.Unmarshal(rr.Body.Bytes(), &info); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(info, self) {
+				t.Errorf("Unexpected pairing info %v", info)
+			}
+		}
+	}
+
+	paired, err := peersFile.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paired) != 1 || paired[0].Url != "http://node2:9001/" {
+		t.Errorf("Expected node2 to be paired, got %v", paired)
+	}
+}
+
+func TestRequestValidation(t *testing.T) {
+	tm := TransactionManager{Enclave: &MockEnclave{}}
+	shortKey := base64.StdEncoding.EncodeToString([]byte("short"))
+
+	var tests = []struct {
+		handler  http.HandlerFunc
+		body     string
+		headers  map[string]string
+		expected api.ErrorResponse
+	}{
+		{tm.send, `{"to":["` + receiver + `"]}`, nil,
+			api.ErrorResponse{Code: api.CodeMissingField, Field: "payload"}},
+		{tm.send, `{"payload":"!!!","to":["` + receiver + `"]}`, nil,
+			api.ErrorResponse{Code: api.CodeInvalidEncoding, Field: "payload"}},
+		{tm.send, `{"payload":"` + encodedPayload + `","from":"!!!"}`, nil,
+			api.ErrorResponse{Code: api.CodeInvalidEncoding, Field: "from"}},
+		{tm.send, `{"payload":"` + encodedPayload + `","to":["` + shortKey + `"]}`, nil,
+			api.ErrorResponse{Code: api.CodeInvalidKey, Field: "to"}},
+		{tm.send, `{"payload":"` + encodedPayload + `","to":[""]}`, nil,
+			api.ErrorResponse{Code: api.CodeMissingField, Field: "to"}},
+		{tm.send, `{"payload":`, nil, api.ErrorResponse{Code: api.CodeInvalidBody}},
+		{tm.send, `{"payload":"` + encodedPayload + `","idempotencyKey":"new"}`,
+			map[string]string{hIdempotencyKey: "replay"},
+			api.ErrorResponse{Code: api.CodeBadRequest, Field: "idempotencyKey"}},
+		{tm.sendRaw, "", map[string]string{hTo: receiver},
+			api.ErrorResponse{Code: api.CodeMissingField, Field: "payload"}},
+		{tm.sendRaw, string(payload), map[string]string{hFrom: shortKey},
+			api.ErrorResponse{Code: api.CodeInvalidKey, Field: hFrom}},
+		{tm.receive, `{"to":"` + receiver + `"}`, nil,
+			api.ErrorResponse{Code: api.CodeMissingField, Field: "key"}},
+		{tm.receive, `{"key":"` + encodedPayload + `","to":"!!!"}`, nil,
+			api.ErrorResponse{Code: api.CodeInvalidEncoding, Field: "to"}},
+		{tm.receiveRaw, "", nil, api.ErrorResponse{Code: api.CodeMissingField, Field: hKey}},
+		{tm.delete, `{}`, nil, api.ErrorResponse{Code: api.CodeMissingField, Field: "key"}},
+		{tm.resend, `{"type":"some","publicKey":"` + sender + `"}`, nil,
+			api.ErrorResponse{Code: api.CodeBadRequest}},
+		{tm.send, `{"payload":"` + encodedPayload + `","to":["` + receiver + `"],"privacyGroupId":"` +
+			privacyGroupId + `"}`, nil,
+			api.ErrorResponse{Code: api.CodeBadRequest, Field: "privacyGroupId"}},
+		{tm.createPrivacyGroup, `{"addresses":["` + shortKey + `"]}`, nil,
+			api.ErrorResponse{Code: api.CodeInvalidKey, Field: "addresses"}},
+		{tm.findPrivacyGroup, `{}`, nil, api.ErrorResponse{Code: api.CodeMissingField, Field: "addresses"}},
+		{tm.deletePrivacyGroup, `{}`, nil,
+			api.ErrorResponse{Code: api.CodeMissingField, Field: "privacyGroupId"}},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest("POST", "/", bytes.NewBufferString(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, value := range test.headers {
+			req.Header.Set(name, value)
+		}
+
+		rr := httptest.NewRecorder()
+		test.handler.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != http.StatusBadRequest {
+			t.Errorf("Request %s returned wrong status code: got %v want %v",
+				test.body, status, http.StatusBadRequest)
+		}
+		if contentType := rr.Header().Get("Content-Type"); contentType != "application/json" {
+			t.Errorf("Request %s returned wrong content type: %s", test.body, contentType)
+		}
+
+		var response api.ErrorResponse
+		if err = json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		if response.Code != test.expected.Code || response.Field != test.expected.Field ||
+			response.Message == "" {
+			t.Errorf("Request %s returned unexpected error: got %v want %v",
+				test.body, response, test.expected)
+		}
+	}
+}
+
+func TestPrivacyGroups(t *testing.T) {
+	tm := TransactionManager{Enclave: &MockEnclave{}}
+
+	var group api.PrivacyGroup
+	runJsonHandlerTest(t,
+		&api.CreatePrivacyGroupRequest{Addresses: []string{receiver}, From: sender, Name: "name"},
+		&group,
+		&api.PrivacyGroup{PrivacyGroupId: privacyGroupId, Name: "name", Members: []string{sender, receiver}},
+		createPrivacyGroup, tm.createPrivacyGroup)
+
+	var groups []api.PrivacyGroup
+	runJsonHandlerTest(t,
+		&api.FindPrivacyGroupRequest{Addresses: []string{sender, receiver}},
+		&groups,
+		&[]api.PrivacyGroup{{PrivacyGroupId: privacyGroupId, Members: []string{sender, receiver}}},
+		findPrivacyGroup, tm.findPrivacyGroup)
+
+	var sendResp api.SendResponse
+	runJsonHandlerTest(t,
+		&api.SendRequest{Payload: encodedPayload, From: sender, PrivacyGroupId: privacyGroupId},
+		&sendResp, &api.SendResponse{Key: encodedPayload}, send, tm.send)
+
+	var deleted string
+	runJsonHandlerTest(t,
+		&api.DeletePrivacyGroupRequest{PrivacyGroupId: privacyGroupId, From: sender},
+		&deleted, &privacyGroupId, deletePrivacyGroup, tm.deletePrivacyGroup)
+
+	unknown := base64.StdEncoding.EncodeToString([]byte("unknown"))
+	requests := []struct {
+		handler http.HandlerFunc
+		request interface{}
+	}{
+		{tm.send, api.SendRequest{Payload: encodedPayload, PrivacyGroupId: unknown}},
+		{tm.deletePrivacyGroup, api.DeletePrivacyGroupRequest{PrivacyGroupId: unknown}},
+	}
+	for _, test := range requests {
+		encoded, err := json.Marshal(test.request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest("POST", "/", bytes.NewBuffer(encoded))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		test.handler.ServeHTTP(rr, req)
+
+		var response api.ErrorResponse
+		if err = json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		if rr.Code != http.StatusNotFound || response.Code != api.CodeNotFound {
+			t.Errorf("Request %s returned %d %v, expected %d %s",
+				encoded, rr.Code, response, http.StatusNotFound, api.CodeNotFound)
+		}
+	}
+}
+
+func TestListPayloads(t *testing.T) {
+	tm := TransactionManager{Enclave: &MockEnclave{}}
+
+	var tests = []struct {
+		query    string
+		expected api.PayloadList
+	}{
+		{"?sender=" + sender, api.PayloadList{Keys: []string{"AQ==", "Ag==", "Aw==", "BA==", "BQ=="}}},
+		{"?sender=" + sender + "&limit=2", api.PayloadList{Keys: []string{"AQ==", "Ag=="}, Next: "Ag=="}},
+		{"?sender=" + sender + "&limit=2&after=Ag==", api.PayloadList{Keys: []string{"Aw==", "BA=="}, Next: "BA=="}},
+		{"?sender=" + sender + "&limit=2&after=BA==", api.PayloadList{Keys: []string{"BQ=="}}},
+		{"?recipient=" + receiver, api.PayloadList{Keys: []string{}}},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", payloads+strings.Replace(test.query, "+", "%2B", -1), nil)
+		rr := httptest.NewRecorder()
+		tm.listPayloads(rr, req)
+
+		var list api.PayloadList
+		if err := json.NewDecoder(rr.Body).Decode(&list); err != nil || rr.Code != http.StatusOK {
+			t.Fatalf("Query %s returned status %d, error: %v", test.query, rr.Code, err)
+		}
+		if !reflect.DeepEqual(list, test.expected) {
+			t.Errorf("Query %s listed %+v, expected %+v", test.query, list, test.expected)
+		}
+	}
+
+	for _, query := range []string{
+		"",
+		"?sender=" + sender + "&recipient=" + receiver,
+		"?sender=invalid",
+		"?sender=" + sender + "&after=invalid",
+		"?sender=" + sender + "&limit=0",
+		"?sender=" + sender + "&limit=1001",
+	} {
+		req := httptest.NewRequest("GET", payloads+strings.Replace(query, "+", "%2B", -1), nil)
+		rr := httptest.NewRecorder()
+		tm.listPayloads(rr, req)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("Query %s returned status %d, expected %d", query, rr.Code, http.StatusBadRequest)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	tm.listPayloads(rr, httptest.NewRequest("POST", payloads+"?sender="+sender, nil))
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected POST to be rejected, got status %d", rr.Code)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	tm := TransactionManager{Enclave: &MockEnclave{}, notifier: newNotifier()}
+	server := httptest.NewServer(http.HandlerFunc(tm.subscribe))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + subscribe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contentType := resp.Header.Get("Content-Type"); contentType != "text/event-stream" {
+		t.Errorf("Subscription returned wrong content type: %s", contentType)
+	}
+
+	sender := nacl.NewKey()
+	epl := api.EncryptedPayload{
+		Sender:         sender,
+		CipherText:     []byte(payload),
+		Nonce:          nacl.NewNonce(),
+		RecipientBoxes: [][]byte{[]byte(payload)},
+		RecipientNonce: nacl.NewNonce(),
+	}
+	encoded := api.EncodePayloadWithRecipients(epl, [][]byte{})
+	req, err := http.NewRequest("POST", push, bytes.NewBuffer(encoded))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tm.push(httptest.NewRecorder(), req)
+
+	reader := bufio.NewReader(resp.Body)
+	var lines []string
+	for len(lines) < 2 {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, strings.TrimSpace(line))
+	}
+
+	expected, _ := json.Marshal(api.PayloadNotification{
+		Key:    base64.StdEncoding.EncodeToString(encoded),
+		Sender: base64.StdEncoding.EncodeToString((*sender)[:]),
+	})
+	if lines[0] != "event: payload" || lines[1] != "data: "+string(expected) {
+		t.Errorf("Received notification %q, expected data %s", lines, expected)
+	}
+
+	resp.Body.Close()
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		tm.notifier.mu.Lock()
+		subscribers := len(tm.notifier.subscribers)
+		tm.notifier.mu.Unlock()
+		if subscribers == 0 {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("Closed subscription was not removed")
+		}
+	}
+}
+
+func TestProbes(t *testing.T) {
+	var tests = []struct {
+		tm             TransactionManager
+		handler        string
+		expectedStatus int
+		expected       api.ProbeResponse
+	}{
+		{TransactionManager{Enclave: &MockEnclave{}}, healthz, http.StatusOK,
+			api.ProbeResponse{Status: "ok"}},
+		{TransactionManager{Enclave: &peersEnclave{}}, readyz, http.StatusOK,
+			api.ProbeResponse{Status: "ok", Checks: []api.ProbeCheck{
+				{Name: "storage", Ok: true},
+				{Name: "keys", Ok: true, Detail: "public keys loaded: 1"},
+			}}},
+		{TransactionManager{Enclave: &peersEnclave{}, readyPeers: true}, readyz, http.StatusOK,
+			api.ProbeResponse{Status: "ok", Checks: []api.ProbeCheck{
+				{Name: "storage", Ok: true},
+				{Name: "keys", Ok: true, Detail: "public keys loaded: 1"},
+				{Name: "peers", Ok: true, Detail: "public keys of other nodes: 1"},
+			}}},
+		{TransactionManager{Enclave: &MockEnclave{}, readyPeers: true}, readyz,
+			http.StatusServiceUnavailable,
+			api.ProbeResponse{Status: "unavailable", Checks: []api.ProbeCheck{
+				{Name: "storage", Ok: true},
+				{Name: "keys", Ok: false, Detail: "public keys loaded: 0"},
+				{Name: "peers", Ok: false, Detail: "public keys of other nodes: 0"},
+			}}},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest("GET", test.handler, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		handler := test.tm.healthz
+		if test.handler == readyz {
+			handler = test.tm.readyz
+		}
+		http.HandlerFunc(handler).ServeHTTP(rr, req)
+
+		if status := rr.Code; status != test.expectedStatus {
+			t.Errorf("%s returned wrong status code: got %v want %v",
+				test.handler, status, test.expectedStatus)
+		}
+		var response api.ProbeResponse
+		if err = json.NewDecoder(rr.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(response, test.expected) {
+			t.Errorf("%s returned unexpected response: got %v want %v",
+				test.handler, response, test.expected)
+		}
+	}
+}
+
+func TestHttpTimeouts(t *testing.T) {
+	timeouts := HttpTimeouts{Read: 50 * time.Millisecond, MaxHeaderBytes: 1024}
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := timeouts.httpServer("", http.HandlerFunc((&TransactionManager{}).version))
+	go server.Serve(listener)
+	defer server.Close()
+
+	// A client which never completes its request is disconnected
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err = fmt.Fprint(conn, "GET /version HTTP/1.1\r\nHost: localhost\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = ioutil.ReadAll(conn); err != nil {
+		t.Errorf("Slow client should be disconnected by the server, error: %v", err)
+	}
+
+	req, err := http.NewRequest("GET", "http://"+listener.Addr().String()+version, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Large", strings.Repeat("a", 8192))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestHeaderFieldsTooLarge {
+		t.Errorf("Request with large headers returned %d, expected %d",
+			resp.StatusCode, http.StatusRequestHeaderFieldsTooLarge)
+	}
+}
+
+func TestPushVerifiesKey(t *testing.T) {
+	epl := api.EncryptedPayload{
+		Sender:         nacl.NewKey(),
+		CipherText:     []byte(payload),
+		Nonce:          nacl.NewNonce(),
+		RecipientBoxes: [][]byte{[]byte(payload)},
+		RecipientNonce: nacl.NewNonce(),
+	}
+	encoded := api.EncodePayloadWithRecipients(epl, [][]byte{})
+	tm := TransactionManager{Enclave: &MockEnclave{}}
+
+	var tests = []struct {
+		key            string
+		expectedStatus int
+		expectedCode   string
+	}{
+		{base64.StdEncoding.EncodeToString(utils.Digest(epl.CipherText)), http.StatusOK, ""},
+		{"", http.StatusOK, ""},
+		{base64.StdEncoding.EncodeToString(utils.Digest([]byte("other"))),
+			http.StatusBadRequest, api.CodeKeyMismatch},
+		{"!!!", http.StatusBadRequest, api.CodeInvalidEncoding},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest("POST", push, bytes.NewBuffer(encoded))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.key != "" {
+			req.Header.Set(api.PushKeyHeader, test.key)
+		}
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(tm.push).ServeHTTP(rr, req)
+
+		if rr.Code != test.expectedStatus {
+			t.Errorf("Push with key %q returned wrong status code: got %v want %v",
+				test.key, rr.Code, test.expectedStatus)
+		}
+		if test.expectedCode != "" {
+			var response api.ErrorResponse
+			if err = json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			if response.Code != test.expectedCode || response.Field != api.PushKeyHeader {
+				t.Errorf("Push with key %q returned unexpected error: %v", test.key, response)
+			}
+		}
+	}
+}
+
+func TestCompressedPush(t *testing.T) {
+	epl := api.EncryptedPayload{
+		Sender:         nacl.NewKey(),
+		CipherText:     []byte(payload),
+		Nonce:          nacl.NewNonce(),
+		RecipientBoxes: [][]byte{[]byte(payload)},
+		RecipientNonce: nacl.NewNonce(),
+	}
+	encoded := api.EncodePayloadWithRecipients(epl, [][]byte{})
+	tm := TransactionManager{Enclave: &MockEnclave{}}
+
+	var encodings []string
+	record := func(handler http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			encodings = append(encodings, r.Header.Get(hContentEncoding))
+			handler.ServeHTTP(w, r)
+		})
+	}
+
+	for _, test := range []struct {
+		handler           http.Handler
+		expectedEncodings []string
+	}{
+		{decompressRequest(0, http.HandlerFunc(tm.push)), []string{"gzip"}},
+		// Nodes which do not support compression fail to decode the payload
+		{http.HandlerFunc(tm.push), []string{"gzip", ""}},
+	} {
+		encodings = nil
+		server := httptest.NewServer(record(test.handler))
+		_, err := api.PushWithCompression(encoded, server.URL, http.DefaultClient, utils.CompressionGzip)
+		server.Close()
+		if err != nil {
+			t.Error(err)
+		}
+		if !reflect.DeepEqual(encodings, test.expectedEncodings) {
+			t.Errorf("Pushed with encodings %v, expected %v", encodings, test.expectedEncodings)
+		}
+	}
+}
+
+func TestDecompressRequest(t *testing.T) {
+	var body []byte
+	handler := decompressRequest(1024, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = ioutil.ReadAll(r.Body)
+	}))
+
+	compressed, err := utils.Gzip([]byte(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tooLarge, err := utils.Gzip(make([]byte, 1025))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		encoding       string
+		body           []byte
+		expectedStatus int
+		expectedBody   []byte
+	}{
+		{"", []byte(payload), http.StatusOK, []byte(payload)},
+		{"gzip", compressed, http.StatusOK, []byte(payload)},
+		{"gzip", []byte(payload), http.StatusBadRequest, nil},
+		{"gzip", tooLarge, http.StatusRequestEntityTooLarge, nil},
+		{"br", []byte(payload), http.StatusUnsupportedMediaType, nil},
+	}
+
+	for _, test := range tests {
+		body = nil
+		req, err := http.NewRequest("POST", push, bytes.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.encoding != "" {
+			req.Header.Set(hContentEncoding, test.encoding)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != test.expectedStatus {
+			t.Errorf("Request with encoding %q returned wrong status code: got %v want %v",
+				test.encoding, rr.Code, test.expectedStatus)
+		}
+		if !bytes.Equal(body, test.expectedBody) {
+			t.Errorf("Request with encoding %q has body %q, expected %q",
+				test.encoding, body, test.expectedBody)
+		}
+	}
+}
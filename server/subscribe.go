@@ -0,0 +1,112 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/blk-io/crux/api"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const subscribe = "/subscribe"
+
+// subscriberBuffer is the number of notifications queued for each subscriber, further
+// notifications are dropped until it catches up.
+const subscriberBuffer = 64
+
+// keepAliveInterval is how often a comment is written to idle subscriptions, so that closed
+// connections are detected.
+var keepAliveInterval = 30 * time.Second
+
+// notifier distributes notifications of pushed payloads to subscribers.
+type notifier struct {
+	mu          sync.Mutex
+	subscribers []chan api.PayloadNotification
+}
+
+func newNotifier() *notifier {
+	return &notifier{}
+}
+
+func (n *notifier) subscribe() chan api.PayloadNotification {
+	ch := make(chan api.PayloadNotification, subscriberBuffer)
+	n.mu.Lock()
+	n.subscribers = append(n.subscribers, ch)
+	n.mu.Unlock()
+	return ch
+}
+
+func (n *notifier) unsubscribe(ch chan api.PayloadNotification) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for i, subscriber := range n.subscribers {
+		if subscriber == ch {
+			n.subscribers = append(n.subscribers[:i], n.subscribers[i+1:]...)
+			return
+		}
+	}
+}
+
+// notify sends notification to all subscribers without blocking, it is a no-op if n is nil.
+func (n *notifier) notify(notification api.PayloadNotification) {
+	if n == nil {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, ch := range n.subscribers {
+		select {
+		case ch <- notification:
+		default:
+			log.WithField("key", notification.Key).Warn(
+				"Subscriber is not keeping up, dropping payload notification")
+		}
+	}
+}
+
+// subscribe streams a notification of each payload pushed to the node to the client as
+// server-sent events, until it disconnects.
+func (s *TransactionManager) subscribe(w http.ResponseWriter, req *http.Request) {
+	if !allowMethod(w, req, http.MethodGet) {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok || s.notifier == nil {
+		internalServerError(w, req, "Subscriptions are not supported")
+		return
+	}
+
+	ch := s.notifier.subscribe()
+	defer s.notifier.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	requestLog(req).Info("Client subscribed to payload notifications")
+
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		var err error
+		select {
+		case notification := <-ch:
+			var data []byte
+			if data, err = json.Marshal(notification); err == nil {
+				_, err = fmt.Fprintf(w, "event: payload\ndata: %s\n\n", data)
+			}
+		case <-keepAlive.C:
+			_, err = fmt.Fprint(w, ": keep-alive\n\n")
+		case <-req.Context().Done():
+			requestLog(req).Info("Client unsubscribed from payload notifications")
+			return
+		}
+		if err != nil {
+			requestLog(req).Warnf("Ending subscription, error: %v", err)
+			return
+		}
+		flusher.Flush()
+	}
+}
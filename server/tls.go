@@ -0,0 +1,52 @@
+package server
+
+import (
+	"crypto/tls"
+	"net/http"
+	"sync"
+)
+
+// certificate is a TLS certificate which can be reloaded from disk while servers are using it,
+// without interrupting established connections.
+type certificate struct {
+	certFile, keyFile string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+func loadCertificate(certFile, keyFile string) (*certificate, error) {
+	c := &certificate{certFile: certFile, keyFile: keyFile}
+	return c, c.reload()
+}
+
+// reload reads the certificate and key files again, leaving the current certificate in place if
+// they are invalid.
+func (c *certificate) reload() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.cert = &cert
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *certificate) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// tlsConfig returns a TLS configuration serving the current certificate.
+func (c *certificate) tlsConfig() *tls.Config {
+	return &tls.Config{GetCertificate: c.getCertificate}
+}
+
+// disableHttp2 prevents server from negotiating HTTP/2 with its TLS clients, which net/http
+// otherwise does by default.
+func disableHttp2(server *http.Server) {
+	server.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+}
@@ -0,0 +1,166 @@
+package storage
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+)
+
+// exportManifest is the final entry of an export, its absence indicates the export is incomplete.
+const exportManifest = "manifest.json"
+
+// checksumRecord is the PAX header record holding the SHA-256 checksum of each exported entry.
+const checksumRecord = "CRUX.sha256"
+
+// ErrExportIncomplete is returned by Import if an export ends without its manifest, as happens
+// if it was truncated, or the export failed partway.
+var ErrExportIncomplete = errors.New("export is incomplete, it has no manifest")
+
+// manifest summarises an export, recording the number of entries exported from each store.
+type manifest struct {
+	Created time.Time      `json:"created"`
+	Entries map[string]int `json:"entries"`
+}
+
+// Export writes the entries of each of the provided stores to w as a tar archive, named by store
+// and hex encoded key, along with their checksums. The number of entries exported from each
+// store is returned.
+// Entries are read through the provided stores, so are not encrypted at rest in the export,
+// although payloads remain encrypted for their recipients.
+func Export(w io.Writer, stores map[string]DataStore) (map[string]int, error) {
+	created := time.Now().UTC()
+	archive := tar.NewWriter(w)
+	entries := make(map[string]int)
+
+	names := make([]string, 0, len(stores))
+	for name := range stores {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		entries[name] = 0
+		var writeErr error
+		err := stores[name].ReadAll(func(key, value *[]byte) {
+			if writeErr != nil {
+				return
+			}
+			checksum := sha256.Sum256(*value)
+			writeErr = writeEntry(archive, name+"/"+hex.EncodeToString(*key), created, *value,
+				map[string]string{checksumRecord: hex.EncodeToString(checksum[:])})
+			if writeErr == nil {
+				entries[name]++
+			}
+		})
+		if err == nil {
+			err = writeErr
+		}
+		if err != nil {
+			return entries, fmt.Errorf("unable to export %s, error: %v", name, err)
+		}
+	}
+
+	encoded, err := json.Marshal(manifest{Created: created, Entries: entries})
+	if err != nil {
+		return entries, err
+	}
+	if err = writeEntry(archive, exportManifest, created, encoded, nil); err != nil {
+		return entries, err
+	}
+	return entries, archive.Close()
+}
+
+func writeEntry(
+	archive *tar.Writer, name string, modTime time.Time, value []byte, records map[string]string) error {
+
+	err := archive.WriteHeader(&tar.Header{
+		Typeflag:   tar.TypeReg,
+		Name:       name,
+		Mode:       0600,
+		Size:       int64(len(value)),
+		ModTime:    modTime,
+		PAXRecords: records,
+		Format:     tar.FormatPAX,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = archive.Write(value)
+	return err
+}
+
+// Import writes the entries of an export read from r to the stores of the same names, returning
+// the number of entries imported into each. Each entry's checksum is verified before it is
+// written, and an error is returned for entries of stores which are not provided.
+// Entries are imported as they are read, so an import which fails will have imported some
+// entries, as stored payloads are keyed by their contents it is safe to import them again.
+func Import(r io.Reader, stores map[string]DataStore) (map[string]int, error) {
+	archive := tar.NewReader(r)
+	imported := make(map[string]int)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return imported, ErrExportIncomplete
+		} else if err != nil {
+			return imported, err
+		}
+
+		value, err := ioutil.ReadAll(archive)
+		if err != nil {
+			return imported, err
+		}
+
+		if header.Name == exportManifest {
+			return imported, checkManifest(value, imported)
+		}
+
+		i := strings.Index(header.Name, "/")
+		if i < 0 {
+			return imported, fmt.Errorf("invalid export entry %s", header.Name)
+		}
+		name := header.Name[:i]
+		store, ok := stores[name]
+		if !ok {
+			return imported, fmt.Errorf("export entry %s is for an unknown store", header.Name)
+		}
+		key, err := hex.DecodeString(header.Name[i+1:])
+		if err != nil {
+			return imported, fmt.Errorf("invalid export entry %s, error: %v", header.Name, err)
+		}
+
+		checksum := sha256.Sum256(value)
+		expected, err := hex.DecodeString(header.PAXRecords[checksumRecord])
+		if err != nil || !bytes.Equal(checksum[:], expected) {
+			return imported, fmt.Errorf("checksum of export entry %s does not match", header.Name)
+		}
+
+		if err = store.Write(&key, &value); err != nil {
+			return imported, err
+		}
+		imported[name]++
+	}
+}
+
+// checkManifest ensures the entries imported match those recorded in an export's manifest.
+func checkManifest(encoded []byte, imported map[string]int) error {
+	var m manifest
+	if err := json.Unmarshal(encoded, &m); err != nil {
+		return fmt.Errorf("invalid export manifest, error: %v", err)
+	}
+	for name, count := range m.Entries {
+		if imported[name] != count {
+			return fmt.Errorf("imported %d %s entries, the export contains %d",
+				imported[name], name, count)
+		}
+	}
+	return nil
+}
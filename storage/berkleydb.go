@@ -20,6 +20,7 @@ func InitBerkeleyDb(dbPath string) (*berkleyDb, error) {
 
 	err = db.Open(
 		dbPath, berkeleydb.DbHash, berkeleydb.DbCreate)
+	bdb.conn = db
 
 	return bdb, err
 }
@@ -51,6 +52,14 @@ func (db *berkleyDb) Read(key *[]byte) (*[]byte, error) {
 	return &decoded, err
 }
 
+// Has reports whether key is present. BerkeleyDB does not distinguish a missing key from other
+// read errors, so any error is treated as the key being absent.
+func (db *berkleyDb) Has(key *[]byte) (bool, error) {
+	b64Key := base64.StdEncoding.EncodeToString(*key)
+	_, err := db.conn.Get(b64Key)
+	return err == nil, nil
+}
+
 func (db *berkleyDb) ReadAll(f func(key, value *[]byte)) error {
 	iter, err := db.conn.Cursor()
 	if err != nil {
@@ -0,0 +1,129 @@
+package storage
+
+import (
+	"bytes"
+	"github.com/blk-io/crux/utils"
+)
+
+// compressedHeader marks values compressed by a compressedStore, distinguishing them from values
+// which were written uncompressed.
+var compressedHeader = []byte("cxz1")
+
+// compressedStore compresses values in an underlying DataStore with gzip. Values are only stored
+// compressed if that makes them smaller, which is rarely the case for encrypted payloads.
+type compressedStore struct {
+	db DataStore
+}
+
+// WithCompression returns a DataStore which compresses values before writing them to db, and
+// decompresses them when they are read. Values written uncompressed, including those written
+// before compression was enabled, are still readable. Compression should be applied before any
+// encryption at rest, i.e. wrapping a DataStore returned by WithEncryption, as encrypted values
+// do not compress. Closing the returned DataStore closes db.
+func WithCompression(db DataStore) DataStore {
+	return &compressedStore{db: db}
+}
+
+func (s *compressedStore) compress(value []byte) ([]byte, error) {
+	compressed, err := utils.Gzip(value)
+	if err != nil {
+		return nil, err
+	}
+	if len(compressedHeader)+len(compressed) >= len(value) {
+		return value, nil
+	}
+	return append(append([]byte{}, compressedHeader...), compressed...), nil
+}
+
+func (s *compressedStore) decompress(value []byte) ([]byte, error) {
+	if !bytes.HasPrefix(value, compressedHeader) {
+		return value, nil
+	}
+	return utils.Gunzip(value[len(compressedHeader):], 0)
+}
+
+func (s *compressedStore) Write(key *[]byte, value *[]byte) error {
+	compressed, err := s.compress(*value)
+	if err != nil {
+		return err
+	}
+	return s.db.Write(key, &compressed)
+}
+
+func (s *compressedStore) Read(key *[]byte) (*[]byte, error) {
+	value, err := s.db.Read(key)
+	if err != nil {
+		return nil, err
+	}
+	decompressed, err := s.decompress(*value)
+	if err != nil {
+		return nil, err
+	}
+	return &decompressed, nil
+}
+
+func (s *compressedStore) Has(key *[]byte) (bool, error) {
+	return s.db.Has(key)
+}
+
+// ReadAll calls f with each value which can be decompressed, returning an error if any could not.
+func (s *compressedStore) ReadAll(f func(key, value *[]byte)) error {
+	return s.readDecompressed(s.db.ReadAll, f)
+}
+
+// ReadPrefix is equivalent to ReadAll, for the entries whose keys begin with prefix.
+func (s *compressedStore) ReadPrefix(prefix []byte, f func(key, value *[]byte)) error {
+	return s.readDecompressed(func(f func(key, value *[]byte)) error {
+		return ReadPrefix(s.db, prefix, f)
+	}, f)
+}
+
+// ReadRange is equivalent to ReadPrefix, as per RangeReader. Reading stops at the first value
+// which cannot be decompressed.
+func (s *compressedStore) ReadRange(
+	prefix, start []byte, f func(key, value *[]byte) bool) (bool, error) {
+
+	var decompressErr error
+	ordered, err := ReadRange(s.db, prefix, start, func(key, value *[]byte) bool {
+		decompressed, err := s.decompress(*value)
+		if err != nil {
+			decompressErr = err
+			return false
+		}
+		return f(key, &decompressed)
+	})
+	if err != nil {
+		return ordered, err
+	}
+	return ordered, decompressErr
+}
+
+func (s *compressedStore) readDecompressed(
+	readAll func(f func(key, value *[]byte)) error, f func(key, value *[]byte)) error {
+
+	var decompressErr error
+	err := readAll(func(key, value *[]byte) {
+		decompressed, err := s.decompress(*value)
+		if err != nil {
+			decompressErr = err
+			return
+		}
+		f(key, &decompressed)
+	})
+	if err != nil {
+		return err
+	}
+	return decompressErr
+}
+
+func (s *compressedStore) Delete(key *[]byte) error {
+	return s.db.Delete(key)
+}
+
+func (s *compressedStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *compressedStore) Compact() error {
+	return compact(s.db)
+}
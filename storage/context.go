@@ -0,0 +1,103 @@
+package storage
+
+import "context"
+
+// contextStore performs the operations of an underlying DataStore on behalf of a context.
+type contextStore struct {
+	ctx context.Context
+	db  DataStore
+}
+
+// WithContext returns a DataStore which performs operations on db on behalf of ctx. Operations
+// are not started once ctx is done. Reads in progress return ctx.Err() as soon as it is done,
+// rather than waiting for slow storage, although they continue in db, as the underlying storage
+// cannot be interrupted. Writes and deletes in progress are always waited for, so that a change
+// is never reported as failed after it has been made. ReadAll stops calling f once ctx is done,
+// but returns only when db has finished iterating. Closing the returned DataStore does not close
+// db.
+func WithContext(ctx context.Context, db DataStore) DataStore {
+	return &contextStore{ctx: ctx, db: db}
+}
+
+// do runs op, returning early with ctx.Err() if ctx is done before it completes. It is only used
+// for reads, which have no effect if abandoned.
+func (s *contextStore) do(op func() error) error {
+	if err := s.ctx.Err(); err != nil {
+		return err
+	}
+	if s.ctx.Done() == nil {
+		return op()
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		result <- op()
+	}()
+	select {
+	case err := <-result:
+		return err
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+	}
+}
+
+func (s *contextStore) Write(key *[]byte, value *[]byte) error {
+	if err := s.ctx.Err(); err != nil {
+		return err
+	}
+	return s.db.Write(key, value)
+}
+
+func (s *contextStore) Read(key *[]byte) (*[]byte, error) {
+	var value *[]byte
+	err := s.do(func() error {
+		read, err := s.db.Read(key)
+		if err == nil {
+			value = read
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+func (s *contextStore) Has(key *[]byte) (bool, error) {
+	var exists bool
+	err := s.do(func() error {
+		has, err := s.db.Has(key)
+		exists = has
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	return exists, nil
+}
+
+func (s *contextStore) ReadAll(f func(key, value *[]byte)) error {
+	if err := s.ctx.Err(); err != nil {
+		return err
+	}
+	err := s.db.ReadAll(func(key, value *[]byte) {
+		if s.ctx.Err() == nil {
+			f(key, value)
+		}
+	})
+	if err == nil {
+		err = s.ctx.Err()
+	}
+	return err
+}
+
+func (s *contextStore) Delete(key *[]byte) error {
+	if err := s.ctx.Err(); err != nil {
+		return err
+	}
+	return s.db.Delete(key)
+}
+
+func (s *contextStore) Close() error {
+	return nil
+}
@@ -1,10 +1,27 @@
 package storage
 
+import "errors"
+
 // DataStore is an interface that facilitates operations with an underlying persistent data store.
 type DataStore interface {
 	Write(key *[]byte, value *[]byte) error
 	Read(key *[]byte) (*[]byte, error)
+	Has(key *[]byte) (bool, error)
 	ReadAll(f func(key, value *[]byte)) error
 	Delete(key *[]byte) error
 	Close() error
 }
+
+// Compacter is implemented by DataStores which can reclaim the space used by deleted entries.
+type Compacter interface {
+	Compact() error
+}
+
+// compact compacts db if it supports compaction.
+func compact(db DataStore) error {
+	c, ok := db.(Compacter)
+	if !ok {
+		return errors.New("storage does not support compaction")
+	}
+	return c.Compact()
+}
@@ -0,0 +1,36 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// ReadDirectory calls f with the name and contents of each file in dir, in the manner of
+// DataStore.ReadAll, for reading Constellation's directory storage, which holds each payload in a
+// file of its own. Contents which are base64 encoded are decoded, and hidden files and
+// subdirectories are skipped.
+func ReadDirectory(dir string, f func(key, value *[]byte)) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if !file.Mode().IsRegular() || strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+		value, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return err
+		}
+		if decoded, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(value))); err == nil {
+			value = decoded
+		}
+		key := []byte(file.Name())
+		f(&key, &value)
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"github.com/kevinburke/nacl"
+	"github.com/kevinburke/nacl/secretbox"
+)
+
+// encryptedHeader marks values encrypted by an encryptedStore, distinguishing them from values
+// written before encryption was enabled.
+var encryptedHeader = []byte("cxe1")
+
+// storageKeyContext separates the storage key from other uses of the same secret.
+const storageKeyContext = "crux storage encryption"
+
+// encryptedStore encrypts values at rest in an underlying DataStore using NaCl secretbox. Keys
+// are stored as is, as they are digests of already encrypted payloads.
+type encryptedStore struct {
+	db  DataStore
+	key nacl.Key
+}
+
+// WithEncryption returns a DataStore which encrypts values before writing them to db, with a key
+// derived from secret. Values written before encryption was enabled are still readable, and are
+// encrypted when next written. Closing the returned DataStore closes db.
+func WithEncryption(db DataStore, secret nacl.Key) DataStore {
+	return &encryptedStore{db: db, key: deriveKey(secret, storageKeyContext)}
+}
+
+// deriveKey derives a key for the given context from secret.
+func deriveKey(secret nacl.Key, context string) nacl.Key {
+	mac := hmac.New(sha256.New, (*secret)[:])
+	mac.Write([]byte(context))
+
+	key := new([nacl.KeySize]byte)
+	copy(key[:], mac.Sum(nil))
+	return key
+}
+
+func (s *encryptedStore) encrypt(value []byte) []byte {
+	nonce := nacl.NewNonce()
+	sealed := append(append([]byte{}, encryptedHeader...), (*nonce)[:]...)
+	return secretbox.Seal(sealed, value, nonce, s.key)
+}
+
+func (s *encryptedStore) decrypt(value []byte) ([]byte, error) {
+	if !bytes.HasPrefix(value, encryptedHeader) {
+		return value, nil
+	}
+	value = value[len(encryptedHeader):]
+	if len(value) < nacl.NonceSize {
+		return nil, errors.New("encrypted value is too short")
+	}
+
+	nonce := new([nacl.NonceSize]byte)
+	copy(nonce[:], value)
+	opened, ok := secretbox.Open(nil, value[nacl.NonceSize:], nonce, s.key)
+	if !ok {
+		return nil, errors.New("unable to decrypt value, the storage key may be incorrect")
+	}
+	return opened, nil
+}
+
+func (s *encryptedStore) Write(key *[]byte, value *[]byte) error {
+	encrypted := s.encrypt(*value)
+	return s.db.Write(key, &encrypted)
+}
+
+func (s *encryptedStore) Read(key *[]byte) (*[]byte, error) {
+	value, err := s.db.Read(key)
+	if err != nil {
+		return nil, err
+	}
+	decrypted, err := s.decrypt(*value)
+	if err != nil {
+		return nil, err
+	}
+	return &decrypted, nil
+}
+
+func (s *encryptedStore) Has(key *[]byte) (bool, error) {
+	return s.db.Has(key)
+}
+
+// ReadAll calls f with each value which can be decrypted, returning an error if any could not.
+func (s *encryptedStore) ReadAll(f func(key, value *[]byte)) error {
+	return s.readDecrypted(s.db.ReadAll, f)
+}
+
+// ReadPrefix is equivalent to ReadAll, for the entries whose keys begin with prefix.
+func (s *encryptedStore) ReadPrefix(prefix []byte, f func(key, value *[]byte)) error {
+	return s.readDecrypted(func(f func(key, value *[]byte)) error {
+		return ReadPrefix(s.db, prefix, f)
+	}, f)
+}
+
+// ReadRange is equivalent to ReadPrefix, as per RangeReader. Reading stops at the first value
+// which cannot be decrypted.
+func (s *encryptedStore) ReadRange(
+	prefix, start []byte, f func(key, value *[]byte) bool) (bool, error) {
+
+	var decryptErr error
+	ordered, err := ReadRange(s.db, prefix, start, func(key, value *[]byte) bool {
+		decrypted, err := s.decrypt(*value)
+		if err != nil {
+			decryptErr = err
+			return false
+		}
+		return f(key, &decrypted)
+	})
+	if err != nil {
+		return ordered, err
+	}
+	return ordered, decryptErr
+}
+
+func (s *encryptedStore) readDecrypted(
+	readAll func(f func(key, value *[]byte)) error, f func(key, value *[]byte)) error {
+
+	var decryptErr error
+	err := readAll(func(key, value *[]byte) {
+		decrypted, err := s.decrypt(*value)
+		if err != nil {
+			decryptErr = err
+			return
+		}
+		f(key, &decrypted)
+	})
+	if err != nil {
+		return err
+	}
+	return decryptErr
+}
+
+func (s *encryptedStore) Delete(key *[]byte) error {
+	return s.db.Delete(key)
+}
+
+func (s *encryptedStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *encryptedStore) Compact() error {
+	return compact(s.db)
+}
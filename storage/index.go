@@ -0,0 +1,135 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+)
+
+// PrefixReader is implemented by DataStores which can read the entries whose keys begin with a
+// prefix without reading every entry.
+type PrefixReader interface {
+	ReadPrefix(prefix []byte, f func(key, value *[]byte)) error
+}
+
+// ReadPrefix calls f with each entry in db whose key begins with prefix, reading only those
+// entries if db is a PrefixReader.
+func ReadPrefix(db DataStore, prefix []byte, f func(key, value *[]byte)) error {
+	if r, ok := db.(PrefixReader); ok {
+		return r.ReadPrefix(prefix, f)
+	}
+	return db.ReadAll(func(key, value *[]byte) {
+		if bytes.HasPrefix(*key, prefix) {
+			f(key, value)
+		}
+	})
+}
+
+// RangeReader is implemented by DataStores which can read the entries whose keys begin with a
+// prefix in key order, starting from the first key which is not less than start. Reading stops
+// once f returns false. ordered is false if the entries were not read in order, such as by a
+// wrapper around a DataStore which is not a RangeReader itself, in which case f was called with
+// every entry regardless of what it returned.
+type RangeReader interface {
+	ReadRange(prefix, start []byte, f func(key, value *[]byte) bool) (ordered bool, err error)
+}
+
+// ReadRange calls f with the entries in db whose keys begin with prefix and are not less than
+// start, as per RangeReader. If db is not a RangeReader, every entry with prefix is read, in no
+// particular order, and ordered is false.
+func ReadRange(db DataStore, prefix, start []byte, f func(key, value *[]byte) bool) (bool, error) {
+	if r, ok := db.(RangeReader); ok {
+		return r.ReadRange(prefix, start, f)
+	}
+	return false, ReadPrefix(db, prefix, func(key, value *[]byte) {
+		if bytes.Compare(*key, start) >= 0 {
+			f(key, value)
+		}
+	})
+}
+
+// maxTermSize is the maximum size of the terms an Index is keyed by, as their size is encoded in
+// a single byte.
+const maxTermSize = 255
+
+// Index is a secondary index of the keys of entries in a DataStore, such as the payloads sent by
+// or to a public key, held in a DataStore of its own. Each term indexes any number of keys, which
+// are listed in order.
+type Index struct {
+	db DataStore
+}
+
+// NewIndex returns an Index held in db, which should be reserved for it, such as by WithPrefix.
+func NewIndex(db DataStore) *Index {
+	return &Index{db: db}
+}
+
+// termPrefix returns the prefix of the entries for term, which is length prefixed so that no
+// term's entries begin with those of another.
+func termPrefix(term []byte) ([]byte, error) {
+	if len(term) > maxTermSize {
+		return nil, errors.New("index term is too long")
+	}
+	return append([]byte{byte(len(term))}, term...), nil
+}
+
+func (i *Index) entry(term, key []byte) ([]byte, error) {
+	prefix, err := termPrefix(term)
+	if err != nil {
+		return nil, err
+	}
+	return append(prefix, key...), nil
+}
+
+// Add indexes key under term.
+func (i *Index) Add(term, key []byte) error {
+	entry, err := i.entry(term, key)
+	if err != nil {
+		return err
+	}
+	value := []byte{}
+	return i.db.Write(&entry, &value)
+}
+
+// Remove removes key from the keys indexed under term.
+func (i *Index) Remove(term, key []byte) error {
+	entry, err := i.entry(term, key)
+	if err != nil {
+		return err
+	}
+	return i.db.Delete(&entry)
+}
+
+// Keys returns the keys indexed under term which follow after, or all of them if after is nil,
+// in order. At most limit keys are returned, if limit is greater than 0. Only the keys returned
+// are read if the Index's DataStore reads its entries in order.
+func (i *Index) Keys(term, after []byte, limit int) ([][]byte, error) {
+	prefix, err := termPrefix(term)
+	if err != nil {
+		return nil, err
+	}
+	start := prefix
+	if after != nil {
+		// The first entry following after, whose key has no shorter successor
+		start = append(append(append([]byte(nil), prefix...), after...), 0)
+	}
+
+	keys := [][]byte{}
+	ordered, err := ReadRange(i.db, prefix, start, func(entry, value *[]byte) bool {
+		keys = append(keys, append([]byte(nil), (*entry)[len(prefix):]...))
+		return limit <= 0 || len(keys) < limit
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if !ordered {
+		sort.Slice(keys, func(a, b int) bool {
+			return bytes.Compare(keys[a], keys[b]) < 0
+		})
+	}
+	if limit > 0 && len(keys) > limit {
+		keys = keys[:limit]
+	}
+	return keys, nil
+}
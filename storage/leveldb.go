@@ -1,19 +1,40 @@
 package storage
 
 import (
+	"bytes"
 	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
+// lowMemoryOptions reduce the memory used by LevelDB from around 12MB plus open file handles per
+// database, at the cost of more frequent disk reads and compactions.
+var lowMemoryOptions = &opt.Options{
+	BlockCacheCapacity:     1 * opt.MiB,
+	WriteBuffer:            1 * opt.MiB,
+	OpenFilesCacheCapacity: 64,
+}
+
 type levelDb struct {
 	dbPath string
 	conn   *leveldb.DB
 }
 
 func InitLevelDb(dbPath string) (*levelDb, error) {
+	return openLevelDb(dbPath, nil)
+}
+
+// InitLevelDbLowMemory opens a LevelDB database with smaller caches and buffers, for use on
+// constrained devices.
+func InitLevelDbLowMemory(dbPath string) (*levelDb, error) {
+	return openLevelDb(dbPath, lowMemoryOptions)
+}
+
+func openLevelDb(dbPath string, options *opt.Options) (*levelDb, error) {
 	db := new(levelDb)
 	db.dbPath = dbPath
 	var err error
-	db.conn, err = leveldb.OpenFile(dbPath, nil)
+	db.conn, err = leveldb.OpenFile(dbPath, options)
 	return db, err
 }
 
@@ -30,11 +51,39 @@ func (db *levelDb) Read(key *[]byte) (*[]byte, error) {
 	}
 }
 
+func (db *levelDb) Has(key *[]byte) (bool, error) {
+	return db.conn.Has(*key, nil)
+}
+
 func (db *levelDb) ReadAll(f func(key, value *[]byte)) error {
-	iter := db.conn.NewIterator(nil, nil)
+	return db.read(nil, func(key, value *[]byte) bool {
+		f(key, value)
+		return true
+	})
+}
+
+func (db *levelDb) ReadPrefix(prefix []byte, f func(key, value *[]byte)) error {
+	return db.read(util.BytesPrefix(prefix), func(key, value *[]byte) bool {
+		f(key, value)
+		return true
+	})
+}
+
+func (db *levelDb) ReadRange(prefix, start []byte, f func(key, value *[]byte) bool) (bool, error) {
+	slice := util.BytesPrefix(prefix)
+	if bytes.Compare(start, slice.Start) > 0 {
+		slice.Start = start
+	}
+	return true, db.read(slice, f)
+}
+
+func (db *levelDb) read(slice *util.Range, f func(key, value *[]byte) bool) error {
+	iter := db.conn.NewIterator(slice, nil)
 	for iter.Next() {
 		key, value := iter.Key(), iter.Value()
-		f(&key, &value)
+		if !f(&key, &value) {
+			break
+		}
 	}
 	iter.Release()
 	return iter.Error()
@@ -47,3 +96,7 @@ func (db *levelDb) Delete(key *[]byte) error {
 func (db *levelDb) Close() error {
 	return db.conn.Close()
 }
+
+func (db *levelDb) Compact() error {
+	return db.conn.CompactRange(util.Range{})
+}
@@ -0,0 +1,61 @@
+package storage
+
+// prefixedStore namespaces keys within an underlying DataStore, allowing several logical stores to
+// share a single database.
+type prefixedStore struct {
+	db     DataStore
+	prefix []byte
+}
+
+// WithPrefix returns a DataStore whose entries are held in db with keys beginning with prefix.
+// Closing the returned DataStore does not close db.
+func WithPrefix(db DataStore, prefix string) DataStore {
+	return &prefixedStore{db: db, prefix: []byte(prefix)}
+}
+
+func (s *prefixedStore) key(key *[]byte) *[]byte {
+	prefixed := make([]byte, len(s.prefix)+len(*key))
+	copy(prefixed, s.prefix)
+	copy(prefixed[len(s.prefix):], *key)
+	return &prefixed
+}
+
+func (s *prefixedStore) Write(key *[]byte, value *[]byte) error {
+	return s.db.Write(s.key(key), value)
+}
+
+func (s *prefixedStore) Read(key *[]byte) (*[]byte, error) {
+	return s.db.Read(s.key(key))
+}
+
+func (s *prefixedStore) Has(key *[]byte) (bool, error) {
+	return s.db.Has(s.key(key))
+}
+
+func (s *prefixedStore) ReadAll(f func(key, value *[]byte)) error {
+	return s.ReadPrefix(nil, f)
+}
+
+func (s *prefixedStore) ReadPrefix(prefix []byte, f func(key, value *[]byte)) error {
+	return ReadPrefix(s.db, *s.key(&prefix), func(key, value *[]byte) {
+		unprefixed := (*key)[len(s.prefix):]
+		f(&unprefixed, value)
+	})
+}
+
+func (s *prefixedStore) ReadRange(
+	prefix, start []byte, f func(key, value *[]byte) bool) (bool, error) {
+
+	return ReadRange(s.db, *s.key(&prefix), *s.key(&start), func(key, value *[]byte) bool {
+		unprefixed := (*key)[len(s.prefix):]
+		return f(&unprefixed, value)
+	})
+}
+
+func (s *prefixedStore) Delete(key *[]byte) error {
+	return s.db.Delete(s.key(key))
+}
+
+func (s *prefixedStore) Close() error {
+	return nil
+}
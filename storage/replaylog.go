@@ -0,0 +1,231 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/kevinburke/nacl"
+	"github.com/kevinburke/nacl/secretbox"
+	"io"
+	"os"
+	"sync"
+)
+
+// replayLogKeyContext separates the replay log key from other uses of the same secret.
+const replayLogKeyContext = "crux replay log"
+
+// Operations recorded in a replay log.
+const (
+	opWrite  byte = 1
+	opDelete byte = 2
+)
+
+// maxRecordSize bounds the records read from a replay log, guarding against corrupt lengths.
+const maxRecordSize = 1 << 30
+
+// ErrReplayLogTruncated is returned by Replay if the final record of a log is incomplete, as
+// happens if the node stopped while the record was being written. All preceding records are
+// still replayed.
+var ErrReplayLogTruncated = errors.New("replay log ends with an incomplete record")
+
+// ReplayLog is an append-only, encrypted log of the writes and deletes made to one or more
+// DataStores, from which their contents can be rebuilt independently of any backups.
+// Each record is synced to disk before the operation it describes is applied, so the log is
+// never behind the DataStores it records.
+type ReplayLog struct {
+	mu   sync.Mutex
+	file *os.File
+	key  nacl.Key
+	size int64 // Size of the log up to the end of the last record appended in full
+}
+
+// OpenReplayLog opens the replay log at path for appending, creating it if required. Records are
+// encrypted with a key derived from secret.
+func OpenReplayLog(path string, secret nacl.Key) (*ReplayLog, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &ReplayLog{file: file, key: deriveKey(secret, replayLogKeyContext), size: info.Size()}, nil
+}
+
+// Wrap returns a DataStore which records every write and delete made to db in the log under
+// name, the name it must be given when the log is replayed. Closing the returned DataStore
+// closes db, but not the log.
+func (l *ReplayLog) Wrap(name string, db DataStore) DataStore {
+	return &loggedStore{db: db, log: l, name: name}
+}
+
+// Close closes the log.
+func (l *ReplayLog) Close() error {
+	return l.file.Close()
+}
+
+// append records an operation on the named store. The record is encoded as:
+// op | len(name) | name | uvarint len(key) | key | value
+// then sealed, and framed by its big endian uint32 length. If the record cannot be written and
+// synced in full, the log is truncated to the end of the previous record, so that a partial
+// record does not prevent those appended after it from being replayed.
+func (l *ReplayLog) append(op byte, name string, key, value []byte) error {
+	record := make([]byte, 0, 2+len(name)+binary.MaxVarintLen64+len(key)+len(value))
+	record = append(record, op, byte(len(name)))
+	record = append(record, name...)
+	var keyLen [binary.MaxVarintLen64]byte
+	record = append(record, keyLen[:binary.PutUvarint(keyLen[:], uint64(len(key)))]...)
+	record = append(record, key...)
+	record = append(record, value...)
+
+	nonce := nacl.NewNonce()
+	sealed := secretbox.Seal(append(make([]byte, 4), (*nonce)[:]...), record, nonce, l.key)
+	binary.BigEndian.PutUint32(sealed, uint32(len(sealed)-4))
+
+	_, err := l.file.Write(sealed)
+	if err == nil {
+		err = l.file.Sync()
+	}
+	if err != nil {
+		if truncErr := l.file.Truncate(l.size); truncErr != nil {
+			return fmt.Errorf("%v, and truncating the partial record failed: %v", err, truncErr)
+		}
+		return err
+	}
+	l.size += int64(len(sealed))
+	return nil
+}
+
+// Replay applies the records in the log at path, in the order they were written, to the stores
+// of the same names, returning the number of records applied. Records for stores which are not
+// provided are skipped.
+func Replay(path string, secret nacl.Key, stores map[string]DataStore) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	key := deriveKey(secret, replayLogKeyContext)
+	reader := bufio.NewReader(file)
+	applied := 0
+	for {
+		var frame [4]byte
+		_, err = io.ReadFull(reader, frame[:])
+		if err == io.EOF {
+			return applied, nil
+		} else if err != nil {
+			return applied, ErrReplayLogTruncated
+		}
+
+		size := binary.BigEndian.Uint32(frame[:])
+		if size < nacl.NonceSize+secretbox.Overhead || size > maxRecordSize {
+			return applied, fmt.Errorf("invalid replay log record %d of size %d", applied+1, size)
+		}
+		sealed := make([]byte, size)
+		if _, err = io.ReadFull(reader, sealed); err != nil {
+			return applied, ErrReplayLogTruncated
+		}
+
+		nonce := new([nacl.NonceSize]byte)
+		copy(nonce[:], sealed)
+		record, ok := secretbox.Open(nil, sealed[nacl.NonceSize:], nonce, key)
+		if !ok {
+			return applied, fmt.Errorf(
+				"unable to decrypt replay log record %d, the key may be incorrect", applied+1)
+		}
+
+		if err = applyRecord(record, stores); err != nil {
+			return applied, fmt.Errorf("unable to replay record %d, %v", applied+1, err)
+		}
+		applied++
+	}
+}
+
+func applyRecord(record []byte, stores map[string]DataStore) error {
+	if len(record) < 2 || len(record) < 2+int(record[1]) {
+		return errors.New("record is too short")
+	}
+	op, name := record[0], string(record[2:2+record[1]])
+	record = record[2+len(name):]
+
+	keyLen, n := binary.Uvarint(record)
+	if n <= 0 || uint64(len(record)-n) < keyLen {
+		return errors.New("invalid key length")
+	}
+	key := record[n : n+int(keyLen)]
+	value := record[n+int(keyLen):]
+
+	db, ok := stores[name]
+	if !ok {
+		return nil
+	}
+	switch op {
+	case opWrite:
+		return db.Write(&key, &value)
+	case opDelete:
+		return db.Delete(&key)
+	default:
+		return fmt.Errorf("unknown operation %d", op)
+	}
+}
+
+// loggedStore records the changes made to an underlying DataStore in a ReplayLog.
+type loggedStore struct {
+	db   DataStore
+	log  *ReplayLog
+	name string
+}
+
+// Write and Delete log the change before applying it, holding the log's lock so that changes are
+// applied in the order they were logged. Changes which cannot be logged are not applied.
+func (s *loggedStore) Write(key *[]byte, value *[]byte) error {
+	s.log.mu.Lock()
+	defer s.log.mu.Unlock()
+
+	if err := s.log.append(opWrite, s.name, *key, *value); err != nil {
+		return err
+	}
+	return s.db.Write(key, value)
+}
+
+func (s *loggedStore) Read(key *[]byte) (*[]byte, error) {
+	return s.db.Read(key)
+}
+
+func (s *loggedStore) Has(key *[]byte) (bool, error) {
+	return s.db.Has(key)
+}
+
+func (s *loggedStore) ReadAll(f func(key, value *[]byte)) error {
+	return s.db.ReadAll(f)
+}
+
+func (s *loggedStore) ReadPrefix(prefix []byte, f func(key, value *[]byte)) error {
+	return ReadPrefix(s.db, prefix, f)
+}
+
+func (s *loggedStore) ReadRange(prefix, start []byte, f func(key, value *[]byte) bool) (bool, error) {
+	return ReadRange(s.db, prefix, start, f)
+}
+
+func (s *loggedStore) Delete(key *[]byte) error {
+	s.log.mu.Lock()
+	defer s.log.mu.Unlock()
+
+	if err := s.log.append(opDelete, s.name, *key, nil); err != nil {
+		return err
+	}
+	return s.db.Delete(key)
+}
+
+func (s *loggedStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *loggedStore) Compact() error {
+	return compact(s.db)
+}
@@ -0,0 +1,171 @@
+// Package testutil starts networks of crux nodes within a single process, for integration tests
+// which exercise the propagation of payloads between nodes.
+package testutil
+
+import (
+	"fmt"
+	"github.com/blk-io/crux/api"
+	"github.com/blk-io/crux/client"
+	"github.com/blk-io/crux/enclave"
+	"github.com/blk-io/crux/server"
+	"github.com/blk-io/crux/storage"
+	"github.com/blk-io/crux/utils"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// partyInfoAttempts is the number of rounds of party info exchanged before a network which has
+// not discovered all of its nodes' keys fails to start.
+const partyInfoAttempts = 20
+
+// Node is a crux node started by StartNetwork, serving its public API over HTTP on an ephemeral
+// port, and its private API on a socket in a temporary directory.
+type Node struct {
+	Url       string                 // URL of the node's public API
+	IpcPath   string                 // Path of the node's IPC socket
+	PublicKey []byte                 // Public key of the node's single keypair
+	Enclave   *enclave.SecureEnclave // The node's enclave, for inspecting its storage
+	PartyInfo *api.PartyInfo         // The node's party info, shared with its enclave
+	Client    *client.IpcClient      // Client for the node's private API
+
+	dir string
+	db  storage.DataStore
+}
+
+// Network is a set of nodes which know of each other, and the public keys each hosts.
+type Network struct {
+	Nodes []*Node
+}
+
+// StartNetwork starts n nodes, which each know the first as their boot node, and exchanges party
+// info between them until each node knows the public keys of all others. The test fails if the
+// nodes cannot be started.
+// Servers cannot be stopped once started, so Close only releases the nodes' storage and removes
+// their directories, and the servers remain listening until the test process exits.
+func StartNetwork(t testing.TB, n int) *Network {
+	network := &Network{}
+	var bootNodes []string
+	for i := 0; i < n; i++ {
+		node, err := startNode(bootNodes)
+		if err != nil {
+			network.Close()
+			t.Fatalf("Unable to start node %d, error: %v", i, err)
+		}
+		network.Nodes = append(network.Nodes, node)
+		if i == 0 {
+			bootNodes = []string{node.Url}
+		}
+	}
+
+	if err := network.exchangePartyInfo(); err != nil {
+		network.Close()
+		t.Fatal(err)
+	}
+	return network
+}
+
+// Close closes the storage of each node and removes their directories.
+func (network *Network) Close() {
+	for _, node := range network.Nodes {
+		node.db.Close()
+		os.RemoveAll(node.dir)
+	}
+}
+
+// exchangePartyInfo polls the party info of each node's peers until all nodes know the public keys
+// of every node.
+func (network *Network) exchangePartyInfo() error {
+	for attempt := 0; attempt < partyInfoAttempts; attempt++ {
+		for _, node := range network.Nodes {
+			node.PartyInfo.GetPartyInfo()
+		}
+		if network.discovered() {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return fmt.Errorf("nodes did not discover each other's keys after %d attempts", partyInfoAttempts)
+}
+
+// discovered reports whether each node knows the URL hosting every node's public key.
+func (network *Network) discovered() bool {
+	for _, node := range network.Nodes {
+		for _, other := range network.Nodes {
+			key, err := utils.ToKey(other.PublicKey)
+			if err != nil {
+				return false
+			}
+			if url, ok := node.PartyInfo.GetRecipient(key); !ok || url != other.Url {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// startNode starts a node with a newly generated keypair, which knows of otherNodes.
+func startNode(otherNodes []string) (*Node, error) {
+	dir, err := ioutil.TempDir("", "crux-node")
+	if err != nil {
+		return nil, err
+	}
+	node, err := initNode(dir, otherNodes)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	return node, nil
+}
+
+func initNode(dir string, otherNodes []string) (*Node, error) {
+	port, err := freePort()
+	if err != nil {
+		return nil, err
+	}
+	keyFile := filepath.Join(dir, "node")
+	if err = enclave.DoKeyGeneration(keyFile); err != nil {
+		return nil, err
+	}
+	db, err := storage.InitLevelDb(filepath.Join(dir, "crux.db"))
+	if err != nil {
+		return nil, err
+	}
+
+	url := fmt.Sprintf("http://localhost:%d/", port)
+	httpClient := client.New(client.DefaultConfig())
+	pi := api.InitPartyInfo(url, otherNodes, httpClient, false)
+	enc := enclave.Init(db, []string{keyFile + ".pub"}, []string{keyFile + ".key"}, pi, httpClient, false)
+	pi.RegisterPublicKeys(enc.PubKeys)
+
+	ipcPath := filepath.Join(dir, "crux.ipc")
+	_, err = server.Init(enc, server.ServerConfig{Port: port, IpcPath: ipcPath, GrpcJsonPort: -1})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &Node{
+		Url:       url,
+		IpcPath:   ipcPath,
+		PublicKey: (*enc.PubKeys[0])[:],
+		Enclave:   enc,
+		PartyInfo: &pi,
+		Client:    client.NewIpcClient(ipcPath),
+		dir:       dir,
+		db:        db,
+	}, nil
+}
+
+// freePort returns a TCP port which is currently free on localhost.
+func freePort() (int, error) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		return 0, err
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port, nil
+}
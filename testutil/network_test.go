@@ -0,0 +1,99 @@
+package testutil
+
+import (
+	"bytes"
+	"encoding/base64"
+	"github.com/blk-io/crux/api"
+	"testing"
+	"time"
+)
+
+func TestSendBetweenNodes(t *testing.T) {
+	network := StartNetwork(t, 3)
+	defer network.Close()
+	a, b, c := network.Nodes[0], network.Nodes[1], network.Nodes[2]
+
+	payload := []byte("payload for b")
+	key, err := a.Client.Send(payload, nil, [][]byte{b.PublicKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received, err := b.Client.Receive(key, b.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, payload) {
+		t.Errorf("B received %s, expected %s", received, payload)
+	}
+
+	// The sender can retrieve its own payload, while other nodes never receive it
+	if received, err = a.Client.Receive(key, nil); err != nil || !bytes.Equal(received, payload) {
+		t.Errorf("A retrieved %s, expected %s, error: %v", received, payload, err)
+	}
+	if _, err = c.Client.Receive(key, nil); err == nil {
+		t.Error("C should not have received a payload it was not a recipient of")
+	}
+}
+
+func TestSendToMultipleNodes(t *testing.T) {
+	network := StartNetwork(t, 3)
+	defer network.Close()
+	a, b, c := network.Nodes[0], network.Nodes[1], network.Nodes[2]
+
+	payload := []byte("payload for a and c")
+	key, err := b.Client.SendRaw(payload, nil, [][]byte{a.PublicKey, c.PublicKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, node := range map[string]*Node{"A": a, "C": c} {
+		received, err := node.Client.Receive(key, nil)
+		if err != nil || !bytes.Equal(received, payload) {
+			t.Errorf("%s received %s, expected %s, error: %v", name, received, payload, err)
+		}
+	}
+}
+
+func TestSendAsync(t *testing.T) {
+	network := StartNetwork(t, 2)
+	defer network.Close()
+	a, b := network.Nodes[0], network.Nodes[1]
+
+	// Sends to keys of nodes outside the network fail to be delivered
+	unknown := bytes.Repeat([]byte{1}, 32)
+	payload := []byte("payload sent asynchronously")
+	id, err := a.Client.SendAsync(payload, nil, [][]byte{b.PublicKey, unknown})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var status api.SendStatus
+	for deadline := time.Now().Add(10 * time.Second); ; {
+		if status, err = a.Client.SendStatus(id); err != nil {
+			t.Fatal(err)
+		}
+		if status.State != api.SendPending || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status.State != api.SendComplete || len(status.Recipients) != 2 {
+		t.Fatalf("Expected a complete send to 2 recipients, got %+v", status)
+	}
+	if state := status.Recipients[0].State; state != api.SendDelivered {
+		t.Errorf("Expected delivery to B to be %s, got %s", api.SendDelivered, state)
+	}
+	if state := status.Recipients[1].State; state != api.SendFailed {
+		t.Errorf("Expected delivery to an unknown node to be %s, got %s", api.SendFailed, state)
+	}
+
+	key, err := base64.StdEncoding.DecodeString(status.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	received, err := b.Client.Receive(key, nil)
+	if err != nil || !bytes.Equal(received, payload) {
+		t.Errorf("B received %s, expected %s, error: %v", received, payload, err)
+	}
+}
@@ -0,0 +1,58 @@
+package utils
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+)
+
+// Compression algorithms which can be configured for storage and pushed payloads.
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+)
+
+// ErrDecompressedTooLarge is returned when data decompresses to more than the maximum size.
+var ErrDecompressedTooLarge = errors.New("decompressed data exceeds the maximum size")
+
+// Gzip compresses data with gzip.
+func Gzip(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Gunzip decompresses gzip compressed data, returning ErrDecompressedTooLarge if it decompresses
+// to more than maxSize bytes, or maxSize is 0 or less for no limit.
+func Gunzip(data []byte, maxSize int64) ([]byte, error) {
+	return GunzipReader(bytes.NewReader(data), maxSize)
+}
+
+// GunzipReader is equivalent to Gunzip, reading the compressed data from r.
+func GunzipReader(r io.Reader, maxSize int64) ([]byte, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	if maxSize <= 0 {
+		return ioutil.ReadAll(zr)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(zr, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxSize {
+		return nil, ErrDecompressedTooLarge
+	}
+	return data, nil
+}
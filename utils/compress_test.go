@@ -0,0 +1,32 @@
+package utils
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestGzip(t *testing.T) {
+	data := bytes.Repeat([]byte("crux"), 256)
+	compressed, err := Gzip(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(compressed) >= len(data) {
+		t.Errorf("Compressed %d bytes to %d bytes", len(data), len(compressed))
+	}
+
+	for _, maxSize := range []int64{0, int64(len(data))} {
+		decompressed, err := Gunzip(compressed, maxSize)
+		if err != nil || !bytes.Equal(decompressed, data) {
+			t.Errorf("Decompressed with maximum size %d to %d bytes, error: %v",
+				maxSize, len(decompressed), err)
+		}
+	}
+
+	if _, err = Gunzip(compressed, int64(len(data)-1)); err != ErrDecompressedTooLarge {
+		t.Errorf("Expected data larger than the maximum size to be rejected, error: %v", err)
+	}
+	if _, err = Gunzip(data, 0); err == nil {
+		t.Error("Data which is not gzip compressed should be rejected")
+	}
+}
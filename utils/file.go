@@ -1,28 +1,151 @@
 package utils
 
 import (
+	"fmt"
 	"net"
 	"os"
+	"os/user"
 	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
+// DefaultIpcSocketMode restricts access to the IPC socket to the user running crux.
+const DefaultIpcSocketMode os.FileMode = 0600
+
+// IpcSocketOptions controls who can access an IPC socket.
+type IpcSocketOptions struct {
+	Mode  os.FileMode // Permissions of the socket file, DefaultIpcSocketMode if unset
+	Group string      // Name or ID of the group to own the socket file, if set
+
+	// Names or IDs of the users permitted to connect, checked against the peer credentials of
+	// each connection, which is only supported on Linux. Connections from other users are
+	// closed. If empty, any user with access to the socket may connect.
+	Users []string
+}
+
+// umaskMu serialises changes to the process umask.
+var umaskMu sync.Mutex
+
+// IsAbstractSocket reports whether path refers to a socket in the Linux abstract namespace,
+// denoted by a leading @. Abstract sockets have no file on disk to clean up or protect.
+func IsAbstractSocket(path string) bool {
+	return strings.HasPrefix(path, "@")
+}
+
 func CreateIpcSocket(path string) (net.Listener, error) {
+	return CreateIpcSocketWithOptions(path, IpcSocketOptions{})
+}
+
+// CreateIpcSocketWithOptions creates a unix socket listener at path. Any stale socket left by a
+// previous process is removed first, and the socket file is created with the permissions and
+// group specified in opts. If opts restricts the users permitted to connect, connections from
+// other users are closed as they are accepted.
+func CreateIpcSocketWithOptions(path string, opts IpcSocketOptions) (net.Listener, error) {
+	listener, err := createIpcSocket(path, opts)
+	if err != nil || len(opts.Users) == 0 {
+		return listener, err
+	}
+	restricted, err := restrictUsers(listener, opts.Users)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return restricted, nil
+}
+
+func createIpcSocket(path string, opts IpcSocketOptions) (net.Listener, error) {
+	if IsAbstractSocket(path) {
+		if runtime.GOOS != "linux" {
+			return nil, fmt.Errorf("abstract socket %s is only supported on Linux", path)
+		}
+		return net.Listen("unix", path)
+	}
+
+	mode := opts.Mode
+	if mode == 0 {
+		mode = DefaultIpcSocketMode
+	}
+
+	gid := -1
+	if opts.Group != "" {
+		var err error
+		gid, err = lookupGroupId(opts.Group)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	err := CreateDirForFile(path)
 	if err != nil {
 		return nil, err
 	}
-	os.Remove(path)
 
-	var listener net.Listener
-	listener, err = net.Listen("unix", path)
+	err = RemoveStaleSocket(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create the socket with the requested permissions, rather than changing them afterwards,
+	// so there is no window where other users can connect
+	umaskMu.Lock()
+	oldMask := syscall.Umask(int(^mode & 0777))
+	listener, err := net.Listen("unix", path)
+	syscall.Umask(oldMask)
+	umaskMu.Unlock()
 	if err != nil {
 		return nil, err
 	}
-	os.Chmod(path, 0600)
+
+	err = os.Chmod(path, mode)
+	if err == nil && gid >= 0 {
+		err = os.Chown(path, -1, gid)
+	}
+	if err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("unable to set permissions on socket %s, error: %v", path, err)
+	}
 
 	return listener, nil
 }
 
+func lookupGroupId(group string) (int, error) {
+	if gid, err := strconv.Atoi(group); err == nil {
+		return gid, nil
+	}
+	g, err := user.LookupGroup(group)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(g.Gid)
+}
+
+// RemoveStaleSocket removes any file left at path by a previous process, such as a socket
+// belonging to a process which crashed. An error is returned if the socket is still being served
+// by a live process.
+func RemoveStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if info.Mode()&os.ModeSocket != 0 {
+		conn, err := net.DialTimeout("unix", path, time.Second)
+		if err == nil {
+			conn.Close()
+			return fmt.Errorf("socket %s is in use by another process", path)
+		}
+	}
+
+	return os.Remove(path)
+}
+
 func CreateDirForFile(path string) error {
 	return os.MkdirAll(filepath.Dir(path), os.FileMode(0755))
 }
@@ -1,8 +1,16 @@
 package utils
 
 import (
+	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
 	"testing"
+	"time"
 )
 
 func TestCreateIpcSocket(t *testing.T) {
@@ -21,3 +29,148 @@ func TestCreateIpcSocket(t *testing.T) {
 		t.Errorf("Listener not initialised")
 	}
 }
+
+func TestRemoveStaleSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestRemoveStaleSocket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ipcPath := filepath.Join(dir, "crux.ipc")
+	listener, err := CreateIpcSocket(ipcPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = CreateIpcSocket(ipcPath)
+	if err == nil {
+		t.Error("Socket in use by a live listener should not be removed")
+	}
+
+	// Simulate a crash, where the socket file is left behind
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	listener.Close()
+
+	listener, err = CreateIpcSocket(ipcPath)
+	if err != nil {
+		t.Fatalf("Stale socket should have been replaced, error: %v", err)
+	}
+	listener.Close()
+}
+
+func TestIpcSocketPermissions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestIpcSocketPermissions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, mode := range []os.FileMode{0, 0660} {
+		ipcPath := filepath.Join(dir, "crux.ipc")
+		listener, err := CreateIpcSocketWithOptions(ipcPath, IpcSocketOptions{Mode: mode})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := mode
+		if expected == 0 {
+			expected = DefaultIpcSocketMode
+		}
+		info, err := os.Stat(ipcPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if perm := info.Mode().Perm(); perm != expected {
+			t.Errorf("Socket has wrong permissions: got %v want %v", perm, expected)
+		}
+		listener.Close()
+	}
+
+	_, err = CreateIpcSocketWithOptions(filepath.Join(dir, "crux.ipc"),
+		IpcSocketOptions{Group: "no-such-group-for-crux"})
+	if err == nil {
+		t.Error("Unknown group should be rejected")
+	}
+}
+
+func TestAbstractSocket(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("Abstract sockets are only supported on Linux")
+	}
+
+	path := fmt.Sprintf("@crux-test-%d", os.Getpid())
+	listener, err := CreateIpcSocket(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("Unable to connect to abstract socket, error: %v", err)
+	}
+	conn.Close()
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Abstract socket should not create a file")
+	}
+}
+
+func TestIpcSocketUsers(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("Peer credentials are only supported on Linux")
+	}
+
+	dir, err := ioutil.TempDir("", "TestIpcSocketUsers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ipcPath := filepath.Join(dir, "crux.ipc")
+	for _, test := range []struct {
+		uid       int
+		permitted bool
+	}{
+		{os.Getuid(), true},
+		{os.Getuid() + 1, false},
+	} {
+		listener, err := CreateIpcSocketWithOptions(ipcPath,
+			IpcSocketOptions{Mode: 0666, Users: []string{strconv.Itoa(test.uid)}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		accepted := make(chan net.Conn, 1)
+		go func() {
+			conn, err := listener.Accept()
+			if err == nil {
+				accepted <- conn
+			}
+		}()
+
+		conn, err := net.Dial("unix", ipcPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// A rejected connection is closed by the listener
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = conn.Read(make([]byte, 1))
+		closed := err == io.EOF
+		if closed == test.permitted {
+			t.Errorf("Connection from user %d should be permitted: %v, read error: %v",
+				os.Getuid(), test.permitted, err)
+		}
+		conn.Close()
+		listener.Close()
+		if test.permitted {
+			(<-accepted).Close()
+		}
+	}
+
+	_, err = CreateIpcSocketWithOptions(ipcPath,
+		IpcSocketOptions{Users: []string{"no-such-user-for-crux"}})
+	if err == nil {
+		t.Error("Unknown user should be rejected")
+	}
+}
@@ -1,9 +1,59 @@
 package utils
 
-import "golang.org/x/crypto/sha3"
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"golang.org/x/crypto/sha3"
+	"hash"
+	"sync"
+)
 
-func Sha3Hash(payload []byte) []byte {
-	sha3Hash := sha3.New512()
-	sha3Hash.Write(payload)
-	return sha3Hash.Sum(nil)
+// Hash algorithms which can be configured for the digests payloads are stored under. Nodes must
+// use the same algorithm to exchange payloads, and Constellation nodes use SHA3-512.
+const (
+	HashSha3   = "sha3-512"
+	HashSha256 = "sha256"
+)
+
+var (
+	hashMu     sync.RWMutex
+	hashes     = map[string]func() hash.Hash{HashSha3: sha3.New512, HashSha256: sha256.New}
+	digestHash = sha3.New512
+)
+
+// RegisterHash makes a hash algorithm available to SetDigestHash under name, replacing any
+// algorithm already registered under it.
+func RegisterHash(name string, newHash func() hash.Hash) {
+	hashMu.Lock()
+	defer hashMu.Unlock()
+	hashes[name] = newHash
+}
+
+// SetDigestHash sets the algorithm used by Digest to the hash registered under name.
+func SetDigestHash(name string) error {
+	hashMu.Lock()
+	defer hashMu.Unlock()
+	newHash, ok := hashes[name]
+	if !ok {
+		return fmt.Errorf("unsupported hash %s", name)
+	}
+	digestHash = newHash
+	return nil
+}
+
+// Digest returns the digest of payload, using SHA3-512 unless another algorithm has been set with
+// SetDigestHash. Payloads are stored under the digest of their cipher text, so their keys are
+// derived from, and can be verified against, their contents.
+func Digest(payload []byte) []byte {
+	hashMu.RLock()
+	h := digestHash()
+	hashMu.RUnlock()
+	h.Write(payload)
+	return h.Sum(nil)
+}
+
+// VerifyDigest reports whether digest is the Digest of payload.
+func VerifyDigest(payload, digest []byte) bool {
+	return bytes.Equal(Digest(payload), digest)
 }
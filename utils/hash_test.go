@@ -0,0 +1,53 @@
+package utils
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestDigest(t *testing.T) {
+
+	// SHA3-512 is used by default, test vectors from FIPS 202
+	values := map[string]string{
+		"": "a69f73cca23a9ac5c8b567dc185a756e97c982164fe25859e0d1dcc1475c80a6" +
+			"15b2123af1f5f94c11e3e9402c3ac558f500199d95b6d3e301758586281dcd26",
+		"abc": "b751850b1a57168a5693cd924b6b096e08f621827444f70d884f5d0240d2712e" +
+			"10e116e9192af3c91a7ec57647e3934057340b4cf408d5a56592f8274eec53f0",
+	}
+
+	for value, expected := range values {
+		digest := Digest([]byte(value))
+		if hex.EncodeToString(digest) != expected {
+			t.Errorf("SHA3-512 digest of %q is %x, expected %s", value, digest, expected)
+		}
+		if !VerifyDigest([]byte(value), digest) {
+			t.Errorf("Digest of %q should be verified", value)
+		}
+		if VerifyDigest([]byte(value+"tampered"), digest) {
+			t.Errorf("Digest of %q should not verify other payloads", value)
+		}
+		if VerifyDigest([]byte(value), digest[:32]) {
+			t.Errorf("Truncated digest of %q should not be verified", value)
+		}
+	}
+}
+
+func TestDigestHash(t *testing.T) {
+	if err := SetDigestHash(HashSha256); err != nil {
+		t.Fatal(err)
+	}
+	defer SetDigestHash(HashSha3)
+
+	digest := Digest([]byte("abc"))
+	expected := "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"
+	if hex.EncodeToString(digest) != expected {
+		t.Errorf("SHA-256 digest of abc is %x, expected %s", digest, expected)
+	}
+	if !VerifyDigest([]byte("abc"), digest) || VerifyDigest([]byte("abd"), digest) {
+		t.Error("Digest should only verify the payload it was computed for")
+	}
+
+	if err := SetDigestHash("md5"); err == nil {
+		t.Error("Unregistered hashes should not be set")
+	}
+}
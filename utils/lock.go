@@ -0,0 +1,72 @@
+package utils
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// AcquirePidFile creates a lock file at path containing the current process ID, ensuring only
+// one process uses the resources it guards. Lock files left behind by processes which are no
+// longer running are replaced, as are those holding our own process ID, which a restarted
+// container is often given again.
+func AcquirePidFile(path string) error {
+	err := CreateDirForFile(path)
+	if err != nil {
+		return err
+	}
+
+	for {
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			_, err = fmt.Fprintf(file, "%d\n", os.Getpid())
+			file.Close()
+			return err
+		}
+		if !os.IsExist(err) {
+			return err
+		}
+
+		pid, err := readPidFile(path)
+		if err == nil && pid != os.Getpid() && processAlive(pid) {
+			return fmt.Errorf("lock file %s is held by running process %d", path, pid)
+		}
+
+		err = os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("unable to remove stale lock file %s, error: %v", path, err)
+		}
+	}
+}
+
+// ReleasePidFile removes the lock file at path if it is held by the current process.
+func ReleasePidFile(path string) error {
+	pid, err := readPidFile(path)
+	if err != nil || pid != os.Getpid() {
+		return err
+	}
+	return os.Remove(path)
+}
+
+func readPidFile(path string) (int, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(contents)))
+}
+
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	err = process.Signal(syscall.Signal(0))
+	return err == nil || err == syscall.EPERM
+}
@@ -0,0 +1,59 @@
+package utils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestAcquirePidFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestAcquirePidFile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	lockFile := filepath.Join(dir, "crux.db.pid")
+
+	// The parent process, which is running
+	err = ioutil.WriteFile(lockFile, []byte(strconv.Itoa(os.Getppid())), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = AcquirePidFile(lockFile)
+	if err == nil {
+		t.Error("Lock file held by a running process should not be acquired")
+	}
+
+	// Left behind by a previous process with our process ID, such as in a restarted container
+	err = AcquirePidFile(lockFile + ".own")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = AcquirePidFile(lockFile + ".own")
+	if err != nil {
+		t.Errorf("Lock file holding our own process ID should have been replaced, error: %v", err)
+	}
+
+	err = ReleasePidFile(lockFile + ".own")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(lockFile + ".own"); !os.IsNotExist(err) {
+		t.Errorf("Lock file should have been released, error: %v", err)
+	}
+
+	// A process ID which cannot be running
+	err = ioutil.WriteFile(lockFile, []byte(strconv.Itoa(-1)), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = AcquirePidFile(lockFile)
+	if err != nil {
+		t.Errorf("Stale lock file should have been replaced, error: %v", err)
+	}
+}
@@ -0,0 +1,65 @@
+package utils
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"os/user"
+	"runtime"
+	"strconv"
+)
+
+// peerCredListener only accepts connections from processes running as one of the permitted
+// users, determined from the peer credentials of each unix socket connection.
+type peerCredListener struct {
+	net.Listener
+	uids map[int]bool
+}
+
+// restrictUsers wraps listener so it only accepts connections from users, which are user names
+// or IDs. Peer credentials are only supported on Linux.
+func restrictUsers(listener net.Listener, users []string) (net.Listener, error) {
+	if runtime.GOOS != "linux" {
+		return nil, fmt.Errorf("restricting IPC socket users is only supported on Linux")
+	}
+	uids := make(map[int]bool)
+	for _, u := range users {
+		uid, err := lookupUserId(u)
+		if err != nil {
+			return nil, fmt.Errorf("unable to resolve IPC socket user %s, error: %v", u, err)
+		}
+		uids[uid] = true
+	}
+	return &peerCredListener{Listener: listener, uids: uids}, nil
+}
+
+// Accept waits for the next connection from a permitted user, closing any from other users.
+func (l *peerCredListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		uid, err := peerUid(conn)
+		if err == nil && l.uids[uid] {
+			return conn, nil
+		}
+		if err != nil {
+			log.Warnf("Rejecting IPC connection, unable to read peer credentials: %v", err)
+		} else {
+			log.Warnf("Rejecting IPC connection from unpermitted user ID %d", uid)
+		}
+		conn.Close()
+	}
+}
+
+func lookupUserId(name string) (int, error) {
+	if uid, err := strconv.Atoi(name); err == nil {
+		return uid, nil
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(u.Uid)
+}
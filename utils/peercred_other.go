@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package utils
+
+import (
+	"fmt"
+	"net"
+)
+
+// peerUid is not supported on this platform.
+func peerUid(conn net.Conn) (int, error) {
+	return -1, fmt.Errorf("peer credentials are only supported on Linux")
+}
@@ -1,7 +1,12 @@
 package utils
 
-import "net/url"
+import (
+	"net/url"
+	"strings"
+)
 
+// BuildUrl appends the endpoint at rawPath to rawUrl, preserving any path rawUrl has, such as
+// for nodes served under a path prefix.
 func BuildUrl(rawUrl, rawPath string) (string, error) {
 	baseUrl, err := url.Parse(rawUrl)
 	if err != nil {
@@ -14,5 +19,9 @@ func BuildUrl(rawUrl, rawPath string) (string, error) {
 		return "", err
 	}
 
-	return baseUrl.ResolveReference(path).String(), nil
+	baseUrl.Path = strings.TrimRight(baseUrl.Path, "/") + "/" + strings.TrimLeft(path.Path, "/")
+	baseUrl.RawPath = ""
+	baseUrl.RawQuery = path.RawQuery
+	baseUrl.Fragment = ""
+	return baseUrl.String(), nil
 }
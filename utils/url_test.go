@@ -7,6 +7,9 @@ func TestBuildUrl(t *testing.T) {
 	runUrlTest(t, "http://localhost:9001", "/endpoint", "http://localhost:9001/endpoint")
 	runUrlTest(t, "http://localhost:9001", "endpoint", "http://localhost:9001/endpoint")
 	runUrlTest(t, "http://localhost:9001//", "/endpoint", "http://localhost:9001/endpoint")
+	runUrlTest(t, "http://localhost:9001/crux/", "/endpoint", "http://localhost:9001/crux/endpoint")
+	runUrlTest(t, "http://localhost:9001/crux", "/endpoint", "http://localhost:9001/crux/endpoint")
+	runUrlTest(t, "http://localhost:9001/crux", "endpoint?to=key", "http://localhost:9001/crux/endpoint?to=key")
 }
 
 func runUrlTest(t *testing.T, baseUrl, path, expected string) {
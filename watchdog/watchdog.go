@@ -0,0 +1,142 @@
+// Package watchdog monitors crux's background loops, such as polling other nodes for their party
+// info, restarting any which stop reporting progress.
+//
+// A deadlocked loop would otherwise silently stop payloads from being distributed, while the node
+// continued to report that it was up.
+package watchdog
+
+import (
+	"github.com/blk-io/crux/api"
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Loop is a background loop, which must call heartbeat at least once per timeout while it is
+// making progress, and return once stop is closed.
+type Loop func(stop <-chan struct{}, heartbeat func())
+
+// Watchdog restarts loops which have not sent a heartbeat within their timeout.
+type Watchdog struct {
+	mu    sync.Mutex
+	loops map[string]*subsystem
+	alert func(api.SubsystemStatus) // Called whenever a loop is restarted
+}
+
+type subsystem struct {
+	run           Loop
+	timeout       time.Duration
+	stop          chan struct{}
+	generation    int // Incremented on restart, so heartbeats from a stuck loop are ignored
+	lastHeartbeat time.Time
+	restarts      int
+	lastRestart   time.Time
+}
+
+// New creates a Watchdog, which logs an error whenever a loop is restarted. alert, if provided,
+// is also called.
+func New(alert func(api.SubsystemStatus)) *Watchdog {
+	return &Watchdog{loops: make(map[string]*subsystem), alert: alert}
+}
+
+// Go starts run in a new goroutine under the given name, restarting it if it does not send a
+// heartbeat within timeout.
+func (w *Watchdog) Go(name string, timeout time.Duration, run Loop) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	s := &subsystem{run: run, timeout: timeout}
+	w.loops[name] = s
+	w.start(s, time.Now())
+}
+
+// start must be called with the lock held.
+func (w *Watchdog) start(s *subsystem, now time.Time) {
+	s.generation++
+	s.stop = make(chan struct{})
+	s.lastHeartbeat = now
+
+	generation := s.generation
+	heartbeat := func() {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		if s.generation == generation {
+			s.lastHeartbeat = time.Now()
+		}
+	}
+	go s.run(s.stop, heartbeat)
+}
+
+// Watch checks the loops every interval until stop is closed.
+func (w *Watchdog) Watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			w.check(now)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// check restarts any loops which have not sent a heartbeat within their timeout as of now.
+// The stuck goroutine is asked to stop, but as it may never do so, it is abandoned.
+func (w *Watchdog) check(now time.Time) {
+	var restarted []api.SubsystemStatus
+	w.mu.Lock()
+	for name, s := range w.loops {
+		stalled := now.Sub(s.lastHeartbeat)
+		if stalled <= s.timeout {
+			continue
+		}
+
+		log.WithFields(log.Fields{"subsystem": name, "stalled": stalled}).Error(
+			"Background loop has stopped responding, restarting it")
+		close(s.stop)
+		s.restarts++
+		s.lastRestart = now
+		restarted = append(restarted, s.status(name, now))
+		w.start(s, now)
+	}
+	w.mu.Unlock()
+
+	if w.alert != nil {
+		for _, status := range restarted {
+			w.alert(status)
+		}
+	}
+}
+
+// Status returns the state of each loop, ordered by name. A nil Watchdog has no loops.
+func (w *Watchdog) Status() []api.SubsystemStatus {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := time.Now()
+	statuses := make([]api.SubsystemStatus, 0, len(w.loops))
+	for name, s := range w.loops {
+		statuses = append(statuses, s.status(name, now))
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+func (s *subsystem) status(name string, now time.Time) api.SubsystemStatus {
+	status := api.SubsystemStatus{
+		Name:          name,
+		Healthy:       now.Sub(s.lastHeartbeat) <= s.timeout,
+		LastHeartbeat: s.lastHeartbeat.UTC(),
+		Restarts:      s.restarts,
+	}
+	if s.restarts > 0 {
+		lastRestart := s.lastRestart.UTC()
+		status.LastRestart = &lastRestart
+	}
+	return status
+}
@@ -0,0 +1,78 @@
+package watchdog
+
+import (
+	"github.com/blk-io/crux/api"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRestart(t *testing.T) {
+	var alerts []api.SubsystemStatus
+	w := New(func(status api.SubsystemStatus) {
+		alerts = append(alerts, status)
+	})
+
+	var started, stopped int32
+	beats := make(chan func(), 2)
+	w.Go("stuck", time.Minute, func(stop <-chan struct{}, heartbeat func()) {
+		atomic.AddInt32(&started, 1)
+		beats <- heartbeat
+		<-stop
+		atomic.AddInt32(&stopped, 1)
+	})
+	w.Go("healthy", time.Minute, func(stop <-chan struct{}, heartbeat func()) {
+		<-stop
+	})
+	stale := <-beats
+
+	// A loop is only restarted once its timeout has elapsed
+	w.check(time.Now().Add(30 * time.Second))
+	if len(alerts) != 0 {
+		t.Fatalf("Unexpected restart %v", alerts)
+	}
+
+	w.mu.Lock()
+	w.loops["healthy"].lastHeartbeat = time.Now().Add(time.Hour)
+	w.mu.Unlock()
+	w.check(time.Now().Add(2 * time.Minute))
+	<-beats
+
+	if len(alerts) != 1 || alerts[0].Name != "stuck" || alerts[0].Restarts != 1 ||
+		alerts[0].Healthy || alerts[0].LastRestart == nil {
+		t.Fatalf("Unexpected alerts %v", alerts)
+	}
+	if atomic.LoadInt32(&started) != 2 {
+		t.Errorf("Loop was started %d times, expected 2", started)
+	}
+	for i := 0; i < 100 && atomic.LoadInt32(&stopped) != 1; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if atomic.LoadInt32(&stopped) != 1 {
+		t.Error("Stuck loop was not asked to stop")
+	}
+
+	// Heartbeats from the abandoned loop are ignored
+	w.mu.Lock()
+	restarted := w.loops["stuck"].lastHeartbeat
+	w.mu.Unlock()
+	stale()
+	w.mu.Lock()
+	if w.loops["stuck"].lastHeartbeat != restarted {
+		t.Error("Heartbeat from a restarted loop was recorded")
+	}
+	w.mu.Unlock()
+
+	statuses := w.Status()
+	if len(statuses) != 2 || statuses[0].Name != "healthy" || statuses[1].Name != "stuck" ||
+		!statuses[1].Healthy || statuses[1].Restarts != 1 {
+		t.Errorf("Unexpected status %v", statuses)
+	}
+}
+
+func TestNilStatus(t *testing.T) {
+	var w *Watchdog
+	if statuses := w.Status(); len(statuses) != 0 {
+		t.Errorf("Unexpected status %v", statuses)
+	}
+}